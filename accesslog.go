@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	accessMu  sync.Mutex
+	accessOut io.Writer
+)
+
+// openAccessLog opens the access log destination. It leaves accessOut nil
+// when access logging is off.
+func openAccessLog() error {
+	switch cfg.AccessLogFormat {
+	case "off":
+		return nil
+	case "combined", "json":
+	default:
+		return fmt.Errorf("unknown format %q: want combined, json or off", cfg.AccessLogFormat)
+	}
+	for path, rate := range cfg.AccessLogSample {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("sample rate of %s must be between 0 and 1", path)
+		}
+	}
+	if cfg.AccessLogFile == "" {
+		accessOut = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(cfg.AccessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	accessOut = f
+	return nil
+}
+
+// accessRecord carries what inner handlers learn about a request, such as
+// the authenticated caller, out to the access log.
+type accessRecord struct {
+	identity string
+}
+
+type accessRecordKey struct{}
+
+// noteIdentity records the caller of r for the access log.
+func noteIdentity(r *http.Request, id string) {
+	if rec, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		rec.identity = id
+	}
+}
+
+// accessWriter records the status and body size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *accessWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// accessEntry is one line of the JSON access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RemoteIP  string    `json:"remote_ip"`
+	Identity  string    `json:"identity,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route,omitempty"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+var (
+	httpRequests       = newCounter("datascribe_http_requests_total", "HTTP requests by route and status code.")
+	httpRequestSeconds = newCounter("datascribe_http_request_duration_seconds_total", "Time spent serving HTTP requests, by route.")
+)
+
+// accessLog counts every request in the HTTP metrics and writes a line per
+// request to the access log, in the Apache combined format followed by the
+// latency in microseconds, or as JSON. Paths in cfg.QuietPaths are left out
+// of both, and paths listed in cfg.AccessLogSample are only logged at their
+// sample rate. Panics and 5xx responses are reported to the error tracker.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		path := r.URL.Path
+		rec := &accessRecord{}
+		aw := &accessWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+		defer func() {
+			if p := recover(); p != nil {
+				if p != http.ErrAbortHandler {
+					trackPanic(r.Method+" "+r.Pattern, p, debug.Stack(), map[string]string{"route": r.Pattern})
+				}
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(aw, r)
+
+		if slices.Contains(cfg.QuietPaths, path) {
+			return
+		}
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.inc("route", route, "code", strconv.Itoa(aw.status))
+		httpRequestSeconds.add(elapsed.Seconds(), "route", route)
+		if aw.status >= 500 {
+			trackError(fmt.Sprintf("%s %s returned %d", r.Method, route, aw.status),
+				map[string]string{"route": route, "status": strconv.Itoa(aw.status), "identity": rec.identity}, nil, nil)
+		}
+
+		if accessOut == nil {
+			return
+		}
+		if rate, ok := cfg.AccessLogSample[path]; ok && rand.Float64() >= rate {
+			return
+		}
+		// Share tokens are credentials; keep them out of the log
+		if token := r.PathValue("token"); token != "" {
+			path = strings.Replace(path, token, "-", 1)
+		}
+		e := accessEntry{Time: start.UTC(), RemoteIP: clientIP(r).String(), Identity: rec.identity,
+			Method: r.Method, Path: path, Route: r.Pattern, Proto: r.Proto, Status: aw.status, Bytes: aw.bytes,
+			LatencyMS: float64(elapsed.Microseconds()) / 1000,
+			Referer:   r.Referer(), UserAgent: r.UserAgent()}
+		writeAccessEntry(e)
+	})
+}
+
+func writeAccessEntry(e accessEntry) {
+	var line []byte
+	if cfg.AccessLogFormat == "json" {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			log.Printf("access log: %v", err)
+			return
+		}
+	} else {
+		user := "-"
+		if e.Identity != "" {
+			user = strings.ReplaceAll(e.Identity, " ", "_")
+		}
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.FormatInt(e.Bytes, 10)
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] %s %d %s %s %s %d", e.RemoteIP, user,
+			e.Time.Local().Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, size,
+			quoteOrDash(e.Referer), quoteOrDash(e.UserAgent), int64(e.LatencyMS*1000))
+	}
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	if _, err := accessOut.Write(append(line, '\n')); err != nil {
+		log.Printf("access log: %v", err)
+	}
+}
+
+// quoteOrDash quotes a combined log field, writing "-" when it is empty.
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
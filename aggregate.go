@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	codeNonNumericValue = "non_numeric_value"
+	codeTooManyGroups   = "too_many_groups"
+)
+
+// aggregateFuncs are the aggregations POST /aggregate supports. All but
+// count need numeric values; missing values are skipped, as in pandas.
+var aggregateFuncs = []string{"sum", "mean", "count", "min", "max"}
+
+// aggregation is one output column: fn applied to column.
+type aggregation struct {
+	column string
+	fn     string
+	idx    int
+}
+
+func (a aggregation) name() string { return a.column + "_" + a.fn }
+
+// parseAggregations reads the aggregations field: either a JSON object of
+// column names to a function or list of functions, or a comma-separated
+// list of column:function pairs.
+func parseAggregations(v string) ([]aggregation, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, errors.New("aggregations is required")
+	}
+	var aggs []aggregation
+	if strings.HasPrefix(v, "{") {
+		var spec map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(v), &spec); err != nil {
+			return nil, errors.New("aggregations must be a JSON object of column names to functions")
+		}
+		columns := make([]string, 0, len(spec))
+		for col := range spec {
+			columns = append(columns, col)
+		}
+		sort.Strings(columns)
+		for _, col := range columns {
+			var fns []string
+			if err := json.Unmarshal(spec[col], &fns); err != nil {
+				var fn string
+				if err := json.Unmarshal(spec[col], &fn); err != nil {
+					return nil, fmt.Errorf("aggregations[%q] must be a function name or a list of them", col)
+				}
+				fns = []string{fn}
+			}
+			for _, fn := range fns {
+				aggs = append(aggs, aggregation{column: col, fn: fn})
+			}
+		}
+	} else {
+		for _, pair := range strings.Split(v, ",") {
+			col, fn, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				return nil, fmt.Errorf("aggregation %q must be column:function", pair)
+			}
+			aggs = append(aggs, aggregation{column: col, fn: fn})
+		}
+	}
+	for _, a := range aggs {
+		if !slices.Contains(aggregateFuncs, a.fn) {
+			return nil, fmt.Errorf("unknown aggregation %q for %s (want %s)", a.fn, a.column, strings.Join(aggregateFuncs, ", "))
+		}
+	}
+	return aggs, nil
+}
+
+// aggState accumulates one aggregation of one group.
+type aggState struct {
+	count    int
+	sum      float64
+	min, max float64
+}
+
+func (s *aggState) value(fn string) any {
+	switch fn {
+	case "count":
+		return s.count
+	case "sum":
+		return s.sum
+	}
+	if s.count == 0 {
+		return nil
+	}
+	switch fn {
+	case "mean":
+		return s.sum / float64(s.count)
+	case "min":
+		return s.min
+	default:
+		return s.max
+	}
+}
+
+type aggGroup struct {
+	key   []string
+	rows  int
+	state []aggState
+}
+
+// aggregateResult is the JSON response of POST /aggregate; the CSV form has
+// the same columns.
+type aggregateResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// aggregateError is a data problem found while streaming the file.
+type aggregateError struct {
+	code string
+	msg  string
+}
+
+func (e *aggregateError) Error() string { return e.msg }
+
+// handleAggregate groups an uploaded CSV by the group_by columns and
+// computes the requested aggregations. The file is streamed, so memory
+// grows with the number of groups (capped by cfg.AggregateMaxGroups), not
+// rows. format=csv returns CSV instead of JSON.
+func handleAggregate(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "aggregate")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("unsupported format %q (want json or csv)", format), http.StatusBadRequest)
+		return
+	}
+	groupBy, err := parseNameList("group_by", r.FormValue("group_by"))
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	aggs, err := parseAggregations(r.FormValue("aggregations"))
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+
+	result, err := aggregate(t, groupBy, aggs)
+	var ae *aggregateError
+	switch {
+	case errors.As(err, &ae):
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: ae.msg, Code: ae.code})
+		return
+	case errors.Is(err, errInvalidOptions):
+		writeOptionsError(w, err)
+		return
+	case err != nil:
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="aggregate.csv"`)
+	out := csv.NewWriter(w)
+	out.Write(result.Columns)
+	record := make([]string, len(result.Columns))
+	for _, row := range result.Rows {
+		for i, v := range row {
+			record[i] = formatCell(v)
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("aggregate: %v", err)
+	}
+}
+
+func aggregate(t *csvTable, groupBy []string, aggs []aggregation) (*aggregateResult, error) {
+	keys, err := keyIndexes(t.Columns, groupBy)
+	if err != nil {
+		return nil, err
+	}
+	if len(groupBy) == 0 {
+		keys = nil // one group for the whole file
+	}
+	var aggColumns []string
+	for _, a := range aggs {
+		aggColumns = append(aggColumns, a.column)
+	}
+	aggIdx, err := keyIndexes(t.Columns, aggColumns)
+	if err != nil {
+		return nil, err
+	}
+	for i := range aggs {
+		aggs[i].idx = aggIdx[i]
+	}
+
+	groups := map[rowKey]*aggGroup{}
+	for line := 1; ; line++ {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", line, err)
+		}
+		key := pick(row, keys, false)
+		k := hashKey(key)
+		g, ok := groups[k]
+		if !ok {
+			if len(groups) >= cfg.AggregateMaxGroups {
+				return nil, &aggregateError{codeTooManyGroups, fmt.Sprintf("more than %d groups", cfg.AggregateMaxGroups)}
+			}
+			g = &aggGroup{key: key, state: make([]aggState, len(aggs))}
+			groups[k] = g
+		}
+		g.rows++
+		for i, a := range aggs {
+			v := strings.TrimSpace(row[a.idx])
+			if isNA(v) {
+				continue
+			}
+			s := &g.state[i]
+			if a.fn == "count" {
+				s.count++
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, &aggregateError{codeNonNumericValue, fmt.Sprintf("row %d: %s value %q is not numeric", line, a.column, v)}
+			}
+			if s.count == 0 || f < s.min {
+				s.min = f
+			}
+			if s.count == 0 || f > s.max {
+				s.max = f
+			}
+			s.count++
+			s.sum += f
+		}
+	}
+
+	sorted := make([]*aggGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(a, b int) bool { return slices.Compare(sorted[a].key, sorted[b].key) < 0 })
+
+	result := &aggregateResult{Columns: append(slices.Clone(groupBy), "rows"), Rows: [][]any{}}
+	for _, a := range aggs {
+		result.Columns = append(result.Columns, a.name())
+	}
+	for _, g := range sorted {
+		row := make([]any, 0, len(result.Columns))
+		for _, v := range g.key {
+			row = append(row, v)
+		}
+		row = append(row, g.rows)
+		for i, a := range aggs {
+			row = append(row, g.state[i].value(a.fn))
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, nil
+}
+
+func formatCell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the Python scripts beyond the usual 0 (success) and
+// 1 (crash).
+const (
+	exitUsage              = 2 // argparse rejected the command line
+	exitMalformedCSV       = 3
+	exitUnsupportedColumns = 4
+	exitInvalidQuery       = 5
+	exitQueryTimeout       = 6
+	exitInvalidTarget      = 7
+	exitUnsupportedFormat  = 8 // convert.py cannot read the upload format
+)
+
+// Machine-readable error codes returned with analyzer failures.
+const (
+	codeMalformedCSV       = "malformed_csv"
+	codeUnsupportedColumns = "unsupported_columns"
+	codeAnalyzerTimeout    = "analyzer_timeout"
+	codeAnalyzerCrashed    = "analyzer_crashed"
+	codeInvalidQuery       = "invalid_query"
+	codeQueryTimeout       = "query_timeout"
+	codeInvalidTarget      = "invalid_target"
+	codeReportTooLarge     = "report_too_large"
+)
+
+// analysisError is a classified analyzer failure.
+type analysisError struct {
+	Code    string
+	Status  int
+	Message string
+	Stderr  string
+	// engineFault marks crashes that cannot come from the input: the
+	// script could not be started, was killed by a signal, rejected its
+	// command line or could not load its own code.
+	engineFault bool
+}
+
+func (e *analysisError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Is reports input-caused failures (4xx) as errUploadRejected so they are
+// neither retried nor dead-lettered.
+func (e *analysisError) Is(target error) bool {
+	return target == errUploadRejected && e.Status < 500
+}
+
+// runAnalysis invokes the local Python script (predict.py) on the CSV at
+// inPath and writes the PDF report to outPath, applying opts. It returns the
+// script's output; failures are returned as *analysisError. Reports are
+// held to cfg.ReportMaxPages and cfg.ReportMaxSize, converted to PDF/A
+// when opts ask for it, and signed when a signing certificate is configured.
+// All of it shares one memory budget.
+func runAnalysis(ctx context.Context, inPath, outPath string, opts analysisOptions) (analysisOutput, error) {
+	ctx = withMemoryBudget(ctx)
+	optArgs, err := opts.args(filepath.Dir(outPath))
+	if err != nil {
+		return analysisOutput{}, err
+	}
+	args := append([]string{"--input", inPath, "--output", outPath}, optArgs...)
+	if cfg.ReportMaxPages > 0 {
+		args = append(args, "--max-pages="+strconv.Itoa(cfg.ReportMaxPages))
+	}
+	if slices.Contains(opts.Artifacts, "charts") {
+		args = append(args, "--charts-dir="+chartsDir(outPath))
+	}
+	out, err := runPredict(ctx, args...)
+	if err != nil {
+		return out, err
+	}
+	if opts.PDFA {
+		if err := convertToPDFA(ctx, outPath); err != nil {
+			return out, err
+		}
+	}
+	if info, err := os.Stat(outPath); err == nil && cfg.ReportMaxSize > 0 && info.Size() > cfg.ReportMaxSize {
+		return out, &analysisError{Code: codeReportTooLarge, Status: http.StatusUnprocessableEntity,
+			Message: fmt.Sprintf("report is %d bytes, more than the %d allowed; select fewer charts or columns",
+				info.Size(), cfg.ReportMaxSize)}
+	}
+	if signer != nil {
+		// The report is signed in memory, next to its signed copy
+		need := 2 * fileSize(outPath)
+		budget := memoryBudgetFrom(ctx)
+		if err := budget.reserve(need, "signing the report"); err != nil {
+			return out, err
+		}
+		defer budget.release(need)
+		if err := signer.signFile(outPath); err != nil {
+			return out, &analysisError{Code: codeSigningFailed, Status: http.StatusInternalServerError,
+				Message: "signing the report failed: " + err.Error()}
+		}
+	}
+	return out, nil
+}
+
+// runPredict runs predict.py with args under the analysis timeout.
+func runPredict(ctx context.Context, args ...string) (analysisOutput, error) {
+	return runPython(ctx, "predict.py", args...)
+}
+
+// runPython runs one of the Python scripts shipped next to the binary under
+// the analysis timeout, unless the analyzer circuit is open.
+func runPython(ctx context.Context, script string, args ...string) (analysisOutput, error) {
+	return runPythonTo(ctx, nil, script, args...)
+}
+
+// runPythonTo is runPython sending the script's stdout to report instead of
+// the returned output, unless report is nil. The script runs within the
+// memory budget of ctx, or a budget of its own.
+func runPythonTo(ctx context.Context, report io.Writer, script string, args ...string) (analysisOutput, error) {
+	if err := circuitAllow(ctx); err != nil {
+		return analysisOutput{}, err
+	}
+	ctx = withMemoryBudget(ctx)
+	budget := memoryBudgetFrom(ctx)
+	logBuffers := 2 * int64(cfg.AnalyzerLogLimit)
+	if err := budget.reserve(logBuffers, "the analyzer output"); err != nil {
+		return analysisOutput{}, err
+	}
+	defer budget.release(logBuffers)
+	ctx, cancel := context.WithTimeout(ctx, analysisTimeout(ctx))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "python3", append([]string{script}, args...)...)
+	cmd.Dir = "."                   // run from current directory; ensure predict.py is colocated with this binary
+	cmd.WaitDelay = 5 * time.Second // don't hang on pipes held open by orphaned children
+	stdout := &tailBuffer{limit: cfg.AnalyzerLogLimit}
+	stderr := &tailBuffer{limit: cfg.AnalyzerLogLimit}
+	cmd.Stdout = stdout
+	if report != nil {
+		cmd.Stdout = report
+	}
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	exceeded, err := budget.run(cmd)
+	out := analysisOutput{Stdout: scrubSecrets(stdout.String()), Stderr: scrubSecrets(stderr.String())}
+	if cmd.ProcessState != nil {
+		out.cpu = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	if exceeded {
+		ae := memoryExceeded("the analyzer used more than the %d bytes left of the job's budget; raise DATASCRIBE_JOB_MEMORY_LIMIT or analyze fewer columns",
+			budget.limit-logBuffers)
+		ae.Stderr = out.Stderr
+		return out, ae
+	}
+	if err != nil {
+		ae := classifyAnalysisError(ctx, err, out.Stderr)
+		circuitRecord(ctx, ae)
+		return out, ae
+	}
+	circuitRecord(ctx, nil)
+	log.Printf("Analysis finished in %s", time.Since(start))
+	return out, nil
+}
+
+// classifyAnalysisError maps the way predict.py failed to an error code and
+// HTTP status. Older analyzers without dedicated exit codes are recognised
+// by the pandas exception names in their traceback.
+func classifyAnalysisError(ctx context.Context, err error, stderr string) *analysisError {
+	e := &analysisError{Stderr: stderr, Message: lastLine(stderr)}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		e.Code, e.Status = codeAnalyzerTimeout, http.StatusGatewayTimeout
+		e.Message = fmt.Sprintf("analysis did not finish within %s", analysisTimeout(ctx))
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitMalformedCSV,
+		strings.Contains(stderr, "pandas.errors.ParserError"),
+		strings.Contains(stderr, "pandas.errors.EmptyDataError"),
+		strings.Contains(stderr, "UnicodeDecodeError"):
+		e.Code, e.Status = codeMalformedCSV, http.StatusUnprocessableEntity
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitUnsupportedColumns:
+		e.Code, e.Status = codeUnsupportedColumns, http.StatusBadRequest
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitInvalidQuery:
+		e.Code, e.Status = codeInvalidQuery, http.StatusBadRequest
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitQueryTimeout:
+		e.Code, e.Status = codeQueryTimeout, http.StatusGatewayTimeout
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitInvalidTarget:
+		e.Code, e.Status = codeInvalidTarget, http.StatusBadRequest
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitUnsupportedFormat:
+		e.Code, e.Status = codeUnsupportedFormat, http.StatusUnsupportedMediaType
+	default:
+		e.Code, e.Status = codeAnalyzerCrashed, http.StatusInternalServerError
+		if e.Message == "" {
+			e.Message = err.Error()
+		}
+		e.engineFault = !errors.As(err, &exitErr) || !exitErr.Exited() || exitErr.ExitCode() == exitUsage ||
+			slices.ContainsFunc(engineExceptions, func(name string) bool { return strings.HasPrefix(e.Message, name+":") })
+	}
+	return e
+}
+
+// engineExceptions are the Python exceptions of a broken analyzer
+// environment, which no input can cause.
+var engineExceptions = []string{"ModuleNotFoundError", "ImportError", "SyntaxError", "IndentationError"}
+
+// lastLine returns the last non-empty line of s, which for a Python
+// traceback is the exception message.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// logAnalysisError records a failed analysis together with the analyzer's stderr.
+func logAnalysisError(name string, err error) {
+	var ae *analysisError
+	if errors.As(err, &ae) && ae.Stderr != "" {
+		log.Printf("analysis of %s failed: %v\n%s", name, err, ae.Stderr)
+		return
+	}
+	log.Printf("analysis of %s failed: %v", name, err)
+}
+
+// writeAnalysisError sends err as a JSON error with its machine-readable code.
+func writeAnalysisError(w http.ResponseWriter, err error) {
+	var ae *analysisError
+	if !errors.As(err, &ae) {
+		writeJSON(w, http.StatusInternalServerError, errorBody{Error: err.Error(), Code: codeAnalyzerCrashed})
+		return
+	}
+	writeJSON(w, ae.Status, errorBody{Error: ae.Message, Code: ae.Code})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The anonymize option maps columns to transforms that are applied to the
+// uploaded CSV in one streaming pass, right after the options are
+// validated, so neither the analyzer nor the job workspace ever holds the
+// original values:
+//
+//	hash       keyed SHA-256 (HMAC) of the value, the same for equal values
+//	mask[:N]   every character but the last N (default 4) replaced by *
+//	month      dates generalized to their month, 2024-03
+//	year       dates generalized to their year, 2024
+//	bucket:W   numbers replaced by the interval of width W holding them
+//
+// Missing values are left as they are, so the report still counts them.
+
+// anonymizeTransforms are the transforms without a parameter, followed by
+// those written name:parameter.
+var anonymizeTransforms = []string{"hash", "mask", "month", "year", "mask:N", "bucket:W"}
+
+// anonymizeTransform is a parsed transform.
+type anonymizeTransform struct {
+	name  string
+	keep  int     // mask
+	width float64 // bucket
+}
+
+// parseTransform parses one transform of the anonymize option.
+func parseTransform(spec string) (anonymizeTransform, error) {
+	name, param, hasParam := strings.Cut(spec, ":")
+	t := anonymizeTransform{name: name, keep: 4}
+	switch {
+	case name == "hash" || name == "month" || name == "year":
+		if hasParam {
+			return t, fmt.Errorf("%s takes no parameter", name)
+		}
+	case name == "mask":
+		if hasParam {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				return t, fmt.Errorf("mask:N needs a non-negative number of characters to keep, not %q", param)
+			}
+			t.keep = n
+		}
+	case name == "bucket":
+		w, err := strconv.ParseFloat(param, 64)
+		if err != nil || !(w > 0) || math.IsInf(w, 0) {
+			return t, fmt.Errorf("bucket:W needs a positive bucket width, not %q", param)
+		}
+		t.width = w
+	default:
+		return t, fmt.Errorf("unknown transform %q", spec)
+	}
+	return t, nil
+}
+
+// parseAnonymize parses a JSON object mapping column names to transforms.
+func parseAnonymize(v string) (map[string]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var policy map[string]string
+	if err := json.Unmarshal([]byte(v), &policy); err != nil {
+		return nil, errors.New(`anonymize must be a JSON object of column names to transforms, e.g. {"email": "hash"}`)
+	}
+	for column, spec := range policy {
+		if _, err := parseTransform(spec); err != nil {
+			return nil, fmt.Errorf("anonymize[%q]: %w", column, err)
+		}
+	}
+	return policy, nil
+}
+
+var (
+	anonymizeKeyOnce sync.Once
+	anonymizeKey     []byte
+)
+
+// anonymizeHashKey returns the HMAC key of the hash transform. Without
+// cfg.AnonymizeKey a random key is made per process, so hashes only match
+// within one server run.
+func anonymizeHashKey() []byte {
+	anonymizeKeyOnce.Do(func() {
+		if cfg.AnonymizeKey != "" {
+			anonymizeKey = []byte(cfg.AnonymizeKey)
+			return
+		}
+		anonymizeKey = make([]byte, 32)
+		rand.Read(anonymizeKey)
+	})
+	return anonymizeKey
+}
+
+// anonymizeDateLayouts are the date formats the month and year transforms
+// recognize.
+var anonymizeDateLayouts = []string{
+	time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02",
+	"2006/01/02", "2006-01", "20060102",
+}
+
+// apply transforms one value. Dates and numbers that cannot be read are
+// withheld rather than passed through.
+func (t anonymizeTransform) apply(v string) string {
+	if isNA(v) {
+		return v
+	}
+	switch t.name {
+	case "hash":
+		mac := hmac.New(sha256.New, anonymizeHashKey())
+		mac.Write([]byte(v))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	case "mask":
+		n := utf8.RuneCountInString(v)
+		if n <= t.keep {
+			return strings.Repeat("*", n)
+		}
+		cut := len(v)
+		for range t.keep {
+			_, size := utf8.DecodeLastRuneInString(v[:cut])
+			cut -= size
+		}
+		return strings.Repeat("*", n-t.keep) + v[cut:]
+	case "month", "year":
+		s := strings.TrimSpace(v)
+		for _, layout := range anonymizeDateLayouts {
+			if d, err := time.Parse(layout, s); err == nil {
+				if t.name == "year" {
+					return d.Format("2006")
+				}
+				return d.Format("2006-01")
+			}
+		}
+		return ""
+	case "bucket":
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return ""
+		}
+		lo := math.Floor(f/t.width) * t.width
+		return "[" + strconv.FormatFloat(lo, 'f', -1, 64) + ", " + strconv.FormatFloat(lo+t.width, 'f', -1, 64) + ")"
+	}
+	return v
+}
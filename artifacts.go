@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jobArtifactOptions are the artifacts a job produces only when its
+// options ask for them.
+var jobArtifactOptions = []string{"charts"}
+
+// datasetFormats are the encodings a dataset artifact can be downloaded in.
+var datasetFormats = []string{"csv", "tsv", "jsonl"}
+
+// jobArtifact is a file a job produced besides its report. The manifest of
+// a job lists them and GET /jobs/{id}/artifacts/{name} serves them.
+type jobArtifact struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size_bytes"`
+	SHA256      string `json:"sha256"`
+	// Formats lists the encodings a dataset can be downloaded in with
+	// ?format=; the first is the stored one.
+	Formats []string `json:"formats,omitempty"`
+
+	file string // name in the job workspace
+}
+
+// chartsDir is where predict.py saves the report pages as images when the
+// report is written to outPath.
+func chartsDir(outPath string) string {
+	return filepath.Join(filepath.Dir(outPath), "charts")
+}
+
+// collectArtifacts builds the artifact manifest of an analyzed job.
+func collectArtifacts(j *job) ([]jobArtifact, error) {
+	var list []jobArtifact
+	add := func(a jobArtifact) error {
+		info, err := os.Stat(j.ws.path(a.file))
+		if err != nil {
+			return err
+		}
+		if a.SHA256, err = fileSHA256(j.ws.path(a.file)); err != nil {
+			return err
+		}
+		a.Size = info.Size()
+		list = append(list, a)
+		return nil
+	}
+
+	var changes []string
+	if in := j.Input; in != nil && (in.Format != "csv" || in.Compression != "" || in.Delimiter != ",") {
+		changes = append(changes, "converted from "+describeInput(in))
+	}
+	if len(j.Options.Derive) > 0 {
+		changes = append(changes, "extended with the derived columns "+strings.Join(derivedNames(j.Options.Derive), ", "))
+	}
+	if j.Options.Filter != "" {
+		changes = append(changes, "filtered to the rows matching "+j.Options.Filter)
+	}
+	if len(j.Options.Anonymize) > 0 {
+		changes = append(changes, "anonymized")
+	}
+	if len(changes) > 0 {
+		err := add(jobArtifact{Name: "cleaned.csv", file: "input.csv", ContentType: "text/csv", Formats: datasetFormats,
+			Description: fmt.Sprintf("The upload %s, as it was analyzed.", strings.Join(changes, " and "))})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if slices.Contains(j.Options.Artifacts, "charts") {
+		n, err := zipCharts(j.ws, chartsDir(j.reportPath()), j.ws.path("charts.zip"))
+		if err != nil {
+			return nil, err
+		}
+		err = add(jobArtifact{Name: "charts.zip", file: "charts.zip", ContentType: "application/zip",
+			Description: fmt.Sprintf("The %d report pages as PNG images.", n)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// describeInput names the format of an upload, such as "gzip-compressed tsv".
+func describeInput(in *inputInfo) string {
+	format := in.Format
+	if in.Format == "csv" && in.Delimiter != "," {
+		format = fmt.Sprintf("%q-delimited", in.Delimiter)
+	}
+	if in.Compression != "" {
+		format = in.Compression + "-compressed " + format
+	}
+	return format
+}
+
+// zipCharts stores the page images in dir as a zip archive at dst and
+// removes dir. It returns the number of images.
+func zipCharts(ws *workspace, dir, dst string) (int, error) {
+	defer os.RemoveAll(dir)
+	pages, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return 0, err
+	}
+	slices.Sort(pages)
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(ws.writer(out))
+	now := time.Now()
+	for _, page := range pages {
+		// PNGs are compressed already
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.Base(page), Method: zip.Store, Modified: now})
+		if err != nil {
+			return 0, err
+		}
+		if err := copyFileTo(w, page); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return len(pages), out.Close()
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// handleGetJobArtifact serves an artifact of a finished job. Datasets can
+// be re-encoded on the way out with format=csv, tsv or jsonl.
+func handleGetJobArtifact(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	i := slices.IndexFunc(j.Artifacts, func(a jobArtifact) bool { return a.Name == name })
+	if i < 0 {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	a := j.Artifacts[i]
+	format := r.FormValue("format")
+	if format != "" && !slices.Contains(a.Formats, format) {
+		if len(a.Formats) == 0 {
+			http.Error(w, fmt.Sprintf("%s is only available as is", a.Name), http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("unsupported format %q (want %s)", format, strings.Join(a.Formats, ", ")), http.StatusBadRequest)
+		}
+		return
+	}
+
+	f, err := os.Open(j.ws.path(a.file))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open artifact: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if format == "" || format == a.Formats[0] {
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		w.Header().Set("ETag", `"`+a.SHA256+`"`)
+		http.ServeContent(w, r, a.Name, *j.FinishedAt, f)
+		return
+	}
+
+	filename := strings.TrimSuffix(a.Name, filepath.Ext(a.Name)) + "." + format
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if err := encodeDataset(w, f, format); err != nil {
+		// Headers are gone once rows are streamed
+		log.Printf("job %s: encoding %s as %s: %v", j.ID, a.Name, format, err)
+	}
+}
+
+// encodeDataset streams the CSV in r as tsv or jsonl. JSON Lines objects
+// map the header names to the cell strings, in column order.
+func encodeDataset(w http.ResponseWriter, r io.Reader, format string) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	header = slices.Clone(header)
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	if format == "tsv" {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		tw := csv.NewWriter(w)
+		tw.Comma = '\t'
+		if err := tw.Write(header); err != nil {
+			return err
+		}
+		for {
+			rec, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := tw.Write(rec); err != nil {
+				return err
+			}
+		}
+		tw.Flush()
+		return tw.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	keys := make([][]byte, len(header))
+	for i, name := range header {
+		keys[i], _ = json.Marshal(name)
+	}
+	bw := bufio.NewWriter(w)
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		// Written by hand to keep the columns in order
+		bw.WriteByte('{')
+		for i, key := range keys {
+			if i >= len(rec) {
+				break
+			}
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			value, _ := json.Marshal(rec[i])
+			bw.Write(key)
+			bw.WriteByte(':')
+			bw.Write(value)
+		}
+		if _, err := bw.WriteString("}\n"); err != nil {
+			return err
+		}
+	}
+}
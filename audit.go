@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time     time.Time      `json:"time"`
+	Event    string         `json:"event"`
+	Identity string         `json:"identity,omitempty"`
+	RemoteIP string         `json:"remote_ip"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+)
+
+// openAuditLog opens cfg.AuditLogFile for appending. While it is unset,
+// audit events go to the process log.
+func openAuditLog() error {
+	if cfg.AuditLogFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(cfg.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// audit records event for the request r as a JSON line.
+func audit(r *http.Request, event string, details map[string]any) {
+	line, err := json.Marshal(auditEvent{Time: time.Now().UTC(), Event: event, Identity: identityFrom(r),
+		RemoteIP: clientIP(r).String(), Details: details})
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	if auditFile == nil {
+		log.Printf("audit: %s", line)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
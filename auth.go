@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// errNoCredentials is returned by an authenticator when the request does not
+// carry credentials for its scheme, so the next scheme can be tried.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator verifies one credential scheme and returns the caller identity.
+type authenticator func(r *http.Request) (string, error)
+
+type identityKey struct{}
+
+// identityFrom returns the authenticated caller of r, or "" for anonymous requests.
+func identityFrom(r *http.Request) string {
+	id, _ := r.Context().Value(identityKey{}).(string)
+	return id
+}
+
+// enabledAuthenticators lists the credential schemes turned on by config.
+func enabledAuthenticators() []authenticator {
+	var auths []authenticator
+	if cfg.ClientCAFile != "" {
+		auths = append(auths, verifyClientCert)
+	}
+	if len(cfg.HMACKeys) > 0 {
+		auths = append(auths, verifySignature)
+	}
+	return auths
+}
+
+// requireAuth rejects requests that fail every enabled credential scheme.
+// When no scheme is configured the endpoint stays open, as before.
+func requireAuth(next http.Handler) http.Handler {
+	auths := enabledAuthenticators()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(auths) == 0 || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Schemes may swap r.Body for a spooled copy; release it once done.
+		defer func() { r.Body.Close() }()
+		for _, auth := range auths {
+			id, err := auth(r)
+			if errors.Is(err, errNoCredentials) {
+				continue
+			}
+			if err != nil {
+				log.Printf("auth rejected from %s: %v", r.RemoteAddr, err)
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			noteIdentity(r, id)
+			ctx := context.WithValue(r.Context(), identityKey{}, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		http.Error(w, "unauthorized: missing credentials", http.StatusUnauthorized)
+	})
+}
+
+// requireAdmin only lets identities listed in cfg.AdminIdentities through.
+// It must run behind requireAuth; anonymous callers are never admins.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := identityFrom(r); id == "" || !slices.Contains(cfg.AdminIdentities, id) {
+			http.Error(w, "forbidden: admin access required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// canaryCSV is the tiny dataset analyzed by the health monitor. It has a
+// numeric, a categorical and a missing value so the main code paths run.
+const canaryCSV = "id,value,group\n1,2.5,a\n2,3.5,b\n3,,a\n4,1.0,c\n"
+
+// canaryState is the outcome of the analyzer health checks.
+type canaryState struct {
+	Ready               bool       `json:"ready"`
+	LastRun             *time.Time `json:"last_run,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LatencySeconds      float64    `json:"latency_seconds"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+var (
+	canaryMu sync.Mutex
+	canary   canaryState
+
+	canaryRuns = newCounter("datascribe_canary_runs_total", "Canary analyses by result.")
+	_          = newGaugeFunc("datascribe_canary_latency_seconds", "Duration of the latest canary analysis.", func() float64 {
+		return currentCanary().LatencySeconds
+	})
+	_ = newGaugeFunc("datascribe_ready", "1 when the analyzer passes its health checks.", func() float64 {
+		if currentCanary().Ready && !currentCircuit().Open {
+			return 1
+		}
+		return 0
+	})
+)
+
+func currentCanary() canaryState {
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	return canary
+}
+
+// startCanary warms up the analyzer and then checks it every interval. The
+// instance reports unready until the first canary passes, and again after
+// cfg.CanaryFailureThreshold consecutive failures.
+func startCanary(interval time.Duration) {
+	if interval <= 0 {
+		canary.Ready = true
+		return
+	}
+	go func() {
+		for {
+			runCanary()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func runCanary() {
+	start := time.Now()
+	err := canaryAnalysis(context.WithValue(context.Background(), circuitCanaryKey{}, true))
+	latency := time.Since(start)
+
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	now := time.Now().UTC()
+	canary.LastRun = &now
+	canary.LatencySeconds = latency.Seconds()
+	if err != nil {
+		canaryRuns.inc("result", "failure")
+		canary.ConsecutiveFailures++
+		canary.LastError, _ = failureDetails(err)
+		if canary.ConsecutiveFailures >= cfg.CanaryFailureThreshold || canary.LastSuccess == nil {
+			canary.Ready = false
+		}
+		logAnalysisError("canary", err)
+		return
+	}
+	canaryRuns.inc("result", "success")
+	canary.ConsecutiveFailures = 0
+	canary.LastError = ""
+	canary.LastSuccess = &now
+	canary.Ready = true
+}
+
+func canaryAnalysis(ctx context.Context) error {
+	ws, err := allocateWorkspace("canary", int64(len(canaryCSV)))
+	if err != nil {
+		return err
+	}
+	defer ws.release()
+	in := ws.path("canary.csv")
+	if err := os.WriteFile(in, []byte(canaryCSV), 0o600); err != nil {
+		return err
+	}
+	_, err = runAnalysis(ctx, in, ws.path("report.pdf"), analysisOptions{})
+	return err
+}
+
+// handleReadyz reports whether this instance should receive traffic: the
+// canary passes and the analyzer circuit is closed.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	state := currentCanary()
+	circuit := currentCircuit()
+	state.Ready = state.Ready && !circuit.Open
+	status := http.StatusOK
+	if !state.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, struct {
+		canaryState
+		Circuit circuitState `json:"circuit"`
+	}{state, circuit})
+}
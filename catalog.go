@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finished jobs are pushed to a data catalog when DATASCRIBE_CATALOG_TYPE
+// is set: the schema inferred for the upload, its profile and a link to
+// the report. Jobs of a registered dataset update the same catalog entry
+// on every version; other jobs are named after their name or file.
+//
+// OpenMetadata tables are created or updated in the database schema
+// DATASCRIBE_CATALOG_SCHEMA (service.database.schema) through
+// DATASCRIBE_CATALOG_URL, its API base such as http://om:8585/api.
+// DataHub datasets of the platform DATASCRIBE_CATALOG_PLATFORM are written
+// as aspects through DATASCRIBE_CATALOG_URL, the GMS endpoint. Both
+// authenticate with the bearer token DATASCRIBE_CATALOG_TOKEN.
+
+// catalogSync is the outcome of pushing a job to the catalog.
+type catalogSync struct {
+	Catalog string `json:"catalog"`
+	// Entity is the fully qualified name or URN of the catalog entry.
+	Entity string `json:"entity"`
+	Error  string `json:"error,omitempty"`
+}
+
+// catalogTypes are the supported values of cfg.CatalogType.
+var catalogTypes = []string{"openmetadata", "datahub"}
+
+var catalogNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// checkCatalogConfig validates the catalog settings at startup.
+func checkCatalogConfig() error {
+	if cfg.CatalogType == "" {
+		return nil
+	}
+	if !slices.Contains(catalogTypes, cfg.CatalogType) {
+		return fmt.Errorf("invalid DATASCRIBE_CATALOG_TYPE=%q: want %s", cfg.CatalogType, strings.Join(catalogTypes, " or "))
+	}
+	if cfg.CatalogURL == "" {
+		return errors.New("DATASCRIBE_CATALOG_URL is required")
+	}
+	if cfg.CatalogType == "openmetadata" && cfg.CatalogSchema == "" {
+		return errors.New("DATASCRIBE_CATALOG_SCHEMA is required for openmetadata")
+	}
+	return nil
+}
+
+// catalogEntry is what is pushed about a job.
+type catalogEntry struct {
+	Name        string
+	Description string
+	ReportURL   string
+	Profile     *jobProfile
+	Stats       datasetStats
+	Properties  map[string]string
+	At          time.Time
+}
+
+// syncCatalog pushes the finished job j to the configured catalog. It
+// returns nil when there is none; failures are reported in the result
+// rather than failing the job.
+func syncCatalog(j *job) *catalogSync {
+	if cfg.CatalogType == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CatalogTimeout)
+	defer cancel()
+	e, err := newCatalogEntry(ctx, j)
+	res := &catalogSync{Catalog: cfg.CatalogType}
+	if err == nil {
+		if cfg.CatalogType == "openmetadata" {
+			res.Entity, err = pushOpenMetadata(ctx, e)
+		} else {
+			res.Entity, err = pushDataHub(ctx, e)
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func newCatalogEntry(ctx context.Context, j *job) (*catalogEntry, error) {
+	p, err := loadJobProfile(ctx, j)
+	if err != nil {
+		return nil, fmt.Errorf("inferring schema: %w", err)
+	}
+	var stats datasetStats
+	if j.stats != nil {
+		stats = *j.stats
+	} else if stats, err = computeStats(j.inputPath(), j.Options); err != nil {
+		return nil, fmt.Errorf("profiling: %w", err)
+	}
+	e := &catalogEntry{
+		Name:    cmp.Or(j.Name, j.Filename),
+		Profile: p,
+		Stats:   stats,
+		At:      *j.FinishedAt,
+		Properties: map[string]string{
+			"datascribe_job_id":        j.ID,
+			"datascribe_report_sha256": j.ReportSHA256,
+			"datascribe_filename":      j.Filename,
+		},
+	}
+	if j.Dataset != "" {
+		datasetsMu.Lock()
+		if d, ok := datasets[j.Dataset]; ok {
+			e.Name = cmp.Or(d.Name, d.ID)
+		}
+		datasetsMu.Unlock()
+		e.Properties["datascribe_dataset_id"] = j.Dataset
+		e.Properties["datascribe_dataset_version"] = strconv.Itoa(j.DatasetVersion)
+	}
+	e.Name = cmp.Or(strings.Trim(catalogNameInvalid.ReplaceAllString(e.Name, "_"), "_"), j.ID)
+	e.ReportURL = catalogReportURL(j)
+	e.Description = fmt.Sprintf("Profiled by DataScribe: %d rows, %d columns.", stats.Rows, len(stats.Columns))
+	if e.ReportURL != "" {
+		e.Description += fmt.Sprintf(" [Report](%s)", e.ReportURL)
+	}
+	return e, nil
+}
+
+// catalogReportURL links to the report of j under cfg.PublicURL, preferring
+// the copies that outlive the job: the dataset version, then the report
+// store.
+func catalogReportURL(j *job) string {
+	if cfg.PublicURL == "" {
+		return ""
+	}
+	base := strings.TrimSuffix(cfg.PublicURL, "/") + "/v1"
+	switch {
+	case j.DatasetVersion > 0:
+		return fmt.Sprintf("%s/datasets/%s/reports/%d", base, j.Dataset, j.DatasetVersion)
+	case store != nil:
+		return base + "/reports/" + j.ID
+	}
+	return base + "/jobs/" + j.ID + "/report"
+}
+
+// nullCount returns the number of missing values of a column.
+func (e *catalogEntry) nullCount(s columnStats) int {
+	return int(math.Round(s.MissingPct / 100 * float64(e.Stats.Rows)))
+}
+
+// catalogPost sends v as JSON with method to u and decodes the response
+// into out, if given.
+func catalogPost(ctx context.Context, method, u string, v, out any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.CatalogToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.CatalogToken)
+	}
+	if out == nil {
+		out = &json.RawMessage{}
+	}
+	return doJSON(req, out)
+}
+
+// openMetadataTypes maps profile types to OpenMetadata column data types.
+var openMetadataTypes = map[string]string{
+	"boolean": "BOOLEAN", "integer": "BIGINT", "number": "DOUBLE", "datetime": "TIMESTAMP", "string": "STRING",
+}
+
+// pushOpenMetadata creates or updates the table and adds a profile to it.
+func pushOpenMetadata(ctx context.Context, e *catalogEntry) (string, error) {
+	base := strings.TrimSuffix(cfg.CatalogURL, "/")
+	columns := make([]map[string]any, len(e.Profile.Columns))
+	for i, c := range e.Profile.Columns {
+		columns[i] = map[string]any{"name": c.Name, "dataType": cmp.Or(openMetadataTypes[c.Type], "STRING"),
+			"dataTypeDisplay": c.DType}
+	}
+	create := map[string]any{"name": e.Name, "databaseSchema": cfg.CatalogSchema, "columns": columns,
+		"description": e.Description}
+	if e.ReportURL != "" {
+		create["sourceUrl"] = e.ReportURL
+	}
+	var table struct {
+		ID  string `json:"id"`
+		FQN string `json:"fullyQualifiedName"`
+	}
+	if err := catalogPost(ctx, http.MethodPut, base+"/v1/tables", create, &table); err != nil {
+		return "", fmt.Errorf("openmetadata table: %w", err)
+	}
+
+	ts := e.At.UnixMilli()
+	profiles := []map[string]any{}
+	for _, s := range e.Stats.Columns {
+		p := map[string]any{"name": s.Name, "timestamp": ts, "nullProportion": s.MissingPct / 100,
+			"nullCount": e.nullCount(s), "distinctCount": s.Distinct}
+		if s.Numeric {
+			p["min"], p["max"], p["mean"], p["stddev"] = *s.Min, *s.Max, *s.Mean, *s.Std
+		}
+		profiles = append(profiles, p)
+	}
+	profile := map[string]any{
+		"tableProfile":  map[string]any{"timestamp": ts, "rowCount": e.Stats.Rows, "columnCount": len(e.Stats.Columns)},
+		"columnProfile": profiles,
+	}
+	if err := catalogPost(ctx, http.MethodPut, base+"/v1/tables/"+url.PathEscape(table.ID)+"/tableProfile", profile, nil); err != nil {
+		return table.FQN, fmt.Errorf("openmetadata profile: %w", err)
+	}
+	return table.FQN, nil
+}
+
+// dataHubTypes maps profile types to DataHub schema field types.
+var dataHubTypes = map[string]string{
+	"boolean": "BooleanType", "integer": "NumberType", "number": "NumberType", "datetime": "TimeType", "string": "StringType",
+}
+
+// pushDataHub upserts the schema, properties and a profile of the dataset.
+func pushDataHub(ctx context.Context, e *catalogEntry) (string, error) {
+	platform := "urn:li:dataPlatform:" + cfg.CatalogPlatform
+	urn := fmt.Sprintf("urn:li:dataset:(%s,%s,PROD)", platform, e.Name)
+
+	fields := make([]map[string]any, len(e.Profile.Columns))
+	for i, c := range e.Profile.Columns {
+		fields[i] = map[string]any{
+			"fieldPath":      c.Name,
+			"nativeDataType": c.DType,
+			"type":           map[string]any{"type": map[string]any{"com.linkedin.schema." + cmp.Or(dataHubTypes[c.Type], "StringType"): map[string]any{}}},
+			"nullable":       c.Missing > 0,
+		}
+	}
+	schema := map[string]any{
+		"schemaName":     e.Name,
+		"platform":       platform,
+		"version":        0,
+		"hash":           "",
+		"platformSchema": map[string]any{"com.linkedin.schema.OtherSchema": map[string]any{"rawSchema": ""}},
+		"fields":         fields,
+	}
+	properties := map[string]any{"name": e.Name, "description": e.Description, "customProperties": e.Properties}
+	if e.ReportURL != "" {
+		properties["externalUrl"] = e.ReportURL
+	}
+	profiles := []map[string]any{}
+	for _, s := range e.Stats.Columns {
+		p := map[string]any{"fieldPath": s.Name, "nullProportion": s.MissingPct / 100,
+			"nullCount": e.nullCount(s), "uniqueCount": s.Distinct}
+		if s.Numeric {
+			format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+			p["min"], p["max"], p["mean"], p["stdev"] = format(*s.Min), format(*s.Max), format(*s.Mean), format(*s.Std)
+		}
+		profiles = append(profiles, p)
+	}
+	profile := map[string]any{"timestampMillis": e.At.UnixMilli(), "rowCount": e.Stats.Rows,
+		"columnCount": len(e.Stats.Columns), "fieldProfiles": profiles}
+
+	endpoint := strings.TrimSuffix(cfg.CatalogURL, "/") + "/aspects?action=ingestProposal"
+	for _, aspect := range []struct {
+		name  string
+		value any
+	}{{"schemaMetadata", schema}, {"datasetProperties", properties}, {"datasetProfile", profile}} {
+		value, err := json.Marshal(aspect.value)
+		if err != nil {
+			return "", err
+		}
+		proposal := map[string]any{"proposal": map[string]any{
+			"entityType": "dataset", "entityUrn": urn, "changeType": "UPSERT", "aspectName": aspect.name,
+			"aspect": map[string]any{"contentType": "application/json", "value": string(value)},
+		}}
+		if err := catalogPost(ctx, http.MethodPost, endpoint, proposal, nil); err != nil {
+			return urn, fmt.Errorf("datahub %s: %w", aspect.name, err)
+		}
+	}
+	return urn, nil
+}
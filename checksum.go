@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// hashingBody hashes every byte read through it.
+type hashingBody struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	return n, err
+}
+
+// newContentMD5Body wraps body so that its RFC 1864 Content-MD5 can be
+// checked once it has been read completely.
+func newContentMD5Body(body io.ReadCloser) *hashingBody {
+	return &hashingBody{ReadCloser: body, h: md5.New()}
+}
+
+// verifyContentMD5 drains the rest of the body and compares its digest with
+// the base64 value of a Content-MD5 header.
+func (b *hashingBody) verifyContentMD5(want string) error {
+	if _, err := io.Copy(io.Discard, b); err != nil {
+		return err
+	}
+	got := base64.StdEncoding.EncodeToString(b.h.Sum(nil))
+	if got != strings.TrimSpace(want) {
+		return fmt.Errorf("Content-MD5 mismatch: computed %s", got)
+	}
+	return nil
+}
+
+// copyWithSHA256 copies src to dst and returns the hex sha256 of the data.
+func copyWithSHA256(dst io.Writer, src io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := copyBody(io.MultiWriter(dst, h), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunked uploads are a simpler alternative to tus:
+//
+//	POST /uploads                    create a session, returns its ID
+//	PUT  /uploads/{id}/parts/{n}     store part n (1-based), optionally with X-Content-SHA256
+//	POST /uploads/{id}/complete      assemble parts 1..N in order and queue the analysis
+//
+// Parts may be uploaded in any order and re-sent to overwrite a bad copy.
+
+// maxUploadParts bounds the number of parts in one session.
+const maxUploadParts = 10000
+
+type uploadPart struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type uploadSession struct {
+	mu       sync.Mutex
+	ID       string             `json:"id"`
+	Filename string             `json:"filename"`
+	Name     string             `json:"name,omitempty"`
+	Tags     []string           `json:"tags,omitempty"`
+	Labels   map[string]string  `json:"labels,omitempty"`
+	Dataset  string             `json:"dataset,omitempty"`
+	Source   string             `json:"source,omitempty"`
+	Priority jobPriority        `json:"priority"`
+	Options  analysisOptions    `json:"options"`
+	Expires  time.Time          `json:"expires_at"`
+	Parts    map[int]uploadPart `json:"-"`
+	owner    string
+	ws       *workspace
+}
+
+func (s *uploadSession) partPath(n int) string {
+	return s.ws.path(strconv.Itoa(n) + ".part")
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*uploadSession{}
+)
+
+func registerChunkedUploads() {
+	handleAPI("POST /uploads", protected(requiresEngine(handleCreateSession)))
+	handleAPI("PUT /uploads/{id}/parts/{n}", protected(handlePutPart))
+	handleAPI("POST /uploads/{id}/complete", protected(handleCompleteSession))
+}
+
+// lookupSession returns the session named in the request path if the caller owns it.
+func lookupSession(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	sessionsMu.Lock()
+	s, ok := sessions[r.PathValue("id")]
+	sessionsMu.Unlock()
+	if !ok || s.owner != identityFrom(r) {
+		http.Error(w, "upload session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return s, true
+}
+
+// handleCreateSession starts a chunked upload. The optional filename, name,
+// tags, labels, dataset and priority query parameters are recorded on the
+// resulting job.
+func handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	priority, err := parsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, tags, err := parseLabels(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := parseJobLabels(r.URL.Query().Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dataset := r.URL.Query().Get("dataset")
+	if err := checkDataset(dataset, identityFrom(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := parseSource(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	get, err := withPreset(r, query.Get)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	opts, err := decodeAnalysisOptions(get, slices.Collect(maps.Keys(query)),
+		[]string{"filename", "name", "tags", "labels", "dataset", "source", "priority", "preset"})
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	s := &uploadSession{
+		ID:       newID(),
+		Filename: sanitizeFilename(r.URL.Query().Get("filename")),
+		Name:     name,
+		Tags:     tags,
+		Labels:   labels,
+		Dataset:  dataset,
+		Source:   source,
+		Priority: priority,
+		Options:  opts,
+		Expires:  time.Now().Add(cfg.UploadExpiry).UTC(),
+		Parts:    map[int]uploadPart{},
+		owner:    identityFrom(r),
+	}
+	if s.ws, err = workspaces.allocate("sessions"); err != nil {
+		writeWorkspaceError(w, "session", err)
+		return
+	}
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+
+	w.Header().Set("Location", apiPath(r, "/uploads/"+s.ID))
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// handlePutPart stores one part, verifying X-Content-SHA256 when present.
+func handlePutPart(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSession(w, r)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 1 || n > maxUploadParts {
+		http.Error(w, fmt.Sprintf("part number must be between 1 and %d", maxUploadParts), http.StatusBadRequest)
+		return
+	}
+
+	limit := uploadLimit(r)
+	tmp, err := os.CreateTemp(s.ws.dir, "incoming_*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create part: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := copyBody(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, limit))
+	tmp.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadTooLarge(w, r, limit)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to read part: %v", err), http.StatusBadRequest)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if want := r.Header.Get("X-Content-SHA256"); want != "" && !strings.EqualFold(want, sum) {
+		http.Error(w, fmt.Sprintf("part %d checksum mismatch: got sha256 %s", n, sum), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for num, p := range s.Parts {
+		if num != n {
+			total += p.Size
+		}
+	}
+	if total+size > limit {
+		writeUploadTooLarge(w, r, limit)
+		return
+	}
+	if err := os.Rename(tmp.Name(), s.partPath(n)); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store part: %v", err), http.StatusInternalServerError)
+		return
+	}
+	part := uploadPart{Number: n, Size: size, SHA256: sum}
+	s.Parts[n] = part
+	writeJSON(w, http.StatusOK, part)
+}
+
+// completeRequest is the optional body of POST /uploads/{id}/complete. When
+// given, the listed part checksums and the whole-file checksum must match.
+type completeRequest struct {
+	Parts  []uploadPart `json:"parts"`
+	SHA256 string       `json:"sha256"`
+}
+
+// handleCompleteSession assembles the parts into a job input and queues it.
+func handleCompleteSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSession(w, r)
+	if !ok {
+		return
+	}
+	var req completeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	numbers := make([]int, 0, len(s.Parts))
+	for n := range s.Parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	if len(numbers) == 0 {
+		http.Error(w, "no parts uploaded", http.StatusBadRequest)
+		return
+	}
+	for i, n := range numbers {
+		if n != i+1 {
+			http.Error(w, fmt.Sprintf("missing part %d", i+1), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, p := range req.Parts {
+		got, ok := s.Parts[p.Number]
+		if !ok || !strings.EqualFold(got.SHA256, p.SHA256) {
+			http.Error(w, fmt.Sprintf("part %d checksum mismatch", p.Number), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	if dryRun {
+		// Validate a throwaway copy and keep the session for the real run
+		dryRunSession(w, r, s, numbers, req)
+		return
+	}
+
+	var size int64
+	for _, p := range s.Parts {
+		size += p.Size
+	}
+	j, err := createJob(jobSpec{Filename: s.Filename, Name: s.Name, Tags: s.Tags, Labels: s.Labels, Dataset: s.Dataset, Owner: s.owner,
+		Priority: s.Priority, Options: s.Options, Channel: "chunked", Source: s.Source, Size: size})
+	if err != nil {
+		writeWorkspaceError(w, "job", err)
+		return
+	}
+	prov := j.Provenance.clone()
+	start := time.Now()
+	sum, err := assembleParts(s, numbers, j.inputPath())
+	if err != nil {
+		deleteJob(j.ID)
+		http.Error(w, fmt.Sprintf("failed to assemble upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, sum) {
+		deleteJob(j.ID)
+		http.Error(w, fmt.Sprintf("upload checksum mismatch: got sha256 %s", sum), http.StatusUnprocessableEntity)
+		return
+	}
+	prov.Size, prov.SHA256 = fileSize(j.inputPath()), sum
+	prov.stage("assemble", start)
+	start = time.Now()
+	input, err := ingestFile(r.Context(), j.ws, j.inputPath(), uploadLimitFor(s.owner), s.Options.Delimiter)
+	if err != nil {
+		quarantine(err, j.inputPath(), s.Filename, s.owner, "chunked upload "+s.ID)
+		deleteJob(j.ID)
+		writeIngestError(w, err)
+		return
+	}
+	prov.stage("ingest", start)
+	updateJob(j.ID, func(j *job) { j.Input = input })
+	start = time.Now()
+	if err := s.Options.validate(j.inputPath()); err != nil {
+		quarantine(err, j.inputPath(), s.Filename, s.owner, "chunked upload "+s.ID)
+		deleteJob(j.ID)
+		writeOptionsError(w, err)
+		return
+	}
+	if err := prepareRows(j.ws, j.inputPath(), s.Options); err != nil {
+		quarantine(err, j.inputPath(), s.Filename, s.owner, "chunked upload "+s.ID)
+		deleteJob(j.ID)
+		writeIngestError(w, err)
+		return
+	}
+	prov.stage("prepare", start)
+	updateJob(j.ID, func(j *job) { j.Provenance = prov })
+	if err := submitJob(j); err != nil {
+		deleteJob(j.ID)
+		writeSubmitError(w, err)
+		return
+	}
+
+	deleteSession(s.ID)
+	queued, _ := getJob(j.ID)
+	w.Header().Set("Location", apiPath(r, "/jobs/"+j.ID))
+	writeJSON(w, http.StatusAccepted, queued)
+}
+
+// dryRunSession runs the checks of handleCompleteSession on the assembled
+// upload without creating a job. The caller holds s.mu.
+func dryRunSession(w http.ResponseWriter, r *http.Request, s *uploadSession, numbers []int, req completeRequest) {
+	path := s.ws.path("dry-run.csv")
+	defer os.Remove(path)
+	sum, err := assembleParts(s, numbers, path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to assemble upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, sum) {
+		http.Error(w, fmt.Sprintf("upload checksum mismatch: got sha256 %s", sum), http.StatusUnprocessableEntity)
+		return
+	}
+	input, err := ingestFile(r.Context(), s.ws, path, uploadLimitFor(s.owner), s.Options.Delimiter)
+	if err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	if err := s.Options.validate(path); err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	if err := prepareRows(s.ws, path, s.Options); err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	if err := s.ws.checkQuota(); err != nil {
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+		return
+	}
+	if err := checkSubmit(s.owner, s.Priority); err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+	res, err := newDryRunResult(path, s.Filename, sum, s.Options, fmt.Sprintf("queue a %s priority analysis job", s.Priority))
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	res.Input = input
+	wait := estimatedWait().Seconds()
+	res.EstimatedWaitSeconds = &wait
+	writeJSON(w, http.StatusOK, res)
+}
+
+// assembleParts concatenates the numbered parts into dst and returns its sha256.
+func assembleParts(s *uploadSession, numbers []int, dst string) (string, error) {
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	h := sha256.New()
+	for _, n := range numbers {
+		part, err := os.Open(s.partPath(n))
+		if err != nil {
+			return "", err
+		}
+		_, err = copyBody(io.MultiWriter(out, h), part)
+		part.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
+}
+
+func deleteSession(id string) {
+	sessionsMu.Lock()
+	s, ok := sessions[id]
+	delete(sessions, id)
+	sessionsMu.Unlock()
+	if ok {
+		s.ws.release()
+	}
+}
+
+// expireSessions drops chunked upload sessions whose expiry has passed.
+func expireSessions() {
+	now := time.Now()
+	var expired []string
+	sessionsMu.Lock()
+	for id, s := range sessions {
+		if now.After(s.Expires) {
+			expired = append(expired, id)
+		}
+	}
+	sessionsMu.Unlock()
+	for _, id := range expired {
+		deleteSession(id)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// testSession registers a chunked upload session owned by the anonymous
+// caller.
+func testSession(t *testing.T) *uploadSession {
+	s := &uploadSession{ID: newID(), Expires: time.Now().Add(time.Hour), Parts: map[int]uploadPart{}, ws: &workspace{dir: t.TempDir()}}
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, s.ID)
+		sessionsMu.Unlock()
+	})
+	return s
+}
+
+// TestChunkedParts stores parts out of order, with re-sends and bad
+// copies, in a session limited to 12 bytes.
+func TestChunkedParts(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.MaxUploadSize, cfg.UploadLimits = 12, nil
+
+	s := testSession(t)
+	tests := []struct {
+		name   string
+		n      string
+		body   string
+		sha256 string // X-Content-SHA256, if any
+		status int
+	}{
+		{name: "part 0", n: "0", body: "a", status: http.StatusBadRequest},
+		{name: "past the last part", n: strconv.Itoa(maxUploadParts + 1), body: "a", status: http.StatusBadRequest},
+		{name: "not a number", n: "two", body: "a", status: http.StatusBadRequest},
+		{name: "second part first", n: "2", body: "3,4\n", status: http.StatusOK},
+		{name: "bad copy", n: "1", body: "a,b\n", sha256: sha256Hex("a,c\n"), status: http.StatusUnprocessableEntity},
+		{name: "first part", n: "1", body: "a,b\n", sha256: strings.ToUpper(sha256Hex("a,b\n")), status: http.StatusOK},
+		{name: "over the limit", n: "3", body: "5,6\n7", status: http.StatusRequestEntityTooLarge},
+		{name: "re-sent within the limit", n: "1", body: "x,yy\n", status: http.StatusOK},
+		{name: "third part", n: "3", body: "5,6", status: http.StatusOK},
+		{name: "part too large", n: "4", body: strings.Repeat("z", 13), status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/uploads/"+s.ID+"/parts/"+tt.n, strings.NewReader(tt.body))
+		r.SetPathValue("id", s.ID)
+		r.SetPathValue("n", tt.n)
+		if tt.sha256 != "" {
+			r.Header.Set("X-Content-SHA256", tt.sha256)
+		}
+		w := httptest.NewRecorder()
+		handlePutPart(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	dst := s.ws.path("assembled")
+	sum, err := assembleParts(s, []int{1, 2, 3}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "x,yy\n3,4\n5,6"
+	if data, _ := os.ReadFile(dst); string(data) != want || sum != sha256Hex(want) {
+		t.Errorf("assembled %q with sha256 %s, want %q with %s", data, sum, want, sha256Hex(want))
+	}
+	if got := s.Parts[1]; got.Size != 5 || got.SHA256 != sha256Hex("x,yy\n") {
+		t.Errorf("part 1 = %+v, want the re-sent copy", got)
+	}
+}
+
+func TestChunkedCompleteChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  map[int]string
+		body   string
+		status int
+		want   string
+	}{
+		{name: "no parts", status: http.StatusBadRequest, want: "no parts uploaded"},
+		{name: "gap", parts: map[int]string{1: "a", 3: "c"}, status: http.StatusBadRequest, want: "missing part 2"},
+		{name: "no first part", parts: map[int]string{2: "b"}, status: http.StatusBadRequest, want: "missing part 1"},
+		{name: "listed checksum differs", parts: map[int]string{1: "a", 2: "b"},
+			body:   `{"parts": [{"number": 1, "sha256": "` + sha256Hex("a") + `"}, {"number": 2, "sha256": "` + sha256Hex("c") + `"}]}`,
+			status: http.StatusUnprocessableEntity, want: "part 2 checksum mismatch"},
+		{name: "listed part missing", parts: map[int]string{1: "a"},
+			body:   `{"parts": [{"number": 2, "sha256": "` + sha256Hex("b") + `"}]}`,
+			status: http.StatusUnprocessableEntity, want: "part 2 checksum mismatch"},
+		{name: "invalid body", parts: map[int]string{1: "a"}, body: `{"parts": 1}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		s := testSession(t)
+		for n, data := range tt.parts {
+			s.Parts[n] = uploadPart{Number: n, Size: int64(len(data)), SHA256: sha256Hex(data)}
+		}
+		r := httptest.NewRequest("POST", "/uploads/"+s.ID+"/complete", strings.NewReader(tt.body))
+		r.SetPathValue("id", s.ID)
+		w := httptest.NewRecorder()
+		handleCompleteSession(w, r)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The analyzer circuit breaker stops running the Python scripts after
+// cfg.CircuitThreshold consecutive crashes, typically a broken environment
+// after a deploy, and fails analyses fast until a canary probe, run every
+// cfg.CircuitProbeInterval, succeeds again. Only crashes no input can
+// cause are counted: the script failing to start or to load its code,
+// being killed by a signal or rejecting its command line, and any failure
+// of the canary, whose input is known to be good. A tenant's uploads that
+// make the analyzer raise an exception therefore cannot open the circuit
+// for everyone; timeouts and cancelled runs are not counted either.
+
+const codeAnalyzerUnavailable = "analyzer_unavailable"
+
+// circuitState is the state of the breaker as shown on /readyz.
+type circuitState struct {
+	Open                bool       `json:"open"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+}
+
+var (
+	circuitMu sync.Mutex
+	circuit   circuitState
+
+	circuitTransitions = newCounter("datascribe_analyzer_circuit_transitions_total", "Analyzer circuit breaker state changes.")
+	circuitRejections  = newCounter("datascribe_analyzer_circuit_rejections_total", "Analyses rejected while the analyzer circuit was open.")
+	_                  = newGaugeFunc("datascribe_analyzer_circuit_open", "1 while the analyzer circuit breaker is open.", func() float64 {
+		if currentCircuit().Open {
+			return 1
+		}
+		return 0
+	})
+)
+
+// circuitProbeKey marks the context of a probe, which runs while the
+// circuit is open.
+type circuitProbeKey struct{}
+
+// circuitCanaryKey marks the context of a canary analysis, whose crashes
+// are always the analyzer's fault.
+type circuitCanaryKey struct{}
+
+func currentCircuit() circuitState {
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	return circuit
+}
+
+// circuitAllow returns an error while the circuit is open.
+func circuitAllow(ctx context.Context) error {
+	if ctx.Value(circuitProbeKey{}) != nil {
+		return nil
+	}
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	if !circuit.Open {
+		return nil
+	}
+	circuitRejections.inc()
+	return &analysisError{Code: codeAnalyzerUnavailable, Status: http.StatusServiceUnavailable,
+		Message: fmt.Sprintf("the analyzer is paused after %d consecutive failures; try again later", circuit.ConsecutiveFailures)}
+}
+
+// circuitRecord counts the outcome of an analyzer run and opens the circuit
+// once the engine faults reach the threshold.
+func circuitRecord(ctx context.Context, err error) {
+	if cfg.CircuitThreshold <= 0 || ctx.Value(circuitProbeKey{}) != nil {
+		return
+	}
+	var ae *analysisError
+	crashed := errors.As(err, &ae) && ae.Code == codeAnalyzerCrashed && ctx.Err() == nil &&
+		(ae.engineFault || ctx.Value(circuitCanaryKey{}) != nil)
+	if err != nil && !crashed {
+		return
+	}
+	circuitMu.Lock()
+	defer circuitMu.Unlock()
+	if !crashed {
+		circuit.ConsecutiveFailures = 0
+		return
+	}
+	circuit.ConsecutiveFailures++
+	if circuit.Open || circuit.ConsecutiveFailures < cfg.CircuitThreshold {
+		return
+	}
+	now := time.Now().UTC()
+	circuit.Open, circuit.OpenedAt = true, &now
+	circuitTransitions.inc("state", "open")
+	log.Printf("analyzer circuit opened after %d consecutive failures", circuit.ConsecutiveFailures)
+	go probeCircuit()
+}
+
+// probeCircuit runs the canary analysis every cfg.CircuitProbeInterval and
+// closes the circuit once it passes.
+func probeCircuit() {
+	ctx := context.WithValue(context.Background(), circuitProbeKey{}, true)
+	for {
+		time.Sleep(cfg.CircuitProbeInterval)
+		err := canaryAnalysis(ctx)
+		now := time.Now().UTC()
+		circuitMu.Lock()
+		circuit.LastProbe = &now
+		if err == nil {
+			circuit.Open, circuit.OpenedAt, circuit.ConsecutiveFailures = false, nil, 0
+			circuitTransitions.inc("state", "closed")
+			circuitMu.Unlock()
+			log.Printf("analyzer circuit closed: probe passed")
+			return
+		}
+		circuitMu.Unlock()
+		logAnalysisError("circuit probe", err)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the runtime settings of the server. Every field is read from
+// a DATASCRIBE_* environment variable so deployments can be tuned without
+// rebuilding the binary.
+type config struct {
+	// Addr is the listen address.
+	Addr string
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile is a PEM bundle used to verify client certificates.
+	ClientCAFile string
+	// MTLSRequired rejects TLS handshakes without a valid client certificate.
+	MTLSRequired bool
+	// MTLSIdentities maps a certificate SAN or CN to a caller identity,
+	// given as name=identity pairs; name:identity is accepted too.
+	MTLSIdentities map[string]string
+	// H2C accepts HTTP/2 with prior knowledge on the plaintext listener.
+	H2C bool
+	// WebSocketOrigins are the origins besides the server's own whose
+	// pages may open the /ws WebSocket.
+	WebSocketOrigins []string
+	// UpgradeTimeout bounds how long the process started by an upgrade
+	// (SIGUSR2) may take to become ready before the upgrade is abandoned.
+	UpgradeTimeout time.Duration
+	// UpgradeDrainTimeout bounds how long the replaced process keeps running
+	// its requests and jobs after an upgrade.
+	UpgradeDrainTimeout time.Duration
+
+	// LegacySunset is announced in the Sunset header of unversioned routes.
+	LegacySunset time.Time
+
+	// AllowCIDRs, when non-empty, limits protected endpoints to these ranges.
+	AllowCIDRs []netip.Prefix
+	// DenyCIDRs are rejected even if they also match AllowCIDRs.
+	DenyCIDRs []netip.Prefix
+	// TrustedProxies may supply the client address via X-Forwarded-For.
+	TrustedProxies []netip.Prefix
+
+	// WorkspaceRoot holds per-job and per-upload working directories. It is
+	// wiped at startup and may live on tmpfs.
+	WorkspaceRoot string
+	// WorkspaceVolumes, when set, replace WorkspaceRoot with a datascribe
+	// directory on each of these volumes, such as local NVMe drives. Each
+	// workspace goes to the volume with the most free space, and temporary
+	// files to the first one.
+	WorkspaceVolumes []string
+	// WorkspaceMinFree is the free space a workspace volume must keep
+	// besides the input of new work, which is refused otherwise.
+	WorkspaceMinFree int64
+	// WorkspaceLimit caps the disk space of a single workspace; 0 disables it.
+	WorkspaceLimit int64
+	// MemoryWorkspaceRoot is a memory-backed directory, such as a tmpfs
+	// mount, for the workspaces of inputs of up to MemoryWorkspaceMax bytes,
+	// while they take up to MemoryWorkspaceBudget in total. It is wiped at
+	// startup; small inputs use WorkspaceRoot while it is unset.
+	MemoryWorkspaceRoot   string
+	MemoryWorkspaceMax    int64
+	MemoryWorkspaceBudget int64
+	// DedupInputs stores identical job inputs once; see dedup.go.
+	DedupInputs bool
+	// Workers is the number of analyses run concurrently for queued jobs.
+	Workers int
+	// QueueSize is the number of jobs that may wait for a worker.
+	QueueSize int
+	// HighPriorityLimit caps the high priority jobs one caller may have in flight.
+	HighPriorityLimit int
+	// HighPriorityLimits overrides HighPriorityLimit per caller identity.
+	HighPriorityLimits map[string]int
+	// JobRetention is how long finished jobs and their reports are kept.
+	JobRetention time.Duration
+	// AnalysisTimeout bounds a single predict.py run.
+	AnalysisTimeout time.Duration
+	// EndpointPolicies sets the concurrency and timeout of endpoints by
+	// path; see policy.go.
+	EndpointPolicies map[string]string
+	// EstimateCellsPerSecond and EstimateOverhead model analysis time for
+	// POST /estimate: overhead plus rows times columns at this rate.
+	EstimateCellsPerSecond float64
+	EstimateOverhead       time.Duration
+	// DisconnectMode decides what happens to a synchronous analysis whose
+	// client disconnects: "cancel" stops the analyzer, "async" lets it
+	// finish and keeps the result as a job.
+	DisconnectMode string
+	// ProfileWorkers is the number of goroutines POST /profile parses a file
+	// with; 0 uses one per CPU.
+	ProfileWorkers int
+	// StreamReports relays the PDF of a synchronous analysis to the client
+	// as predict.py writes it, instead of sending the finished file.
+	StreamReports bool
+	// ReportMaxPages caps the pages of a generated report; further charts are
+	// left out. 0 disables the limit.
+	ReportMaxPages int
+	// ReportMaxSize rejects reports larger than this many bytes; 0 disables it.
+	ReportMaxSize int64
+	// Ghostscript is the gs binary used to produce PDF/A reports and to render
+	// page previews.
+	Ghostscript string
+	// PDFAICCProfile is the sRGB ICC profile embedded as the output intent of
+	// PDF/A reports; pdfa=true is refused while it is unset.
+	PDFAICCProfile string
+	// PreviewResolution is the DPI report page previews are rendered at.
+	PreviewResolution int
+	// ShareDefaultExpiry is the lifetime of a report share link created
+	// without expires_in.
+	ShareDefaultExpiry time.Duration
+	// AuditLogFile receives audit events as JSON lines; they go to the
+	// process log while it is unset.
+	AuditLogFile string
+	// AccessLogFormat is "combined", "json" or "off".
+	AccessLogFormat string
+	// AccessLogFile receives the access log; it goes to stdout, apart from
+	// the process log on stderr, while it is unset.
+	AccessLogFile string
+	// AccessLogSample maps request paths to the fraction of their requests
+	// that are logged, e.g. /healthz=0.01.
+	AccessLogSample map[string]float64
+	// QuietPaths, typically load balancer probes and scrapes, are left out
+	// of the access log and the HTTP request metrics.
+	QuietPaths []string
+	// MetricLabels are the job label keys exported as dimensions of the job
+	// metrics, each with at most MetricLabelValues distinct values.
+	MetricLabels      []string
+	MetricLabelValues int
+	// ExportConnectorsFile is the JSON file of per-identity Google Drive and
+	// Dropbox connectors that finished reports are exported to.
+	ExportConnectorsFile string
+	// ExportTimeout bounds the export of one report.
+	ExportTimeout time.Duration
+	// CatalogType is "openmetadata" or "datahub" to push the schema and
+	// profile of each finished job to that catalog at CatalogURL, with the
+	// bearer token CatalogToken. OpenMetadata tables are created in the
+	// database schema CatalogSchema; DataHub datasets belong to the platform
+	// CatalogPlatform.
+	CatalogType     string
+	CatalogURL      string
+	CatalogToken    string
+	CatalogSchema   string
+	CatalogPlatform string
+	// CatalogTimeout bounds the push of one job.
+	CatalogTimeout time.Duration
+	// PublicURL is the address clients reach the server at, used for the
+	// report links of catalog entries.
+	PublicURL string
+	// ReportStoreDir keeps finished reports on local disk after their jobs
+	// expire; reports are not kept while it is unset.
+	ReportStoreDir string
+	// QuarantineDir keeps uploads rejected for their content, for
+	// QuarantineTTL and within the size caps; see quarantine.go. They are
+	// not kept while it is unset.
+	QuarantineDir         string
+	QuarantineTTL         time.Duration
+	QuarantineMaxFileSize int64
+	QuarantineMaxSize     int64
+	// SigningCertFile and SigningKeyFile are the PEM certificate chain and key
+	// used to sign reports; reports are unsigned while they are unset.
+	SigningCertFile string
+	SigningKeyFile  string
+	// AnonymizeKey is the HMAC key of the anonymize hash transform. Set it
+	// for hashes that match across restarts and replicas; a random key is
+	// used otherwise.
+	AnonymizeKey string
+	// JobMemoryLimit is the memory budget of each analysis, in bytes: the
+	// server's buffers for it and the analyzer's resident memory. 0
+	// disables it.
+	JobMemoryLimit int64
+	// AnalyzerLogLimit caps the stdout and stderr kept per analyzer run, in bytes.
+	AnalyzerLogLimit int
+	// Engine is python, or disabled to serve only the endpoints that do not
+	// need the analyzer; see engine.go.
+	Engine string
+	// CanaryInterval is how often the analyzer health check runs; 0 disables it.
+	CanaryInterval time.Duration
+	// CanaryFailureThreshold is the consecutive canary failures that mark the
+	// instance unready.
+	CanaryFailureThreshold int
+	// CircuitThreshold is the consecutive analyzer crashes that open the
+	// circuit breaker; 0 disables it.
+	CircuitThreshold int
+	// CircuitProbeInterval is how often an open circuit probes the analyzer.
+	CircuitProbeInterval time.Duration
+	// JobMaxAttempts is how many times a failing analysis is tried.
+	JobMaxAttempts int
+	// JobWaitMax caps the wait of a long-polling GET /jobs/{id}.
+	JobWaitMax time.Duration
+	// DLQRetention is how long dead-lettered jobs and their inputs are kept.
+	DLQRetention time.Duration
+	// AdminIdentities may use the /admin endpoints.
+	AdminIdentities []string
+	// FeatureFlags sets the rule of feature flags by name; see flags.go.
+	FeatureFlags map[string]string
+	// UploadExpiry is how long an incomplete resumable upload is kept.
+	UploadExpiry time.Duration
+
+	// MaxUploadSize is the default upper bound for uploads, in bytes.
+	MaxUploadSize int64
+	// MultipartMemory is how much of the files of a multipart upload is
+	// kept in memory; the rest is spooled to disk. See spool.go.
+	MultipartMemory int64
+	// SpoolDir holds spooled request bodies and other temporary files.
+	SpoolDir string
+	// UploadBufferSize is the size of the buffers request bodies are
+	// copied with.
+	UploadBufferSize int64
+	// UploadLimits overrides MaxUploadSize per caller identity.
+	UploadLimits map[string]int64
+
+	// ClamdAddr points at a clamd daemon (tcp://host:port or unix:///path).
+	ClamdAddr string
+	// ScanURL is an external scanning API used when clamd is not configured.
+	ScanURL string
+	// ScanTimeout bounds a single malware scan.
+	ScanTimeout time.Duration
+
+	// AggregateMaxGroups caps the groups POST /aggregate holds in memory.
+	AggregateMaxGroups int
+	// ModelDir stores trained models. Unlike WorkspaceRoot it survives
+	// restarts.
+	ModelDir string
+	// BaselineDir stores the dataset profiles registered for drift
+	// monitoring. Like ModelDir it survives restarts.
+	BaselineDir string
+	// DatasetDir stores registered datasets and the reports of each of their
+	// versions. Like ModelDir it survives restarts.
+	DatasetDir string
+	// PresetsFile stores the option presets admins define for tenants.
+	PresetsFile string
+	// DriftPSIThreshold and DriftKSThreshold are the default PSI and KS
+	// statistic at which a column counts as drifted.
+	DriftPSIThreshold float64
+	DriftKSThreshold  float64
+	// DriftWebhookURL receives a JSON alert whenever a batch drifts.
+	DriftWebhookURL string
+	// DriftWebhookTimeout bounds a single webhook delivery.
+	DriftWebhookTimeout time.Duration
+	// ErrorTrackerDSN is a Sentry DSN or webhook URL that panics, 5xx
+	// responses and failed jobs are reported to.
+	ErrorTrackerDSN string
+	// ErrorTrackerTimeout bounds a single event delivery.
+	ErrorTrackerTimeout time.Duration
+	// QueryMaxRows caps, and is the default for, rows returned by POST /query.
+	QueryMaxRows int
+	// QueryTimeout bounds how long a POST /query statement may run.
+	QueryTimeout time.Duration
+
+	// HMACKeys maps a key ID to its shared secret for signed requests, given
+	// as id:secret pairs; id=secret is accepted too.
+	HMACKeys map[string]string
+	// SignatureMaxSkew bounds how far a signed timestamp may drift from now.
+	SignatureMaxSkew time.Duration
+}
+
+// cfg is the configuration loaded at startup.
+var cfg config
+
+func loadConfig() config {
+	return config{
+		Addr:                   envString("DATASCRIBE_ADDR", ":8080"),
+		TLSCertFile:            envString("DATASCRIBE_TLS_CERT", ""),
+		TLSKeyFile:             envString("DATASCRIBE_TLS_KEY", ""),
+		ClientCAFile:           envString("DATASCRIBE_CLIENT_CA", ""),
+		MTLSRequired:           envBool("DATASCRIBE_MTLS_REQUIRED", false),
+		MTLSIdentities:         envIdentityMap("DATASCRIBE_MTLS_IDENTITIES"),
+		H2C:                    envBool("DATASCRIBE_H2C", false),
+		WebSocketOrigins:       envList("DATASCRIBE_WEBSOCKET_ORIGINS"),
+		UpgradeTimeout:         envDuration("DATASCRIBE_UPGRADE_TIMEOUT", time.Minute),
+		UpgradeDrainTimeout:    envDuration("DATASCRIBE_UPGRADE_DRAIN_TIMEOUT", time.Hour),
+		LegacySunset:           envDate("DATASCRIBE_LEGACY_SUNSET", time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)),
+		AllowCIDRs:             envPrefixes("DATASCRIBE_ALLOW_CIDRS"),
+		DenyCIDRs:              envPrefixes("DATASCRIBE_DENY_CIDRS"),
+		TrustedProxies:         envPrefixes("DATASCRIBE_TRUSTED_PROXIES"),
+		WorkspaceRoot:          envString("DATASCRIBE_WORKSPACE_ROOT", filepath.Join(os.TempDir(), "datascribe")),
+		WorkspaceVolumes:       envList("DATASCRIBE_WORKSPACE_VOLUMES"),
+		WorkspaceMinFree:       envSize("DATASCRIBE_WORKSPACE_MIN_FREE", 0),
+		WorkspaceLimit:         envSize("DATASCRIBE_WORKSPACE_LIMIT", 1<<30),
+		MemoryWorkspaceRoot:    envString("DATASCRIBE_MEMORY_WORKSPACE_ROOT", ""),
+		MemoryWorkspaceMax:     envSize("DATASCRIBE_MEMORY_WORKSPACE_MAX", 8<<20),
+		MemoryWorkspaceBudget:  envSize("DATASCRIBE_MEMORY_WORKSPACE_BUDGET", 256<<20),
+		DedupInputs:            envBool("DATASCRIBE_DEDUP_INPUTS", false),
+		Workers:                envInt("DATASCRIBE_WORKERS", 2),
+		QueueSize:              envInt("DATASCRIBE_QUEUE_SIZE", 100),
+		HighPriorityLimit:      envInt("DATASCRIBE_HIGH_PRIORITY_LIMIT", 2),
+		HighPriorityLimits:     envIntMap("DATASCRIBE_HIGH_PRIORITY_LIMITS"),
+		JobRetention:           envDuration("DATASCRIBE_JOB_RETENTION", 24*time.Hour),
+		AnalysisTimeout:        envDuration("DATASCRIBE_ANALYSIS_TIMEOUT", 10*time.Minute),
+		EndpointPolicies:       envMap("DATASCRIBE_ENDPOINT_POLICIES"),
+		DisconnectMode:         envString("DATASCRIBE_DISCONNECT_MODE", "cancel"),
+		ProfileWorkers:         envInt("DATASCRIBE_PROFILE_WORKERS", 0),
+		StreamReports:          envBool("DATASCRIBE_STREAM_REPORTS", false),
+		EstimateCellsPerSecond: envFloat("DATASCRIBE_ESTIMATE_CELLS_PER_SECOND", 25000),
+		EstimateOverhead:       envDuration("DATASCRIBE_ESTIMATE_OVERHEAD", 5*time.Second),
+		ReportMaxPages:         envInt("DATASCRIBE_REPORT_MAX_PAGES", 200),
+		ReportMaxSize:          envSize("DATASCRIBE_REPORT_MAX_SIZE", 100<<20),
+		Ghostscript:            envString("DATASCRIBE_GHOSTSCRIPT", "gs"),
+		PDFAICCProfile:         envString("DATASCRIBE_PDFA_ICC_PROFILE", ""),
+		PreviewResolution:      envInt("DATASCRIBE_PREVIEW_RESOLUTION", 50),
+		ShareDefaultExpiry:     envDuration("DATASCRIBE_SHARE_DEFAULT_EXPIRY", 7*24*time.Hour),
+		AuditLogFile:           envString("DATASCRIBE_AUDIT_LOG", ""),
+		AccessLogFormat:        envString("DATASCRIBE_ACCESS_LOG_FORMAT", "combined"),
+		AccessLogFile:          envString("DATASCRIBE_ACCESS_LOG", ""),
+		AccessLogSample:        envFloatMap("DATASCRIBE_ACCESS_LOG_SAMPLE"),
+		QuietPaths:             envListDefault("DATASCRIBE_QUIET_PATHS", "/healthz,/readyz,/metrics,/scaling"),
+		MetricLabels:           envList("DATASCRIBE_METRIC_LABELS"),
+		MetricLabelValues:      envInt("DATASCRIBE_METRIC_LABEL_VALUES", 20),
+		ExportConnectorsFile:   envString("DATASCRIBE_EXPORT_CONNECTORS", ""),
+		ExportTimeout:          envDuration("DATASCRIBE_EXPORT_TIMEOUT", time.Minute),
+		CatalogType:            envString("DATASCRIBE_CATALOG_TYPE", ""),
+		CatalogURL:             envString("DATASCRIBE_CATALOG_URL", ""),
+		CatalogToken:           envString("DATASCRIBE_CATALOG_TOKEN", ""),
+		CatalogSchema:          envString("DATASCRIBE_CATALOG_SCHEMA", ""),
+		CatalogPlatform:        envString("DATASCRIBE_CATALOG_PLATFORM", "datascribe"),
+		CatalogTimeout:         envDuration("DATASCRIBE_CATALOG_TIMEOUT", 30*time.Second),
+		PublicURL:              envString("DATASCRIBE_PUBLIC_URL", ""),
+		ReportStoreDir:         envString("DATASCRIBE_REPORT_STORE_DIR", ""),
+		QuarantineDir:          envString("DATASCRIBE_QUARANTINE_DIR", ""),
+		QuarantineTTL:          envDuration("DATASCRIBE_QUARANTINE_TTL", 24*time.Hour),
+		QuarantineMaxFileSize:  envSize("DATASCRIBE_QUARANTINE_MAX_FILE_SIZE", 10<<20),
+		QuarantineMaxSize:      envSize("DATASCRIBE_QUARANTINE_MAX_SIZE", 1<<30),
+		SigningCertFile:        envString("DATASCRIBE_SIGNING_CERT", ""),
+		SigningKeyFile:         envString("DATASCRIBE_SIGNING_KEY", ""),
+		AnonymizeKey:           envString("DATASCRIBE_ANONYMIZE_KEY", ""),
+		JobMemoryLimit:         envSize("DATASCRIBE_JOB_MEMORY_LIMIT", 0),
+		AnalyzerLogLimit:       int(envSize("DATASCRIBE_ANALYZER_LOG_LIMIT", 64<<10)),
+		Engine:                 envString("DATASCRIBE_ENGINE", "python"),
+		CanaryInterval:         envDuration("DATASCRIBE_CANARY_INTERVAL", 5*time.Minute),
+		CanaryFailureThreshold: envInt("DATASCRIBE_CANARY_FAILURE_THRESHOLD", 2),
+		CircuitThreshold:       envInt("DATASCRIBE_CIRCUIT_THRESHOLD", 5),
+		CircuitProbeInterval:   envDuration("DATASCRIBE_CIRCUIT_PROBE_INTERVAL", 30*time.Second),
+		JobMaxAttempts:         envInt("DATASCRIBE_JOB_MAX_ATTEMPTS", 2),
+		JobWaitMax:             envDuration("DATASCRIBE_JOB_WAIT_MAX", time.Minute),
+		DLQRetention:           envDuration("DATASCRIBE_DLQ_RETENTION", 7*24*time.Hour),
+		AdminIdentities:        envList("DATASCRIBE_ADMIN_IDENTITIES"),
+		FeatureFlags:           envMap("DATASCRIBE_FEATURE_FLAGS"),
+		UploadExpiry:           envDuration("DATASCRIBE_UPLOAD_EXPIRY", 24*time.Hour),
+		MaxUploadSize:          envSize("DATASCRIBE_MAX_UPLOAD_SIZE", 50<<20),
+		MultipartMemory:        envSize("DATASCRIBE_MULTIPART_MEMORY", 32<<20),
+		SpoolDir:               envString("DATASCRIBE_SPOOL_DIR", ""),
+		UploadBufferSize:       envSize("DATASCRIBE_UPLOAD_BUFFER_SIZE", 32<<10),
+		UploadLimits:           envSizeMap("DATASCRIBE_UPLOAD_LIMITS"),
+		ClamdAddr:              envString("DATASCRIBE_CLAMD_ADDR", ""),
+		ScanURL:                envString("DATASCRIBE_SCAN_URL", ""),
+		ScanTimeout:            envDuration("DATASCRIBE_SCAN_TIMEOUT", 60*time.Second),
+		AggregateMaxGroups:     envInt("DATASCRIBE_AGGREGATE_MAX_GROUPS", 100000),
+		ModelDir:               envString("DATASCRIBE_MODEL_DIR", "models"),
+		BaselineDir:            envString("DATASCRIBE_BASELINE_DIR", "baselines"),
+		DatasetDir:             envString("DATASCRIBE_DATASET_DIR", "datasets"),
+		PresetsFile:            envString("DATASCRIBE_PRESETS_FILE", "presets.json"),
+		DriftPSIThreshold:      envFloat("DATASCRIBE_DRIFT_PSI_THRESHOLD", 0.2),
+		DriftKSThreshold:       envFloat("DATASCRIBE_DRIFT_KS_THRESHOLD", 0.1),
+		DriftWebhookURL:        envString("DATASCRIBE_DRIFT_WEBHOOK_URL", ""),
+		DriftWebhookTimeout:    envDuration("DATASCRIBE_DRIFT_WEBHOOK_TIMEOUT", 10*time.Second),
+		ErrorTrackerDSN:        envString("DATASCRIBE_ERROR_TRACKER_DSN", ""),
+		ErrorTrackerTimeout:    envDuration("DATASCRIBE_ERROR_TRACKER_TIMEOUT", 10*time.Second),
+		QueryMaxRows:           envInt("DATASCRIBE_QUERY_MAX_ROWS", 1000),
+		QueryTimeout:           envDuration("DATASCRIBE_QUERY_TIMEOUT", 30*time.Second),
+		HMACKeys:               envKeyMap("DATASCRIBE_HMAC_KEYS"),
+		SignatureMaxSkew:       envDuration("DATASCRIBE_SIGNATURE_MAX_SKEW", 5*time.Minute),
+	}
+}
+
+// envString returns the environment variable key, or def when it is unset.
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envInt returns the environment variable key parsed as an int, or def.
+func envInt(key string, def int) int {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return n
+}
+
+// envFloat returns the environment variable key parsed as a float64, or def.
+func envFloat(key string, def float64) float64 {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return f
+}
+
+// envKeyMap parses a comma-separated list of id:secret pairs, the format
+// of DATASCRIBE_HMAC_KEYS from the start, or id=secret pairs like envMap.
+// The ID ends at the first : or =, so secrets may contain either, as
+// base64 ones do.
+func envKeyMap(key string) map[string]string {
+	out := map[string]string{}
+	for _, item := range envList(key) {
+		i := strings.IndexAny(item, ":=")
+		if i <= 0 {
+			log.Fatalf("invalid %s entry %q: want id:secret", key, item)
+		}
+		out[strings.TrimSpace(item[:i])] = strings.TrimSpace(item[i+1:])
+	}
+	return out
+}
+
+// envIdentityMap parses a comma-separated list of name=identity pairs, or
+// name:identity pairs, the format map variables had before envMap moved
+// to =. Names are certificate SANs, which may contain colons themselves,
+// as URIs and IPv6 addresses do, so without = the identity is what follows
+// the last colon.
+func envIdentityMap(key string) map[string]string {
+	out := map[string]string{}
+	for _, item := range envList(key) {
+		i := strings.IndexByte(item, '=')
+		if i < 0 {
+			i = strings.LastIndexByte(item, ':')
+		}
+		if i <= 0 {
+			log.Fatalf("invalid %s entry %q: want name=identity", key, item)
+		}
+		out[strings.TrimSpace(item[:i])] = strings.TrimSpace(item[i+1:])
+	}
+	return out
+}
+
+// envIntMap parses a comma-separated list of name=int pairs.
+func envIntMap(key string) map[string]int {
+	out := map[string]int{}
+	for name, v := range envMap(key) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s entry %s=%q: %v", key, name, v, err)
+		}
+		out[name] = n
+	}
+	return out
+}
+
+// envFloatMap parses a comma-separated list of name=float pairs.
+func envFloatMap(key string) map[string]float64 {
+	out := map[string]float64{}
+	for name, v := range envMap(key) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("invalid %s entry %s=%q: %v", key, name, v, err)
+		}
+		out[name] = f
+	}
+	return out
+}
+
+// envBool returns the environment variable key parsed as a bool, or def.
+func envBool(key string, def bool) bool {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return b
+}
+
+// envDuration returns the environment variable key parsed as a duration, or def.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return d
+}
+
+// envDate returns the environment variable key parsed as a YYYY-MM-DD date
+// in UTC, or def.
+func envDate(key string, def time.Time) time.Time {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return t
+}
+
+// envSize returns the environment variable key parsed with parseSize, or def.
+func envSize(key string, def int64) int64 {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", key, v, err)
+	}
+	return n
+}
+
+// envSizeMap parses a comma-separated list of name=size pairs.
+func envSizeMap(key string) map[string]int64 {
+	out := map[string]int64{}
+	for name, v := range envMap(key) {
+		n, err := parseSize(v)
+		if err != nil {
+			log.Fatalf("invalid %s entry %s=%q: %v", key, name, v, err)
+		}
+		out[name] = n
+	}
+	return out
+}
+
+// parseSize parses a byte count with an optional KB, MB or GB suffix
+// (binary multiples), e.g. "512", "100KB" or "2GB".
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// envList returns the comma-separated environment variable key as a slice.
+func envList(key string) []string {
+	return envListDefault(key, "")
+}
+
+// envListDefault is envList with the list def used while key is unset.
+func envListDefault(key, def string) []string {
+	var out []string
+	for _, item := range strings.Split(envString(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envPrefixes parses a comma-separated list of CIDRs or bare IP addresses.
+func envPrefixes(key string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, item := range envList(key) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				log.Fatalf("invalid %s entry %q: %v", key, item, err)
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			log.Fatalf("invalid %s entry %q: %v", key, item, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+// envMap parses a comma-separated list of name=value pairs.
+func envMap(key string) map[string]string {
+	out := map[string]string{}
+	for _, item := range envList(key) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Fatalf("invalid %s entry %q: want name=value", key, item)
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return out
+}
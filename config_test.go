@@ -0,0 +1,46 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestEnvKeyMap(t *testing.T) {
+	tests := []struct {
+		env  string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"partner:s3cret", map[string]string{"partner": "s3cret"}},
+		{"partner=s3cret", map[string]string{"partner": "s3cret"}},
+		{" a : x , b=y ", map[string]string{"a": "x", "b": "y"}},
+		// only the first separator splits, secrets may contain either
+		{"a:x=y:z,b=p:q", map[string]string{"a": "x=y:z", "b": "p:q"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("DATASCRIBE_TEST_KEYS", tt.env)
+		if got := envKeyMap("DATASCRIBE_TEST_KEYS"); !maps.Equal(got, tt.want) {
+			t.Errorf("envKeyMap(%q) = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestEnvIdentityMap(t *testing.T) {
+	tests := []struct {
+		env  string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"client.example.com=billing", map[string]string{"client.example.com": "billing"}},
+		{"client.example.com:billing", map[string]string{"client.example.com": "billing"}},
+		{"spiffe://corp/ns/etl=etl", map[string]string{"spiffe://corp/ns/etl": "etl"}},
+		{"spiffe://corp/ns/etl:etl", map[string]string{"spiffe://corp/ns/etl": "etl"}},
+		{"2001:db8::1:ops, ci@example.com = ci", map[string]string{"2001:db8::1": "ops", "ci@example.com": "ci"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("DATASCRIBE_TEST_IDENTITIES", tt.env)
+		if got := envIdentityMap("DATASCRIBE_TEST_IDENTITIES"); !maps.Equal(got, tt.want) {
+			t.Errorf("envIdentityMap(%q) = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
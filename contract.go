@@ -0,0 +1,732 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The schema option attaches a contract the upload must meet before it is
+// analyzed, as a Frictionless Table Schema ({"fields": [...]}) or a JSON
+// Schema describing one row ({"type": "object", "properties": {...}}).
+// Both are read into a contract: which columns must be present, their
+// types, and the required, unique, minimum, maximum, enum, pattern,
+// minLength and maxLength constraints. The upload is checked in one pass
+// before it is prepared, so the contract applies to the delivered columns
+// rather than derived ones; violations fail the request with a list of
+// them, and the report of a conforming upload gets a conformance appendix.
+
+const (
+	// maxSchemaLen bounds the size of a schema document.
+	maxSchemaLen = 1 << 20
+	// maxContractViolations is how many violations a response lists; all
+	// are counted.
+	maxContractViolations = 100
+)
+
+const codeSchemaViolation = "schema_violation"
+
+// contractTypes are the column types a contract can require.
+var contractTypes = []string{"any", "boolean", "date", "datetime", "integer", "number", "string", "time", "year"}
+
+// contract is a schema document in the form it is checked in.
+type contract struct {
+	Fields     []contractField
+	PrimaryKey []string
+	// Missing are the values counted as missing; isNA when nil.
+	Missing []string
+	// Closed forbids columns the contract does not list.
+	Closed bool
+}
+
+type contractField struct {
+	Name   string
+	Type   string
+	Layout []string // time layouts of date, datetime and time values
+	// Optional columns may be left out of the upload.
+	Optional         bool
+	Required, Unique bool
+	Minimum, Maximum *contractBound
+	Enum             []string
+	Pattern          *regexp.Regexp
+	MinLength        *int
+	MaxLength        *int
+	TrueValues       []string
+	FalseValues      []string
+}
+
+type contractBound struct {
+	text      string
+	value     float64 // numbers, and Unix seconds of times
+	exclusive bool
+}
+
+// contractViolation is one way the upload breaks its contract. Row counts
+// data rows from 1 and is left out for problems with the header.
+type contractViolation struct {
+	Row     int    `json:"row,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// contractError fails an upload that breaks its contract.
+type contractError struct {
+	Violations []contractViolation
+	Count      int
+}
+
+func (e *contractError) Error() string {
+	if e.Count == 1 {
+		return "the upload violates its schema: " + e.Violations[0].Message
+	}
+	return fmt.Sprintf("the upload violates its schema in %d places", e.Count)
+}
+
+func (e *contractError) add(v contractViolation) {
+	e.Count++
+	if len(e.Violations) < maxContractViolations {
+		e.Violations = append(e.Violations, v)
+	}
+}
+
+// contractErrorBody is the 422 response for a contractError.
+type contractErrorBody struct {
+	errorBody
+	Violations     []contractViolation `json:"violations"`
+	ViolationCount int                 `json:"violation_count"`
+	Truncated      bool                `json:"truncated,omitempty"`
+}
+
+func writeContractError(w http.ResponseWriter, e *contractError) {
+	writeJSON(w, http.StatusUnprocessableEntity, contractErrorBody{
+		errorBody:      errorBody{Error: e.Error(), Code: codeSchemaViolation},
+		Violations:     e.Violations,
+		ViolationCount: e.Count,
+		Truncated:      e.Count > len(e.Violations),
+	})
+}
+
+// parseContract reads a Frictionless Table Schema or a JSON Schema.
+func parseContract(doc string) (*contract, error) {
+	if len(doc) > maxSchemaLen {
+		return nil, fmt.Errorf("schema is larger than %d bytes", maxSchemaLen)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(doc), &raw); err != nil {
+		return nil, errors.New("schema must be a JSON object: a Frictionless Table Schema or a JSON Schema of a row")
+	}
+	if _, ok := raw["fields"]; ok {
+		return parseTableSchema(doc)
+	}
+	if _, ok := raw["properties"]; ok {
+		return parseJSONSchema(doc)
+	}
+	return nil, errors.New(`schema has neither "fields" (Frictionless Table Schema) nor "properties" (JSON Schema)`)
+}
+
+type tableSchema struct {
+	Fields []struct {
+		Name        string   `json:"name"`
+		Type        string   `json:"type"`
+		Format      string   `json:"format"`
+		TrueValues  []string `json:"trueValues"`
+		FalseValues []string `json:"falseValues"`
+		Constraints struct {
+			Required  bool            `json:"required"`
+			Unique    bool            `json:"unique"`
+			Minimum   json.RawMessage `json:"minimum"`
+			Maximum   json.RawMessage `json:"maximum"`
+			Enum      []any           `json:"enum"`
+			Pattern   string          `json:"pattern"`
+			MinLength *int            `json:"minLength"`
+			MaxLength *int            `json:"maxLength"`
+		} `json:"constraints"`
+	} `json:"fields"`
+	PrimaryKey    json.RawMessage `json:"primaryKey"`
+	MissingValues []string        `json:"missingValues"`
+}
+
+func parseTableSchema(doc string) (*contract, error) {
+	var s tableSchema
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		return nil, fmt.Errorf("schema: invalid Table Schema: %v", err)
+	}
+	c := &contract{Missing: s.MissingValues}
+	for i, f := range s.Fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("schema: fields[%d] has no name", i)
+		}
+		cf := contractField{Name: f.Name, Type: f.Type, Required: f.Constraints.Required, Unique: f.Constraints.Unique,
+			MinLength: f.Constraints.MinLength, MaxLength: f.Constraints.MaxLength,
+			TrueValues: f.TrueValues, FalseValues: f.FalseValues}
+		if cf.Type == "" {
+			cf.Type = "string"
+		}
+		if err := cf.setLayout(f.Format); err != nil {
+			return nil, fmt.Errorf("schema: field %q: %w", f.Name, err)
+		}
+		var err error
+		if cf.Minimum, err = cf.bound(f.Constraints.Minimum, false); err != nil {
+			return nil, fmt.Errorf("schema: field %q: minimum: %w", f.Name, err)
+		}
+		if cf.Maximum, err = cf.bound(f.Constraints.Maximum, false); err != nil {
+			return nil, fmt.Errorf("schema: field %q: maximum: %w", f.Name, err)
+		}
+		for _, v := range f.Constraints.Enum {
+			cf.Enum = append(cf.Enum, enumText(v))
+		}
+		// Table Schema patterns match the whole value
+		if f.Constraints.Pattern != "" {
+			if cf.Pattern, err = regexp.Compile(`^(?:` + f.Constraints.Pattern + `)$`); err != nil {
+				return nil, fmt.Errorf("schema: field %q: pattern: %v", f.Name, err)
+			}
+		}
+		c.Fields = append(c.Fields, cf)
+	}
+	if len(s.PrimaryKey) > 0 {
+		var key string
+		if json.Unmarshal(s.PrimaryKey, &key) == nil {
+			c.PrimaryKey = []string{key}
+		} else if json.Unmarshal(s.PrimaryKey, &c.PrimaryKey) != nil {
+			return nil, errors.New("schema: primaryKey must be a field name or a list of them")
+		}
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type jsonSchemaProperty struct {
+	Type             json.RawMessage `json:"type"`
+	Format           string          `json:"format"`
+	Minimum          json.RawMessage `json:"minimum"`
+	Maximum          json.RawMessage `json:"maximum"`
+	ExclusiveMinimum json.RawMessage `json:"exclusiveMinimum"`
+	ExclusiveMaximum json.RawMessage `json:"exclusiveMaximum"`
+	Enum             []any           `json:"enum"`
+	Pattern          string          `json:"pattern"`
+	MinLength        *int            `json:"minLength"`
+	MaxLength        *int            `json:"maxLength"`
+}
+
+func parseJSONSchema(doc string) (*contract, error) {
+	var s struct {
+		Properties           orderedProperties `json:"properties"`
+		Required             []string          `json:"required"`
+		AdditionalProperties *bool             `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		return nil, fmt.Errorf("schema: invalid JSON Schema: %v", err)
+	}
+	c := &contract{Closed: s.AdditionalProperties != nil && !*s.AdditionalProperties}
+	for _, name := range s.Required {
+		if !slices.ContainsFunc(s.Properties, func(p namedProperty) bool { return p.name == name }) {
+			// A required column needs no constraints of its own
+			s.Properties = append(s.Properties, namedProperty{name: name})
+		}
+	}
+	for _, p := range s.Properties {
+		required := slices.Contains(s.Required, p.name)
+		cf := contractField{Name: p.name, Type: "any", Required: required, Optional: !required,
+			MinLength: p.MinLength, MaxLength: p.MaxLength}
+		types, err := schemaTypes(p.Type)
+		if err != nil {
+			return nil, fmt.Errorf("schema: property %q: %w", p.name, err)
+		}
+		// A null type lets the column have missing values
+		if slices.Contains(types, "null") {
+			cf.Required = false
+			types = slices.DeleteFunc(types, func(t string) bool { return t == "null" })
+		}
+		switch {
+		case len(types) > 1:
+			return nil, fmt.Errorf("schema: property %q: only one type besides null is supported, got %s", p.name, strings.Join(types, ", "))
+		case len(types) == 1:
+			cf.Type = types[0]
+		}
+		if cf.Type == "string" {
+			switch p.Format {
+			case "date", "date-time", "time":
+				cf.Type = strings.ReplaceAll(p.Format, "date-time", "datetime")
+			}
+		}
+		if err := cf.setLayout(""); err != nil {
+			return nil, fmt.Errorf("schema: property %q: %w", p.name, err)
+		}
+		for _, b := range []struct {
+			raw       json.RawMessage
+			dst       **contractBound
+			exclusive bool
+			name      string
+		}{
+			{p.Minimum, &cf.Minimum, false, "minimum"}, {p.Maximum, &cf.Maximum, false, "maximum"},
+			{p.ExclusiveMinimum, &cf.Minimum, true, "exclusiveMinimum"}, {p.ExclusiveMaximum, &cf.Maximum, true, "exclusiveMaximum"},
+		} {
+			if len(b.raw) == 0 {
+				continue
+			}
+			if *b.dst, err = cf.bound(b.raw, b.exclusive); err != nil {
+				return nil, fmt.Errorf("schema: property %q: %s: %w", p.name, b.name, err)
+			}
+		}
+		for _, v := range p.Enum {
+			if v == nil {
+				cf.Required = false
+				continue
+			}
+			cf.Enum = append(cf.Enum, enumText(v))
+		}
+		if p.Pattern != "" {
+			if cf.Pattern, err = regexp.Compile(p.Pattern); err != nil {
+				return nil, fmt.Errorf("schema: property %q: pattern: %v", p.name, err)
+			}
+		}
+		c.Fields = append(c.Fields, cf)
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// jsonSchemaTypes maps JSON Schema types to contract types. Objects and
+// arrays have no CSV form.
+var jsonSchemaTypes = map[string]string{"string": "string", "integer": "integer", "number": "number", "boolean": "boolean", "null": "null"}
+
+func schemaTypes(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var types []string
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		types = []string{one}
+	} else if json.Unmarshal(raw, &types) != nil {
+		return nil, errors.New("type must be a type name or a list of them")
+	}
+	for i, t := range types {
+		mapped, ok := jsonSchemaTypes[t]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %q (want string, integer, number, boolean or null)", t)
+		}
+		types[i] = mapped
+	}
+	return types, nil
+}
+
+// namedProperty and orderedProperties keep JSON Schema properties in the
+// order the document lists them, so violations and the report follow it.
+type namedProperty struct {
+	name string
+	jsonSchemaProperty
+}
+
+type orderedProperties []namedProperty
+
+func (ps *orderedProperties) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("properties must be an object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		p := namedProperty{name: t.(string)}
+		if err := dec.Decode(&p.jsonSchemaProperty); err != nil {
+			return fmt.Errorf("property %q: %v", p.name, err)
+		}
+		*ps = append(*ps, p)
+	}
+	return nil
+}
+
+func enumText(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// check rejects contracts that cannot be met or tested.
+func (c *contract) check() error {
+	if len(c.Fields) == 0 {
+		return errors.New("schema lists no columns")
+	}
+	names := map[string]bool{}
+	for _, f := range c.Fields {
+		if names[f.Name] {
+			return fmt.Errorf("schema lists column %q twice", f.Name)
+		}
+		names[f.Name] = true
+		if !slices.Contains(contractTypes, f.Type) {
+			return fmt.Errorf("schema: column %q has unsupported type %q (want %s)", f.Name, f.Type, strings.Join(contractTypes, ", "))
+		}
+		if f.Minimum != nil || f.Maximum != nil {
+			if f.Type == "string" || f.Type == "boolean" || f.Type == "any" {
+				return fmt.Errorf("schema: column %q of type %s cannot have a minimum or maximum", f.Name, f.Type)
+			}
+		}
+	}
+	for _, key := range c.PrimaryKey {
+		if !names[key] {
+			return fmt.Errorf("schema: primary key column %q is not a field", key)
+		}
+	}
+	return nil
+}
+
+// setLayout sets the time layouts of date, datetime and time columns from
+// a Table Schema format: empty or "default" for ISO 8601, "any" for the
+// common forms, or a strftime pattern.
+func (f *contractField) setLayout(format string) error {
+	switch f.Type {
+	case "date", "datetime", "time":
+	default:
+		return nil
+	}
+	switch format {
+	case "", "default":
+		f.Layout = map[string][]string{
+			"date":     {"2006-01-02"},
+			"datetime": {time.RFC3339Nano, "2006-01-02T15:04:05"},
+			"time":     {"15:04:05", "15:04:05Z07:00"},
+		}[f.Type]
+	case "any":
+		f.Layout = slices.Concat(anonymizeDateLayouts, []string{"02/01/2006", "15:04:05", "15:04"})
+	default:
+		layout, err := strftimeLayout(format)
+		if err != nil {
+			return err
+		}
+		f.Layout = []string{layout}
+	}
+	return nil
+}
+
+// strftimeLayouts maps strftime directives to Go time layout elements.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'H': "15", 'I': "03", 'M': "04", 'S': "05",
+	'f': "000000", 'p': "PM", 'b': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday", 'j': "002",
+	'z': "-0700", 'Z': "MST", '%': "%",
+}
+
+func strftimeLayout(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("format %q ends with a lone %%", format)
+		}
+		layout, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("format %q has unsupported directive %%%c", format, format[i])
+		}
+		b.WriteString(layout)
+	}
+	return b.String(), nil
+}
+
+// bound reads a minimum or maximum, a number or, for times, a string.
+func (f *contractField) bound(raw json.RawMessage, exclusive bool) (*contractBound, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) != nil {
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, errors.New("must be a number or a string")
+		}
+		text = strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	v, ok := f.parse(text)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a valid %s", text, f.Type)
+	}
+	return &contractBound{text: text, value: v, exclusive: exclusive}, nil
+}
+
+// parse reads a value of the column type. Numbers, years and times are
+// returned as an ordered number for the bounds; other types as 0.
+func (f *contractField) parse(v string) (float64, bool) {
+	v = strings.TrimSpace(v)
+	switch f.Type {
+	case "integer", "year":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || f.Type == "year" && len(v) != 4 {
+			return 0, false
+		}
+		return float64(n), true
+	case "number":
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil && !math.IsNaN(n)
+	case "boolean":
+		trueValues, falseValues := f.TrueValues, f.FalseValues
+		if trueValues == nil {
+			trueValues = []string{"true", "True", "TRUE", "1"}
+		}
+		if falseValues == nil {
+			falseValues = []string{"false", "False", "FALSE", "0"}
+		}
+		return 0, slices.Contains(trueValues, v) || slices.Contains(falseValues, v)
+	case "date", "datetime", "time":
+		for _, layout := range f.Layout {
+			if t, err := time.Parse(layout, v); err == nil {
+				if f.Type == "time" {
+					// Times of day compare within one day
+					return float64(t.Hour()*3600+t.Minute()*60+t.Second()) + float64(t.Nanosecond())/1e9, true
+				}
+				return float64(t.UnixNano()) / 1e9, true
+			}
+		}
+		return 0, false
+	}
+	return 0, true
+}
+
+// describe returns the checks of a field, for the report.
+func (f *contractField) describe() []string {
+	checks := []string{f.Type}
+	if f.Required {
+		checks = append(checks, "required")
+	}
+	if f.Unique {
+		checks = append(checks, "unique")
+	}
+	if f.Optional {
+		checks = append(checks, "may be absent")
+	}
+	for _, b := range []struct {
+		bound  *contractBound
+		op, eq string
+	}{{f.Minimum, ">", ">="}, {f.Maximum, "<", "<="}} {
+		if b.bound == nil {
+			continue
+		}
+		op := b.eq
+		if b.bound.exclusive {
+			op = b.op
+		}
+		checks = append(checks, op+" "+b.bound.text)
+	}
+	if len(f.Enum) > 0 {
+		checks = append(checks, "one of "+strings.Join(f.Enum, ", "))
+	}
+	if f.Pattern != nil {
+		checks = append(checks, "matches "+f.Pattern.String())
+	}
+	if f.MinLength != nil {
+		checks = append(checks, fmt.Sprintf("at least %d characters", *f.MinLength))
+	}
+	if f.MaxLength != nil {
+		checks = append(checks, fmt.Sprintf("at most %d characters", *f.MaxLength))
+	}
+	return checks
+}
+
+// contractSummary lists the checks of each column of a contract, which
+// predict.py shows in the conformance appendix of the report.
+func contractSummary(doc string) []map[string]any {
+	c, err := parseContract(doc)
+	if err != nil {
+		return nil
+	}
+	var fields []map[string]any
+	for _, f := range c.Fields {
+		fields = append(fields, map[string]any{"column": f.Name, "checks": f.describe()})
+	}
+	if len(c.PrimaryKey) > 0 {
+		fields = append(fields, map[string]any{"column": strings.Join(c.PrimaryKey, ", "), "checks": []string{"primary key"}})
+	}
+	if c.Closed {
+		fields = append(fields, map[string]any{"column": "(other columns)", "checks": []string{"not allowed"}})
+	}
+	return fields
+}
+
+// checkContract checks the CSV at path against the schema of opts and
+// returns a *contractError listing the violations.
+func checkContract(path string, opts analysisOptions) error {
+	c, err := parseContract(opts.Schema)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedInput, err)
+	}
+	names := uploadColumnNames(header, opts)
+	first := []string(nil)
+	if !opts.hasHeader() {
+		first = slices.Clone(header)
+	}
+
+	e := &contractError{}
+	index := make([]int, len(c.Fields))
+	for i, f := range c.Fields {
+		index[i] = slices.Index(names, f.Name)
+		if index[i] < 0 && !f.Optional {
+			e.add(contractViolation{Column: f.Name, Rule: "column", Message: fmt.Sprintf("column %q is missing", f.Name)})
+		}
+	}
+	if c.Closed {
+		for _, name := range names {
+			if !slices.ContainsFunc(c.Fields, func(f contractField) bool { return f.Name == name }) {
+				e.add(contractViolation{Column: name, Rule: "column", Message: fmt.Sprintf("column %q is not in the schema", name)})
+			}
+		}
+	}
+	if e.Count > 0 {
+		return e
+	}
+	var keyIndex []int
+	for _, key := range c.PrimaryKey {
+		keyIndex = append(keyIndex, slices.Index(names, key))
+	}
+	missing := isNA
+	if c.Missing != nil {
+		missing = func(v string) bool { return slices.Contains(c.Missing, v) }
+	}
+
+	seen := make([]map[string]int, len(c.Fields))
+	keys := map[string]int{}
+	for row := 1; ; row++ {
+		rec := first
+		first = nil
+		if rec == nil {
+			if rec, err = r.Read(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%w: %v", errMalformedInput, err)
+			}
+		}
+		cell := func(i int) string {
+			if i >= 0 && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+		for i, f := range c.Fields {
+			if index[i] < 0 {
+				continue
+			}
+			v := cell(index[i])
+			if missing(v) {
+				if f.Required {
+					e.add(contractViolation{Row: row, Column: f.Name, Rule: "required", Message: fmt.Sprintf("row %d: %s is missing", row, f.Name)})
+				}
+				continue
+			}
+			if rule, msg := f.violation(v); rule != "" {
+				e.add(contractViolation{Row: row, Column: f.Name, Value: v, Rule: rule, Message: fmt.Sprintf("row %d: %s %s", row, f.Name, msg)})
+			}
+			if f.Unique {
+				if seen[i] == nil {
+					seen[i] = map[string]int{}
+				}
+				if prev, dup := seen[i][v]; dup {
+					e.add(contractViolation{Row: row, Column: f.Name, Value: v, Rule: "unique",
+						Message: fmt.Sprintf("row %d: %s repeats the value of row %d", row, f.Name, prev)})
+				} else {
+					seen[i][v] = row
+				}
+			}
+		}
+		if len(keyIndex) > 0 {
+			parts := make([]string, len(keyIndex))
+			complete := true
+			for i, k := range keyIndex {
+				parts[i] = cell(k)
+				complete = complete && !missing(parts[i])
+			}
+			key := strings.Join(parts, "\x00")
+			column := strings.Join(c.PrimaryKey, ", ")
+			switch prev, dup := keys[key]; {
+			case !complete:
+				e.add(contractViolation{Row: row, Column: column, Rule: "primary_key", Message: fmt.Sprintf("row %d: the primary key (%s) is incomplete", row, column)})
+			case dup:
+				e.add(contractViolation{Row: row, Column: column, Value: strings.Join(parts, ", "), Rule: "primary_key",
+					Message: fmt.Sprintf("row %d: the primary key (%s) repeats row %d", row, column, prev)})
+			default:
+				keys[key] = row
+			}
+		}
+	}
+	if e.Count > 0 {
+		return e
+	}
+	return nil
+}
+
+// violation checks a present value against the field and returns the rule
+// it breaks, with a message, or "".
+func (f *contractField) violation(v string) (rule, msg string) {
+	n, ok := f.parse(v)
+	if !ok {
+		return "type", fmt.Sprintf("%q is not a valid %s", v, f.Type)
+	}
+	if len(f.Enum) > 0 {
+		in := slices.Contains(f.Enum, v)
+		if !in && (f.Type == "number" || f.Type == "integer") {
+			in = slices.ContainsFunc(f.Enum, func(e string) bool {
+				m, err := strconv.ParseFloat(e, 64)
+				return err == nil && m == n
+			})
+		}
+		if !in {
+			return "enum", fmt.Sprintf("%q is not one of %s", v, strings.Join(f.Enum, ", "))
+		}
+	}
+	if b := f.Minimum; b != nil && (n < b.value || b.exclusive && n == b.value) {
+		if b.exclusive {
+			return "minimum", fmt.Sprintf("%s is not above %s", v, b.text)
+		}
+		return "minimum", fmt.Sprintf("%s is below the minimum %s", v, b.text)
+	}
+	if b := f.Maximum; b != nil && (n > b.value || b.exclusive && n == b.value) {
+		if b.exclusive {
+			return "maximum", fmt.Sprintf("%s is not below %s", v, b.text)
+		}
+		return "maximum", fmt.Sprintf("%s is above the maximum %s", v, b.text)
+	}
+	if f.Pattern != nil && !f.Pattern.MatchString(v) {
+		return "pattern", fmt.Sprintf("%q does not match %s", v, f.Pattern)
+	}
+	length := utf8.RuneCountInString(v)
+	if f.MinLength != nil && length < *f.MinLength {
+		return "min_length", fmt.Sprintf("%q is shorter than %d characters", v, *f.MinLength)
+	}
+	if f.MaxLength != nil && length > *f.MaxLength {
+		return "max_length", fmt.Sprintf("%q is longer than %d characters", v, *f.MaxLength)
+	}
+	return "", ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseContractErrors(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`[]`, "schema must be a JSON object"},
+		{`{"type": "object"}`, `schema has neither "fields"`},
+		{`{"fields": []}`, "schema lists no columns"},
+		{`{"fields": [{"type": "integer"}]}`, "fields[0] has no name"},
+		{`{"fields": [{"name": "a"}, {"name": "a"}]}`, `schema lists column "a" twice`},
+		{`{"fields": [{"name": "a", "type": "geopoint"}]}`, `column "a" has unsupported type "geopoint"`},
+		{`{"fields": [{"name": "a", "constraints": {"minimum": 1}}]}`, `column "a" of type string cannot have a minimum or maximum`},
+		{`{"fields": [{"name": "a", "type": "integer", "constraints": {"maximum": "ten"}}]}`, `field "a": maximum: "ten" is not a valid integer`},
+		{`{"fields": [{"name": "a", "type": "date", "format": "%d/%q"}]}`, "unsupported directive %q"},
+		{`{"fields": [{"name": "a", "type": "date", "format": "%Y%"}]}`, "ends with a lone %"},
+		{`{"fields": [{"name": "a", "constraints": {"pattern": "("}}]}`, `field "a": pattern`},
+		{`{"fields": [{"name": "a"}], "primaryKey": "b"}`, `primary key column "b" is not a field`},
+		{`{"fields": [{"name": "a"}], "primaryKey": 1}`, "primaryKey must be a field name or a list of them"},
+		{`{"properties": {"a": {"type": ["string", "integer"]}}}`, "only one type besides null is supported"},
+		{`{"properties": {"a": {"type": "object"}}}`, `unsupported type "object"`},
+		{`{"properties": []}`, "properties must be an object"},
+		{`{"properties": {}}`, "schema lists no columns"},
+	}
+	for _, tt := range tests {
+		if _, err := parseContract(tt.doc); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseContract(%s) = %v, want an error with %q", tt.doc, err, tt.want)
+		}
+	}
+}
+
+func TestParseContract(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string // the columns and their checks, as contractSummary lists them
+	}{
+		{`{"fields": [{"name": "id", "type": "integer", "constraints": {"required": true, "unique": true, "minimum": 1}}, {"name": "tier", "constraints": {"enum": ["a", 2]}}], "primaryKey": ["id"]}`,
+			"id: integer required unique >= 1; tier: string one of a, 2; id: primary key"},
+		{`{"fields": [{"name": "day", "type": "date", "constraints": {"maximum": "2026-12-31"}}, {"name": "code", "constraints": {"pattern": "[A-Z]+", "maxLength": 8}}]}`,
+			"day: date <= 2026-12-31; code: string matches ^(?:[A-Z]+)$ at most 8 characters"},
+		{`{"properties": {"score": {"type": "number", "exclusiveMinimum": 0, "maximum": 1}, "note": {"type": ["string", "null"], "minLength": 2}}, "required": ["score", "note", "id"], "additionalProperties": false}`,
+			"score: number required > 0 <= 1; note: string at least 2 characters; id: any required; (other columns): not allowed"},
+		{`{"properties": {"at": {"type": "string", "format": "date-time"}, "kind": {"enum": ["x", null]}}}`,
+			"at: datetime may be absent; kind: any may be absent one of x"},
+	}
+	for _, tt := range tests {
+		if _, err := parseContract(tt.doc); err != nil {
+			t.Errorf("parseContract(%s) failed: %v", tt.doc, err)
+			continue
+		}
+		var columns []string
+		for _, f := range contractSummary(tt.doc) {
+			columns = append(columns, fmt.Sprintf("%s: %s", f["column"], strings.Join(f["checks"].([]string), " ")))
+		}
+		if got := strings.Join(columns, "; "); got != tt.want {
+			t.Errorf("contractSummary(%s) = %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestCheckContract(t *testing.T) {
+	const schema = `{"fields": [
+		{"name": "id", "type": "integer", "constraints": {"required": true, "unique": true}},
+		{"name": "score", "type": "number", "constraints": {"minimum": 0, "maximum": 1}},
+		{"name": "day", "type": "date", "format": "%d/%m/%Y"},
+		{"name": "ok", "type": "boolean", "trueValues": ["y"], "falseValues": ["n"]},
+		{"name": "tier", "constraints": {"enum": ["a", "b"]}}
+	]}`
+	tests := []struct {
+		name string
+		csv  string
+		want []string // rules broken, as row:column:rule
+	}{
+		{name: "conforming", csv: "id,score,day,ok,tier\n1,0.5,31/12/2026,y,a\n2,,,n,\n"},
+		{name: "missing column", csv: "id,score,day,ok\n1,0.5,31/12/2026,y\n", want: []string{"0:tier:column"}},
+		{name: "values", csv: "id,score,day,ok,tier\n1,1.5,2026-12-31,yes,c\nx,-1,01/01/2026,y,a\n",
+			want: []string{"1:score:maximum", "1:day:type", "1:ok:type", "1:tier:enum", "2:id:type", "2:score:minimum"}},
+		{name: "required and unique", csv: "id,score,day,ok,tier\n1,,,,\n,,,,\n1,,,,\n",
+			want: []string{"2:id:required", "3:id:unique"}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "data.csv")
+		if err := os.WriteFile(path, []byte(tt.csv), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := checkContract(path, analysisOptions{Schema: schema})
+		var got []string
+		var ce *contractError
+		if errors.As(err, &ce) {
+			for _, v := range ce.Violations {
+				got = append(got, fmt.Sprintf("%d:%s:%s", v.Row, v.Column, v.Rule))
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: violations = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
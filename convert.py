@@ -0,0 +1,39 @@
+#!/usr/bin/env python3
+"""
+convert.py
+----------
+Converts a Parquet file to CSV for the server's ingestion pipeline, which
+reads every other upload format itself.
+
+Usage:
+    python convert.py --input data.parquet --output data.csv
+"""
+
+import argparse
+import sys
+
+# Exit codes understood by the Go server (see analyzer.go)
+EXIT_MALFORMED_CSV = 3
+EXIT_UNSUPPORTED_FORMAT = 8
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Convert a Parquet file to CSV")
+    parser.add_argument("--input", required=True, help="Parquet file to read")
+    parser.add_argument("--output", required=True, help="CSV file to write")
+    args = parser.parse_args()
+
+    try:
+        import pandas as pd
+        df = pd.read_parquet(args.input)
+    except ImportError as e:
+        print(f"Parquet uploads are not supported by this server: {e}", file=sys.stderr)
+        sys.exit(EXIT_UNSUPPORTED_FORMAT)
+    except Exception as e:  # pyarrow and fastparquet raise their own types
+        print(f"unreadable Parquet file: {e}", file=sys.stderr)
+        sys.exit(EXIT_MALFORMED_CSV)
+    df.to_csv(args.output, index=False)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dataset is a registered dataset. Each successful job submitted with
+// dataset=<id> adds a version holding its report and key statistics.
+type dataset struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	Versions  []*reportVersion `json:"-"`
+	// Expectations are checked on every upload; see expectations.go.
+	Expectations *expectationSuite `json:"expectations,omitempty"`
+	// SemanticTypes apply to the columns of every upload; see semantic.go.
+	SemanticTypes map[string]string `json:"semantic_types,omitempty"`
+
+	owner string
+}
+
+// datasetRecord is a dataset as persisted in <dir>/dataset.json.
+type datasetRecord struct {
+	dataset
+	Versions []*reportVersion `json:"versions"`
+	Owner    string           `json:"owner"`
+}
+
+// reportVersion is one analysis of a dataset. Changes compares its
+// statistics with the previous version and is absent on v1.
+type reportVersion struct {
+	Version       int          `json:"version"`
+	JobID         string       `json:"job_id"`
+	DatasetSHA256 string       `json:"dataset_sha256"`
+	ReportSHA256  string       `json:"report_sha256"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Stats         datasetStats `json:"stats"`
+	Changes       *statsDiff   `json:"changes,omitempty"`
+	// Expectations are the results of the suite of the dataset, if any.
+	Expectations *expectationResults `json:"expectations,omitempty"`
+}
+
+type datasetStats struct {
+	Rows    int           `json:"rows"`
+	Columns []columnStats `json:"columns"`
+}
+
+// columnStats summarizes one column. Distinct is counted up to
+// driftMaxCategories; the moments are set for numeric columns.
+type columnStats struct {
+	Name       string   `json:"name"`
+	Numeric    bool     `json:"numeric"`
+	MissingPct float64  `json:"missing_pct"`
+	Distinct   int      `json:"distinct"`
+	Mean       *float64 `json:"mean,omitempty"`
+	Std        *float64 `json:"std,omitempty"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+}
+
+// statsDiff lists what changed between two versions; Columns only holds
+// columns present in both whose statistics differ.
+type statsDiff struct {
+	RowsChange     int               `json:"rows_change"`
+	AddedColumns   []string          `json:"added_columns,omitempty"`
+	RemovedColumns []string          `json:"removed_columns,omitempty"`
+	Columns        []columnStatsDiff `json:"columns"`
+}
+
+type columnStatsDiff struct {
+	Column           string   `json:"column"`
+	TypeChanged      bool     `json:"type_changed,omitempty"`
+	MissingPctChange float64  `json:"missing_pct_change"`
+	DistinctChange   int      `json:"distinct_change"`
+	MeanChange       *float64 `json:"mean_change,omitempty"`
+	StdChange        *float64 `json:"std_change,omitempty"`
+	MinChange        *float64 `json:"min_change,omitempty"`
+	MaxChange        *float64 `json:"max_change,omitempty"`
+}
+
+var (
+	datasetsMu sync.Mutex
+	datasets   = map[string]*dataset{}
+)
+
+func datasetDir(id string) string { return filepath.Join(cfg.DatasetDir, id) }
+
+func versionReportPath(id string, version int) string {
+	return filepath.Join(datasetDir(id), fmt.Sprintf("v%d.pdf", version))
+}
+
+// loadDatasets reads every stored dataset.
+func loadDatasets() error {
+	if err := os.MkdirAll(cfg.DatasetDir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.DatasetDir, "*", "dataset.json"))
+	if err != nil {
+		return err
+	}
+	datasetsMu.Lock()
+	defer datasetsMu.Unlock()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var rec datasetRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("skipping dataset %s: %v", path, err)
+			continue
+		}
+		d := rec.dataset
+		d.Versions, d.owner = rec.Versions, rec.Owner
+		datasets[d.ID] = &d
+	}
+	log.Printf("loaded %d datasets from %s", len(paths), cfg.DatasetDir)
+	return nil
+}
+
+// saveDataset writes d atomically. The caller holds datasetsMu.
+func saveDataset(d *dataset) error {
+	data, err := json.Marshal(datasetRecord{dataset: *d, Versions: d.Versions, Owner: d.owner})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(datasetDir(d.ID), "dataset.json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// checkDataset validates the dataset parameter of a submission by owner.
+func checkDataset(id, owner string) error {
+	if id == "" {
+		return nil
+	}
+	datasetsMu.Lock()
+	d, ok := datasets[id]
+	datasetsMu.Unlock()
+	if !ok || d.owner != owner {
+		return fmt.Errorf("dataset %q not found", id)
+	}
+	return nil
+}
+
+// addDatasetVersion stores the report of the finished job j as the next
+// version of its dataset and returns the version number.
+func addDatasetVersion(j *job, reportSHA256 string, finished time.Time) (int, error) {
+	var stats datasetStats
+	var err error
+	if j.stats != nil {
+		// Computed already to check the expectations
+		stats = *j.stats
+	} else if stats, err = computeStats(j.inputPath(), j.Options); err != nil {
+		return 0, err
+	}
+	inputSHA256, err := fileSHA256(j.inputPath())
+	if err != nil {
+		return 0, err
+	}
+	// Copy the report before taking the lock; the rename is cheap
+	tmp := filepath.Join(datasetDir(j.Dataset), j.ID+".pdf.tmp")
+	if err := copyFile(j.reportPath(), tmp); err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	datasetsMu.Lock()
+	defer datasetsMu.Unlock()
+	d, ok := datasets[j.Dataset]
+	if !ok {
+		return 0, fmt.Errorf("dataset %s was deleted", j.Dataset)
+	}
+	v := &reportVersion{Version: len(d.Versions) + 1, JobID: j.ID, DatasetSHA256: inputSHA256,
+		ReportSHA256: reportSHA256, CreatedAt: finished, Stats: stats, Expectations: j.Expectations}
+	if len(d.Versions) > 0 {
+		v.Changes = diffStats(d.Versions[len(d.Versions)-1].Stats, stats)
+	}
+	if err := os.Rename(tmp, versionReportPath(d.ID, v.Version)); err != nil {
+		return 0, err
+	}
+	d.Versions = append(d.Versions, v)
+	if err := saveDataset(d); err != nil {
+		d.Versions = d.Versions[:len(d.Versions)-1]
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// computeStats reads the CSV at path once and summarizes each column.
+func computeStats(path string, opts analysisOptions) (datasetStats, error) {
+	t, err := openTable(path, opts)
+	if err != nil {
+		return datasetStats{}, err
+	}
+	defer t.Close()
+
+	type acc struct {
+		missing, count     int
+		numeric            bool
+		sum, sumSq, lo, hi float64
+		distinct           map[string]struct{}
+	}
+	accs := make([]*acc, len(t.Columns))
+	for i, name := range t.Columns {
+		// Identifiers and categories have no meaningful moments
+		numeric := !textSemanticType(opts.SemanticTypes[name])
+		accs[i] = &acc{numeric: numeric, lo: math.Inf(1), hi: math.Inf(-1), distinct: map[string]struct{}{}}
+	}
+	stats := datasetStats{Columns: make([]columnStats, len(t.Columns))}
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return datasetStats{}, err
+		}
+		stats.Rows++
+		for i, v := range row {
+			a := accs[i]
+			if isNA(v) {
+				a.missing++
+				continue
+			}
+			a.count++
+			if len(a.distinct) < driftMaxCategories {
+				a.distinct[v] = struct{}{}
+			}
+			if !a.numeric {
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				a.numeric = false
+				continue
+			}
+			a.sum += f
+			a.sumSq += f * f
+			a.lo, a.hi = min(a.lo, f), max(a.hi, f)
+		}
+	}
+	for i, a := range accs {
+		c := columnStats{Name: t.Columns[i], Numeric: a.numeric && a.count > 0,
+			MissingPct: round4(pct(a.missing, stats.Rows)), Distinct: len(a.distinct)}
+		if c.Numeric {
+			n := float64(a.count)
+			mean := a.sum / n
+			std := math.Sqrt(max(a.sumSq/n-mean*mean, 0))
+			c.Mean, c.Std, c.Min, c.Max = ptr(round4(mean)), ptr(round4(std)), ptr(a.lo), ptr(a.hi)
+		}
+		stats.Columns[i] = c
+	}
+	return stats, nil
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// diffStats compares the statistics of two versions.
+func diffStats(prev, cur datasetStats) *statsDiff {
+	d := &statsDiff{RowsChange: cur.Rows - prev.Rows, Columns: []columnStatsDiff{}}
+	before := map[string]columnStats{}
+	for _, c := range prev.Columns {
+		before[c.Name] = c
+	}
+	seen := map[string]bool{}
+	for _, c := range cur.Columns {
+		seen[c.Name] = true
+		p, ok := before[c.Name]
+		if !ok {
+			d.AddedColumns = append(d.AddedColumns, c.Name)
+			continue
+		}
+		cd := columnStatsDiff{Column: c.Name, TypeChanged: p.Numeric != c.Numeric,
+			MissingPctChange: round4(c.MissingPct - p.MissingPct), DistinctChange: c.Distinct - p.Distinct}
+		if p.Numeric && c.Numeric {
+			change := func(a, b *float64) *float64 { return ptr(round4(*b - *a)) }
+			cd.MeanChange, cd.StdChange = change(p.Mean, c.Mean), change(p.Std, c.Std)
+			cd.MinChange, cd.MaxChange = change(p.Min, c.Min), change(p.Max, c.Max)
+		}
+		if cd.changed() {
+			d.Columns = append(d.Columns, cd)
+		}
+	}
+	for _, c := range prev.Columns {
+		if !seen[c.Name] {
+			d.RemovedColumns = append(d.RemovedColumns, c.Name)
+		}
+	}
+	return d
+}
+
+func (c columnStatsDiff) changed() bool {
+	nonzero := func(p *float64) bool { return p != nil && *p != 0 }
+	return c.TypeChanged || c.MissingPctChange != 0 || c.DistinctChange != 0 ||
+		nonzero(c.MeanChange) || nonzero(c.StdChange) || nonzero(c.MinChange) || nonzero(c.MaxChange)
+}
+
+// handleCreateDataset registers a dataset; name is optional.
+func handleCreateDataset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if len(name) > maxNameLength {
+		http.Error(w, fmt.Sprintf("name must be at most %d bytes", maxNameLength), http.StatusBadRequest)
+		return
+	}
+	d := &dataset{ID: newID(), Name: name, CreatedAt: time.Now().UTC(), owner: identityFrom(r)}
+	if err := os.MkdirAll(datasetDir(d.ID), 0o700); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store dataset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	datasetsMu.Lock()
+	err := saveDataset(d)
+	if err == nil {
+		datasets[d.ID] = d
+	}
+	datasetsMu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to store dataset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiPath(r, "/datasets/"+d.ID))
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// lookupDataset returns the dataset named by the id path value, answering
+// 404 when it does not exist or belongs to someone else.
+func lookupDataset(w http.ResponseWriter, r *http.Request) (*dataset, bool) {
+	datasetsMu.Lock()
+	d, ok := datasets[r.PathValue("id")]
+	datasetsMu.Unlock()
+	if !ok || d.owner != identityFrom(r) {
+		http.Error(w, "dataset not found", http.StatusNotFound)
+		return nil, false
+	}
+	return d, true
+}
+
+// handleListDatasets returns a page of the caller's datasets, newest first unless
+// sorted otherwise; see listquery.go.
+func handleListDatasets(w http.ResponseWriter, r *http.Request) {
+	owner := identityFrom(r)
+	list := []dataset{}
+	datasetsMu.Lock()
+	for _, d := range datasets {
+		if d.owner == owner {
+			list = append(list, *d)
+		}
+	}
+	datasetsMu.Unlock()
+	datasetList.serve(w, r, list)
+}
+
+var datasetList = listSpec[dataset]{
+	name: "datasets",
+	id:   func(d dataset) string { return d.ID },
+	fields: []listField[dataset]{
+		textField("id", func(d dataset) string { return d.ID }),
+		textField("name", func(d dataset) string { return d.Name }),
+		timeField("created_at", func(d dataset) time.Time { return d.CreatedAt }),
+	},
+	defaultSort: "-created_at",
+}
+
+func handleDeleteDataset(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	datasetsMu.Lock()
+	delete(datasets, d.ID)
+	datasetsMu.Unlock()
+	if err := os.RemoveAll(datasetDir(d.ID)); err != nil {
+		log.Printf("failed to remove dataset %s: %v", d.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListDatasetReports returns the version chain of a dataset, oldest
+// first, each with the change in key statistics since the version before.
+func handleListDatasetReports(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	datasetsMu.Lock()
+	versions := slices.Clone(d.Versions)
+	datasetsMu.Unlock()
+	if versions == nil {
+		versions = []*reportVersion{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dataset": d, "reports": versions})
+}
+
+// handleGetDatasetReport serves the PDF of one version, which is kept
+// after the job that produced it expires.
+func handleGetDatasetReport(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("version"))
+	datasetsMu.Lock()
+	found := err == nil && n >= 1 && n <= len(d.Versions)
+	datasetsMu.Unlock()
+	if !found {
+		http.Error(w, "report version not found", http.StatusNotFound)
+		return
+	}
+	disposition, err := reportDisposition(r, fmt.Sprintf("%s-v%d.csv", cmp.Or(d.Name, d.ID), n))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveReport(w, r, versionReportPath(d.ID, n), disposition)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// With DATASCRIBE_DEDUP_INPUTS set, the analyzed input of every queued job
+// is stored once per content hash, however many jobs and tenants submit
+// the same file. Blobs live under <workspace root>/blobs/<sha256> and each
+// job workspace holds a hard link to its blob, so the jobs keep reading and
+// replacing their input.csv as before; every code path that changes an
+// input writes a new file and renames it over the old one, which leaves
+// the blob alone.
+//
+// A blob is reference counted by the jobs using it and removed with the
+// last one. Each reference records the tenant that owns the job, and the
+// bytes are only ever reachable through a job its owner can see: tenants
+// cannot tell that anyone else submitted the same file.
+
+// inputBlob is one stored input. Refs maps job IDs to their owners.
+type inputBlob struct {
+	sha256 string
+	size   int64
+	refs   map[string]string
+}
+
+type blobStore struct {
+	root string
+
+	mu    sync.Mutex
+	blobs map[string]*inputBlob
+	jobs  map[string]string // job ID to sha256
+}
+
+// inputBlobs is nil unless DATASCRIBE_DEDUP_INPUTS is set.
+var inputBlobs *blobStore
+
+var _ = newGaugeFunc("datascribe_dedup_saved_bytes", "Disk space saved by storing identical job inputs once.", func() float64 {
+	return float64(inputBlobs.savedBytes())
+})
+
+// newBlobStore prepares root, which lies under the workspace root and is
+// therefore empty after a restart, like the jobs referring to it.
+func newBlobStore(root string) (*blobStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &blobStore{root: root, blobs: map[string]*inputBlob{}, jobs: map[string]string{}}, nil
+}
+
+// adopt moves the input of the queued job j into the store, replacing it
+// with a link to the existing blob of the same content if there is one.
+// It is called again for requeued jobs and then does nothing. It is best
+// effort: a job whose input cannot be adopted keeps its own copy.
+func (s *blobStore) adopt(j *job) {
+	// Hard links cannot reach memory workspaces or other volumes
+	if s == nil || j.ws.m != workspaces || j.ws.root != workspaces.roots[0] {
+		return
+	}
+	s.mu.Lock()
+	_, done := s.jobs[j.ID]
+	s.mu.Unlock()
+	if done {
+		return
+	}
+	sum, err := fileSHA256(j.inputPath())
+	if err != nil {
+		log.Printf("dedup: job %s: %v", j.ID, err)
+		return
+	}
+	path := filepath.Join(s.root, sum)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[sum]
+	if ok {
+		// Link the blob next to the input and swap it in atomically
+		tmp := j.inputPath() + ".blob"
+		os.Remove(tmp)
+		if err := os.Link(path, tmp); err != nil {
+			log.Printf("dedup: job %s: %v", j.ID, err)
+			return
+		}
+		if err := os.Rename(tmp, j.inputPath()); err != nil {
+			os.Remove(tmp)
+			log.Printf("dedup: job %s: %v", j.ID, err)
+			return
+		}
+	} else {
+		if err := os.Link(j.inputPath(), path); err != nil {
+			log.Printf("dedup: job %s: %v", j.ID, err)
+			return
+		}
+		b = &inputBlob{sha256: sum, size: fileSize(path), refs: map[string]string{}}
+		s.blobs[sum] = b
+	}
+	b.refs[j.ID] = j.owner
+	s.jobs[j.ID] = sum
+}
+
+// remove deletes the store with every blob in it.
+func (s *blobStore) remove() {
+	if s == nil {
+		return
+	}
+	if err := os.RemoveAll(s.root); err != nil {
+		log.Printf("dedup: removing %s: %v", s.root, err)
+	}
+}
+
+// release drops the reference of the job id, removing its blob if no other
+// job refers to it. The job's own link goes with its workspace.
+func (s *blobStore) release(id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	delete(s.jobs, id)
+	b := s.blobs[sum]
+	delete(b.refs, id)
+	if len(b.refs) == 0 {
+		delete(s.blobs, sum)
+		if err := os.Remove(filepath.Join(s.root, sum)); err != nil {
+			log.Printf("dedup: removing blob %s: %v", sum, err)
+		}
+	}
+}
+
+// savedBytes returns the disk space the extra references would otherwise
+// take.
+func (s *blobStore) savedBytes() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var saved int64
+	for _, b := range s.blobs {
+		saved += b.size * int64(len(b.refs)-1)
+	}
+	return saved
+}
+
+// blobEntry describes a blob to administrators.
+type blobEntry struct {
+	SHA256  string   `json:"sha256"`
+	Size    int64    `json:"size_bytes"`
+	Jobs    []string `json:"jobs"`
+	Tenants []string `json:"tenants"`
+}
+
+// handleListBlobs lists the stored inputs with the jobs and tenants using
+// them, largest first.
+func handleListBlobs(w http.ResponseWriter, r *http.Request) {
+	if inputBlobs == nil {
+		http.Error(w, "input deduplication is not enabled", http.StatusNotFound)
+		return
+	}
+	inputBlobs.mu.Lock()
+	list := make([]blobEntry, 0, len(inputBlobs.blobs))
+	for _, b := range inputBlobs.blobs {
+		e := blobEntry{SHA256: b.sha256, Size: b.size, Jobs: []string{}, Tenants: []string{}}
+		for id, owner := range b.refs {
+			e.Jobs = append(e.Jobs, id)
+			if !slices.Contains(e.Tenants, owner) {
+				e.Tenants = append(e.Tenants, owner)
+			}
+		}
+		sort.Strings(e.Jobs)
+		sort.Strings(e.Tenants)
+		list = append(list, e)
+	}
+	inputBlobs.mu.Unlock()
+	sort.Slice(list, func(i, k int) bool {
+		if list[i].Size != list[k].Size {
+			return list[i].Size > list[k].Size
+		}
+		return list[i].SHA256 < list[k].SHA256
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"blobs": list, "saved_bytes": inputBlobs.savedBytes()})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The derive option adds columns computed from others while the upload is
+// prepared, e.g. {"margin": "(revenue - cost) / revenue"}. Expressions are
+// arithmetic over numbers and columns:
+//
+//	+ - * / %  with the usual precedence, and parentheses
+//	abs(x) sqrt(x) log(x) exp(x) floor(x) ceil(x) round(x[, digits])
+//	min(x, y, ...) max(x, y, ...)
+//
+// Derived columns may use each other, but not in a cycle. A row gets a
+// missing value when an input is missing or not a number, or the result is
+// not a finite number, such as after a division by zero. Derived columns
+// are appended after the uploaded ones, in name order.
+
+// maxDerivedColumns bounds the number of columns derive may add.
+const maxDerivedColumns = 100
+
+// deriveFunctions maps the functions of derive expressions to their
+// minimum and maximum number of arguments; -1 means any number.
+var deriveFunctions = map[string][2]int{
+	"abs": {1, 1}, "sqrt": {1, 1}, "log": {1, 1}, "exp": {1, 1}, "floor": {1, 1}, "ceil": {1, 1},
+	"round": {1, 2}, "min": {2, -1}, "max": {2, -1},
+}
+
+// deriveNode is a node of a parsed derive expression. eval returns false
+// when the result is missing.
+type deriveNode interface {
+	eval(rec []string) (float64, bool)
+}
+
+type deriveNumber float64
+
+func (n deriveNumber) eval([]string) (float64, bool) { return float64(n), true }
+
+type deriveColumn struct {
+	name  string
+	index int // in the record, set by newDerivation
+}
+
+func (n *deriveColumn) eval(rec []string) (float64, bool) {
+	if n.index >= len(rec) {
+		return 0, false
+	}
+	v := strings.TrimSpace(rec[n.index])
+	if isNA(v) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+type deriveNegate struct{ x deriveNode }
+
+func (n *deriveNegate) eval(rec []string) (float64, bool) {
+	v, ok := n.x.eval(rec)
+	return -v, ok
+}
+
+type deriveBinary struct {
+	op          string
+	left, right deriveNode
+}
+
+func (n *deriveBinary) eval(rec []string) (float64, bool) {
+	l, ok := n.left.eval(rec)
+	if !ok {
+		return 0, false
+	}
+	r, ok := n.right.eval(rec)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	}
+	return math.Mod(l, r), true
+}
+
+type deriveCall struct {
+	fn   string
+	args []deriveNode
+}
+
+func (n *deriveCall) eval(rec []string) (float64, bool) {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, ok := a.eval(rec)
+		if !ok {
+			return 0, false
+		}
+		args[i] = v
+	}
+	switch n.fn {
+	case "abs":
+		return math.Abs(args[0]), true
+	case "sqrt":
+		return math.Sqrt(args[0]), true
+	case "log":
+		return math.Log(args[0]), true
+	case "exp":
+		return math.Exp(args[0]), true
+	case "floor":
+		return math.Floor(args[0]), true
+	case "ceil":
+		return math.Ceil(args[0]), true
+	case "round":
+		if len(args) == 1 {
+			return math.Round(args[0]), true
+		}
+		scale := math.Pow(10, math.Round(args[1]))
+		return math.Round(args[0]*scale) / scale, true
+	case "min":
+		return slices.Min(args), true
+	}
+	return slices.Max(args), true
+}
+
+// derivedColumn is one parsed column of the derive option.
+type derivedColumn struct {
+	name string
+	root deriveNode
+	refs []*deriveColumn
+	uses []string // referenced columns, in order of appearance
+}
+
+// parseDerive parses a JSON object mapping new column names to
+// expressions, and checks that derived columns do not depend on
+// themselves.
+func parseDerive(v string) (map[string]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var exprs map[string]string
+	if err := json.Unmarshal([]byte(v), &exprs); err != nil {
+		return nil, errors.New(`derive must be a JSON object of new column names to expressions, e.g. {"margin": "(revenue - cost) / revenue"}`)
+	}
+	if len(exprs) > maxDerivedColumns {
+		return nil, fmt.Errorf("derive adds %d columns, more than the limit of %d", len(exprs), maxDerivedColumns)
+	}
+	if _, err := compileDerive(exprs); err != nil {
+		return nil, err
+	}
+	return exprs, nil
+}
+
+// compileDerive parses the derive expressions and returns them in an order
+// in which every column comes after the derived columns it uses.
+func compileDerive(exprs map[string]string) ([]*derivedColumn, error) {
+	names := make([]string, 0, len(exprs))
+	for name := range exprs {
+		if strings.TrimSpace(name) == "" {
+			return nil, errors.New("derive: column names cannot be empty")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parsed := make(map[string]*derivedColumn, len(names))
+	for _, name := range names {
+		c, err := parseDeriveExpr(name, exprs[name])
+		if err != nil {
+			return nil, fmt.Errorf("derive[%q]: %w", name, err)
+		}
+		parsed[name] = c
+	}
+
+	var order []*derivedColumn
+	state := map[string]int{} // 1 while visiting, 2 when done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			cycle := append(path[slices.Index(path, name):], name)
+			return fmt.Errorf("derive: %q depends on itself through %s", name, strings.Join(cycle, " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, use := range parsed[name].uses {
+			if _, ok := parsed[use]; ok {
+				if err := visit(use, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = 2
+		order = append(order, parsed[name])
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// derivedNames returns the names of the derived columns in the order they
+// are appended to the data.
+func derivedNames(exprs map[string]string) []string {
+	names := make([]string, 0, len(exprs))
+	for name := range exprs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deriveUses returns the columns the derive expressions use that they do
+// not define themselves.
+func deriveUses(exprs map[string]string) []string {
+	columns, err := compileDerive(exprs)
+	if err != nil {
+		return nil
+	}
+	var uses []string
+	for _, c := range columns {
+		for _, use := range c.uses {
+			if _, derived := exprs[use]; !derived && !slices.Contains(uses, use) {
+				uses = append(uses, use)
+			}
+		}
+	}
+	return uses
+}
+
+// derivation computes the derived columns of a record.
+type derivation struct {
+	order []*derivedColumn
+	slot  []int // of each column in order, in the extended record
+}
+
+// newDerivation compiles exprs for records with the given column names.
+// Derived values go after them, in derivedNames order.
+func newDerivation(exprs map[string]string, names []string) (*derivation, error) {
+	order, err := compileDerive(exprs)
+	if err != nil {
+		return nil, err
+	}
+	all := slices.Concat(names, derivedNames(exprs))
+	d := &derivation{order: order, slot: make([]int, len(order))}
+	for i, c := range order {
+		d.slot[i] = slices.Index(all, c.name)
+		for _, ref := range c.refs {
+			if ref.index = slices.Index(all, ref.name); ref.index < 0 {
+				return nil, &unknownColumnsError{Columns: []string{ref.name}}
+			}
+		}
+	}
+	return d, nil
+}
+
+// extend pads rec to width fields and appends the derived values.
+func (d *derivation) extend(rec []string, width int) []string {
+	for len(rec) < width {
+		rec = append(rec, "")
+	}
+	rec = append(rec[:width], make([]string, len(d.order))...)
+	for i, c := range d.order {
+		v, ok := c.root.eval(rec)
+		if ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			rec[d.slot[i]] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	return rec
+}
+
+// deriveParser is a recursive descent parser of the grammar
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | "(" sum ")" | number | column | function "(" sum { "," sum } ")"
+type deriveParser struct {
+	exprTokens
+	c *derivedColumn
+}
+
+func parseDeriveExpr(name, src string) (*derivedColumn, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &deriveParser{exprTokens: exprTokens{tokens: tokens}, c: &derivedColumn{name: name}}
+	if p.c.root, err = p.sum(0); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokenOp && (slices.Contains(filterComparisons, t.text) || t.text == "&&" || t.text == "||") {
+		return nil, p.errorAt(t, "derived columns are numbers, not conditions: %s cannot be used (filter takes conditions)", t)
+	}
+	return p.c, p.end()
+}
+
+func (p *deriveParser) sum(depth int) (deriveNode, error) {
+	left, err := p.product(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !p.accept("+") && !p.accept("-") {
+			return left, nil
+		}
+		right, err := p.product(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &deriveBinary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *deriveParser) product(depth int) (deriveNode, error) {
+	left, err := p.unary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !p.accept("*") && !p.accept("/") && !p.accept("%") {
+			return left, nil
+		}
+		right, err := p.unary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &deriveBinary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *deriveParser) unary(depth int) (deriveNode, error) {
+	if depth > maxExprDepth {
+		return nil, p.errorAt(p.peek(), "expression nested too deeply")
+	}
+	if p.accept("-") {
+		x, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &deriveNegate{x}, nil
+	}
+	t := p.take()
+	switch {
+	case t.kind == tokenOp && t.text == "(":
+		x, err := p.sum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("unclosed ( at position %d", t.pos+1)
+		}
+		return x, nil
+	case t.kind == tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return deriveNumber(f), nil
+	case t.kind == tokenString:
+		return nil, p.errorAt(t, "%s is text, but derived columns are computed from numbers", t)
+	case t.kind == tokenIdent && p.peek().kind == tokenOp && p.peek().text == "(":
+		return p.call(t, depth)
+	case t.kind == tokenIdent && t.text == "null":
+		return nil, p.errorAt(t, "null cannot be used in arithmetic; rows with missing inputs get a missing value")
+	case t.kind == tokenIdent || t.kind == tokenColumn:
+		ref := &deriveColumn{name: t.text}
+		p.c.refs = append(p.c.refs, ref)
+		if !slices.Contains(p.c.uses, t.text) {
+			p.c.uses = append(p.c.uses, t.text)
+		}
+		return ref, nil
+	}
+	return nil, p.errorAt(t, "expected a number, column or function but found %s", t)
+}
+
+func (p *deriveParser) call(name exprToken, depth int) (deriveNode, error) {
+	arity, ok := deriveFunctions[name.text]
+	if !ok {
+		known := make([]string, 0, len(deriveFunctions))
+		for fn := range deriveFunctions {
+			known = append(known, fn)
+		}
+		sort.Strings(known)
+		return nil, p.errorAt(name, "unknown function %q (want %s)", name.text, strings.Join(known, ", "))
+	}
+	p.take() // (
+	var args []deriveNode
+	for {
+		arg, err := p.sum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			break
+		}
+		if !p.accept(",") {
+			return nil, p.errorAt(p.peek(), "expected , or ) in the arguments of %s", name.text)
+		}
+	}
+	if len(args) < arity[0] || arity[1] >= 0 && len(args) > arity[1] {
+		want := strconv.Itoa(arity[0])
+		switch {
+		case arity[1] < 0:
+			want = "at least " + want
+		case arity[1] != arity[0]:
+			want += " or " + strconv.Itoa(arity[1])
+		}
+		return nil, p.errorAt(name, "%s takes %s arguments, not %d", name.text, want, len(args))
+	}
+	return &deriveCall{fn: name.text, args: args}, nil
+}
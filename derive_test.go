@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDeriveErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`["margin"]`, "derive must be a JSON object"},
+		{`{" ": "a"}`, "column names cannot be empty"},
+		{`{"m": "a +"}`, `derive["m"]`},
+		{`{"m": "(a + b"}`, "unclosed ( at position 1"},
+		{`{"m": "a > 1"}`, "derived columns are numbers, not conditions"},
+		{`{"m": "\"a\" * 2"}`, "is text, but derived columns are computed from numbers"},
+		{`{"m": "a + null"}`, "null cannot be used in arithmetic"},
+		{`{"m": "median(a)"}`, `unknown function "median"`},
+		{`{"m": "round(a, 1, 2)"}`, "round"},
+		{`{"m": "min(a)"}`, "min"},
+		{`{"m": "max(a b)"}`, "expected , or ) in the arguments of max"},
+		{`{"a": "b + 1", "b": "c * a"}`, `"a" depends on itself through a -> b -> a`},
+		{`{"a": "a"}`, `"a" depends on itself through a -> a`},
+		{`{"m": "` + strings.Repeat("(", maxExprDepth+2) + `1` + strings.Repeat(")", maxExprDepth+2) + `"}`, "nested too deeply"},
+	}
+	for _, tt := range tests {
+		if _, err := parseDerive(tt.in); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseDerive(%s) = %v, want an error with %q", tt.in, err, tt.want)
+		}
+	}
+	if exprs, err := parseDerive("  "); exprs != nil || err != nil {
+		t.Errorf("parseDerive of blanks = %v, %v, want nothing", exprs, err)
+	}
+}
+
+func TestDerivationExtend(t *testing.T) {
+	exprs := map[string]string{
+		"margin": "(revenue - cost) / revenue",
+		"pct":    "round(margin * 100, 1)",
+		"big":    "max(revenue, `unit cost` * 10, 50)",
+		"rest":   "-revenue % 7 + abs(cost) - floor(sqrt(4)) + ceil(log(exp(0.5)))",
+	}
+	d, err := newDerivation(exprs, []string{"revenue", "cost", "unit cost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := derivedNames(exprs); !slices.Equal(got, []string{"big", "margin", "pct", "rest"}) {
+		t.Errorf("derivedNames = %q", got)
+	}
+	if got := deriveUses(exprs); !slices.Equal(got, []string{"revenue", "unit cost", "cost"}) {
+		t.Errorf("deriveUses = %q", got)
+	}
+	tests := []struct {
+		rec  []string
+		want []string
+	}{
+		{[]string{"200", "150", "3"}, []string{"200", "150", "3", "200", "0.25", "25", "145"}},
+		{[]string{"0", "5", "9"}, []string{"0", "5", "9", "90", "", "", "4"}},
+		{[]string{"10", "NA"}, []string{"10", "NA", "", "", "", "", ""}},
+		{[]string{" 7 ", "x", "1", "extra"}, []string{" 7 ", "x", "1", "50", "", "", ""}},
+	}
+	for _, tt := range tests {
+		if got := d.extend(slices.Clone(tt.rec), 3); !slices.Equal(got, tt.want) {
+			t.Errorf("extend(%q) = %q, want %q", tt.rec, got, tt.want)
+		}
+	}
+
+	if _, err := newDerivation(map[string]string{"m": "price * 2"}, []string{"cost"}); err == nil || !strings.Contains(err.Error(), "price") {
+		t.Errorf("derivation from a missing column: error = %v, want one naming price", err)
+	}
+}
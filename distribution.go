@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	defaultBins = 20
+	maxBins     = 1000
+)
+
+type distribution struct {
+	Column  string `json:"column"`
+	Count   int    `json:"count"`
+	Missing int    `json:"missing"`
+	// NonNumeric values are skipped, as are values <= 0 on a log scale
+	// (Excluded).
+	NonNumeric int      `json:"non_numeric"`
+	Excluded   int      `json:"excluded"`
+	Min        *float64 `json:"min"`
+	Max        *float64 `json:"max"`
+	Binning    string   `json:"binning"`
+	LogScale   bool     `json:"log_scale"`
+	// Approximate is set when quantile bin edges come from a t-digest; the
+	// counts of the bins are exact either way.
+	Approximate bool      `json:"approximate"`
+	Bins        []histBin `json:"bins"`
+}
+
+// histBin counts the values in [Lower, Upper); the last bin includes Upper.
+type histBin struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int     `json:"count"`
+}
+
+// handleDistribution bins the numeric values of one column of an uploaded
+// CSV. bins sets the number of bins; binning=quantile makes them hold
+// roughly equal counts instead of having equal widths, and log_scale=true
+// spaces them evenly in log10. format=png draws the histogram instead of
+// returning JSON.
+//
+// The file is read twice, for the range and then the counts, so memory
+// does not grow with it. Quantile edges are estimated with a t-digest
+// unless exact=true, which sorts every value instead.
+func handleDistribution(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "distribution")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "png" {
+		http.Error(w, fmt.Sprintf("unsupported format %q (want json or png)", format), http.StatusBadRequest)
+		return
+	}
+	d := &distribution{Column: r.FormValue("column"), Binning: r.FormValue("binning")}
+	if d.Column == "" {
+		http.Error(w, "column is required", http.StatusBadRequest)
+		return
+	}
+	if d.Binning == "" {
+		d.Binning = "equal_width"
+	}
+	if d.Binning != "equal_width" && d.Binning != "quantile" {
+		http.Error(w, fmt.Sprintf("unsupported binning %q (want equal_width or quantile)", d.Binning), http.StatusBadRequest)
+		return
+	}
+	bins := defaultBins
+	if v := r.FormValue("bins"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxBins {
+			http.Error(w, fmt.Sprintf("bins must be between 1 and %d", maxBins), http.StatusBadRequest)
+			return
+		}
+		bins = n
+	}
+	if v := r.FormValue("log_scale"); v != "" {
+		var err error
+		if d.LogScale, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "log_scale must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	exact, ok := exactRequested(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+	idx, err := keyIndexes(t.Columns, []string{d.Column})
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	if exact {
+		var values []float64
+		if values, err = d.read(t, idx[0]); err == nil {
+			d.histogram(values, bins)
+		}
+	} else {
+		err = d.stream(in.path, in.opts, t, idx[0], bins)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+
+	if format != "png" {
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, d.plot(800, 400)); err != nil {
+		log.Printf("distribution: %v", err)
+	}
+}
+
+// read collects the usable values of column i, sorted and, on a log scale,
+// as log10.
+func (d *distribution) read(t *csvTable, i int) ([]float64, error) {
+	var values []float64
+	err := d.each(t, i, func(f float64) { values = append(values, f) })
+	slices.Sort(values)
+	return values, err
+}
+
+// each calls fn with the usable values of column i, on a log scale as
+// log10, counting them and the values left out.
+func (d *distribution) each(t *csvTable, i int, fn func(float64)) error {
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		v := row[i]
+		if isNA(v) {
+			d.Missing++
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		switch {
+		case err != nil || math.IsNaN(f) || math.IsInf(f, 0):
+			d.NonNumeric++
+		case d.LogScale && f <= 0:
+			d.Excluded++
+		default:
+			if d.LogScale {
+				f = math.Log10(f)
+			}
+			d.Count++
+			fn(f)
+		}
+	}
+	return nil
+}
+
+// stream fills d.Bins in two passes over the CSV at path, of which t is
+// the first: one for the range and a t-digest of column i, one counting
+// the values of each bin.
+func (d *distribution) stream(path string, opts analysisOptions, t *csvTable, i, bins int) error {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	var digest *tdigest
+	if d.Binning == "quantile" {
+		digest = newTDigest()
+		d.Approximate = true
+	}
+	err := d.each(t, i, func(f float64) {
+		lo, hi = min(lo, f), max(hi, f)
+		if digest != nil {
+			digest.add(f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	d.Bins = []histBin{}
+	if d.Count == 0 {
+		return nil
+	}
+	edges := d.edges(lo, hi, bins, func(q float64) float64 { return digest.quantile(q) })
+	if len(edges) < 2 {
+		d.Bins = append(d.Bins, histBin{Lower: d.unscale(lo), Upper: d.unscale(hi), Count: d.Count})
+		return nil
+	}
+	counts := make([]int, len(edges)-1)
+	inner := edges[1 : len(edges)-1]
+	second, err := openTable(path, opts)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+	// The counters were taken in the first pass
+	pass := *d
+	if err := pass.each(second, i, func(f float64) {
+		k, _ := slices.BinarySearch(inner, math.Nextafter(f, math.Inf(1)))
+		counts[k]++
+	}); err != nil {
+		return err
+	}
+	for k, n := range counts {
+		d.Bins = append(d.Bins, histBin{Lower: d.unscale(edges[k]), Upper: d.unscale(edges[k+1]), Count: n})
+	}
+	return nil
+}
+
+// unscale undoes the log scale of a value.
+func (d *distribution) unscale(f float64) float64 {
+	if d.LogScale {
+		return math.Pow(10, f)
+	}
+	return f
+}
+
+// edges returns the bin edges for values from lo to hi, equally spaced or
+// at the quantiles q returns. Ties collapse quantiles, so fewer edges may
+// be returned.
+func (d *distribution) edges(lo, hi float64, bins int, q func(float64) float64) []float64 {
+	d.Min, d.Max = ptr(d.unscale(lo)), ptr(d.unscale(hi))
+	edges := make([]float64, 0, bins+1)
+	if d.Binning == "quantile" {
+		for k := 0; k <= bins; k++ {
+			e := min(max(q(float64(k)/float64(bins)), lo), hi)
+			// Keep edges strictly increasing
+			if k == 0 || e > edges[len(edges)-1] {
+				edges = append(edges, e)
+			}
+		}
+	} else if hi > lo {
+		for k := 0; k <= bins; k++ {
+			edges = append(edges, lo+(hi-lo)*float64(k)/float64(bins))
+		}
+	}
+	return edges
+}
+
+// histogram fills d.Bins from the sorted values.
+func (d *distribution) histogram(values []float64, bins int) {
+	d.Bins = []histBin{}
+	if len(values) == 0 {
+		return
+	}
+	lo, hi := values[0], values[len(values)-1]
+	edges := d.edges(lo, hi, bins, func(q float64) float64 { return quantile(values, q) })
+	if len(edges) < 2 {
+		// A single distinct value gets a single bin
+		d.Bins = append(d.Bins, histBin{Lower: d.unscale(lo), Upper: d.unscale(hi), Count: len(values)})
+		return
+	}
+	prev := 0
+	for k := 1; k < len(edges); k++ {
+		n := len(values)
+		if k < len(edges)-1 {
+			n, _ = slices.BinarySearch(values, edges[k])
+		}
+		d.Bins = append(d.Bins, histBin{Lower: d.unscale(edges[k-1]), Upper: d.unscale(edges[k]), Count: n - prev})
+		prev = n
+	}
+}
+
+// plot draws the histogram as bars whose area is proportional to the count,
+// so unequal quantile bins are not misleading. Bars are placed on a log10
+// axis when d.LogScale is set.
+func (d *distribution) plot(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	const margin = 30
+	axis := color.RGBA{0x33, 0x33, 0x33, 0xff}
+	bar := color.RGBA{0x46, 0x82, 0xb4, 0xff}
+	fill := func(x0, y0, x1, y1 int, c color.Color) {
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	if len(d.Bins) > 0 {
+		scale := func(f float64) float64 {
+			if d.LogScale {
+				return math.Log10(f)
+			}
+			return f
+		}
+		lo, hi := scale(d.Bins[0].Lower), scale(d.Bins[len(d.Bins)-1].Upper)
+		densities := make([]float64, len(d.Bins))
+		peak := 0.0
+		for k, b := range d.Bins {
+			span := scale(b.Upper) - scale(b.Lower)
+			if span <= 0 {
+				span = 1
+			}
+			densities[k] = float64(b.Count) / span
+			peak = max(peak, densities[k])
+		}
+		plotW, plotH := float64(width-2*margin), float64(height-2*margin)
+		x := func(f float64) int {
+			if hi == lo {
+				return margin
+			}
+			return margin + int((f-lo)/(hi-lo)*plotW)
+		}
+		for k, b := range d.Bins {
+			x0, x1 := x(scale(b.Lower)), x(scale(b.Upper))
+			if hi == lo {
+				x1 = width - margin
+			}
+			top := height - margin - int(densities[k]/peak*plotH)
+			// Leave a one pixel gap between neighbouring bars
+			fill(x0+1, top, max(x1, x0+2), height-margin, bar)
+		}
+	}
+	fill(margin, height-margin, width-margin, height-margin+2, axis)
+	fill(margin-2, margin, margin, height-margin+2, axis)
+	return img
+}
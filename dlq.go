@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dlqEntry is a dead-lettered job as shown to admins.
+type dlqEntry struct {
+	job
+	Owner string `json:"owner"`
+}
+
+func registerDLQ() {
+	handleAPI("GET /admin/dlq", protected(requireAdmin(handleListDLQ)))
+	handleAPI("POST /admin/dlq/{id}/requeue", protected(requireAdmin(requiresEngine(handleRequeueDLQ))))
+	handleAPI("DELETE /admin/dlq/{id}", protected(requireAdmin(handleDeleteDLQ)))
+}
+
+var _ = newGaugeFunc("datascribe_dlq_size", "Jobs in the dead-letter queue.", func() float64 {
+	return float64(len(deadLetteredJobs()))
+})
+
+// deadLetteredJobs returns the DLQ, most recent failure first.
+func deadLetteredJobs() []dlqEntry {
+	jobsMu.Lock()
+	var entries []dlqEntry
+	for _, j := range jobs {
+		if j.DeadLettered {
+			entries = append(entries, dlqEntry{job: *j, Owner: j.owner})
+		}
+	}
+	jobsMu.Unlock()
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].FinishedAt.After(*entries[b].FinishedAt)
+	})
+	return entries
+}
+
+func handleListDLQ(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": deadLetteredJobs()})
+}
+
+// handleRequeueDLQ resets a dead-lettered job and queues it again with a
+// fresh set of attempts.
+func handleRequeueDLQ(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	j, ok := getJob(id)
+	if !ok || !j.DeadLettered {
+		http.Error(w, "job not found in dead-letter queue", http.StatusNotFound)
+		return
+	}
+	updateJob(id, func(j *job) {
+		j.Status = jobQueued
+		j.DeadLettered = false
+		j.Attempts = 0
+		j.StartedAt = nil
+		j.FinishedAt = nil
+	})
+	if !jobQueue.push(id, j.Priority) {
+		now := time.Now().UTC()
+		updateJob(id, func(j *job) {
+			j.Status = jobFailed
+			j.DeadLettered = true
+			j.FinishedAt = &now
+		})
+		writeQueueFull(w)
+		return
+	}
+	queued, _ := getJob(id)
+	writeJSON(w, http.StatusAccepted, queued)
+}
+
+func handleDeleteDLQ(w http.ResponseWriter, r *http.Request) {
+	j, ok := getJob(r.PathValue("id"))
+	if !ok || !j.DeadLettered {
+		http.Error(w, "job not found in dead-letter queue", http.StatusNotFound)
+		return
+	}
+	deleteJob(j.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
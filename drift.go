@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// driftSampleSize is how many values per numeric column are kept for
+	// the KS statistic and the PSI bin edges.
+	driftSampleSize = 10000
+	// driftMaxCategories caps the distinct values tracked per categorical
+	// column; rarer values are pooled into otherCategory.
+	driftMaxCategories = 1000
+	driftBins          = 10
+	otherCategory      = "__other__"
+	// psiFloor stands in for empty bins so that PSI stays finite.
+	psiFloor = 1e-4
+	// maxNewCategories limits the new values listed per column.
+	maxNewCategories = 20
+)
+
+// baseline is a registered dataset profile that later batches are
+// compared against.
+type baseline struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name,omitempty"`
+	Rows    int              `json:"rows"`
+	Columns []string         `json:"columns"`
+	Profile []*columnProfile `json:"-"`
+	// PSIThreshold and KSThreshold mark a column as drifted.
+	PSIThreshold  float64   `json:"psi_threshold"`
+	KSThreshold   float64   `json:"ks_threshold"`
+	DatasetSHA256 string    `json:"dataset_sha256"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	owner string
+}
+
+// baselineRecord is a baseline as persisted in <id>.json.
+type baselineRecord struct {
+	baseline
+	Profile []*columnProfile `json:"profile"`
+	Owner   string           `json:"owner"`
+}
+
+// columnProfile summarizes one column: a value sample and fixed bins for
+// numeric columns, value shares for categorical ones.
+type columnProfile struct {
+	Name    string `json:"name"`
+	Numeric bool   `json:"numeric"`
+	Count   int    `json:"count"`
+	Missing int    `json:"missing"`
+	// Sample is sorted. Edges are the inner bin edges, deciles of the
+	// baseline, and Shares the fraction of values in each bin.
+	Sample     []float64          `json:"sample,omitempty"`
+	Edges      []float64          `json:"edges,omitempty"`
+	Shares     []float64          `json:"shares,omitempty"`
+	Categories map[string]float64 `json:"categories,omitempty"`
+}
+
+// columnDrift is the comparison of one column with its baseline.
+type columnDrift struct {
+	Column        string   `json:"column"`
+	PSI           float64  `json:"psi"`
+	KS            *float64 `json:"ks,omitempty"`
+	NewCategories []string `json:"new_categories,omitempty"`
+	// TypeChanged is set when a numeric baseline column now holds text.
+	TypeChanged   bool    `json:"type_changed,omitempty"`
+	MissingChange float64 `json:"missing_pct_change"`
+	Drifted       bool    `json:"drifted"`
+}
+
+type driftReport struct {
+	BaselineID     string        `json:"baseline_id"`
+	Rows           int           `json:"rows"`
+	Drifted        []string      `json:"drifted_columns"`
+	MissingColumns []string      `json:"missing_columns,omitempty"`
+	NewColumns     []string      `json:"new_columns,omitempty"`
+	Columns        []columnDrift `json:"columns"`
+}
+
+var (
+	baselinesMu sync.Mutex
+	baselines   = map[string]*baseline{}
+)
+
+func baselinePath(id string) string { return filepath.Join(cfg.BaselineDir, id+".json") }
+
+// loadBaselines reads every stored baseline.
+func loadBaselines() error {
+	if err := os.MkdirAll(cfg.BaselineDir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.BaselineDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	baselinesMu.Lock()
+	defer baselinesMu.Unlock()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var rec baselineRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("skipping baseline %s: %v", path, err)
+			continue
+		}
+		b := rec.baseline
+		b.Profile, b.owner = rec.Profile, rec.Owner
+		baselines[b.ID] = &b
+	}
+	log.Printf("loaded %d baselines from %s", len(paths), cfg.BaselineDir)
+	return nil
+}
+
+// saveBaseline writes b atomically.
+func saveBaseline(b *baseline) error {
+	data, err := json.Marshal(baselineRecord{baseline: *b, Profile: b.Profile, Owner: b.owner})
+	if err != nil {
+		return err
+	}
+	tmp := baselinePath(b.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, baselinePath(b.ID))
+}
+
+// profileTable reads t to the end and profiles each column. A column is
+// numeric when every non-missing value parses as a float; value shares are
+// kept for every column so that a batch can be compared with a categorical
+// baseline even when its values look numeric.
+func profileTable(t *csvTable) ([]*columnProfile, int, error) {
+	profiles := make([]*columnProfile, len(t.Columns))
+	counts := make([]map[string]int, len(t.Columns))
+	for i, name := range t.Columns {
+		profiles[i] = &columnProfile{Name: name, Numeric: true}
+		counts[i] = map[string]int{}
+	}
+	// A fixed seed keeps profiles of the same file identical
+	rng := rand.New(rand.NewPCG(1, 2))
+	rows := 0
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		rows++
+		for i, v := range row {
+			p := profiles[i]
+			if isNA(v) {
+				p.Missing++
+				continue
+			}
+			p.Count++
+			if _, ok := counts[i][v]; ok || len(counts[i]) < driftMaxCategories {
+				counts[i][v]++
+			} else {
+				counts[i][otherCategory]++
+			}
+			if !p.Numeric {
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) {
+				p.Numeric, p.Sample = false, nil
+				continue
+			}
+			// Reservoir sampling keeps a uniform sample of the column
+			if len(p.Sample) < driftSampleSize {
+				p.Sample = append(p.Sample, f)
+			} else if j := rng.IntN(p.Count); j < driftSampleSize {
+				p.Sample[j] = f
+			}
+		}
+	}
+	for i, p := range profiles {
+		if p.Numeric && p.Count > 0 {
+			slices.Sort(p.Sample)
+		} else {
+			p.Numeric, p.Sample = false, nil
+		}
+		p.Categories = make(map[string]float64, len(counts[i]))
+		for v, n := range counts[i] {
+			p.Categories[v] = float64(n) / float64(p.Count)
+		}
+	}
+	return profiles, rows, nil
+}
+
+// setBins fixes the baseline bin edges at the deciles of the sample, which
+// replace the value shares of a numeric column.
+func (p *columnProfile) setBins() {
+	p.Categories = nil
+	for k := 1; k < driftBins; k++ {
+		e := quantile(p.Sample, float64(k)/driftBins)
+		if len(p.Edges) == 0 || e > p.Edges[len(p.Edges)-1] {
+			p.Edges = append(p.Edges, e)
+		}
+	}
+	p.Shares = binShares(p.Sample, p.Edges)
+}
+
+// quantile returns the q-quantile of sorted by linear interpolation.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lo := int(pos)
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (pos-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+// binShares returns the fraction of sorted values in each bin; bin k holds
+// values in (edges[k-1], edges[k]].
+func binShares(sorted, edges []float64) []float64 {
+	shares := make([]float64, len(edges)+1)
+	if len(sorted) == 0 {
+		return shares
+	}
+	prev := 0
+	for k, e := range edges {
+		n, _ := slices.BinarySearch(sorted, math.Nextafter(e, math.Inf(1)))
+		shares[k] = float64(n-prev) / float64(len(sorted))
+		prev = n
+	}
+	shares[len(edges)] = float64(len(sorted)-prev) / float64(len(sorted))
+	return shares
+}
+
+// psi is the population stability index of actual against expected shares.
+func psi(expected, actual []float64) float64 {
+	total := 0.0
+	for k := range expected {
+		e, a := max(expected[k], psiFloor), max(actual[k], psiFloor)
+		total += (a - e) * math.Log(a/e)
+	}
+	return total
+}
+
+// ksStatistic is the two-sample Kolmogorov-Smirnov statistic of two sorted
+// samples.
+func ksStatistic(a, b []float64) float64 {
+	var i, j int
+	d := 0.0
+	for i < len(a) && j < len(b) {
+		v := min(a[i], b[j])
+		for i < len(a) && a[i] == v {
+			i++
+		}
+		for j < len(b) && b[j] == v {
+			j++
+		}
+		d = max(d, math.Abs(float64(i)/float64(len(a))-float64(j)/float64(len(b))))
+	}
+	return d
+}
+
+// compare measures the drift of batch from base, which describe the same
+// column.
+func compare(base, batch *columnProfile, b *baseline) columnDrift {
+	d := columnDrift{Column: base.Name}
+	baseMissing := pct(base.Missing, base.Count+base.Missing)
+	d.MissingChange = round4(pct(batch.Missing, batch.Count+batch.Missing) - baseMissing)
+	switch {
+	case base.Numeric && batch.Numeric:
+		d.PSI = psi(base.Shares, binShares(batch.Sample, base.Edges))
+		ks := round4(ksStatistic(base.Sample, batch.Sample))
+		d.KS = &ks
+	case base.Numeric:
+		d.TypeChanged = true
+	default:
+		var expected, actual []float64
+		for v, share := range base.Categories {
+			expected = append(expected, share)
+			actual = append(actual, batch.Categories[v])
+		}
+		for v, share := range batch.Categories {
+			if _, ok := base.Categories[v]; !ok {
+				expected = append(expected, 0)
+				actual = append(actual, share)
+				d.NewCategories = append(d.NewCategories, v)
+			}
+		}
+		d.PSI = psi(expected, actual)
+		slices.Sort(d.NewCategories)
+		if len(d.NewCategories) > maxNewCategories {
+			d.NewCategories = d.NewCategories[:maxNewCategories]
+		}
+	}
+	d.Drifted = d.TypeChanged || d.PSI >= b.PSIThreshold || (d.KS != nil && *d.KS >= b.KSThreshold)
+	d.PSI = round4(d.PSI)
+	return d
+}
+
+// handleCreateBaseline profiles an uploaded CSV and registers it as a
+// baseline. psi_threshold and ks_threshold override the configured drift
+// thresholds for it.
+func handleCreateBaseline(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "baseline")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	b := &baseline{ID: newID(), Name: r.FormValue("name"), PSIThreshold: cfg.DriftPSIThreshold,
+		KSThreshold: cfg.DriftKSThreshold, DatasetSHA256: in.sha256, owner: identityFrom(r)}
+	for field, dst := range map[string]*float64{"psi_threshold": &b.PSIThreshold, "ks_threshold": &b.KSThreshold} {
+		if v := r.FormValue(field); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				http.Error(w, fmt.Sprintf("%s must be a positive number", field), http.StatusBadRequest)
+				return
+			}
+			*dst = f
+		}
+	}
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+	if b.Profile, b.Rows, err = profileTable(t); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+	b.Columns = t.Columns
+	for _, p := range b.Profile {
+		if p.Numeric {
+			p.setBins()
+		}
+	}
+	b.CreatedAt = time.Now().UTC()
+	if err := saveBaseline(b); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store baseline: %v", err), http.StatusInternalServerError)
+		return
+	}
+	baselinesMu.Lock()
+	baselines[b.ID] = b
+	baselinesMu.Unlock()
+
+	w.Header().Set("Location", apiPath(r, "/baselines/"+b.ID))
+	writeJSON(w, http.StatusCreated, b)
+}
+
+// lookupBaseline returns the baseline named by the id path value, answering
+// 404 when it does not exist or belongs to someone else.
+func lookupBaseline(w http.ResponseWriter, r *http.Request) (*baseline, bool) {
+	baselinesMu.Lock()
+	b, ok := baselines[r.PathValue("id")]
+	baselinesMu.Unlock()
+	if !ok || b.owner != identityFrom(r) {
+		http.Error(w, "baseline not found", http.StatusNotFound)
+		return nil, false
+	}
+	return b, true
+}
+
+// handleListBaselines returns a page of the caller's baselines, newest first unless
+// sorted otherwise; see listquery.go.
+func handleListBaselines(w http.ResponseWriter, r *http.Request) {
+	owner := identityFrom(r)
+	list := []baseline{}
+	baselinesMu.Lock()
+	for _, b := range baselines {
+		if b.owner == owner {
+			list = append(list, *b)
+		}
+	}
+	baselinesMu.Unlock()
+	baselineList.serve(w, r, list)
+}
+
+var baselineList = listSpec[baseline]{
+	name: "baselines",
+	id:   func(b baseline) string { return b.ID },
+	fields: []listField[baseline]{
+		textField("id", func(b baseline) string { return b.ID }),
+		textField("name", func(b baseline) string { return b.Name }),
+		numberField("rows", func(b baseline) float64 { return float64(b.Rows) }),
+		tagsField("columns", func(b baseline) []string { return b.Columns }),
+		timeField("created_at", func(b baseline) time.Time { return b.CreatedAt }),
+	},
+	defaultSort: "-created_at",
+}
+
+func handleGetBaseline(w http.ResponseWriter, r *http.Request) {
+	if b, ok := lookupBaseline(w, r); ok {
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+func handleDeleteBaseline(w http.ResponseWriter, r *http.Request) {
+	b, ok := lookupBaseline(w, r)
+	if !ok {
+		return
+	}
+	baselinesMu.Lock()
+	delete(baselines, b.ID)
+	baselinesMu.Unlock()
+	if err := os.Remove(baselinePath(b.ID)); err != nil {
+		log.Printf("failed to remove baseline %s: %v", b.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDrift compares an uploaded batch with a baseline column by column:
+// PSI over the baseline's bins or categories, the KS statistic for numeric
+// columns, and values the baseline never saw. When a column drifts past
+// the baseline's thresholds the report is also posted to the configured
+// webhook.
+func handleDrift(w http.ResponseWriter, r *http.Request) {
+	b, ok := lookupBaseline(w, r)
+	if !ok {
+		return
+	}
+	in, ok := receiveCSV(w, r, "drift")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+	profiles, rows, err := profileTable(t)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+
+	report := &driftReport{BaselineID: b.ID, Rows: rows, Drifted: []string{}, Columns: []columnDrift{}}
+	batch := map[string]*columnProfile{}
+	for _, p := range profiles {
+		batch[p.Name] = p
+		if !slices.Contains(b.Columns, p.Name) {
+			report.NewColumns = append(report.NewColumns, p.Name)
+		}
+	}
+	for _, base := range b.Profile {
+		p, ok := batch[base.Name]
+		if !ok {
+			report.MissingColumns = append(report.MissingColumns, base.Name)
+			continue
+		}
+		d := compare(base, p, b)
+		if d.Drifted {
+			report.Drifted = append(report.Drifted, d.Column)
+		}
+		report.Columns = append(report.Columns, d)
+	}
+	if len(report.Drifted) > 0 && cfg.DriftWebhookURL != "" {
+		go sendDriftAlert(b, report)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// driftAlert is the body posted to DATASCRIBE_DRIFT_WEBHOOK_URL.
+type driftAlert struct {
+	Event    string       `json:"event"`
+	Baseline *baseline    `json:"baseline"`
+	Owner    string       `json:"owner,omitempty"`
+	Report   *driftReport `json:"report"`
+}
+
+func sendDriftAlert(b *baseline, report *driftReport) {
+	body, err := json.Marshal(driftAlert{Event: "drift_detected", Baseline: b, Owner: b.owner, Report: report})
+	if err != nil {
+		log.Printf("drift webhook: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DriftWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.DriftWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("drift webhook: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("drift webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("drift webhook: unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestDriftStatistics(t *testing.T) {
+	sorted := []float64{1, 2, 2, 3, 4, 5, 6, 7, 8, 10}
+	for q, want := range map[float64]float64{0: 1, 0.5: 4.5, 0.25: 2.25, 1: 10} {
+		if got := quantile(sorted, q); math.Abs(got-want) > 1e-9 {
+			t.Errorf("quantile(%g) = %g, want %g", q, got, want)
+		}
+	}
+	if got, want := binShares(sorted, []float64{2, 5}), []float64{0.3, 0.3, 0.4}; !slices.Equal(got, want) {
+		t.Errorf("binShares = %v, want %v", got, want)
+	}
+	if got := binShares(nil, []float64{2}); !slices.Equal(got, []float64{0, 0}) {
+		t.Errorf("binShares of no values = %v", got)
+	}
+
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"same", []float64{1, 2, 3}, []float64{1, 2, 3}, 0},
+		{"apart", []float64{1, 2}, []float64{3, 4}, 1},
+		{"shifted", []float64{1, 2, 3, 4}, []float64{2, 3, 4, 5}, 0.25},
+		{"ties", []float64{1, 1, 2, 2}, []float64{1, 2, 2, 2}, 0.25},
+	}
+	for _, tt := range tests {
+		if got := ksStatistic(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: ksStatistic = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+
+	if got := psi([]float64{0.5, 0.5}, []float64{0.5, 0.5}); got != 0 {
+		t.Errorf("psi of equal shares = %g", got)
+	}
+	// An empty bin counts as psiFloor rather than making PSI infinite
+	want := (0.5-psiFloor)*math.Log(0.5/psiFloor) + (0.5-1)*math.Log(0.5)
+	if got := psi([]float64{0.5, 0.5}, []float64{0, 1}); math.IsInf(got, 0) || math.Abs(got-want) > 1e-9 {
+		t.Errorf("psi with an empty bin = %g, want %g", got, want)
+	}
+}
+
+func TestDriftCompare(t *testing.T) {
+	b := &baseline{PSIThreshold: 0.2, KSThreshold: 0.3}
+	numeric := func(from float64, missing int) *columnProfile {
+		p := &columnProfile{Name: "x", Numeric: true, Missing: missing}
+		for i := range 1000 {
+			p.Sample = append(p.Sample, from+float64(i))
+		}
+		p.Count = len(p.Sample)
+		p.setBins()
+		return p
+	}
+	categorical := func(shares map[string]float64) *columnProfile {
+		return &columnProfile{Name: "c", Count: 100, Categories: shares}
+	}
+	tests := []struct {
+		name        string
+		base, batch *columnProfile
+		drifted     bool
+		check       func(d columnDrift) bool
+	}{
+		{name: "same numbers", base: numeric(0, 0), batch: numeric(0, 0),
+			check: func(d columnDrift) bool { return d.PSI == 0 && *d.KS == 0 }},
+		{name: "slightly shifted", base: numeric(0, 0), batch: numeric(20, 0),
+			check: func(d columnDrift) bool { return *d.KS == 0.02 }},
+		{name: "shifted numbers", base: numeric(0, 0), batch: numeric(500, 0), drifted: true,
+			check: func(d columnDrift) bool { return *d.KS == 0.5 && d.PSI > 0.2 }},
+		{name: "more missing", base: numeric(0, 0), batch: numeric(0, 1000),
+			check: func(d columnDrift) bool { return d.MissingChange == 50 }},
+		{name: "now text", base: numeric(0, 0), batch: categorical(map[string]float64{"a": 1}), drifted: true,
+			check: func(d columnDrift) bool { return d.TypeChanged }},
+		{name: "same categories", base: categorical(map[string]float64{"a": 0.5, "b": 0.5}), batch: categorical(map[string]float64{"a": 0.5, "b": 0.5}),
+			check: func(d columnDrift) bool { return d.PSI == 0 && d.KS == nil }},
+		{name: "new category", base: categorical(map[string]float64{"a": 0.5, "b": 0.5}), batch: categorical(map[string]float64{"a": 0.4, "b": 0.2, "z": 0.4}),
+			drifted: true, check: func(d columnDrift) bool { return slices.Equal(d.NewCategories, []string{"z"}) }},
+	}
+	for _, tt := range tests {
+		d := compare(tt.base, tt.batch, b)
+		if d.Drifted != tt.drifted || !tt.check(d) {
+			t.Errorf("%s: %+v, want drifted %v", tt.name, d, tt.drifted)
+		}
+	}
+}
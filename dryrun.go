@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// dryRunResult is the response to a request made with dry_run=true: the
+// input was received, parsed and validated against the options and quotas,
+// but not analyzed.
+type dryRunResult struct {
+	DryRun    bool   `json:"dry_run"`
+	Filename  string `json:"filename"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256"`
+	// Input is the detected format of the upload.
+	Input *inputInfo `json:"input,omitempty"`
+	// Columns are the columns that would be analyzed, after the column
+	// selection of the options.
+	Columns []string        `json:"columns"`
+	Options analysisOptions `json:"options"`
+	// Action is what the request would have done.
+	Action string `json:"action"`
+	// EstimatedWaitSeconds is set for job submissions.
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds,omitempty"`
+}
+
+// dryRunRequested reports whether r asks for a dry run, replying 400 to a
+// malformed dry_run value.
+func dryRunRequested(w http.ResponseWriter, r *http.Request) (dryRun, ok bool) {
+	v := r.FormValue("dry_run")
+	if v == "" {
+		return false, true
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid dry_run %q: want true or false", v), http.StatusBadRequest)
+		return false, false
+	}
+	return dryRun, true
+}
+
+// newDryRunResult describes the validated input at path.
+func newDryRunResult(path, filename, sum string, opts analysisOptions, action string) (*dryRunResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTable(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	return &dryRunResult{DryRun: true, Filename: filename, SizeBytes: info.Size(), SHA256: sum,
+		Columns: t.Columns, Options: opts, Action: action}, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDuplicateSamples bounds the groups, and the row numbers per group,
+// included in a duplicates report.
+const maxDuplicateSamples = 10
+
+// duplicatesReport is the JSON response of POST /duplicates.
+type duplicatesReport struct {
+	Rows       int             `json:"rows"`
+	KeyColumns []string        `json:"key_columns"`
+	Exact      duplicateResult `json:"exact"`
+	// Near counts rows that match an earlier row only after trimming,
+	// case folding, collapsing whitespace and normalising numbers.
+	Near duplicateResult `json:"near"`
+}
+
+type duplicateResult struct {
+	// DuplicateRows is the number of rows that repeat an earlier row.
+	DuplicateRows int               `json:"duplicate_rows"`
+	Groups        int               `json:"groups"`
+	Samples       []duplicateSample `json:"samples"`
+}
+
+// duplicateSample is one group of duplicates: the key values of its first
+// row and the 1-based numbers of the rows in the group.
+type duplicateSample struct {
+	Count  int      `json:"count"`
+	Rows   []int    `json:"rows"`
+	Values []string `json:"values"`
+}
+
+// dupGroup accumulates one key while the file is streamed.
+type dupGroup struct {
+	first    int
+	count    int
+	variants int // distinct exact keys, for near-duplicate groups
+	rows     []int
+	values   []string
+}
+
+func (g *dupGroup) add(row int) {
+	g.count++
+	if len(g.rows) < maxDuplicateSamples {
+		g.rows = append(g.rows, row)
+	}
+}
+
+type rowKey [sha256.Size]byte
+
+func hashKey(fields []string) rowKey {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	var k rowKey
+	h.Sum(k[:0])
+	return k
+}
+
+// normalizeField is the comparison form of a value for near duplicates.
+func normalizeField(v string) string {
+	v = strings.ToLower(strings.Join(strings.Fields(v), " "))
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return v
+}
+
+// handleDuplicates reports exact and near-duplicate rows of an uploaded
+// CSV, compared on the key_columns form field (all columns by default).
+// With format=csv it instead returns the CSV with duplicates removed;
+// dedupe=near also drops near duplicates.
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "duplicates")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	keyColumns, err := parseNameList("key_columns", r.FormValue("key_columns"))
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+	keys, err := keyIndexes(t.Columns, keyColumns)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+
+	switch format := r.FormValue("format"); format {
+	case "", "json":
+		report, err := findDuplicates(t, keys)
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	case "csv":
+		near := false
+		switch r.FormValue("dedupe") {
+		case "", "exact":
+		case "near":
+			near = true
+		default:
+			http.Error(w, "dedupe must be exact or near", http.StatusBadRequest)
+			return
+		}
+		writeDeduplicated(w, t, keys, near)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q (want json or csv)", format), http.StatusBadRequest)
+	}
+}
+
+// keyIndexes returns the positions of names in columns, or of every column
+// when names is empty.
+func keyIndexes(columns, names []string) ([]int, error) {
+	if len(names) == 0 {
+		idx := make([]int, len(columns))
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx, nil
+	}
+	var idx []int
+	e := &unknownColumnsError{}
+	for _, name := range names {
+		i := slices.Index(columns, name)
+		if i < 0 {
+			e.Columns = append(e.Columns, name)
+			continue
+		}
+		idx = append(idx, i)
+	}
+	if len(e.Columns) > 0 {
+		return nil, e
+	}
+	return idx, nil
+}
+
+func pick(row []string, idx []int, normalize bool) []string {
+	out := make([]string, len(idx))
+	for j, i := range idx {
+		out[j] = row[i]
+		if normalize {
+			out[j] = normalizeField(out[j])
+		}
+	}
+	return out
+}
+
+func findDuplicates(t *csvTable, keys []int) (*duplicatesReport, error) {
+	report := &duplicatesReport{}
+	for _, i := range keys {
+		report.KeyColumns = append(report.KeyColumns, t.Columns[i])
+	}
+	exact := map[rowKey]*dupGroup{}
+	near := map[rowKey]*dupGroup{}
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", report.Rows+1, err)
+		}
+		report.Rows++
+		values := pick(row, keys, false)
+		ek, nk := hashKey(values), hashKey(pick(row, keys, true))
+
+		eg, seen := exact[ek]
+		if !seen {
+			eg = &dupGroup{first: report.Rows, values: values}
+			exact[ek] = eg
+		} else {
+			report.Exact.DuplicateRows++
+		}
+		eg.add(report.Rows)
+
+		ng, nearSeen := near[nk]
+		if !nearSeen {
+			ng = &dupGroup{first: report.Rows, values: values}
+			near[nk] = ng
+		}
+		// Near groups track one row per distinct exact variant
+		if !seen {
+			if nearSeen {
+				report.Near.DuplicateRows++
+			}
+			ng.variants++
+			ng.add(report.Rows)
+		}
+	}
+	report.Exact.Groups, report.Exact.Samples = summarizeGroups(exact, func(g *dupGroup) bool { return g.count > 1 })
+	report.Near.Groups, report.Near.Samples = summarizeGroups(near, func(g *dupGroup) bool { return g.variants > 1 })
+	return report, nil
+}
+
+// summarizeGroups counts the groups matching keep and returns samples of
+// the earliest ones.
+func summarizeGroups(groups map[rowKey]*dupGroup, keep func(*dupGroup) bool) (int, []duplicateSample) {
+	var kept []*dupGroup
+	for _, g := range groups {
+		if keep(g) {
+			kept = append(kept, g)
+		}
+	}
+	sort.Slice(kept, func(a, b int) bool { return kept[a].first < kept[b].first })
+	samples := []duplicateSample{}
+	for _, g := range kept[:min(len(kept), maxDuplicateSamples)] {
+		samples = append(samples, duplicateSample{Count: g.count, Rows: g.rows, Values: g.values})
+	}
+	return len(kept), samples
+}
+
+// writeDeduplicated streams the table as CSV, keeping the first row of
+// every key.
+func writeDeduplicated(w http.ResponseWriter, t *csvTable, keys []int, near bool) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="deduplicated.csv"`)
+	out := csv.NewWriter(w)
+	out.Write(t.Columns)
+	seen := map[rowKey]bool{}
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Headers are gone; all we can do is cut the download short
+			log.Printf("deduplicate: %v", err)
+			return
+		}
+		k := hashKey(pick(row, keys, near))
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out.Write(row)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("deduplicate: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// With DATASCRIBE_ENGINE=disabled the server runs without the Python
+// analysis engine, e.g. from a minimal image without Python. It serves only
+// the endpoints implemented in Go; the ones that need the engine answer 501
+// with engine_disabled, and no canary runs. Parquet uploads are read by the
+// engine too, so they are refused with 415 and engine_disabled wherever
+// they arrive.
+
+const codeEngineDisabled = "engine_disabled"
+
+var errEngineDisabled = errors.New("this server runs without the Python analysis engine")
+
+func engineDisabled() bool { return cfg.Engine == "disabled" }
+
+// writeEngineDisabled answers a request that needs the engine.
+func writeEngineDisabled(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotImplemented, errorBody{
+		Error: "this server runs without the Python analysis engine: only /estimate, /missing, /profile, /duplicates, " +
+			"/aggregate, /distribution, /join without analyze and the baseline and dataset endpoints are available",
+		Code: codeEngineDisabled,
+	})
+}
+
+// requiresEngine serves h only while the engine is enabled.
+func requiresEngine(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if engineDisabled() {
+			writeEngineDisabled(w)
+			return
+		}
+		h(w, r)
+	}
+}
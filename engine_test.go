@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEngineDisabled(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.Engine = "disabled"
+
+	w := httptest.NewRecorder()
+	requiresEngine(handleQuery)(w, httptest.NewRequest("POST", "/query", nil))
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), codeEngineDisabled) {
+		t.Errorf("/query = %d %q, want 501 %s", w.Code, strings.TrimSpace(w.Body.String()), codeEngineDisabled)
+	}
+
+	ws := &workspace{dir: t.TempDir()}
+	path := filepath.Join(ws.dir, "data")
+	if err := os.WriteFile(path, []byte("PAR1\x00\x00\x00\x00PAR1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ingestFile(context.Background(), ws, path, 1<<20, "")
+	w = httptest.NewRecorder()
+	writeIngestError(w, err)
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), codeEngineDisabled) {
+		t.Errorf("Parquet upload = %d %q, want 415 %s", w.Code, strings.TrimSpace(w.Body.String()), codeEngineDisabled)
+	}
+	if quarantinable(err) {
+		t.Errorf("Parquet upload without the engine is quarantined")
+	}
+}
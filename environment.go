@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// analyzerEnvironment is the Python environment predict.py runs in. It is
+// captured once per server process, as the packages are not expected to
+// change under a running server, and recorded in the provenance of every
+// job so that a report can be traced to the exact package versions.
+type analyzerEnvironment struct {
+	Python string `json:"python"`
+	// Packages are the lines of pip freeze, sorted.
+	Packages []string `json:"packages"`
+	// SHA256 digests Python and Packages, so environments compare at a
+	// glance.
+	SHA256 string `json:"sha256"`
+}
+
+const codeEnvironmentMismatch = "environment_mismatch"
+
+var currentEnvironment = sync.OnceValue(func() *analyzerEnvironment {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	env := &analyzerEnvironment{Packages: []string{}}
+	version, err := exec.CommandContext(ctx, "python3", "--version").Output()
+	if err != nil {
+		log.Printf("capturing the analyzer environment: python3 --version: %v", err)
+		return nil
+	}
+	env.Python = strings.TrimSpace(strings.TrimPrefix(string(version), "Python "))
+	freeze, err := exec.CommandContext(ctx, "python3", "-m", "pip", "freeze", "--all").Output()
+	if err != nil {
+		log.Printf("capturing the analyzer environment: pip freeze: %v", err)
+		return nil
+	}
+	for _, line := range strings.Split(string(freeze), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			env.Packages = append(env.Packages, line)
+		}
+	}
+	slices.Sort(env.Packages)
+	sum := sha256.Sum256([]byte(env.Python + "\n" + strings.Join(env.Packages, "\n")))
+	env.SHA256 = hex.EncodeToString(sum[:])
+	return env
+})
+
+// gitBlobHash returns the hash git gives the contents of the file at path,
+// which identifies the version of predict.py without a checkout.
+func gitBlobHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// environmentDiff lists how the analyzer now differs from the one that
+// produced a report: the script, the Python version and each package
+// added, removed or at another version.
+func environmentDiff(recorded, current *analyzerVersion) []string {
+	var diff []string
+	if recorded.ScriptGitHash != current.ScriptGitHash {
+		diff = append(diff, fmt.Sprintf("%s: git hash %s, now %s", recorded.Script, recorded.ScriptGitHash, current.ScriptGitHash))
+	}
+	was, now := recorded.Environment, current.Environment
+	if was == nil || now == nil {
+		if was != now {
+			diff = append(diff, "the Python environment could not be captured for both runs")
+		}
+		return diff
+	}
+	if was.Python != now.Python {
+		diff = append(diff, fmt.Sprintf("python: %s, now %s", was.Python, now.Python))
+	}
+	versions := func(packages []string) map[string]string {
+		m := map[string]string{}
+		for _, p := range packages {
+			name, version, _ := strings.Cut(p, "==")
+			m[strings.ToLower(name)] = version
+		}
+		return m
+	}
+	before, after := versions(was.Packages), versions(now.Packages)
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b, inBefore := before[name]
+		a, inAfter := after[name]
+		switch {
+		case !inAfter:
+			diff = append(diff, fmt.Sprintf("%s: %s, now not installed", name, b))
+		case !inBefore:
+			diff = append(diff, fmt.Sprintf("%s: not installed, now %s", name, a))
+		case a != b:
+			diff = append(diff, fmt.Sprintf("%s: %s, now %s", name, b, a))
+		}
+	}
+	return diff
+}
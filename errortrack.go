@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Failures are reported to an error tracker named by cfg.ErrorTrackerDSN.
+// A DSN with a key, https://<key>@<host>/<project>, is a Sentry project and
+// receives events through its envelope endpoint; any other URL is a generic
+// webhook that is posted the event JSON as is. Events never carry dataset
+// values: analyzer output is reduced to the exception type and traceback
+// frames, which name code but not data.
+
+// trackedEvent is an event in the Sentry event format.
+type trackedEvent struct {
+	EventID    string             `json:"event_id"`
+	Timestamp  time.Time          `json:"timestamp"`
+	Level      string             `json:"level"`
+	Platform   string             `json:"platform"`
+	Logger     string             `json:"logger"`
+	ServerName string             `json:"server_name,omitempty"`
+	Message    string             `json:"message"`
+	Tags       map[string]string  `json:"tags,omitempty"`
+	Extra      map[string]any     `json:"extra,omitempty"`
+	Exception  *trackedExceptions `json:"exception,omitempty"`
+}
+
+type trackedExceptions struct {
+	Values []trackedException `json:"values"`
+}
+
+type trackedException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// errorTracker delivers events in the background; events are dropped while
+// its buffer is full rather than slowing down requests.
+type errorTracker struct {
+	endpoint string
+	// sentryKey is empty for a generic webhook.
+	sentryKey string
+	events    chan trackedEvent
+}
+
+// tracker is nil unless DATASCRIBE_ERROR_TRACKER_DSN is set.
+var tracker *errorTracker
+
+var trackedEventsDropped = newCounter("datascribe_error_events_dropped_total", "Error tracker events dropped because delivery fell behind.")
+
+// startErrorTracker parses the DSN and starts delivering events.
+func startErrorTracker(dsn string) (*errorTracker, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	t := &errorTracker{endpoint: dsn, events: make(chan trackedEvent, 64)}
+	if u.User != nil {
+		project := path.Base(u.Path)
+		if project == "/" || project == "." {
+			return nil, errors.New("sentry DSN has no project ID")
+		}
+		t.sentryKey = u.User.Username()
+		t.endpoint = (&url.URL{Scheme: u.Scheme, Host: u.Host,
+			Path: path.Join(path.Dir(u.Path), "api", project, "envelope") + "/"}).String()
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *errorTracker) run() {
+	for e := range t.events {
+		if err := t.send(e); err != nil {
+			log.Printf("error tracker: %v", err)
+		}
+	}
+}
+
+func (t *errorTracker) send(e trackedEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	if t.sentryKey != "" {
+		header, _ := json.Marshal(map[string]string{"event_id": e.EventID})
+		body = bytes.Join([][]byte{header, []byte(`{"type":"event"}`), body}, []byte("\n"))
+		contentType = "application/x-sentry-envelope"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ErrorTrackerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if t.sentryKey != "" {
+		req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=datascribe/1.0, sentry_key="+t.sentryKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// trackError queues an event; it does nothing without an error tracker.
+func trackError(message string, tags map[string]string, extra map[string]any, exc *trackedException) {
+	if tracker == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	e := trackedEvent{EventID: newID(), Timestamp: time.Now().UTC(), Level: "error", Platform: "go",
+		Logger: "datascribe", ServerName: host, Message: message, Tags: tags, Extra: extra}
+	if exc != nil {
+		e.Exception = &trackedExceptions{Values: []trackedException{*exc}}
+	}
+	select {
+	case tracker.events <- e:
+	default:
+		trackedEventsDropped.inc()
+	}
+}
+
+// trackPanic reports a recovered panic with its stack.
+func trackPanic(where string, p any, stack []byte, tags map[string]string) {
+	trackError("panic in "+where, tags, map[string]any{"stack": string(stack)},
+		&trackedException{Type: "panic", Value: fmt.Sprint(p)})
+}
+
+// trackJobFailure reports a job that failed for good. Failures caused by the
+// input, such as a malformed CSV, are the caller's to fix and not reported.
+func trackJobFailure(j *job, attempt int, err error) {
+	if errors.Is(err, errUploadRejected) {
+		return
+	}
+	tags := map[string]string{"job_id": j.ID, "priority": string(j.Priority)}
+	extra := map[string]any{"attempt": attempt}
+	var ae *analysisError
+	if !errors.As(err, &ae) {
+		tags["error_code"] = codeAnalyzerCrashed
+		trackError("job failed: "+err.Error(), tags, extra, nil)
+		return
+	}
+	tags["error_code"] = ae.Code
+	excType, frames := scrubTraceback(ae.Stderr)
+	if len(frames) > 0 {
+		extra["traceback"] = frames
+	}
+	var exc *trackedException
+	if excType != "" {
+		exc = &trackedException{Type: excType, Value: "(message withheld: it may contain data values)"}
+	}
+	trackError("job failed: "+ae.Code, tags, extra, exc)
+}
+
+// scrubTraceback returns the exception type and the "File ..., line N, in
+// f" frames of a Python traceback, leaving out the exception message and
+// anything else the analyzer printed.
+func scrubTraceback(stderr string) (string, []string) {
+	if !strings.Contains(stderr, "Traceback (most recent call last):") {
+		return "", nil
+	}
+	var frames []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, `File "`) {
+			frames = append(frames, line)
+		}
+	}
+	last := lastLine(stderr)
+	excType, _, _ := strings.Cut(last, ":")
+	if strings.ContainsAny(excType, " \t'\"") {
+		// Not an exception line
+		excType = ""
+	}
+	return excType, frames
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// estimateSampleRows bounds the rows read to estimate the row count.
+const estimateSampleRows = 10000
+
+// Resource classes of an estimate, by expected analysis time.
+const (
+	resourceSmall  = "small"  // under 30 seconds
+	resourceMedium = "medium" // under 5 minutes
+	resourceLarge  = "large"
+)
+
+// estimate is the JSON response of POST /estimate.
+type estimate struct {
+	SizeBytes   int64 `json:"size_bytes"`
+	Columns     int   `json:"columns"`
+	SampledRows int   `json:"sampled_rows"`
+	// EstimatedRows is exact when the whole file was sampled.
+	EstimatedRows      int64   `json:"estimated_rows"`
+	Exact              bool    `json:"exact"`
+	EstimatedSeconds   float64 `json:"estimated_seconds"`
+	QueueWaitSeconds   float64 `json:"queue_wait_seconds"`
+	ResourceClass      string  `json:"resource_class"`
+	ExceedsTimeout     bool    `json:"exceeds_timeout"`
+	ExceedsUploadLimit bool    `json:"exceeds_upload_limit"`
+}
+
+// handleEstimate predicts how long the analysis of a CSV would take, from
+// its column count and a sample of its rows. Clients with a large file may
+// send only its beginning and pass the full size in bytes as size.
+func handleEstimate(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "estimate")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	info, err := os.Stat(in.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := estimate{SizeBytes: info.Size()}
+	if v := r.FormValue("size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < info.Size() {
+			http.Error(w, "size must be the file size in bytes, at least the size of the uploaded part", http.StatusBadRequest)
+			return
+		}
+		e.SizeBytes = n
+	}
+
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	defer t.Close()
+	e.Columns = len(t.Columns)
+	headerBytes := t.offset()
+	eof := false
+	for e.SampledRows < estimateSampleRows {
+		if _, err := t.next(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+				return
+			}
+			eof = true
+			break
+		}
+		e.SampledRows++
+	}
+	e.EstimatedRows = int64(e.SampledRows)
+	e.Exact = eof && e.SizeBytes == info.Size()
+	if sampled := t.offset() - headerBytes; !e.Exact && e.SampledRows > 0 && sampled > 0 {
+		perRow := float64(sampled) / float64(e.SampledRows)
+		e.EstimatedRows = int64(math.Round(float64(e.SizeBytes-headerBytes) / perRow))
+	}
+
+	seconds := cfg.EstimateOverhead.Seconds() + float64(e.EstimatedRows)*float64(e.Columns)/cfg.EstimateCellsPerSecond
+	e.EstimatedSeconds = math.Round(seconds*10) / 10
+	e.QueueWaitSeconds = math.Round(estimatedWait().Seconds()*10) / 10
+	switch d := time.Duration(seconds * float64(time.Second)); {
+	case d < 30*time.Second:
+		e.ResourceClass = resourceSmall
+	case d < 5*time.Minute:
+		e.ResourceClass = resourceMedium
+	default:
+		e.ResourceClass = resourceLarge
+	}
+	e.ExceedsTimeout = seconds > cfg.AnalysisTimeout.Seconds()
+	e.ExceedsUploadLimit = e.SizeBytes > uploadLimit(r)
+	writeJSON(w, http.StatusOK, e)
+}
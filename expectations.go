@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An expectation suite is a list of checks stored with a dataset, such as
+//
+//	{"expectations": [
+//	  {"type": "not_null", "column": "id"},
+//	  {"type": "between", "column": "score", "min": 0, "max": 1},
+//	  {"type": "row_count", "min": 1000}
+//	], "gate": true}
+//
+// Every job submitted with dataset=<id> evaluates the suite on its input
+// before analysis. The results are part of the job, the dataset version and
+// the report. With gate set, GET /jobs/{id}/expectations answers 422 when
+// any expectation failed, so a CI step can fail on it.
+
+// maxExpectations limits the size of a suite.
+const maxExpectations = 100
+
+const codeExpectationsFailed = "expectations_failed"
+
+// expectationTypes lists the supported expectations.
+var expectationTypes = []string{"column_exists", "not_null", "between", "mean_between", "row_count"}
+
+// expectation is one check. Column is required except for row_count. Min
+// and Max bound the values, the mean or the row count; at least one is
+// required for those. Mostly is the fraction of rows not_null requires to
+// be set, 1 by default.
+type expectation struct {
+	Type   string   `json:"type"`
+	Column string   `json:"column,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Mostly *float64 `json:"mostly,omitempty"`
+}
+
+type expectationSuite struct {
+	Expectations []expectation `json:"expectations"`
+	Gate         bool          `json:"gate"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// expectationResults is the outcome of evaluating a suite on one upload.
+type expectationResults struct {
+	Passed  bool                `json:"passed"`
+	Gate    bool                `json:"gate"`
+	Failed  int                 `json:"failed"`
+	Results []expectationResult `json:"results"`
+}
+
+// expectationResult is the outcome of one expectation. Observed is the
+// value it was checked against: the row count, the mean, the fraction of
+// set values or the [min, max] of the column.
+type expectationResult struct {
+	expectation
+	Passed   bool   `json:"passed"`
+	Observed any    `json:"observed,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// parseExpectationSuite parses and checks a suite sent by a client.
+func parseExpectationSuite(data []byte) (expectationSuite, error) {
+	var s expectationSuite
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return s, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if len(s.Expectations) > maxExpectations {
+		return s, fmt.Errorf("at most %d expectations are allowed", maxExpectations)
+	}
+	for i, e := range s.Expectations {
+		if err := e.check(); err != nil {
+			return s, fmt.Errorf("expectations[%d]: %w", i, err)
+		}
+	}
+	if s.Expectations == nil {
+		s.Expectations = []expectation{}
+	}
+	return s, nil
+}
+
+func (e expectation) check() error {
+	if !slices.Contains(expectationTypes, e.Type) {
+		return fmt.Errorf("unknown type %q (want %s)", e.Type, strings.Join(expectationTypes, ", "))
+	}
+	if e.Type == "row_count" {
+		if e.Column != "" {
+			return errors.New("row_count takes no column")
+		}
+	} else if e.Column == "" {
+		return fmt.Errorf("%s requires a column", e.Type)
+	}
+	bounded := e.Min != nil || e.Max != nil
+	switch e.Type {
+	case "between", "mean_between", "row_count":
+		if !bounded {
+			return fmt.Errorf("%s requires min, max or both", e.Type)
+		}
+		if e.Min != nil && e.Max != nil && *e.Min > *e.Max {
+			return errors.New("min is greater than max")
+		}
+	default:
+		if bounded {
+			return fmt.Errorf("%s takes no min or max", e.Type)
+		}
+	}
+	if e.Mostly != nil {
+		if e.Type != "not_null" {
+			return fmt.Errorf("%s takes no mostly", e.Type)
+		}
+		if *e.Mostly <= 0 || *e.Mostly > 1 {
+			return errors.New("mostly must be above 0 and at most 1")
+		}
+	}
+	return nil
+}
+
+// evaluateExpectations checks the suite against the statistics of an upload.
+func evaluateExpectations(s *expectationSuite, stats datasetStats) *expectationResults {
+	res := &expectationResults{Passed: true, Gate: s.Gate, Results: make([]expectationResult, len(s.Expectations))}
+	for i, e := range s.Expectations {
+		r := e.evaluate(stats)
+		if !r.Passed {
+			res.Passed = false
+			res.Failed++
+		}
+		res.Results[i] = r
+	}
+	return res
+}
+
+func (e expectation) evaluate(stats datasetStats) expectationResult {
+	r := expectationResult{expectation: e}
+	within := func(v float64) bool {
+		return (e.Min == nil || v >= *e.Min) && (e.Max == nil || v <= *e.Max)
+	}
+	if e.Type == "row_count" {
+		r.Observed, r.Passed = stats.Rows, within(float64(stats.Rows))
+		return r
+	}
+	i := slices.IndexFunc(stats.Columns, func(c columnStats) bool { return c.Name == e.Column })
+	if i < 0 {
+		r.Detail = "column not found"
+		return r
+	}
+	c := stats.Columns[i]
+	switch e.Type {
+	case "column_exists":
+		r.Passed = true
+	case "not_null":
+		set := round4(1 - c.MissingPct/100)
+		mostly := 1.0
+		if e.Mostly != nil {
+			mostly = *e.Mostly
+		}
+		r.Observed, r.Passed = set, set >= mostly
+		if !r.Passed {
+			r.Detail = fmt.Sprintf("%g%% of values are missing", c.MissingPct)
+		}
+	case "between", "mean_between":
+		if !c.Numeric {
+			r.Detail = "column is not numeric"
+			return r
+		}
+		if e.Type == "mean_between" {
+			r.Observed, r.Passed = *c.Mean, within(*c.Mean)
+		} else {
+			r.Observed, r.Passed = [2]float64{*c.Min, *c.Max}, within(*c.Min) && within(*c.Max)
+		}
+	}
+	return r
+}
+
+// failedGate reports whether the results fail a gated suite.
+func (r *expectationResults) failedGate() bool { return r != nil && r.Gate && !r.Passed }
+
+// checkExpectations evaluates the suite of the dataset of j, if it has one,
+// on the input of j.
+func checkExpectations(j *job) error {
+	datasetsMu.Lock()
+	var suite *expectationSuite
+	if d, ok := datasets[j.Dataset]; ok && d.Expectations != nil && len(d.Expectations.Expectations) > 0 {
+		suite = d.Expectations
+	}
+	datasetsMu.Unlock()
+	if suite == nil {
+		return nil
+	}
+	stats, err := computeStats(j.inputPath(), j.Options)
+	if err != nil {
+		return err
+	}
+	j.stats = &stats
+	j.Expectations = evaluateExpectations(suite, stats)
+	return nil
+}
+
+// handleGetDatasetExpectations returns the expectation suite of a dataset.
+func handleGetDatasetExpectations(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	datasetsMu.Lock()
+	suite := d.Expectations
+	datasetsMu.Unlock()
+	if suite == nil {
+		suite = &expectationSuite{Expectations: []expectation{}}
+	}
+	writeJSON(w, http.StatusOK, suite)
+}
+
+// handlePutDatasetExpectations replaces the expectation suite of a dataset.
+// Jobs already running keep the suite they started with.
+func handlePutDatasetExpectations(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	suite, err := parseExpectationSuite(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	suite.UpdatedAt = time.Now().UTC()
+
+	datasetsMu.Lock()
+	prev := d.Expectations
+	d.Expectations = &suite
+	if err = saveDataset(d); err != nil {
+		d.Expectations = prev
+	}
+	datasetsMu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to store dataset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &suite)
+}
+
+// handleGetJobExpectations returns the expectation results of a finished
+// job, with 422 when they fail a gated suite.
+func handleGetJobExpectations(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if j.Status == jobQueued || j.Status == jobRunning {
+		http.Error(w, fmt.Sprintf("expectations not evaluated yet: job is %s", j.Status), http.StatusConflict)
+		return
+	}
+	if j.Expectations == nil {
+		http.Error(w, "job has no expectations", http.StatusNotFound)
+		return
+	}
+	if j.Expectations.failedGate() {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":        fmt.Sprintf("%d of %d expectations failed", j.Expectations.Failed, len(j.Expectations.Results)),
+			"code":         codeExpectationsFailed,
+			"expectations": j.Expectations,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, j.Expectations)
+}
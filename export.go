@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// Finished reports of a caller with an export connector are uploaded to
+// their Google Drive folder or Dropbox path, and the link is stored on the
+// job. Connectors are read from the JSON file DATASCRIBE_EXPORT_CONNECTORS,
+// keyed by caller identity:
+//
+//	{"alice": {"type": "gdrive", "folder_id": "...", "credentials_file": "sa.json"},
+//	 "bob":   {"type": "dropbox", "path": "/Reports", "app_key": "...",
+//	           "app_secret": "...", "refresh_token": "..."}}
+//
+// Drive uploads authenticate as a service account with access to the
+// folder; Dropbox uses an app's offline refresh token.
+
+var (
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	driveUploadURL     = "https://www.googleapis.com/upload/drive/v3/files"
+	dropboxTokenURL    = "https://api.dropboxapi.com/oauth2/token"
+	dropboxUploadURL   = "https://content.dropboxapi.com/2/files/upload"
+	dropboxShareURL    = "https://api.dropboxapi.com/2/sharing/create_shared_link_with_settings"
+	errUnknownExporter = errors.New("unknown connector type (want gdrive or dropbox)")
+)
+
+// exportConnector is one caller's export destination.
+type exportConnector struct {
+	Type string `json:"type"`
+	// Google Drive
+	FolderID        string `json:"folder_id"`
+	CredentialsFile string `json:"credentials_file"`
+	// Dropbox
+	Path         string `json:"path"`
+	AppKey       string `json:"app_key"`
+	AppSecret    string `json:"app_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	account *serviceAccount
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+}
+
+// serviceAccount holds the fields of a Google service account key file.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+// reportExport is the outcome of exporting a job's report.
+type reportExport struct {
+	Destination string `json:"destination"`
+	URL         string `json:"url,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// exportConnectors is keyed by caller identity.
+var exportConnectors = map[string]*exportConnector{}
+
+// loadExportConnectors reads cfg.ExportConnectorsFile.
+func loadExportConnectors() error {
+	if cfg.ExportConnectorsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.ExportConnectorsFile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &exportConnectors); err != nil {
+		return err
+	}
+	for identity, c := range exportConnectors {
+		if err := c.init(); err != nil {
+			return fmt.Errorf("connector for %s: %w", identity, err)
+		}
+	}
+	return nil
+}
+
+func (c *exportConnector) init() error {
+	switch c.Type {
+	case "gdrive":
+		if c.FolderID == "" || c.CredentialsFile == "" {
+			return errors.New("gdrive needs folder_id and credentials_file")
+		}
+		data, err := os.ReadFile(c.CredentialsFile)
+		if err != nil {
+			return err
+		}
+		c.account = &serviceAccount{}
+		if err := json.Unmarshal(data, c.account); err != nil {
+			return err
+		}
+		block, _ := pem.Decode([]byte(c.account.PrivateKey))
+		if block == nil {
+			return errors.New("service account key has no PEM private key")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if c.account.key, ok = key.(*rsa.PrivateKey); !ok {
+			return errors.New("service account key is not RSA")
+		}
+		if c.account.TokenURI == "" {
+			c.account.TokenURI = googleTokenURL
+		}
+	case "dropbox":
+		if c.Path == "" || c.AppKey == "" || c.AppSecret == "" || c.RefreshToken == "" {
+			return errors.New("dropbox needs path, app_key, app_secret and refresh_token")
+		}
+	default:
+		return errUnknownExporter
+	}
+	return nil
+}
+
+func (c *exportConnector) destination() string {
+	if c.Type == "gdrive" {
+		return "gdrive:" + c.FolderID
+	}
+	return "dropbox:" + c.Path
+}
+
+// exportReport uploads the report of the finished job j when its owner has
+// a connector. It returns nil otherwise; failures are reported in the
+// result rather than failing the job.
+func exportReport(j *job) *reportExport {
+	c, ok := exportConnectors[j.owner]
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ExportTimeout)
+	defer cancel()
+	res := &reportExport{Destination: c.destination()}
+	var err error
+	if c.Type == "gdrive" {
+		res.URL, err = c.uploadDrive(ctx, j.reportPath(), reportFilename(j.Filename))
+	} else {
+		res.URL, err = c.uploadDropbox(ctx, j.reportPath(), reportFilename(j.Filename))
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// accessToken returns a cached OAuth access token, refreshing it a minute
+// before it expires.
+func (c *exportConnector) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry.Add(-time.Minute)) {
+		return c.token, nil
+	}
+	var form url.Values
+	tokenURL := dropboxTokenURL
+	if c.Type == "gdrive" {
+		assertion, err := c.account.assertion(time.Now())
+		if err != nil {
+			return "", err
+		}
+		tokenURL = c.account.TokenURI
+		form = url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	} else {
+		form = url.Values{"grant_type": {"refresh_token"}, "refresh_token": {c.RefreshToken},
+			"client_id": {c.AppKey}, "client_secret": {c.AppSecret}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(req, &tok); err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	c.token, c.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return c.token, nil
+}
+
+// assertion is the signed JWT exchanged for a Drive access token.
+func (a *serviceAccount) assertion(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	claims, err := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/drive",
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// uploadDrive stores the file at src in the folder with a multipart upload
+// and returns its web link.
+func (c *exportConnector) uploadDrive(ctx context.Context, src, name string) (string, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(map[string]any{"name": name, "parents": []string{c.FolderID}, "mimeType": "application/pdf"})
+	if err != nil {
+		return "", err
+	}
+	boundary := newID()
+	head := fmt.Sprintf("--%s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n--%s\r\nContent-Type: application/pdf\r\n\r\n",
+		boundary, meta, boundary)
+	tail := "\r\n--" + boundary + "--\r\n"
+	body := io.MultiReader(strings.NewReader(head), f, strings.NewReader(tail))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		driveUploadURL+"?uploadType=multipart&supportsAllDrives=true&fields=id,webViewLink", body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(head)) + info.Size() + int64(len(tail))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+boundary)
+	var created struct {
+		WebViewLink string `json:"webViewLink"`
+	}
+	if err := doJSON(req, &created); err != nil {
+		return "", fmt.Errorf("drive upload: %w", err)
+	}
+	return created.WebViewLink, nil
+}
+
+// uploadDropbox stores the file at src under the configured path, renaming
+// on conflict, and returns a shared link to it.
+func (c *exportConnector) uploadDropbox(ctx context.Context, src, name string) (string, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	arg, err := dropboxArg(map[string]any{"path": path.Join(c.Path, name), "mode": "add", "autorename": true})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxUploadURL, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", arg)
+	var uploaded struct {
+		PathLower string `json:"path_lower"`
+	}
+	if err := doJSON(req, &uploaded); err != nil {
+		return "", fmt.Errorf("dropbox upload: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]string{"path": uploaded.PathLower})
+	if err != nil {
+		return "", err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, dropboxShareURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var link struct {
+		URL string `json:"url"`
+	}
+	if err := doJSON(req, &link); err != nil {
+		return "", fmt.Errorf("dropbox shared link: %w", err)
+	}
+	return link.URL, nil
+}
+
+// dropboxArg encodes the Dropbox-API-Arg header, which must be ASCII, so
+// other characters are escaped as \uXXXX.
+func dropboxArg(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, r := range string(data) {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case r > 0xffff:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String(), nil
+}
+
+// doJSON sends req and decodes a successful JSON response into v.
+func doJSON(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The filter and derive options share the lexer below: column names, bare
+// or in backticks, double-quoted strings, numbers and operators.
+
+// maxExprLen and maxExprDepth bound the size of an expression.
+const (
+	maxExprLen   = 4096
+	maxExprDepth = 64
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenColumn // backtick-quoted
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return "string " + strconv.Quote(t.text)
+	case tokenColumn:
+		return "column `" + t.text + "`"
+	}
+	return strconv.Quote(t.text)
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "+", "-", "*", "/", "%", ","}
+
+// lexExpr splits an expression into tokens, ending with a tokenEOF.
+// Numbers are unsigned; a leading minus is an operator.
+func lexExpr(src string) ([]exprToken, error) {
+	if len(src) > maxExprLen {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxExprLen)
+	}
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start+1)
+			}
+			s, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d", start+1)
+			}
+			tokens = append(tokens, exprToken{tokenString, s, start})
+			i = end + 1
+		case r == '`':
+			end := strings.IndexByte(src[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated `column name` at position %d", start+1)
+			}
+			tokens = append(tokens, exprToken{tokenColumn, src[i+1 : i+1+end], start})
+			i += end + 2
+		case r >= '0' && r <= '9' || r == '.':
+			end := i + 1
+			for end < len(src) {
+				c := src[end]
+				if c >= '0' && c <= '9' || c == '.' {
+					end++
+				} else if (c == 'e' || c == 'E') && end+1 < len(src) {
+					end++
+					if src[end] == '+' || src[end] == '-' {
+						end++
+					}
+				} else {
+					break
+				}
+			}
+			f, err := strconv.ParseFloat(src[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[i:end], start+1)
+			}
+			tokens = append(tokens, exprToken{tokenNumber, strconv.FormatFloat(f, 'g', -1, 64), start})
+			i = end
+		case r == '_' || unicode.IsLetter(r):
+			end := i + size
+			for end < len(src) {
+				r, size := utf8.DecodeRuneInString(src[end:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, exprToken{tokenIdent, src[i:end], start})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				hint := ""
+				switch r {
+				case '=':
+					hint = "; compare with =="
+				case '&', '|':
+					hint = fmt.Sprintf("; combine with %c%c", r, r)
+				case '\'':
+					hint = `; quote strings with "`
+				}
+				return nil, fmt.Errorf("unexpected %q at position %d%s", r, start+1, hint)
+			}
+			tokens = append(tokens, exprToken{tokenOp, op, start})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{tokenEOF, "", len(src)}), nil
+}
+
+// exprTokens is the token stream of a recursive descent parser.
+type exprTokens struct {
+	tokens []exprToken
+	next   int
+}
+
+func (p *exprTokens) peek() exprToken { return p.tokens[p.next] }
+
+func (p *exprTokens) take() exprToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *exprTokens) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOp && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+// end fails unless every token has been parsed.
+func (p *exprTokens) end() error {
+	if t := p.peek(); t.kind != tokenEOF {
+		return p.errorAt(t, "unexpected %s", t)
+	}
+	return nil
+}
+
+func (p *exprTokens) errorAt(t exprToken, format string, args ...any) error {
+	return fmt.Errorf(format+" at position %d", append(args, t.pos+1)...)
+}
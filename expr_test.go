@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLexExpr(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []exprToken
+	}{
+		{"", nil},
+		{`amount >= 1.5e3`, []exprToken{{tokenIdent, "amount", 0}, {tokenOp, ">=", 7}, {tokenNumber, "1500", 10}}},
+		{"`order id` != \"a \\\"b\\\"\"", []exprToken{{tokenColumn, "order id", 0}, {tokenOp, "!=", 11}, {tokenString, `a "b"`, 14}}},
+		{`-x.y*(2)`, []exprToken{{tokenOp, "-", 0}, {tokenIdent, "x.y", 1}, {tokenOp, "*", 4}, {tokenOp, "(", 5}, {tokenNumber, "2", 6}, {tokenOp, ")", 7}}},
+		{`a&&!b||c`, []exprToken{{tokenIdent, "a", 0}, {tokenOp, "&&", 1}, {tokenOp, "!", 3}, {tokenIdent, "b", 4}, {tokenOp, "||", 5}, {tokenIdent, "c", 7}}},
+		{`größe<1`, []exprToken{{tokenIdent, "größe", 0}, {tokenOp, "<", 7}, {tokenNumber, "1", 8}}},
+	}
+	for _, tt := range tests {
+		got, err := lexExpr(tt.src)
+		if err != nil {
+			t.Errorf("lexExpr(%q) failed: %v", tt.src, err)
+			continue
+		}
+		want := append(tt.want, exprToken{tokenEOF, "", len(tt.src)})
+		if !slices.Equal(got, want) {
+			t.Errorf("lexExpr(%q) = %v, want %v", tt.src, got, want)
+		}
+	}
+}
+
+func TestLexExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`a = 1`, `unexpected '=' at position 3; compare with ==`},
+		{`a & b`, `unexpected '&' at position 3; combine with &&`},
+		{`a == 'x'`, `unexpected '\'' at position 6; quote strings with "`},
+		{`a == "x`, `unterminated string at position 6`},
+		{"`a == 1", "unterminated `column name` at position 1"},
+		{`a == 1.2.3`, `invalid number "1.2.3" at position 6`},
+		{`a == "\q"`, `invalid string at position 6`},
+		{strings.Repeat("a", maxExprLen+1), "expression is longer than 4096 characters"},
+	}
+	for _, tt := range tests {
+		_, err := lexExpr(tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("lexExpr(%.20q) error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
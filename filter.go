@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The filter option keeps only the rows of the upload matching an
+// expression, evaluated while the CSV is streamed so that a slice of a large
+// export can be analyzed as is:
+//
+//	country == "DE" && amount > 0
+//	!(status == "test" || `order id` == null)
+//
+// Columns are named bare, or in backticks when the name is not an
+// identifier. Comparisons with a number compare numerically, and values
+// that are not numbers never match them, not even with !=. Comparisons with
+// a string compare the text as it is. Two columns compare numerically when
+// both values are numbers. null matches missing values.
+
+// errNoMatchingRows is returned when a filter leaves no rows to analyze.
+var errNoMatchingRows = errors.New("the filter matched no rows")
+
+const codeNoMatchingRows = "no_matching_rows"
+
+var filterComparisons = []string{"==", "!=", "<", "<=", ">", ">="}
+
+// rowFilter is a parsed filter expression.
+type rowFilter struct {
+	root    filterNode
+	columns []string // referenced, in order of appearance
+	refs    []*filterOperand
+}
+
+// filterNode is a node of the expression tree.
+type filterNode interface {
+	match(rec []string) bool
+}
+
+type filterLogic struct {
+	and         bool
+	left, right filterNode
+}
+
+func (n *filterLogic) match(rec []string) bool {
+	if n.and {
+		return n.left.match(rec) && n.right.match(rec)
+	}
+	return n.left.match(rec) || n.right.match(rec)
+}
+
+type filterNot struct{ x filterNode }
+
+func (n *filterNot) match(rec []string) bool { return !n.x.match(rec) }
+
+type operandKind int
+
+const (
+	operandColumn operandKind = iota
+	operandString
+	operandNumber
+	operandNull
+)
+
+// filterOperand is one side of a comparison.
+type filterOperand struct {
+	kind   operandKind
+	column string
+	index  int // of column in the record, set by bind
+	text   string
+	number float64
+}
+
+func (o *filterOperand) value(rec []string) string {
+	if o.kind != operandColumn {
+		return o.text
+	}
+	if o.index < len(rec) {
+		return rec[o.index]
+	}
+	return ""
+}
+
+// numberOf returns the operand as a number, if it is one.
+func (o *filterOperand) numberOf(rec []string) (float64, bool) {
+	if o.kind == operandNumber {
+		return o.number, true
+	}
+	if o.kind == operandString {
+		return 0, false
+	}
+	v := strings.TrimSpace(o.value(rec))
+	if isNA(v) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil
+}
+
+type filterCompare struct {
+	op          string
+	left, right *filterOperand
+}
+
+func (n *filterCompare) match(rec []string) bool {
+	numeric := n.left.kind == operandNumber || n.right.kind == operandNumber
+	if numeric || n.left.kind == operandColumn && n.right.kind == operandColumn {
+		l, lok := n.left.numberOf(rec)
+		r, rok := n.right.numberOf(rec)
+		if lok && rok {
+			switch {
+			case l < r:
+				return compared(-1, n.op)
+			case l > r:
+				return compared(1, n.op)
+			}
+			return compared(0, n.op)
+		}
+		if numeric {
+			return false
+		}
+	}
+	return compared(strings.Compare(n.left.value(rec), n.right.value(rec)), n.op)
+}
+
+// compared applies a comparison operator to the result of a three-way
+// comparison.
+func compared(c int, op string) bool {
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+type filterIsNull struct {
+	x      *filterOperand
+	negate bool
+}
+
+func (n *filterIsNull) match(rec []string) bool {
+	return isNA(strings.TrimSpace(n.x.value(rec))) != n.negate
+}
+
+// parseFilter parses a filter expression.
+func parseFilter(src string) (*rowFilter, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	p := &filterParser{exprTokens: exprTokens{tokens: tokens}, f: &rowFilter{}}
+	root, err := p.or(0)
+	if err == nil {
+		err = p.end()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	p.f.root = root
+	return p.f, nil
+}
+
+// filterColumns returns the columns a valid filter expression refers to.
+func filterColumns(src string) []string {
+	f, err := parseFilter(src)
+	if err != nil {
+		return nil
+	}
+	return f.columns
+}
+
+// bind resolves the column names of the filter against the header names.
+func (f *rowFilter) bind(names []string) error {
+	for _, ref := range f.refs {
+		if ref.index = slices.Index(names, ref.column); ref.index < 0 {
+			return &unknownColumnsError{Columns: []string{ref.column}}
+		}
+	}
+	return nil
+}
+
+func (f *rowFilter) match(rec []string) bool { return f.root.match(rec) }
+
+// filterParser is a recursive descent parser of the grammar
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | operand op operand
+//	operand = column | string | [ "-" ] number | null
+type filterParser struct {
+	exprTokens
+	f *rowFilter
+}
+
+func (p *filterParser) or(depth int) (filterNode, error) {
+	left, err := p.and(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and(depth int) (filterNode, error) {
+	left, err := p.unary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary(depth int) (filterNode, error) {
+	if depth > maxExprDepth {
+		return nil, p.errorAt(p.peek(), "expression nested too deeply")
+	}
+	if p.accept("!") {
+		x, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{x}, nil
+	}
+	if t := p.peek(); p.accept("(") {
+		x, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("unclosed ( at position %d", t.pos+1)
+		}
+		return x, nil
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.take()
+	if t.kind != tokenOp || !slices.Contains(filterComparisons, t.text) {
+		return nil, p.errorAt(t, "expected a comparison (==, !=, <, <=, >, >=) but found %s", t)
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if left.kind == operandNull || right.kind == operandNull {
+		if t.text != "==" && t.text != "!=" {
+			return nil, p.errorAt(t, "null can only be compared with == or !=")
+		}
+		x := left
+		if left.kind == operandNull {
+			x = right
+		}
+		return &filterIsNull{x: x, negate: t.text == "!="}, nil
+	}
+	return &filterCompare{op: t.text, left: left, right: right}, nil
+}
+
+func (p *filterParser) operand() (*filterOperand, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenString:
+		return &filterOperand{kind: operandString, text: t.text}, nil
+	case tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return &filterOperand{kind: operandNumber, text: t.text, number: f}, nil
+	case tokenOp:
+		if t.text == "-" && p.peek().kind == tokenNumber {
+			f, _ := strconv.ParseFloat(p.take().text, 64)
+			return &filterOperand{kind: operandNumber, text: strconv.FormatFloat(-f, 'g', -1, 64), number: -f}, nil
+		}
+	case tokenIdent, tokenColumn:
+		if t.kind == tokenIdent && t.text == "null" {
+			return &filterOperand{kind: operandNull}, nil
+		}
+		o := &filterOperand{kind: operandColumn, column: t.text}
+		p.f.refs = append(p.f.refs, o)
+		if !slices.Contains(p.f.columns, t.text) {
+			p.f.columns = append(p.f.columns, t.text)
+		}
+		return o, nil
+	}
+	return nil, p.errorAt(t, "expected a column, string, number or null but found %s", t)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRowFilter(t *testing.T) {
+	header := []string{"country", "amount", "order id", "status", "low", "high"}
+	tests := []struct {
+		expr string
+		rec  []string
+		want bool
+	}{
+		{`country == "DE" && amount > 0`, []string{"DE", "12", "1", "paid", "", ""}, true},
+		{`country == "DE" && amount > 0`, []string{"DE", "-3", "1", "paid", "", ""}, false},
+		{`amount > -5`, []string{"", "-3", "", "", "", ""}, true},
+		{`amount >= 1e1`, []string{"", "10.0", "", "", "", ""}, true},
+		// values that are not numbers never match a number, not even with !=
+		{`amount != 1`, []string{"", "n/a", "", "", "", ""}, false},
+		{`amount != 1`, []string{"", "abc", "", "", "", ""}, false},
+		// a string compares the text as it is
+		{`amount == "10"`, []string{"", "10.0", "", "", "", ""}, false},
+		{`country < "E"`, []string{"DE", "", "", "", "", ""}, true},
+		// two columns compare numerically when both are numbers, else as text
+		{`low < high`, []string{"", "", "", "", "9", "10"}, true},
+		{`low < high`, []string{"", "", "", "", "b", "a"}, false},
+		{"`order id` == null", []string{"", "", "NA", "", "", ""}, true},
+		{"`order id` != null", []string{"", "", "17", "", "", ""}, true},
+		{`null == status`, []string{"", "", "", "", "", ""}, true},
+		{`!(status == "test" || status == "dev")`, []string{"", "", "", "dev", "", ""}, false},
+		{`!(status == "test" || status == "dev")`, []string{"", "", "", "live", "", ""}, true},
+		// && binds tighter than ||
+		{`status == "a" || status == "b" && amount > 100`, []string{"", "1", "", "a", "", ""}, true},
+		{`(status == "a" || status == "b") && amount > 100`, []string{"", "1", "", "a", "", ""}, false},
+		// a short record reads the missing cells as empty
+		{`high == null`, []string{"DE"}, true},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("parseFilter(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if err := f.bind(header); err != nil {
+			t.Errorf("bind of %q failed: %v", tt.expr, err)
+			continue
+		}
+		if got := f.match(tt.rec); got != tt.want {
+			t.Errorf("%q on %q = %v, want %v", tt.expr, tt.rec, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{``, "filter: expected a column, string, number or null but found end of expression at position 1"},
+		{`a`, "filter: expected a comparison (==, !=, <, <=, >, >=) but found end of expression at position 2"},
+		{`a == 1 b`, `filter: unexpected "b" at position 8`},
+		{`(a == 1`, "filter: unclosed ( at position 1"},
+		{`a < null`, "filter: null can only be compared with == or != at position 3"},
+		{`a == 1 &`, "filter: unexpected '&' at position 8; combine with &&"},
+		{strings.Repeat("!", maxExprDepth+2) + "a == 1", "filter: expression nested too deeply at position 66"},
+	}
+	for _, tt := range tests {
+		_, err := parseFilter(tt.expr)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseFilter(%.20q) error = %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestRowFilterColumns(t *testing.T) {
+	f, err := parseFilter("b == 1 && (`a c` > b || a == null)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "a c", "a"}; !slices.Equal(f.columns, want) {
+		t.Errorf("columns = %q, want %q", f.columns, want)
+	}
+	var unknown *unknownColumnsError
+	if err := f.bind([]string{"a", "b"}); !errors.As(err, &unknown) || !slices.Equal(unknown.Columns, []string{"a c"}) {
+		t.Errorf("bind without `a c` = %v, want it reported unknown", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Feature flags gate experimental endpoints and behaviours, so that they
+// can be rolled out to some callers before all of them. A flag is on for
+// everyone, for the listed identities and for a percentage of the others:
+// each caller falls on the same side of the percentage every time, by the
+// hash of the flag and its identity, or its address when anonymous.
+//
+// DATASCRIBE_FEATURE_FLAGS sets flags at startup, as name=rule entries
+// where the rule is on, off, or |-separated identities and a percentage:
+// stream_reports=10%|alice. Admins change them at runtime with
+// PUT /admin/flags/{name}, until the next restart or a DELETE, which
+// restores the configured rule.
+
+const codeFeatureDisabled = "feature_disabled"
+
+// featureFlagDef is a flag the server knows, on by default unless off.
+type featureFlagDef struct {
+	name        string
+	description string
+	off         bool
+}
+
+var featureFlagDefs = []featureFlagDef{
+	{name: "profile", description: "POST /profile, the parallel native profiler"},
+	{name: "stream_reports", description: "streaming the reports of POST /predict while they are drawn, with DATASCRIBE_STREAM_REPORTS set"},
+	{name: "sketch_stats", description: "streaming sketches in the statistics endpoints unless exact=true is given"},
+}
+
+// flagRule says for whom a flag is on.
+type flagRule struct {
+	Enabled    bool     `json:"enabled"`
+	Percent    int      `json:"percent,omitempty"`
+	Identities []string `json:"identities,omitempty"`
+}
+
+var flags struct {
+	mu         sync.Mutex
+	configured map[string]flagRule
+	overrides  map[string]flagRule
+}
+
+// loadFeatureFlags applies cfg.FeatureFlags to the defaults.
+func loadFeatureFlags() error {
+	configured := map[string]flagRule{}
+	for _, def := range featureFlagDefs {
+		configured[def.name] = flagRule{Enabled: !def.off}
+	}
+	for name, spec := range cfg.FeatureFlags {
+		if _, ok := configured[name]; !ok {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+		rule, err := parseFlagRule(spec)
+		if err != nil {
+			return fmt.Errorf("feature flag %s: %w", name, err)
+		}
+		configured[name] = rule
+	}
+	flags.mu.Lock()
+	flags.configured, flags.overrides = configured, map[string]flagRule{}
+	flags.mu.Unlock()
+	return nil
+}
+
+// parseFlagRule parses on, off, or |-separated identities and a percentage.
+func parseFlagRule(spec string) (flagRule, error) {
+	var rule flagRule
+	for _, term := range strings.Split(spec, "|") {
+		switch term = strings.TrimSpace(term); {
+		case term == "on":
+			rule.Enabled = true
+		case term == "off" || term == "":
+		case strings.HasSuffix(term, "%"):
+			p, err := strconv.Atoi(strings.TrimSuffix(term, "%"))
+			if err != nil || p < 0 || p > 100 {
+				return rule, fmt.Errorf("invalid percentage %q", term)
+			}
+			rule.Percent = p
+		default:
+			rule.Identities = append(rule.Identities, term)
+		}
+	}
+	return rule, nil
+}
+
+func (rule flagRule) check() error {
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, not %d", rule.Percent)
+	}
+	if slices.Contains(rule.Identities, "") {
+		return errors.New("identities must not be empty")
+	}
+	return nil
+}
+
+func currentFlagRule(name string) (rule flagRule, overridden, ok bool) {
+	flags.mu.Lock()
+	defer flags.mu.Unlock()
+	if rule, ok := flags.overrides[name]; ok {
+		return rule, true, true
+	}
+	rule, ok = flags.configured[name]
+	return rule, false, ok
+}
+
+// featureEnabled reports whether the flag name is on for the caller of r.
+func featureEnabled(r *http.Request, name string) bool {
+	rule, _, ok := currentFlagRule(name)
+	switch {
+	case !ok:
+		panic("unknown feature flag " + name)
+	case rule.Enabled:
+		return true
+	}
+	id := identityFrom(r)
+	if id != "" && slices.Contains(rule.Identities, id) {
+		return true
+	}
+	if rule.Percent == 0 {
+		return false
+	}
+	key := id
+	if key == "" {
+		key = clientIP(r).String()
+	}
+	return hashString(name+"\x00"+key)%100 < uint64(rule.Percent)
+}
+
+// requiresFlag serves h only to callers for whom the flag name is on; to
+// the others the endpoint does not exist.
+func requiresFlag(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(r, name) {
+			writeJSON(w, http.StatusNotFound, errorBody{Error: "this endpoint is not enabled", Code: codeFeatureDisabled})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func registerFeatureFlags() {
+	handleAPI("GET /admin/flags", protected(requireAdmin(handleListFlags)))
+	handleAPI("PUT /admin/flags/{name}", protected(requireAdmin(handleSetFlag)))
+	handleAPI("DELETE /admin/flags/{name}", protected(requireAdmin(handleResetFlag)))
+}
+
+// flagStatus is a flag as shown to admins: Rule is in force, Configured is
+// the rule from the configuration, which an admin may have overridden.
+type flagStatus struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Rule        flagRule `json:"rule"`
+	Configured  flagRule `json:"configured"`
+	Overridden  bool     `json:"overridden"`
+}
+
+func flagStatusOf(def featureFlagDef) flagStatus {
+	rule, overridden, _ := currentFlagRule(def.name)
+	flags.mu.Lock()
+	configured := flags.configured[def.name]
+	flags.mu.Unlock()
+	return flagStatus{Name: def.name, Description: def.description, Rule: rule, Configured: configured, Overridden: overridden}
+}
+
+func lookupFlag(w http.ResponseWriter, r *http.Request) (featureFlagDef, bool) {
+	name := r.PathValue("name")
+	for _, def := range featureFlagDefs {
+		if def.name == name {
+			return def, true
+		}
+	}
+	http.Error(w, fmt.Sprintf("unknown feature flag %q", name), http.StatusNotFound)
+	return featureFlagDef{}, false
+}
+
+func handleListFlags(w http.ResponseWriter, r *http.Request) {
+	list := make([]flagStatus, 0, len(featureFlagDefs))
+	for _, def := range featureFlagDefs {
+		list = append(list, flagStatusOf(def))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"flags": list})
+}
+
+// handleSetFlag overrides a flag with the rule in the JSON body.
+func handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	def, ok := lookupFlag(w, r)
+	if !ok {
+		return
+	}
+	var rule flagRule
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rule); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := rule.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flags.mu.Lock()
+	flags.overrides[def.name] = rule
+	flags.mu.Unlock()
+	audit(r, "feature_flag_changed", map[string]any{"flag": def.name, "rule": rule})
+	writeJSON(w, http.StatusOK, flagStatusOf(def))
+}
+
+// handleResetFlag restores the configured rule of a flag.
+func handleResetFlag(w http.ResponseWriter, r *http.Request) {
+	def, ok := lookupFlag(w, r)
+	if !ok {
+		return
+	}
+	flags.mu.Lock()
+	delete(flags.overrides, def.name)
+	flags.mu.Unlock()
+	audit(r, "feature_flag_reset", map[string]any{"flag": def.name})
+	writeJSON(w, http.StatusOK, flagStatusOf(def))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFlagRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{spec: "on", want: "{true 0 []}"},
+		{spec: "off", want: "{false 0 []}"},
+		{spec: "", want: "{false 0 []}"},
+		{spec: "10%", want: "{false 10 []}"},
+		{spec: "10% | alice|bob", want: "{false 10 [alice bob]}"},
+		{spec: "alice|on", want: "{true 0 [alice]}"},
+		{spec: "101%", wantErr: `invalid percentage "101%"`},
+		{spec: "-1%", wantErr: `invalid percentage "-1%"`},
+		{spec: "ten%", wantErr: `invalid percentage "ten%"`},
+	}
+	for _, tt := range tests {
+		rule, err := parseFlagRule(tt.spec)
+		if got := fmt.Sprint(err); tt.wantErr != "" && got != tt.wantErr || tt.wantErr == "" && err != nil {
+			t.Errorf("parseFlagRule(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got := fmt.Sprint(rule); tt.wantErr == "" && got != tt.want {
+			t.Errorf("parseFlagRule(%q) = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// useTestFlags configures the feature flags from specs.
+func useTestFlags(t *testing.T, specs map[string]string) {
+	saved := cfg
+	t.Cleanup(func() {
+		cfg = saved
+		loadFeatureFlags()
+	})
+	cfg.FeatureFlags = specs
+	if err := loadFeatureFlags(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flagRequest(identity string) *http.Request {
+	r := httptest.NewRequest("POST", "/profile", nil)
+	if identity != "" {
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	}
+	return r
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	useTestFlags(t, map[string]string{"profile": "alice", "stream_reports": "50%", "sketch_stats": "100%"})
+	tests := []struct {
+		flag, identity string
+		want           bool
+	}{
+		{"profile", "alice", true},
+		{"profile", "bob", false},
+		{"profile", "", false},
+		{"sketch_stats", "bob", true},
+		{"sketch_stats", "", true},
+	}
+	for _, tt := range tests {
+		if got := featureEnabled(flagRequest(tt.identity), tt.flag); got != tt.want {
+			t.Errorf("%s for %q = %v, want %v", tt.flag, tt.identity, got, tt.want)
+		}
+	}
+
+	// A percentage splits callers the same way every time
+	on := 0
+	for i := range 1000 {
+		id := fmt.Sprintf("user%d", i)
+		enabled := featureEnabled(flagRequest(id), "stream_reports")
+		if enabled != featureEnabled(flagRequest(id), "stream_reports") {
+			t.Fatalf("stream_reports changes its mind about %s", id)
+		}
+		if enabled {
+			on++
+		}
+	}
+	if on < 400 || on > 600 {
+		t.Errorf("stream_reports at 50%% is on for %d of 1000 callers", on)
+	}
+
+	w := httptest.NewRecorder()
+	requiresFlag("profile", func(w http.ResponseWriter, r *http.Request) {})(w, flagRequest("bob"))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), codeFeatureDisabled) {
+		t.Errorf("flagged endpoint for bob = %d %s, want 404 %s", w.Code, w.Body, codeFeatureDisabled)
+	}
+}
+
+func TestLoadFeatureFlagsErrors(t *testing.T) {
+	for specs, want := range map[string]string{
+		"nope=on":        `unknown feature flag "nope"`,
+		"profile=200%":   `feature flag profile: invalid percentage "200%"`,
+		"sketch_stats=%": `feature flag sketch_stats: invalid percentage "%"`,
+	} {
+		name, spec, _ := strings.Cut(specs, "=")
+		saved := cfg
+		cfg.FeatureFlags = map[string]string{name: spec}
+		err := loadFeatureFlags()
+		cfg = saved
+		if fmt.Sprint(err) != want {
+			t.Errorf("%s: error = %v, want %q", specs, err, want)
+		}
+	}
+}
+
+func TestFlagAdminAPI(t *testing.T) {
+	useTestFlags(t, map[string]string{"profile": "off"})
+	tests := []struct {
+		method, name, body string
+		status             int
+		enabled            bool // profile for bob afterwards
+	}{
+		{"PUT", "profile", `{"identities": ["bob"]}`, http.StatusOK, true},
+		{"PUT", "profile", `{"percent": 150}`, http.StatusBadRequest, true},
+		{"PUT", "profile", `{"identities": [""]}`, http.StatusBadRequest, true},
+		{"PUT", "profile", `{"enabled": "yes"}`, http.StatusBadRequest, true},
+		{"PUT", "profile", `{"everyone": true}`, http.StatusBadRequest, true},
+		{"PUT", "nope", `{}`, http.StatusNotFound, true},
+		{"DELETE", "profile", "", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/admin/flags/"+tt.name, strings.NewReader(tt.body))
+		r.SetPathValue("name", tt.name)
+		w := httptest.NewRecorder()
+		if tt.method == "PUT" {
+			handleSetFlag(w, r)
+		} else {
+			handleResetFlag(w, r)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s %s %s = %d, want %d: %s", tt.method, tt.name, tt.body, w.Code, tt.status, w.Body)
+		}
+		if got := featureEnabled(flagRequest("bob"), "profile"); got != tt.enabled {
+			t.Errorf("after %s %s %s: profile for bob = %v, want %v", tt.method, tt.name, tt.body, got, tt.enabled)
+		}
+	}
+}
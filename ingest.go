@@ -0,0 +1,599 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Every upload goes through ingestFile before anything reads it. The format
+// is detected from the bytes, never from the filename or Content-Type;
+// gzip and zip wrappers are unpacked and the data is rewritten in place as
+// a comma-separated CSV, so predict.py and the Go endpoints only ever see
+// CSV. What was detected is kept on the job as its inputInfo.
+
+// inputInfo describes an upload as it arrived, before normalization.
+type inputInfo struct {
+	// Format is csv, tsv, jsonl, xlsx or parquet.
+	Format string `json:"format"`
+	// Compression is gzip or zip when the data came wrapped in one.
+	Compression string `json:"compression,omitempty"`
+	// Member is the file that was read from a zip archive.
+	Member string `json:"member,omitempty"`
+	// Sheet is the worksheet that was read from a workbook.
+	Sheet string `json:"sheet,omitempty"`
+	// Delimiter separates the fields of delimited text.
+	Delimiter string `json:"delimiter,omitempty"`
+	Size      int64  `json:"size_bytes"`
+	// NormalizedSize is the size of the CSV that is analyzed.
+	NormalizedSize int64 `json:"normalized_size_bytes"`
+}
+
+var (
+	errUnsupportedFormat = errors.New("unsupported file format")
+	errMalformedInput    = errors.New("malformed input")
+	errInflatedTooLarge  = errors.New("decompressed upload exceeds the upload limit")
+)
+
+const (
+	codeUnsupportedFormat = "unsupported_media_type"
+	codeMalformedInput    = "malformed_input"
+)
+
+// ingestError marks a failure of ingestFile, so callers that pass it up
+// through other steps can still answer with writeIngestError.
+type ingestError struct{ err error }
+
+func (e *ingestError) Error() string { return e.err.Error() }
+func (e *ingestError) Unwrap() error { return e.err }
+
+// writeIngestError answers a failed ingestFile.
+func writeIngestError(w http.ResponseWriter, err error) {
+	var ae *analysisError
+	var ce *contractError
+	switch {
+	case errors.As(err, &ce):
+		writeContractError(w, ce)
+	case errors.Is(err, errUnsupportedFormat):
+		writeJSON(w, http.StatusUnsupportedMediaType, errorBody{Error: err.Error(), Code: codeUnsupportedFormat})
+	case errors.Is(err, errEngineDisabled):
+		writeJSON(w, http.StatusUnsupportedMediaType, errorBody{Error: err.Error(), Code: codeEngineDisabled})
+	case errors.Is(err, errMalformedInput):
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedInput})
+	case errors.Is(err, errNoMatchingRows):
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeNoMatchingRows})
+	case errors.Is(err, errInflatedTooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorBody{Error: err.Error()})
+	case errors.Is(err, errWorkspaceFull):
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+	case errors.As(err, &ae):
+		writeAnalysisError(w, err)
+	default:
+		http.Error(w, fmt.Sprintf("failed to read upload: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// sniffLen is how much of a file detectFormat looks at.
+const sniffLen = 8 << 10
+
+// magic lists the signatures of the binary formats. Formats with an empty
+// name are recognized only to be rejected with a helpful message.
+var magic = []struct {
+	prefix string
+	format string
+	what   string
+}{
+	{"\x1f\x8b", "gzip", ""},
+	{"PK\x03\x04", "zip", ""},
+	{"PAR1", "parquet", ""},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "", "a legacy Excel (.xls) or other OLE document; save it as .xlsx or CSV"},
+	{"%PDF", "", "a PDF document"},
+	{"\x89PNG", "", "a PNG image"},
+	{"\xff\xd8\xff", "", "a JPEG image"},
+	{"BZh", "", "a bzip2 archive; use gzip or zip"},
+	{"\xfd7zXZ\x00", "", "an xz archive; use gzip or zip"},
+	{"7z\xbc\xaf\x27\x1c", "", "a 7-Zip archive; use gzip or zip"},
+	{"\x28\xb5\x2f\xfd", "", "a zstd archive; use gzip or zip"},
+	{"SQLite format 3\x00", "", "an SQLite database"},
+}
+
+// detectFormat names the format of the file at path: gzip, zip, parquet,
+// jsonl or csv, which stands for delimited text of any kind. Anything else
+// fails with errUnsupportedFormat.
+func detectFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+	for _, m := range magic {
+		if bytes.HasPrefix(head, []byte(m.prefix)) {
+			if m.format == "" {
+				return "", fmt.Errorf("%w: the upload is %s", errUnsupportedFormat, m.what)
+			}
+			return m.format, nil
+		}
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", fmt.Errorf("%w: the upload is binary data, not delimited text, JSON Lines, Excel or Parquet", errUnsupportedFormat)
+	}
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\ufeff")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("{")):
+		return "jsonl", nil
+	case bytes.HasPrefix(text, []byte("[")):
+		return "", fmt.Errorf("%w: JSON arrays are not supported; send one object per line (JSON Lines)", errUnsupportedFormat)
+	}
+	return "csv", nil
+}
+
+// sniffedDelimiters are the delimiters sniffDelimiter chooses from, in the
+// order ties are broken.
+var sniffedDelimiters = []byte{',', '\t', ';', '|'}
+
+// sniffDelimiter guesses the delimiter of the text at path from its first
+// lines: the candidate that occurs the same, nonzero number of times on
+// every line, and most often. Without one it picks the candidate most
+// frequent in the header, and a comma when none occurs at all.
+func sniffDelimiter(path string) (rune, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	head = head[:n]
+	if n == sniffLen {
+		// Leave out the line cut off at the end
+		if i := bytes.LastIndexByte(head, '\n'); i > 0 {
+			head = head[:i]
+		}
+	}
+
+	// counts[line][candidate], with quoted text skipped
+	var counts [][]int
+	quoted := false
+	line := make([]int, len(sniffedDelimiters))
+	for _, c := range head {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '\n':
+			counts = append(counts, line)
+			line = make([]int, len(sniffedDelimiters))
+		default:
+			if i := bytes.IndexByte(sniffedDelimiters, c); i >= 0 {
+				line[i]++
+			}
+		}
+		if len(counts) == 20 {
+			break
+		}
+	}
+	if len(counts) < 20 && slices.ContainsFunc(line, func(n int) bool { return n > 0 }) {
+		counts = append(counts, line)
+	}
+	if len(counts) == 0 {
+		return ',', nil
+	}
+
+	best, bestCount := -1, 0
+	for i := range sniffedDelimiters {
+		consistent := counts[0][i] > 0
+		for _, l := range counts[1:] {
+			consistent = consistent && l[i] == counts[0][i]
+		}
+		if consistent && counts[0][i] > bestCount {
+			best, bestCount = i, counts[0][i]
+		}
+	}
+	if best < 0 {
+		for i := range sniffedDelimiters {
+			if counts[0][i] > bestCount {
+				best, bestCount = i, counts[0][i]
+			}
+		}
+	}
+	if best < 0 {
+		return ',', nil
+	}
+	return rune(sniffedDelimiters[best]), nil
+}
+
+// ingestFile detects the format of the upload at path and rewrites it as
+// CSV in place. Delimited text is split on delimiter, or on the detected
+// delimiter when it is empty. Decompressed data is held to limit bytes and
+// written through the quota of ws.
+func ingestFile(ctx context.Context, ws *workspace, path string, limit int64, delimiter string) (*inputInfo, error) {
+	info, err := ingest(ctx, ws, path, limit, delimiter)
+	if err != nil {
+		return nil, &ingestError{err}
+	}
+	return info, nil
+}
+
+func ingest(ctx context.Context, ws *workspace, file string, limit int64, delimiter string) (*inputInfo, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	info := &inputInfo{Size: st.Size()}
+	format, err := detectFormat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	src := file
+	inflated := file + ".inflated"
+	defer os.Remove(inflated)
+	switch format {
+	case "gzip":
+		info.Compression = "gzip"
+		if err := gunzipFile(ws, file, inflated, limit); err != nil {
+			return nil, err
+		}
+		src = inflated
+	case "zip":
+		zr, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unreadable zip archive: %v", errMalformedInput, err)
+		}
+		defer zr.Close()
+		if isWorkbook(&zr.Reader) {
+			format = "xlsx"
+			break
+		}
+		info.Compression = "zip"
+		member, err := zipMember(&zr.Reader)
+		if err != nil {
+			return nil, err
+		}
+		info.Member = member.Name
+		if err := unzipMember(ws, member, inflated, limit); err != nil {
+			return nil, err
+		}
+		src = inflated
+	}
+	if src != file {
+		if format, err = detectFormat(src); err != nil {
+			return nil, err
+		}
+		if format == "gzip" || format == "zip" {
+			return nil, fmt.Errorf("%w: nested archives are not supported", errUnsupportedFormat)
+		}
+	}
+	comma, _ := utf8.DecodeRuneInString(delimiter)
+	if format == "csv" && delimiter == "" {
+		if comma, err = sniffDelimiter(src); err != nil {
+			return nil, err
+		}
+	}
+	if format == "csv" {
+		info.Delimiter = string(comma)
+		if comma == '\t' {
+			format = "tsv"
+		}
+	}
+	info.Format = format
+
+	out := file + ".normalized"
+	defer os.Remove(out)
+	switch format {
+	case "csv", "tsv":
+		if comma == ',' {
+			out = src
+			break
+		}
+		err = convertDelimited(ws, src, out, comma)
+	case "jsonl":
+		err = convertJSONL(ws, src, out)
+	case "xlsx":
+		info.Sheet, err = convertWorkbook(ws, src, out, limit)
+	case "parquet":
+		err = convertParquet(ctx, src, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if out != file {
+		if err := os.Rename(out, file); err != nil {
+			return nil, err
+		}
+	}
+	if st, err = os.Stat(file); err != nil {
+		return nil, err
+	}
+	info.NormalizedSize = st.Size()
+	return info, nil
+}
+
+// limitedReader fails with errInflatedTooLarge once more than limit bytes have
+// been read, guarding against decompression bombs.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64 // bytes left
+}
+
+func newLimitedReader(r io.Reader, limit int64) *limitedReader {
+	return &limitedReader{r: r, limit: limit, n: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		if n, _ := l.r.Read(make([]byte, 1)); n > 0 {
+			return 0, fmt.Errorf("%w (%d bytes)", errInflatedTooLarge, l.limit)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// createIn creates dst and returns a writer that counts against the quota
+// of ws. Callers close the file.
+func createIn(ws *workspace, dst string) (*os.File, io.Writer, error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, ws.writer(f), nil
+}
+
+func gunzipFile(ws *workspace, src, dst string, limit int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("%w: unreadable gzip data: %v", errMalformedInput, err)
+	}
+	out, w, err := createIn(ws, dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(w, newLimitedReader(zr, limit)); err != nil {
+		if errors.Is(err, errInflatedTooLarge) || errors.Is(err, errWorkspaceFull) {
+			return err
+		}
+		return fmt.Errorf("%w: unreadable gzip data: %v", errMalformedInput, err)
+	}
+	return out.Close()
+}
+
+// zipMember returns the one data file in an archive, ignoring directories
+// and the metadata macOS adds.
+func zipMember(zr *zip.Reader) (*zip.File, error) {
+	var member *zip.File
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if member != nil {
+			return nil, fmt.Errorf("%w: the zip archive holds more than one file (%s, %s); send one dataset per upload",
+				errUnsupportedFormat, member.Name, f.Name)
+		}
+		member = f
+	}
+	if member == nil {
+		return nil, fmt.Errorf("%w: the zip archive is empty", errMalformedInput)
+	}
+	return member, nil
+}
+
+func unzipMember(ws *workspace, member *zip.File, dst string, limit int64) error {
+	rc, err := member.Open()
+	if err != nil {
+		return fmt.Errorf("%w: unreadable zip member %s: %v", errMalformedInput, member.Name, err)
+	}
+	defer rc.Close()
+	out, w, err := createIn(ws, dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(w, newLimitedReader(rc, limit)); err != nil {
+		if errors.Is(err, errInflatedTooLarge) || errors.Is(err, errWorkspaceFull) {
+			return err
+		}
+		return fmt.Errorf("%w: unreadable zip member %s: %v", errMalformedInput, member.Name, err)
+	}
+	return out.Close()
+}
+
+// convertDelimited rewrites text separated by comma as CSV.
+func convertDelimited(ws *workspace, src, dst string, comma rune) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, w, err := createIn(ws, dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	r := csv.NewReader(bufio.NewReader(in))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	cw := csv.NewWriter(w)
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errMalformedInput, err)
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// convertJSONL writes JSON Lines as CSV. The columns are the keys of all
+// objects in the order they first appear; null and absent keys are left
+// empty and nested values are written as JSON.
+func convertJSONL(ws *workspace, src, dst string) error {
+	var columns []string
+	index := map[string]int{}
+	err := eachJSONObject(src, func(keys []string, _ []json.RawMessage) error {
+		for _, k := range keys {
+			if _, ok := index[k]; !ok {
+				index[k] = len(columns)
+				columns = append(columns, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("%w: no JSON objects with fields", errMalformedInput)
+	}
+
+	out, w, err := createIn(ws, dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	err = eachJSONObject(src, func(keys []string, values []json.RawMessage) error {
+		clear(row)
+		for i, k := range keys {
+			row[index[k]] = jsonCell(values[i])
+		}
+		return cw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// eachJSONObject calls fn with the keys and raw values of every object in
+// the JSON Lines file at path, in document order.
+func eachJSONObject(path string, fn func(keys []string, values []json.RawMessage) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	var keys []string
+	var values []json.RawMessage
+	for n := 1; ; n++ {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: record %d: %v", errMalformedInput, n, err)
+		}
+		if tok != json.Delim('{') {
+			return fmt.Errorf("%w: record %d is not a JSON object", errMalformedInput, n)
+		}
+		keys, values = keys[:0], values[:0]
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("%w: record %d: %v", errMalformedInput, n, err)
+			}
+			var v json.RawMessage
+			if err := dec.Decode(&v); err != nil {
+				return fmt.Errorf("%w: record %d: %v", errMalformedInput, n, err)
+			}
+			keys = append(keys, tok.(string))
+			values = append(values, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("%w: record %d: %v", errMalformedInput, n, err)
+		}
+		if err := fn(keys, values); err != nil {
+			return err
+		}
+	}
+}
+
+// jsonCell renders a JSON value as a CSV cell.
+func jsonCell(v json.RawMessage) string {
+	v = bytes.TrimSpace(v)
+	switch {
+	case len(v) == 0, string(v) == "null":
+		return ""
+	case v[0] == '"':
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			return s
+		}
+	case v[0] == '{', v[0] == '[':
+		var buf bytes.Buffer
+		if json.Compact(&buf, v) == nil {
+			return buf.String()
+		}
+	}
+	return string(v)
+}
+
+// convertParquet has pandas read the Parquet file, as Go has no Parquet
+// reader in the standard library.
+func convertParquet(ctx context.Context, src, dst string) error {
+	if engineDisabled() {
+		return fmt.Errorf("%w, which reads Parquet: upload CSV, TSV, JSON Lines or Excel instead", errEngineDisabled)
+	}
+	_, err := runPython(ctx, "convert.py", "--input", src, "--output", dst)
+	var ae *analysisError
+	if errors.As(err, &ae) && ae.Code == codeMalformedCSV {
+		return fmt.Errorf("%w: %s", errMalformedInput, ae.Message)
+	}
+	return err
+}
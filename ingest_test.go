@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.String()
+}
+
+// zipped archives files, given as name and content pairs.
+func zipped(files ...string) string {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for i := 0; i+1 < len(files); i += 2 {
+		fw, _ := zw.Create(files[i])
+		fw.Write([]byte(files[i+1]))
+	}
+	zw.Close()
+	return b.String()
+}
+
+func TestSniffDelimiter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rune
+	}{
+		{"", ','},
+		{"single column\n1\n2\n", ','},
+		{"a,b,c\n1,2,3\n", ','},
+		{"a\tb\tc\n1\t2\t3", '\t'},
+		{"a;b\n1,5;2,5\n3,0;4\n", ';'},
+		{"a|b|c\n\"x|y\"|1|2\n", '|'},
+		{"a,b;c;d\n1;2;3\n", ';'},
+		{"a;b,c,d\n1;2,3\n4,5\n", ','},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "data")
+		os.WriteFile(path, []byte(tt.in), 0o600)
+		if got, err := sniffDelimiter(path); err != nil || got != tt.want {
+			t.Errorf("sniffDelimiter(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestIngestFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		delimiter string
+		want      string // the normalized CSV
+		info      inputInfo
+		wantErr   error
+	}{
+		{name: "csv", in: "a,b\n1,2\n", want: "a,b\n1,2\n", info: inputInfo{Format: "csv", Delimiter: ","}},
+		{name: "tsv", in: "a\tb\n1\t\"x,y\"\n", want: "a,b\n1,\"x,y\"\n", info: inputInfo{Format: "tsv", Delimiter: "\t"}},
+		{name: "given delimiter", in: "a,b;c\n1,2;3\n", delimiter: ";", want: "\"a,b\",c\n\"1,2\",3\n", info: inputInfo{Format: "csv", Delimiter: ";"}},
+		{name: "jsonl", in: "{\"a\": 1, \"b\": \"x\"}\n{\"c\": [1], \"a\": null}\n",
+			want: "a,b,c\n1,x,\n,,[1]\n", info: inputInfo{Format: "jsonl"}},
+		{name: "gzip", in: gzipped("a;b\n1;2\n"), want: "a,b\n1,2\n", info: inputInfo{Format: "csv", Compression: "gzip", Delimiter: ";"}},
+		{name: "zip", in: zipped("__MACOSX/._data.csv", "x", "dir/data.csv", "a,b\n1,2\n"), want: "a,b\n1,2\n",
+			info: inputInfo{Format: "csv", Compression: "zip", Member: "dir/data.csv", Delimiter: ","}},
+		{name: "zip of two files", in: zipped("a.csv", "a\n", "b.csv", "b\n"), wantErr: errUnsupportedFormat},
+		{name: "zip of metadata only", in: zipped(".DS_Store", "x"), wantErr: errMalformedInput},
+		{name: "nested archive", in: gzipped(gzipped("a\n")), wantErr: errUnsupportedFormat},
+		{name: "bomb", in: gzipped(strings.Repeat("a,b\n", 1000)), wantErr: errInflatedTooLarge},
+		{name: "pdf", in: "%PDF-1.7\n", wantErr: errUnsupportedFormat},
+		{name: "binary", in: "a,b\n\x00\x01\n", wantErr: errUnsupportedFormat},
+		{name: "json array", in: " [{\"a\": 1}]", wantErr: errUnsupportedFormat},
+		{name: "broken json lines", in: "{\"a\": 1}\n{\"a\": \n", wantErr: errMalformedInput},
+	}
+	for _, tt := range tests {
+		ws := &workspace{dir: t.TempDir(), m: &workspaceManager{}}
+		path := filepath.Join(ws.dir, "upload")
+		if err := os.WriteFile(path, []byte(tt.in), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		info, err := ingestFile(context.Background(), ws, path, 1000, tt.delimiter)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		data, _ := os.ReadFile(path)
+		if string(data) != tt.want {
+			t.Errorf("%s: normalized to %q, want %q", tt.name, data, tt.want)
+		}
+		tt.info.Size, tt.info.NormalizedSize = int64(len(tt.in)), int64(len(tt.want))
+		if *info != tt.info {
+			t.Errorf("%s: info = %+v, want %+v", tt.name, *info, tt.info)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the address of the original client. X-Forwarded-For is
+// only honoured when the direct peer is a trusted proxy, and is walked from
+// the right so that a client cannot spoof its address by prepending entries.
+func clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !matchesAny(addr, cfg.TrustedProxies) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !matchesAny(addr, cfg.TrustedProxies) {
+			break
+		}
+	}
+	return addr
+}
+
+func matchesAny(addr netip.Addr, prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter enforces the configured CIDR deny and allow lists. Deny rules win;
+// when an allow list is set, anything outside it is rejected.
+func ipFilter(next http.Handler) http.Handler {
+	if len(cfg.AllowCIDRs) == 0 && len(cfg.DenyCIDRs) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		denied := !ip.IsValid() || matchesAny(ip, cfg.DenyCIDRs)
+		if len(cfg.AllowCIDRs) > 0 && !matchesAny(ip, cfg.AllowCIDRs) {
+			denied = true
+		}
+		if denied {
+			log.Printf("ip filter rejected %s for %s", ip, r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// analysisOutput is what predict.py printed during one run, capped to
+// cfg.AnalyzerLogLimit bytes per stream and scrubbed of secrets.
+type analysisOutput struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+
+	cpu time.Duration // user and system time of the analyzer process
+}
+
+// tailBuffer keeps the last limit bytes written to it; for a failing Python
+// process the end of the output holds the traceback.
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.limit; over > 0 {
+		b.buf = b.buf[over:]
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "[output truncated]\n" + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// secretPatterns match credentials that may appear in analyzer output.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(password|passwd|secret|token|api[_-]?key|access[_-]?key)(\s*[=:]\s*)\S+`),
+	regexp.MustCompile(`(?i)\b(authorization:\s*)(bearer|basic)\s+\S+`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(?i)(://[^:/\s]+:)[^@\s]+@`),
+}
+
+// scrubSecrets redacts configured secrets and common credential shapes from s.
+func scrubSecrets(s string) string {
+	for _, secret := range cfg.HMACKeys {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "[REDACTED]")
+		}
+	}
+	s = secretPatterns[0].ReplaceAllString(s, "$1$2[REDACTED]")
+	s = secretPatterns[1].ReplaceAllString(s, "$1$2 [REDACTED]")
+	s = secretPatterns[2].ReplaceAllString(s, "[REDACTED]")
+	s = secretPatterns[3].ReplaceAllString(s, "$1[REDACTED]@")
+	return s
+}
+
+// handleGetJobLogs returns the analyzer output of a job's latest attempt.
+// It is admin-only because the output may echo dataset values.
+func handleGetJobLogs(w http.ResponseWriter, r *http.Request) {
+	j, ok := getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"job_id":   j.ID,
+		"attempts": j.Attempts,
+		"stdout":   j.output.Stdout,
+		"stderr":   j.output.Stderr,
+	})
+}
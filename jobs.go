@@ -0,0 +1,825 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jobStatus is the lifecycle state of an asynchronous analysis.
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+)
+
+// job is an analysis run in the background. Its input and report live in
+// its workspace until the job expires.
+type job struct {
+	ID       string          `json:"id"`
+	Status   jobStatus       `json:"status"`
+	Filename string          `json:"filename"`
+	Name     string          `json:"name,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+	Priority jobPriority     `json:"priority"`
+	Options  analysisOptions `json:"options"`
+	Error    string          `json:"error,omitempty"`
+	// ErrorCode is the machine-readable reason for a failure.
+	ErrorCode string      `json:"error_code,omitempty"`
+	Scan      *scanResult `json:"scan,omitempty"`
+	// ReportSHA256 is the digest of the finished report, also used as its ETag.
+	ReportSHA256 string     `json:"report_sha256,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	Attempts     int        `json:"attempts"`
+	// QueuePosition is the number of jobs ahead of a queued job, and
+	// EstimatedStart and EstimatedCompletion are when it should start and
+	// finish, from the recent run times of inputs of similar size. Only
+	// GET /jobs/{id} sets them, for queued and running jobs.
+	QueuePosition       *int       `json:"queue_position,omitempty"`
+	EstimatedStart      *time.Time `json:"estimated_start,omitempty"`
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+	// DeadLettered is set when a job failed every attempt and its input is
+	// kept for inspection via the admin DLQ endpoints.
+	DeadLettered bool `json:"dead_lettered,omitempty"`
+	// Signature describes the certificate the report was signed with, so
+	// recipients can check the signature embedded in the PDF against it.
+	Signature *reportSignature `json:"signature,omitempty"`
+	// Dataset is the registered dataset the report becomes version
+	// DatasetVersion of once the job succeeds.
+	Dataset        string `json:"dataset,omitempty"`
+	DatasetVersion int    `json:"dataset_version,omitempty"`
+	// Export is the upload of the report to the owner's Drive or Dropbox
+	// connector, when one is configured.
+	Export *reportExport `json:"export,omitempty"`
+	// Catalog is the push of the job's schema and profile to the data
+	// catalog, when one is configured.
+	Catalog *catalogSync `json:"catalog,omitempty"`
+	// Provenance records where the input came from and how it was
+	// analyzed; see provenance.go.
+	Provenance *jobProvenance `json:"provenance,omitempty"`
+	// Input is the format the upload arrived in before it was normalized
+	// to CSV.
+	Input *inputInfo `json:"input,omitempty"`
+	// Artifacts are the files the job produced besides its report.
+	Artifacts []jobArtifact `json:"artifacts,omitempty"`
+	// Expectations are the results of the expectation suite of Dataset.
+	Expectations *expectationResults `json:"expectations,omitempty"`
+	// RerunOf is the job whose input this job reran; see rerun.go.
+	RerunOf string `json:"rerun_of,omitempty"`
+	// Labels are key=value pairs for slicing jobs and their metrics; see
+	// labels.go.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	owner  string
+	ws     *workspace
+	output analysisOutput // analyzer output of the latest attempt
+	stats  *datasetStats  // of the input, when computed for Expectations
+}
+
+func (j *job) inputPath() string  { return j.ws.path("input.csv") }
+func (j *job) reportPath() string { return j.ws.path("report.pdf") }
+
+// inputSize is the size of the job's input as received, or else of its
+// normalized CSV.
+func (j *job) inputSize() int64 {
+	if j.Provenance != nil && j.Provenance.Size > 0 {
+		return j.Provenance.Size
+	}
+	if j.ws == nil {
+		return 0
+	}
+	return fileSize(j.inputPath())
+}
+
+var (
+	// errQueueFull is returned by submitJob when no more jobs can be queued.
+	errQueueFull = errors.New("job queue is full")
+	// errPriorityLimit is returned by submitJob when the owner already has
+	// as many high priority jobs in flight as allowed.
+	errPriorityLimit = errors.New("too many high priority jobs in flight")
+	// errUploadRejected marks failures caused by the input itself, which are
+	// neither retried nor dead-lettered.
+	errUploadRejected = errors.New("upload rejected")
+)
+
+var (
+	jobsMu   sync.Mutex
+	jobs     = map[string]*job{}
+	jobQueue *priorityQueue
+	// jobsChanged is closed and replaced, under jobsMu, whenever a job
+	// changes or is deleted, waking the requests waiting for one.
+	jobsChanged = make(chan struct{})
+)
+
+// notifyJobsChanged wakes the waiters of jobsChanged; jobsMu must be held.
+func notifyJobsChanged() {
+	close(jobsChanged)
+	jobsChanged = make(chan struct{})
+}
+
+// newID returns a random identifier for jobs and uploads.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// jobSpec describes a submission.
+type jobSpec struct {
+	Filename string
+	Name     string
+	Tags     []string
+	Labels   map[string]string
+	Dataset  string
+	Owner    string
+	Priority jobPriority
+	Options  analysisOptions
+	// Channel and Source are recorded in the provenance of the job.
+	Channel string
+	Source  string
+	// Size is the size of the input, if known, to choose its workspace.
+	Size int64
+}
+
+// createJob registers a queued job and allocates its working directory.
+// The caller places the input at inputPath and then calls submitJob.
+func createJob(spec jobSpec) (*job, error) {
+	j := &job{
+		ID:        newID(),
+		Status:    jobQueued,
+		Filename:  spec.Filename,
+		Name:      spec.Name,
+		Tags:      spec.Tags,
+		Labels:    spec.Labels,
+		Dataset:   spec.Dataset,
+		Priority:  spec.Priority,
+		Options:   spec.Options,
+		CreatedAt: time.Now().UTC(),
+		Provenance: &jobProvenance{Filename: spec.Filename, Submitter: spec.Owner, Channel: spec.Channel,
+			Source: spec.Source, Stages: []jobStage{}},
+		owner: spec.Owner,
+	}
+	j.Provenance.recordOptions(spec.Options)
+	if j.Priority == "" {
+		j.Priority = priorityNormal
+	}
+	ws, err := allocateWorkspace("jobs", spec.Size)
+	if err != nil {
+		return nil, err
+	}
+	j.ws = ws
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	notifyJobsChanged()
+	jobsMu.Unlock()
+	return j, nil
+}
+
+// submitJob queues a created job for the workers. It fails if the queue is
+// full or the owner exceeds the high priority limit; the caller then still
+// owns the job and should delete it.
+func submitJob(j *job) error {
+	// Checked early too so that a rejected input is not hashed first
+	if j.Priority == priorityHigh && activeHighPriorityJobs(j.owner, j.ID) >= highPriorityLimit(j.owner) {
+		return errPriorityLimit
+	}
+	inputBlobs.adopt(j)
+	// The count and the push share jobsMu, so that concurrent submissions
+	// cannot all pass the check and then queue past the limit together
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if j.Priority == priorityHigh && activeHighPriorityJobsLocked(j.owner, j.ID) >= highPriorityLimit(j.owner) {
+		return errPriorityLimit
+	}
+	if !jobQueue.push(j.ID, j.Priority) {
+		return errQueueFull
+	}
+	return nil
+}
+
+// checkSubmit reports whether submitJob would currently accept a job of
+// owner at priority p, without queueing anything.
+func checkSubmit(owner string, p jobPriority) error {
+	if p == priorityHigh && activeHighPriorityJobs(owner, "") >= highPriorityLimit(owner) {
+		return errPriorityLimit
+	}
+	if jobQueue.len() >= jobQueue.capacity {
+		return errQueueFull
+	}
+	return nil
+}
+
+// activeHighPriorityJobs counts the owner's queued or running high priority
+// jobs other than except.
+func activeHighPriorityJobs(owner, except string) int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return activeHighPriorityJobsLocked(owner, except)
+}
+
+// activeHighPriorityJobsLocked is activeHighPriorityJobs with jobsMu held.
+func activeHighPriorityJobsLocked(owner, except string) int {
+	n := 0
+	for id, j := range jobs {
+		if id != except && j.owner == owner && j.Priority == priorityHigh &&
+			(j.Status == jobQueued || j.Status == jobRunning) {
+			n++
+		}
+	}
+	return n
+}
+
+// highPriorityLimit returns how many high priority jobs owner may have in flight.
+func highPriorityLimit(owner string) int {
+	if n, ok := cfg.HighPriorityLimits[owner]; ok {
+		return n
+	}
+	return cfg.HighPriorityLimit
+}
+
+// getJob returns a snapshot of the job with the given ID.
+func getJob(id string) (job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// updateJob applies fn to the job under the store lock.
+func updateJob(id string, fn func(j *job)) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if j, ok := jobs[id]; ok {
+		fn(j)
+		notifyJobsChanged()
+	}
+}
+
+func deleteJob(id string) {
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	delete(jobs, id)
+	notifyJobsChanged()
+	jobsMu.Unlock()
+	if ok {
+		inputBlobs.release(id)
+		j.ws.release()
+		forgetPreviews(id)
+		forgetShares(id)
+	}
+}
+
+// startWorkers launches n analysis workers and the expiry janitor.
+func startWorkers(n int) {
+	jobQueue = newPriorityQueue(cfg.QueueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				processJob(jobQueue.pop())
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			expireJobs()
+			expireUploads()
+			expireQuarantine()
+			expireSessions()
+		}
+	}()
+}
+
+// processJob runs one attempt of a job. Failed attempts are retried until
+// cfg.JobMaxAttempts is reached, after which the job is dead-lettered with
+// its input kept for debugging. Rejected uploads are never retried.
+func processJob(id string) {
+	j, ok := getJob(id)
+	if !ok {
+		return
+	}
+	runningJobs.Add(1)
+	defer runningJobs.Add(-1)
+	started := time.Now().UTC()
+	attempt := j.Attempts + 1
+	updateJob(id, func(j *job) {
+		j.Status = jobRunning
+		j.StartedAt = &started
+		j.Attempts = attempt
+	})
+	// The stored provenance keeps the submission stages for retries
+	if j.Provenance = j.Provenance.clone(); j.Provenance != nil {
+		j.Provenance.Stages = append(j.Provenance.Stages, jobStage{Stage: "queue", DurationMS: started.Sub(j.CreatedAt).Milliseconds()})
+	}
+
+	err := analyzeJob(&j)
+	var digest string
+	if err == nil {
+		digest, err = fileSHA256(j.reportPath())
+	}
+	finished := time.Now().UTC()
+	recordJobDuration(finished.Sub(started), j.inputSize())
+	jobRunSeconds.add(finished.Sub(started).Seconds(), jobMetricLabels(&j)...)
+	if j.output.cpu > 0 {
+		jobCPU.add(j.output.cpu)
+	}
+	if err == nil && j.Dataset != "" {
+		// The report is still available from the job if this fails
+		start := time.Now()
+		if j.DatasetVersion, err = addDatasetVersion(&j, digest, finished); err != nil {
+			log.Printf("job %s: recording version of dataset %s: %v", id, j.Dataset, err)
+			err = nil
+		}
+		j.Provenance.stage("dataset_version", start)
+	}
+	if err == nil {
+		// Set ahead of the final update for the index entry and the catalog
+		j.ReportSHA256, j.FinishedAt = digest, &finished
+	}
+	if err == nil && store != nil {
+		start := time.Now()
+		if err := store.put(&j, newReportEntry(&j)); err != nil {
+			log.Printf("job %s: storing report: %v", id, err)
+		}
+		j.Provenance.stage("store", start)
+	}
+	if err == nil {
+		start := time.Now()
+		if j.Export = exportReport(&j); j.Export != nil {
+			if j.Export.Error != "" {
+				log.Printf("job %s: exporting report to %s: %s", id, j.Export.Destination, j.Export.Error)
+			}
+			j.Provenance.stage("export", start)
+		}
+		start = time.Now()
+		if j.Catalog = syncCatalog(&j); j.Catalog != nil {
+			if j.Catalog.Error != "" {
+				log.Printf("job %s: pushing to %s: %s", id, j.Catalog.Catalog, j.Catalog.Error)
+			}
+			j.Provenance.stage("catalog", start)
+		}
+	}
+
+	if err != nil && !errors.Is(err, errUploadRejected) && attempt < cfg.JobMaxAttempts {
+		updateJob(id, func(stored *job) {
+			stored.output = j.output
+			stored.Status = jobQueued
+			stored.Error, stored.ErrorCode = failureDetails(err)
+			stored.StartedAt = nil
+		})
+		if jobQueue.push(id, j.Priority) {
+			logAnalysisError(fmt.Sprintf("job %s (attempt %d, retrying)", id, attempt), err)
+			return
+		}
+	}
+
+	updateJob(id, func(stored *job) {
+		stored.Scan = j.Scan
+		stored.output = j.output
+		stored.ReportSHA256 = digest
+		stored.Signature = j.Signature
+		stored.DatasetVersion = j.DatasetVersion
+		stored.Export = j.Export
+		stored.Catalog = j.Catalog
+		stored.Provenance = j.Provenance
+		stored.Artifacts = j.Artifacts
+		stored.Expectations = j.Expectations
+		stored.FinishedAt = &finished
+		stored.Status = jobSucceeded
+		stored.Error, stored.ErrorCode = "", ""
+		if err != nil {
+			stored.Status = jobFailed
+			stored.Error, stored.ErrorCode = failureDetails(err)
+			stored.DeadLettered = !errors.Is(err, errUploadRejected)
+		}
+	})
+	if err != nil {
+		jobsTotal.inc(jobMetricLabels(&j, "status", string(jobFailed))...)
+		logAnalysisError(fmt.Sprintf("job %s (attempt %d, final)", id, attempt), err)
+		trackJobFailure(&j, attempt, err)
+		return
+	}
+	jobsTotal.inc(jobMetricLabels(&j, "status", string(jobSucceeded))...)
+}
+
+// Error codes of jobs rejected outside the analyzer.
+const (
+	codeMalwareDetected = "malware_detected"
+	codeWorkspaceFull   = "workspace_limit_exceeded"
+)
+
+// failureDetails returns the message and machine-readable code stored on a failed job.
+func failureDetails(err error) (string, string) {
+	var ae *analysisError
+	switch {
+	case errors.As(err, &ae):
+		return ae.Message, ae.Code
+	case errors.Is(err, errWorkspaceFull):
+		return err.Error(), codeWorkspaceFull
+	case errors.Is(err, errUploadRejected):
+		return err.Error(), codeMalwareDetected
+	default:
+		return err.Error(), codeAnalyzerCrashed
+	}
+}
+
+// analyzeJob scans the job input when scanning is enabled and runs the
+// analyzer. A panic is turned into an error so the worker survives it.
+func analyzeJob(j *job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := debug.Stack()
+			log.Printf("panic analyzing job %s: %v\n%s", j.ID, p, stack)
+			trackPanic("job analysis", p, stack, map[string]string{"job_id": j.ID})
+			err = fmt.Errorf("panic during analysis: %v", p)
+		}
+	}()
+
+	if scanEnabled() {
+		start := time.Now()
+		res, err := scanFile(context.Background(), j.inputPath())
+		if err != nil {
+			return fmt.Errorf("malware scan unavailable: %v", err)
+		}
+		j.Scan = &res
+		j.Provenance.stage("scan", start)
+		if res.Infected {
+			return fmt.Errorf("%w: malware detected (%s)", errUploadRejected, res.Signature)
+		}
+	}
+	if j.Dataset != "" {
+		j.Options.SemanticTypes = withDatasetSemanticTypes(j.Dataset, j.Options.SemanticTypes)
+	}
+	opts := j.Options
+	if j.Dataset != "" {
+		start := time.Now()
+		if err := checkExpectations(j); err != nil {
+			return err
+		}
+		if j.Expectations != nil {
+			j.Provenance.stage("expectations", start)
+		}
+		opts.expectations = j.Expectations
+	}
+	if p := j.Provenance; p != nil {
+		if p.AnalyzedSHA256, err = fileSHA256(j.inputPath()); err != nil {
+			return err
+		}
+		p.Analyzer = currentAnalyzer()
+		opts.provenance = p
+	}
+	start := time.Now()
+	out, err := runAnalysis(context.Background(), j.inputPath(), j.reportPath(), opts)
+	j.output = out
+	if err != nil {
+		quarantine(err, j.inputPath(), j.Filename, j.owner, "job "+j.ID)
+		return err
+	}
+	j.Provenance.stage("analysis", start)
+	if signer != nil {
+		j.Signature = signer.status()
+	}
+	start = time.Now()
+	if j.Artifacts, err = collectArtifacts(j); err != nil {
+		return err
+	}
+	j.Provenance.stage("artifacts", start)
+	if err := j.ws.checkQuota(); err != nil {
+		return fmt.Errorf("%w: %w", errUploadRejected, err)
+	}
+	return nil
+}
+
+// errClientGone is returned by analyzeForRequest when the client
+// disconnected and there is nobody left to respond to.
+var errClientGone = errors.New("client disconnected")
+
+// analyzeForRequest runs the synchronous analysis of a request. A client that
+// disconnects cancels the analyzer, unless cfg.DisconnectMode is "async": then
+// the analysis runs to completion and its outcome is kept as a job of the
+// caller, so the report can still be fetched from /jobs or /reports.
+func analyzeForRequest(r *http.Request, inPath, outPath, filename string, opts analysisOptions) error {
+	ctx := r.Context()
+	if cfg.DisconnectMode != "async" {
+		_, err := runAnalysis(ctx, inPath, outPath, opts)
+		if ctx.Err() != nil {
+			log.Printf("analysis of %s cancelled: client disconnected", filename)
+			return errClientGone
+		}
+		return err
+	}
+	started := time.Now().UTC()
+	out, err := runAnalysis(context.WithoutCancel(ctx), inPath, outPath, opts)
+	if ctx.Err() == nil {
+		return err
+	}
+	j, aerr := adoptJob(jobSpec{Filename: filename, Owner: identityFrom(r), Options: opts, Channel: "sync", Size: fileSize(inPath)},
+		inPath, outPath, started, out, err)
+	if aerr != nil {
+		log.Printf("client disconnected during analysis of %s; result lost: %v", filename, aerr)
+	} else {
+		log.Printf("client disconnected during analysis of %s; kept as job %s", filename, j.ID)
+	}
+	return errClientGone
+}
+
+// adoptJob records a finished synchronous analysis as a job, moving its
+// input and report into the job's workspace. analysisErr is the outcome of
+// the analysis.
+func adoptJob(spec jobSpec, inPath, outPath string, started time.Time, out analysisOutput, analysisErr error) (*job, error) {
+	created, err := createJob(spec)
+	if err != nil {
+		return nil, err
+	}
+	// created is shared with the job table; work on a copy until the update
+	j := *created
+	j.CreatedAt = started
+	if err := moveFile(inPath, j.inputPath()); err != nil {
+		deleteJob(j.ID)
+		return nil, err
+	}
+	j.Provenance = j.Provenance.clone()
+	j.Provenance.Size = fileSize(j.inputPath())
+	j.Provenance.SHA256, _ = fileSHA256(j.inputPath())
+	j.Provenance.AnalyzedSHA256 = j.Provenance.SHA256
+	j.Provenance.Analyzer = currentAnalyzer()
+	j.Provenance.stage("analysis", started)
+	j.output = out
+	err = analysisErr
+	var digest string
+	if err == nil {
+		if err = moveFile(outPath, j.reportPath()); err == nil {
+			digest, err = fileSHA256(j.reportPath())
+		}
+	}
+	if err == nil && signer != nil {
+		j.Signature = signer.status()
+	}
+	finished := time.Now().UTC()
+	j.StartedAt, j.FinishedAt, j.ReportSHA256 = &started, &finished, digest
+	if err == nil && store != nil {
+		if err := store.put(&j, newReportEntry(&j)); err != nil {
+			log.Printf("job %s: storing report: %v", j.ID, err)
+		}
+	}
+	updateJob(j.ID, func(stored *job) {
+		stored.output = j.output
+		stored.Signature = j.Signature
+		stored.Attempts = 1
+		stored.CreatedAt = started
+		stored.StartedAt, stored.FinishedAt = &started, &finished
+		stored.ReportSHA256 = digest
+		stored.Provenance = j.Provenance
+		stored.Status = jobSucceeded
+		if err != nil {
+			stored.Status = jobFailed
+			stored.Error, stored.ErrorCode = failureDetails(err)
+		}
+	})
+	return &j, nil
+}
+
+// expireJobs removes finished jobs older than the retention period.
+// Dead-lettered jobs follow the separate DLQ retention.
+func expireJobs() {
+	now := time.Now()
+	var expired []string
+	jobsMu.Lock()
+	for id, j := range jobs {
+		retention := cfg.JobRetention
+		if j.DeadLettered {
+			retention = cfg.DLQRetention
+		}
+		if j.FinishedAt != nil && j.FinishedAt.Before(now.Add(-retention)) {
+			expired = append(expired, id)
+		}
+	}
+	jobsMu.Unlock()
+	for _, id := range expired {
+		deleteJob(id)
+	}
+}
+
+// lookupJob returns the job named in the request path if the caller owns it.
+func lookupJob(w http.ResponseWriter, r *http.Request) (job, bool) {
+	j, ok := getJob(r.PathValue("id"))
+	if !ok || j.owner != identityFrom(r) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return job{}, false
+	}
+	return j, true
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+var jobList = listSpec[job]{
+	name: "jobs",
+	id:   func(j job) string { return j.ID },
+	fields: []listField[job]{
+		textField("id", func(j job) string { return j.ID }),
+		textField("status", func(j job) string { return string(j.Status) }),
+		textField("priority", func(j job) string { return string(j.Priority) }),
+		textField("name", func(j job) string { return j.Name }),
+		textField("filename", func(j job) string { return j.Filename }),
+		textField("dataset", func(j job) string { return j.Dataset }),
+		tagsField("tags", func(j job) []string { return j.Tags }),
+		tagsField("labels", func(j job) []string { return labelPairs(j.Labels) }),
+		numberField("attempts", func(j job) float64 { return float64(j.Attempts) }),
+		timeField("created_at", func(j job) time.Time { return j.CreatedAt }),
+		timeField("finished_at", func(j job) time.Time { return timeOrZero(j.FinishedAt) }),
+	},
+	defaultSort: "-created_at",
+}
+
+// handleListJobs lists the caller's jobs with the list query grammar of
+// listquery.go, newest first by default.
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	owner := identityFrom(r)
+	var list []job
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if j.owner == owner {
+			list = append(list, *j)
+		}
+	}
+	jobsMu.Unlock()
+	jobList.serve(w, r, list)
+}
+
+// handleGetJob returns the status of a job as JSON. With wait, a duration
+// of up to cfg.JobWaitMax, it answers once the job has finished or the
+// time is up, whichever comes first, so clients can long-poll instead of
+// polling.
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	wait, err := parseJobWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			jobsMu.Lock()
+			stored, ok := jobs[j.ID]
+			if ok {
+				j = *stored
+			}
+			changed := jobsChanged
+			jobsMu.Unlock()
+			if !ok {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			if j.Status == jobSucceeded || j.Status == jobFailed {
+				break
+			}
+			select {
+			case <-changed:
+				continue
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+			break
+		}
+	}
+	if e, ok := estimateJob(&j); ok {
+		if j.Status == jobQueued {
+			j.QueuePosition, j.EstimatedStart = &e.position, &e.start
+		}
+		j.EstimatedCompletion = &e.completion
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// parseJobWait parses the wait parameter: a duration such as 30s, or a
+// number of seconds.
+func parseJobWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, nerr := strconv.Atoi(v)
+		if nerr != nil {
+			return 0, fmt.Errorf("invalid wait %q: want a duration such as 30s", v)
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < 0 || d > cfg.JobWaitMax {
+		return 0, fmt.Errorf("wait must be between 0 and %s", cfg.JobWaitMax)
+	}
+	return d, nil
+}
+
+// maxBulkStatusIDs caps the jobs of one POST /jobs/status.
+const maxBulkStatusIDs = 500
+
+// handleBulkJobStatus returns the status of many jobs at once, for
+// clients tracking batches: the body is {"ids": [...]}, and the answer
+// lists the caller's jobs among them, in the order asked, and the IDs of
+// the others under not_found.
+func handleBulkJobStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBulkStatusIDs {
+		http.Error(w, fmt.Sprintf("ids must list 1 to %d job IDs", maxBulkStatusIDs), http.StatusBadRequest)
+		return
+	}
+	owner := identityFrom(r)
+	found, notFound := []job{}, []string{}
+	seen := map[string]bool{}
+	jobsMu.Lock()
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if j, ok := jobs[id]; ok && j.owner == owner {
+			found = append(found, *j)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+	jobsMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": found, "not_found": notFound})
+}
+
+// handleGetJobReport serves the PDF report of a finished job, as an
+// attachment unless disposition=inline. Reports never change once written,
+// so the strong ETag and Last-Modified let polling clients revalidate with
+// If-None-Match or If-Modified-Since and get a 304.
+func handleGetJobReport(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	disposition, err := reportDisposition(r, j.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if j.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("report not available: job is %s", j.Status), http.StatusConflict)
+		return
+	}
+
+	report, err := os.Open(j.reportPath())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open generated PDF: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer report.Close()
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", `"`+j.ReportSHA256+`"`)
+	http.ServeContent(w, r, "report.pdf", *j.FinishedAt, report)
+}
+
+// fileSHA256 returns the hex sha256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return copyWithSHA256(io.Discard, f)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// useTestQueue gives the test an empty job queue and job table.
+func useTestQueue(t *testing.T) {
+	savedCfg, savedQueue := cfg, jobQueue
+	jobsMu.Lock()
+	savedJobs := jobs
+	jobs = map[string]*job{}
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		cfg, jobQueue = savedCfg, savedQueue
+		jobsMu.Lock()
+		jobs = savedJobs
+		jobsMu.Unlock()
+	})
+	jobQueue = newPriorityQueue(100)
+}
+
+func addTestJob(owner string, p jobPriority, status jobStatus) *job {
+	j := &job{ID: newID(), owner: owner, Priority: p, Status: status}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+	return j
+}
+
+func TestSubmitJobPriorityLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []jobStatus // of high priority jobs of the owner
+		owner    string
+		other    bool // the existing jobs belong to someone else
+		priority jobPriority
+		want     error
+	}{
+		{name: "below the limit", existing: []jobStatus{jobRunning}, owner: "alice", priority: priorityHigh},
+		{name: "at the limit", existing: []jobStatus{jobRunning, jobQueued}, owner: "alice", priority: priorityHigh, want: errPriorityLimit},
+		{name: "finished jobs do not count", existing: []jobStatus{jobSucceeded, jobFailed, jobRunning}, owner: "alice", priority: priorityHigh},
+		{name: "normal priority", existing: []jobStatus{jobRunning, jobQueued}, owner: "alice", priority: priorityNormal},
+		{name: "other owner", existing: []jobStatus{jobRunning, jobQueued}, owner: "alice", other: true, priority: priorityHigh},
+		{name: "owner limit", existing: []jobStatus{jobRunning, jobQueued, jobQueued}, owner: "batch", priority: priorityHigh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestQueue(t)
+			cfg.HighPriorityLimit = 2
+			cfg.HighPriorityLimits = map[string]int{"batch": 4}
+			for _, status := range tt.existing {
+				owner := tt.owner
+				if tt.other {
+					owner = "bob"
+				}
+				addTestJob(owner, priorityHigh, status)
+			}
+			j := addTestJob(tt.owner, tt.priority, jobQueued)
+			if err := submitJob(j); !errors.Is(err, tt.want) {
+				t.Errorf("submitJob = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestSubmitJobConcurrentHighPriority submits jobs at once for an owner
+// with one slot, which at most one of them may take.
+func TestSubmitJobConcurrentHighPriority(t *testing.T) {
+	useTestQueue(t)
+	cfg.HighPriorityLimit = 1
+	var pending []*job
+	for range 16 {
+		pending = append(pending, addTestJob("alice", priorityHigh, jobQueued))
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, j := range pending {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if submitJob(j) == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted > 1 {
+		t.Errorf("%d high priority jobs accepted, want at most 1", accepted)
+	}
+	if n := jobQueue.len(); n != accepted {
+		t.Errorf("queue holds %d jobs, want %d", n, accepted)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// joinTypes are the supported values of the how field.
+var joinTypes = []string{"inner", "left", "right", "outer"}
+
+// joinSpec describes how POST /join merges its two uploads.
+type joinSpec struct {
+	how     string
+	leftOn  []string
+	rightOn []string
+	// shared is set when both sides use the same key names (the on field);
+	// the key columns then appear once in the output.
+	shared bool
+}
+
+func parseJoinSpec(r *http.Request) (joinSpec, error) {
+	spec := joinSpec{how: r.FormValue("how")}
+	if spec.how == "" {
+		spec.how = "inner"
+	}
+	if !slices.Contains(joinTypes, spec.how) {
+		return spec, fmt.Errorf("how must be one of %s", strings.Join(joinTypes, ", "))
+	}
+	on, err := parseNameList("on", r.FormValue("on"))
+	if err != nil {
+		return spec, err
+	}
+	if len(on) > 0 {
+		spec.leftOn, spec.rightOn, spec.shared = on, on, true
+		return spec, nil
+	}
+	if spec.leftOn, err = parseNameList("left_on", r.FormValue("left_on")); err != nil {
+		return spec, err
+	}
+	if spec.rightOn, err = parseNameList("right_on", r.FormValue("right_on")); err != nil {
+		return spec, err
+	}
+	if len(spec.leftOn) == 0 || len(spec.leftOn) != len(spec.rightOn) {
+		return spec, errors.New("give on, or left_on and right_on with the same number of columns")
+	}
+	return spec, nil
+}
+
+// handleJoin merges the CSVs uploaded as left and right on their key
+// columns and returns the merged CSV. With analyze=true the merged file is
+// analyzed instead and the PDF report returned; the analysis options then
+// refer to the merged columns. The right file is held in memory, so it
+// should be the smaller one. Checksums of the uploads go in
+// content_sha256_left and content_sha256_right.
+func handleJoin(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSVs(w, r, "join", "left", "right")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	spec, err := parseJoinSpec(r)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	disposition, err := reportDisposition(r, "merged.csv")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	merged := in.ws.path("merged.csv")
+	err = joinFiles(in.paths["left"], in.paths["right"], spec, in.ws, merged)
+	switch {
+	case errors.Is(err, errWorkspaceFull):
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+		return
+	case errors.Is(err, errInvalidOptions):
+		writeOptionsError(w, err)
+		return
+	case err != nil:
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+
+	if r.FormValue("analyze") != "true" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="merged.csv"`)
+		http.ServeFile(w, r, merged)
+		return
+	}
+	if engineDisabled() {
+		writeEngineDisabled(w)
+		return
+	}
+	if err := in.opts.validate(merged); err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	if err := prepareRows(in.ws, merged, in.opts); err != nil {
+		writeIngestError(w, err)
+		return
+	}
+	report := in.ws.path("report.pdf")
+	if err := analyzeForRequest(r, merged, report, "merged.csv", in.opts); err != nil {
+		if !errors.Is(err, errClientGone) {
+			logAnalysisError("merged.csv", err)
+			writeAnalysisError(w, err)
+		}
+		return
+	}
+	serveReport(w, r, report, disposition)
+}
+
+// joinFiles hash-joins left and right into dst. Output columns are the left
+// columns followed by the right ones; shared key columns appear once and
+// other names present on both sides get _left and _right suffixes.
+func joinFiles(leftPath, rightPath string, spec joinSpec, ws *workspace, dst string) error {
+	left, err := openTable(leftPath, analysisOptions{})
+	if err != nil {
+		return fmt.Errorf("left: %w", err)
+	}
+	defer left.Close()
+	right, err := openTable(rightPath, analysisOptions{})
+	if err != nil {
+		return fmt.Errorf("right: %w", err)
+	}
+	defer right.Close()
+
+	leftKeys, err := keyIndexes(left.Columns, spec.leftOn)
+	if err != nil {
+		return fmt.Errorf("left: %w", err)
+	}
+	rightKeys, err := keyIndexes(right.Columns, spec.rightOn)
+	if err != nil {
+		return fmt.Errorf("right: %w", err)
+	}
+
+	// Right columns copied to the output, and the output header
+	var rightKept []int
+	for i := range right.Columns {
+		if !spec.shared || !slices.Contains(rightKeys, i) {
+			rightKept = append(rightKept, i)
+		}
+	}
+	var rightNames []string
+	for _, j := range rightKept {
+		rightNames = append(rightNames, right.Columns[j])
+	}
+	header := make([]string, 0, len(left.Columns)+len(rightKept))
+	for _, name := range left.Columns {
+		if slices.Contains(rightNames, name) {
+			name += "_left"
+		}
+		header = append(header, name)
+	}
+	for _, j := range rightKept {
+		name := right.Columns[j]
+		if slices.Contains(left.Columns, name) {
+			name += "_right"
+		}
+		header = append(header, name)
+	}
+
+	// Build the hash table from the right side
+	type rightRow struct {
+		fields  []string
+		matched bool
+	}
+	index := map[rowKey][]*rightRow{}
+	var rightRows []*rightRow
+	for {
+		row, err := right.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("right: %w", err)
+		}
+		rr := &rightRow{fields: slices.Clone(row)}
+		k := hashKey(pick(row, rightKeys, false))
+		index[k] = append(index[k], rr)
+		rightRows = append(rightRows, rr)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := csv.NewWriter(ws.writer(f))
+	out.Write(header)
+	record := make([]string, len(header))
+	emit := func(l []string, rr *rightRow) {
+		clear(record)
+		if l != nil {
+			copy(record, l)
+		}
+		if rr != nil {
+			for n, j := range rightKept {
+				record[len(left.Columns)+n] = rr.fields[j]
+			}
+			// Right-only rows still need the shared key values
+			if l == nil && spec.shared {
+				for n, i := range leftKeys {
+					record[i] = rr.fields[rightKeys[n]]
+				}
+			}
+		}
+		out.Write(record)
+	}
+
+	keepLeft := spec.how == "left" || spec.how == "outer"
+	keepRight := spec.how == "right" || spec.how == "outer"
+	for {
+		row, err := left.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("left: %w", err)
+		}
+		matches := index[hashKey(pick(row, leftKeys, false))]
+		for _, rr := range matches {
+			rr.matched = true
+			emit(row, rr)
+		}
+		if len(matches) == 0 && keepLeft {
+			emit(row, nil)
+		}
+		if err := out.Error(); err != nil {
+			return err
+		}
+	}
+	if keepRight {
+		for _, rr := range rightRows {
+			if !rr.matched {
+				emit(nil, rr)
+			}
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
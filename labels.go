@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Jobs carry labels, key=value pairs such as team=growth or
+// pipeline=nightly, given as the labels parameter of a submission: a
+// comma-separated list of key=value or a JSON object. Keys are lowercase
+// letters, digits and underscores, starting with a letter; values are text
+// without control characters.
+//
+// GET /jobs filters on them as the tags field labels, with
+// filter=labels:has:team=growth. The keys listed in DATASCRIBE_METRIC_LABELS
+// become dimensions of the job metrics, as label_<key>. Each key exports at
+// most DATASCRIBE_METRIC_LABEL_VALUES distinct values, so that a label fed
+// from, say, a run ID cannot grow the metrics without bound. A job with a
+// further value is counted with an empty label_<key>, like a job without
+// the label, and with <key> listed in labels_overflow; any value a job can
+// carry, "other" included, stays its own series.
+
+const (
+	maxJobLabels        = 20
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 100
+)
+
+// parseJobLabels parses the labels parameter of a submission.
+func parseJobLabels(v string) (map[string]string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &labels); err != nil {
+			return nil, fmt.Errorf("invalid labels: %v", err)
+		}
+	} else {
+		for _, pair := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid label %q: want key=value", pair)
+			}
+			labels[key] = value
+		}
+	}
+	if len(labels) > maxJobLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxJobLabels)
+	}
+	for key, value := range labels {
+		if err := checkLabelKey(key); err != nil {
+			return nil, err
+		}
+		if len(value) > maxLabelValueLength {
+			return nil, fmt.Errorf("the value of label %s is longer than %d bytes", key, maxLabelValueLength)
+		}
+		if !utf8.ValidString(value) || strings.ContainsFunc(value, unicode.IsControl) {
+			return nil, fmt.Errorf("the value of label %s must be UTF-8 text without control characters", key)
+		}
+	}
+	return labels, nil
+}
+
+func checkLabelKey(key string) error {
+	valid := key != "" && len(key) <= maxLabelKeyLength && key[0] >= 'a' && key[0] <= 'z'
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			valid = false
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid label key %q: want lowercase letters, digits and underscores, starting with a letter, at most %d bytes",
+			key, maxLabelKeyLength)
+	}
+	return nil
+}
+
+// labelPairs returns labels as sorted key=value strings, for filtering.
+func labelPairs(labels map[string]string) []string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return pairs
+}
+
+// metricLabelValues are the values exported so far for each key of
+// cfg.MetricLabels.
+var metricLabelValues struct {
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}
+
+// jobMetricLabels appends to the label pairs kv those of the keys of
+// cfg.MetricLabels on j, empty when j lacks them, and labels_overflow, the
+// comma-separated keys whose value on j is past the limit.
+func jobMetricLabels(j *job, kv ...string) []string {
+	if len(cfg.MetricLabels) == 0 {
+		return kv
+	}
+	metricLabelValues.mu.Lock()
+	defer metricLabelValues.mu.Unlock()
+	if metricLabelValues.seen == nil {
+		metricLabelValues.seen = map[string]map[string]bool{}
+	}
+	var overflow []string
+	for _, key := range cfg.MetricLabels {
+		value := j.Labels[key]
+		seen := metricLabelValues.seen[key]
+		if seen == nil {
+			seen = map[string]bool{}
+			metricLabelValues.seen[key] = seen
+		}
+		if value != "" && !seen[value] {
+			if len(seen) >= cfg.MetricLabelValues {
+				overflow = append(overflow, key)
+				value = ""
+			} else {
+				seen[value] = true
+			}
+		}
+		kv = append(kv, "label_"+key, value)
+	}
+	return append(kv, "labels_overflow", strings.Join(overflow, ","))
+}
+
+// checkMetricLabels validates cfg.MetricLabels.
+func checkMetricLabels() error {
+	for _, key := range cfg.MetricLabels {
+		if err := checkLabelKey(key); err != nil {
+			return err
+		}
+	}
+	if cfg.MetricLabelValues < 1 {
+		return fmt.Errorf("DATASCRIBE_METRIC_LABEL_VALUES must be at least 1")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseJobLabels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"team=growth", map[string]string{"team": "growth"}},
+		{"team=growth, pipeline=nightly", map[string]string{"team": "growth", "pipeline": "nightly"}},
+		{"run_2=a=b", map[string]string{"run_2": "a=b"}},
+		{"empty=", map[string]string{"empty": ""}},
+		{`{"team": "growth", "region": "eu west"}`, map[string]string{"team": "growth", "region": "eu west"}},
+		{`{"owner": "Zoë"}`, map[string]string{"owner": "Zoë"}},
+	}
+	for _, tt := range tests {
+		got, err := parseJobLabels(tt.in)
+		if err != nil {
+			t.Errorf("parseJobLabels(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !maps.Equal(got, tt.want) {
+			t.Errorf("parseJobLabels(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseJobLabelsErrors(t *testing.T) {
+	var many []string
+	for i := range maxJobLabels + 1 {
+		many = append(many, "k"+strings.Repeat("x", i)+"=v")
+	}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"team", `invalid label "team": want key=value`},
+		{"team=a,,b=c", `invalid label "": want key=value`},
+		{"Team=a", `invalid label key "Team": want lowercase letters, digits and underscores, starting with a letter, at most 63 bytes`},
+		{"1team=a", `invalid label key "1team": want lowercase letters, digits and underscores, starting with a letter, at most 63 bytes`},
+		{"te-am=a", `invalid label key "te-am": want lowercase letters, digits and underscores, starting with a letter, at most 63 bytes`},
+		{"=a", `invalid label key "": want lowercase letters, digits and underscores, starting with a letter, at most 63 bytes`},
+		{strings.Repeat("k", maxLabelKeyLength+1) + "=a", `invalid label key "` + strings.Repeat("k", maxLabelKeyLength+1) + `": want lowercase letters, digits and underscores, starting with a letter, at most 63 bytes`},
+		{"team=" + strings.Repeat("v", maxLabelValueLength+1), "the value of label team is longer than 100 bytes"},
+		{`{"team": "a\nb"}`, "the value of label team must be UTF-8 text without control characters"},
+		{"team=a\x7fb", "the value of label team must be UTF-8 text without control characters"},
+		{"team=\xff", "the value of label team must be UTF-8 text without control characters"},
+		{`{"team": "a"`, "invalid labels: unexpected end of JSON input"},
+		{strings.Join(many, ","), "at most 20 labels are allowed"},
+	}
+	for _, tt := range tests {
+		_, err := parseJobLabels(tt.in)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseJobLabels(%.30q) error = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestRenderLabels(t *testing.T) {
+	tests := []struct {
+		kv   []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"status", "done"}, `status="done"`},
+		{[]string{"a", "1", "b", "2"}, `a="1",b="2"`},
+		{[]string{"label_team", `say "hi"`}, `label_team="say \"hi\""`},
+		{[]string{"label_team", `C:\temp`}, `label_team="C:\\temp"`},
+		{[]string{"label_team", "a\nb"}, `label_team="a\nb"`},
+		{[]string{"label_team", "Zoë"}, `label_team="Zoë"`},
+	}
+	for _, tt := range tests {
+		if got := renderLabels(tt.kv); got != tt.want {
+			t.Errorf("renderLabels(%q) = %s, want %s", tt.kv, got, tt.want)
+		}
+	}
+}
+
+func TestJobMetricLabels(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() {
+		cfg = saved
+		metricLabelValues.mu.Lock()
+		metricLabelValues.seen = nil
+		metricLabelValues.mu.Unlock()
+	})
+	cfg.MetricLabels, cfg.MetricLabelValues = []string{"team", "run"}, 2
+	tests := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{map[string]string{"team": "growth", "run": "1"}, "label_team growth label_run 1 labels_overflow "},
+		{map[string]string{"team": "other", "run": "2"}, "label_team other label_run 2 labels_overflow "},
+		{map[string]string{"team": "ads", "run": "3"}, "label_team  label_run  labels_overflow team,run"},
+		{map[string]string{"team": "other"}, "label_team other label_run  labels_overflow "},
+		{map[string]string{"pipeline": "nightly"}, "label_team  label_run  labels_overflow "},
+		{map[string]string{"team": "growth", "run": "1"}, "label_team growth label_run 1 labels_overflow "},
+	}
+	for _, tt := range tests {
+		got := strings.Join(jobMetricLabels(&job{Labels: tt.labels}), " ")
+		if got != tt.want {
+			t.Errorf("jobMetricLabels(%v) = %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The list endpoints share one query grammar:
+//
+//	limit=N              at most N items (1 to maxListLimit, default 50)
+//	sort=field, -field   the order, ascending or with - descending
+//	filter=field:op:value
+//	                     only items matching; repeated filters all apply
+//	cursor=...           the page after the one whose next_cursor it was
+//
+// Filters compare text with eq, ne, contains and prefix (contains ignoring
+// case), numbers and times with eq, ne, lt, le, gt and ge, and take has
+// for a tag. Times are RFC 3339 timestamps or YYYY-MM-DD dates.
+//
+// Responses carry the page under the name of the list and, when there are
+// more items, next_cursor. Cursors hold the sort key of the last item, so
+// a page stays in place when earlier items are added or removed; a cursor
+// is only valid with the sort it was made with. Errors are 400 with code
+// invalid_list_query.
+
+const (
+	codeInvalidListQuery = "invalid_list_query"
+
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type listKind int
+
+const (
+	listText listKind = iota
+	listNumber
+	listTime
+	listTags
+)
+
+// listField is a field of the items of a list for sorting and filtering.
+type listField[T any] struct {
+	name string
+	kind listKind
+	// get returns a string, float64, time.Time or []string by kind.
+	get func(T) any
+}
+
+func textField[T any](name string, get func(T) string) listField[T] {
+	return listField[T]{name, listText, func(v T) any { return get(v) }}
+}
+
+func numberField[T any](name string, get func(T) float64) listField[T] {
+	return listField[T]{name, listNumber, func(v T) any { return get(v) }}
+}
+
+func timeField[T any](name string, get func(T) time.Time) listField[T] {
+	return listField[T]{name, listTime, func(v T) any { return get(v) }}
+}
+
+func tagsField[T any](name string, get func(T) []string) listField[T] {
+	return listField[T]{name, listTags, func(v T) any { return get(v) }}
+}
+
+// listSpec describes a list endpoint: name is the key of the page in the
+// response, id a unique key that orders equal sort keys.
+type listSpec[T any] struct {
+	name        string
+	id          func(T) string
+	fields      []listField[T]
+	defaultSort string
+}
+
+// listQuery is a parsed list query.
+type listQuery[T any] struct {
+	limit   int
+	sort    string
+	by      listField[T]
+	desc    bool
+	filters []func(T) bool
+	after   *listCursor
+}
+
+// listCursor is the position after which the next page starts.
+type listCursor struct {
+	Sort  string          `json:"sort"`
+	Value json.RawMessage `json:"value"`
+	ID    string          `json:"id"`
+
+	value any
+}
+
+type listQueryError struct{ msg string }
+
+func (e *listQueryError) Error() string { return e.msg }
+
+func listQueryErrorf(format string, args ...any) error {
+	return &listQueryError{fmt.Sprintf(format, args...)}
+}
+
+func (s listSpec[T]) field(name string) (listField[T], bool) {
+	for _, f := range s.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return listField[T]{}, false
+}
+
+func (s listSpec[T]) fieldNames(sortable bool) string {
+	var names []string
+	for _, f := range s.fields {
+		if !sortable || f.kind != listTags {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// parse reads the query string parameters of the grammar.
+func (s listSpec[T]) parse(params url.Values) (listQuery[T], error) {
+	q := listQuery[T]{limit: defaultListLimit, sort: s.defaultSort}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, listQueryErrorf("invalid limit %q: want a number from 1 to %d", v, maxListLimit)
+		}
+		q.limit = n
+	}
+	if v := params.Get("sort"); v != "" {
+		q.sort = v
+	}
+	name, desc := strings.CutPrefix(q.sort, "-")
+	by, ok := s.field(name)
+	if !ok || by.kind == listTags {
+		return q, listQueryErrorf("invalid sort %q: want one of %s, optionally prefixed with -", q.sort, s.fieldNames(true))
+	}
+	q.by, q.desc = by, desc
+	for _, v := range params["filter"] {
+		match, err := s.parseFilter(v)
+		if err != nil {
+			return q, err
+		}
+		q.filters = append(q.filters, match)
+	}
+	if v := params.Get("cursor"); v != "" {
+		c, err := parseListCursor(v, by.kind)
+		if err != nil || c.Sort != q.sort {
+			return q, listQueryErrorf("invalid cursor: it must come from next_cursor of the same sort")
+		}
+		q.after = c
+	}
+	return q, nil
+}
+
+// parseFilter parses field:op:value.
+func (s listSpec[T]) parseFilter(v string) (func(T) bool, error) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 {
+		return nil, listQueryErrorf("invalid filter %q: want field:op:value", v)
+	}
+	name, op, value := parts[0], parts[1], parts[2]
+	f, ok := s.field(name)
+	if !ok {
+		return nil, listQueryErrorf("invalid filter %q: unknown field %q, want one of %s", v, name, s.fieldNames(false))
+	}
+	var want any
+	var ops []string
+	switch f.kind {
+	case listText:
+		want, ops = value, []string{"eq", "ne", "contains", "prefix"}
+	case listNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, listQueryErrorf("invalid filter %q: %s takes a number", v, name)
+		}
+		want, ops = n, []string{"eq", "ne", "lt", "le", "gt", "ge"}
+	case listTime:
+		t, err := parseListTime(value)
+		if err != nil {
+			return nil, listQueryErrorf("invalid filter %q: %s takes an RFC 3339 timestamp or a YYYY-MM-DD date", v, name)
+		}
+		want, ops = t, []string{"eq", "ne", "lt", "le", "gt", "ge"}
+	case listTags:
+		want, ops = value, []string{"has"}
+	}
+	if !slices.Contains(ops, op) {
+		return nil, listQueryErrorf("invalid filter %q: %s takes the operators %s", v, name, strings.Join(ops, ", "))
+	}
+	return func(item T) bool {
+		got := f.get(item)
+		switch op {
+		case "has":
+			return slices.Contains(got.([]string), want.(string))
+		case "contains":
+			return strings.Contains(strings.ToLower(got.(string)), strings.ToLower(want.(string)))
+		case "prefix":
+			return strings.HasPrefix(got.(string), want.(string))
+		}
+		c := compareListValues(got, want)
+		switch op {
+		case "eq":
+			return c == 0
+		case "ne":
+			return c != 0
+		case "lt":
+			return c < 0
+		case "le":
+			return c <= 0
+		case "gt":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+func parseListTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+func compareListValues(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+func parseListCursor(v string, kind listKind) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case listText:
+		var s string
+		err = json.Unmarshal(c.Value, &s)
+		c.value = s
+	case listNumber:
+		var n float64
+		err = json.Unmarshal(c.Value, &n)
+		c.value = n
+	case listTime:
+		var t time.Time
+		err = json.Unmarshal(c.Value, &t)
+		c.value = t
+	}
+	return &c, err
+}
+
+// page filters, sorts and pages a copy of items, and returns the cursor of
+// the next page, if any.
+func (s listSpec[T]) page(q listQuery[T], items []T) ([]T, string) {
+	items = slices.DeleteFunc(slices.Clone(items), func(item T) bool {
+		for _, match := range q.filters {
+			if !match(item) {
+				return true
+			}
+		}
+		return false
+	})
+	// order compares the key value, id with that of item
+	order := func(value any, id string, item T) int {
+		c := compareListValues(value, q.by.get(item))
+		if c == 0 {
+			c = strings.Compare(id, s.id(item))
+		}
+		if q.desc {
+			return -c
+		}
+		return c
+	}
+	slices.SortFunc(items, func(a, b T) int { return order(q.by.get(a), s.id(a), b) })
+	if c := q.after; c != nil {
+		start := slices.IndexFunc(items, func(item T) bool { return order(c.value, c.ID, item) < 0 })
+		if start < 0 {
+			start = len(items)
+		}
+		items = items[start:]
+	}
+	if len(items) <= q.limit {
+		return items, ""
+	}
+	items = items[:q.limit]
+	last := items[len(items)-1]
+	value, _ := json.Marshal(q.by.get(last))
+	cursor, _ := json.Marshal(listCursor{Sort: q.sort, Value: value, ID: s.id(last)})
+	return items, base64.RawURLEncoding.EncodeToString(cursor)
+}
+
+// serve answers r with the page of items it asks for. Items are read after
+// the lock of the list they come from is released, so they must be copies
+// taken under it rather than pointers that writers share.
+func (s listSpec[T]) serve(w http.ResponseWriter, r *http.Request, items []T) {
+	q, err := s.parse(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error(), Code: codeInvalidListQuery})
+		return
+	}
+	page, next := s.page(q, items)
+	body := map[string]any{s.name: page}
+	if page == nil {
+		body[s.name] = []T{}
+	}
+	if next != "" {
+		body["next_cursor"] = next
+	}
+	writeJSON(w, http.StatusOK, body)
+}
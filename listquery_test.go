@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listItem struct {
+	id    string
+	name  string
+	size  float64
+	added time.Time
+	tags  []string
+}
+
+var testListSpec = listSpec[listItem]{
+	name: "items",
+	id:   func(v listItem) string { return v.id },
+	fields: []listField[listItem]{
+		textField("name", func(v listItem) string { return v.name }),
+		numberField("size", func(v listItem) float64 { return v.size }),
+		timeField("added", func(v listItem) time.Time { return v.added }),
+		tagsField("tags", func(v listItem) []string { return v.tags }),
+	},
+	defaultSort: "-added",
+}
+
+func testListItems() []listItem {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+	return []listItem{
+		{"a", "Alpha", 30, day(1), []string{"x"}},
+		{"b", "beta", 10, day(2), nil},
+		{"c", "Gamma", 20, day(3), []string{"x", "y"}},
+		{"d", "delta", 20, day(4), []string{"y"}},
+		{"e", "alphabet", 50, day(5), nil},
+	}
+}
+
+func itemIDs(items []listItem) string {
+	var ids []string
+	for _, v := range items {
+		ids = append(ids, v.id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestListQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "e,d,c,b,a"},
+		{"sort=size", "b,c,d,a,e"},
+		{"sort=-size", "e,a,d,c,b"},
+		{"sort=name", "a,c,e,b,d"},
+		{"filter=name:contains:ALPHA", "e,a"},
+		{"filter=name:prefix:al", "e"},
+		{"filter=name:ne:beta&sort=name", "a,c,e,d"},
+		{"filter=size:ge:20&filter=size:lt:50", "d,c,a"},
+		{"filter=size:eq:20", "d,c"},
+		{"filter=added:gt:2024-03-03", "e,d,c"},
+		{"filter=added:le:2024-03-02T12:00:00Z", "b,a"},
+		{"filter=tags:has:x", "c,a"},
+		{"limit=2", "e,d"},
+	}
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		q, err := testListSpec.parse(params)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if got, _ := testListSpec.page(q, testListItems()); itemIDs(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, itemIDs(got), tt.want)
+		}
+	}
+}
+
+func TestListQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"limit=0", `invalid limit "0": want a number from 1 to 500`},
+		{"limit=501", `invalid limit "501": want a number from 1 to 500`},
+		{"limit=x", `invalid limit "x": want a number from 1 to 500`},
+		{"sort=tags", `invalid sort "tags": want one of name, size, added, optionally prefixed with -`},
+		{"sort=%2Bsize", `invalid sort "+size": want one of name, size, added, optionally prefixed with -`},
+		{"filter=name", `invalid filter "name": want field:op:value`},
+		{"filter=owner:eq:x", `invalid filter "owner:eq:x": unknown field "owner", want one of name, size, added, tags`},
+		{"filter=name:gt:x", `invalid filter "name:gt:x": name takes the operators eq, ne, contains, prefix`},
+		{"filter=size:eq:big", `invalid filter "size:eq:big": size takes a number`},
+		{"filter=added:lt:yesterday", `invalid filter "added:lt:yesterday": added takes an RFC 3339 timestamp or a YYYY-MM-DD date`},
+		{"filter=tags:eq:x", `invalid filter "tags:eq:x": tags takes the operators has`},
+		{"cursor=!!", "invalid cursor: it must come from next_cursor of the same sort"},
+		{"cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"sort":"size","value":1,"id":"a"}`)), "invalid cursor: it must come from next_cursor of the same sort"},
+		{"sort=size&cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"sort":"size","value":"1","id":"a"}`)), "invalid cursor: it must come from next_cursor of the same sort"},
+	}
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		_, err := testListSpec.parse(params)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error = %v, want %q", tt.query, err, tt.want)
+		}
+	}
+}
+
+// TestListCursor pages through each sort and checks that the pages join up
+// to the full list, also when items before the cursor go away in between.
+func TestListCursor(t *testing.T) {
+	for _, sort := range []string{"name", "-name", "size", "-size", "added", "-added"} {
+		params := url.Values{"sort": {sort}}
+		q, err := testListSpec.parse(params)
+		if err != nil {
+			t.Fatalf("sort=%s: %v", sort, err)
+		}
+		all, _ := testListSpec.page(q, testListItems())
+		params.Set("limit", "2")
+		q, _ = testListSpec.parse(params)
+
+		items := testListItems()
+		var got []listItem
+		for range len(items) {
+			page, next := testListSpec.page(q, items)
+			got = append(got, page...)
+			if next == "" {
+				break
+			}
+			// drop what was seen, so the cursor must not count positions
+			items = slices.DeleteFunc(items, func(v listItem) bool { return v.id == page[0].id })
+			params.Set("cursor", next)
+			if q, err = testListSpec.parse(params); err != nil {
+				t.Fatalf("sort=%s: cursor %s: %v", sort, next, err)
+			}
+		}
+		if itemIDs(got) != itemIDs(all) {
+			t.Errorf("sort=%s: pages = %s, want %s", sort, itemIDs(got), itemIDs(all))
+		}
+	}
+}
@@ -1,41 +1,245 @@
+// Route patterns with methods and wildcards (e.g. "GET /jobs/{id}") need the
+// Go 1.22 mux, which must be requested explicitly when building without a go.mod.
+//go:debug httpmuxgo121=0
+
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
-	"io"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"time"
+	"strconv"
 )
 
-// maxUploadSize sets a sane upper bound for CSV uploads (50 MB)
-const maxUploadSize = 50 << 20
-
 func main() {
+	cfg = loadConfig()
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
 
-	http.HandleFunc("/predict", handlePredict)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/scaling", handleScaling)
 
-	addr := ":8080"
-	log.Printf("Server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	handleAPI("GET /status", http.HandlerFunc(handleStatus))
+	handleAPI("GET /options", http.HandlerFunc(handleOptionsSchema))
+	handleAPI("/predict", protected(requiresEngine(handlePredict)))
+	handleAPI("POST /estimate", protected(handleEstimate))
+	handleAPI("POST /missing", protected(handleMissing))
+	handleAPI("POST /profile", protected(requiresFlag("profile", handleProfile)))
+	handleAPI("POST /duplicates", protected(handleDuplicates))
+	handleAPI("POST /suggestions", protected(requiresEngine(handleSuggestions)))
+	handleAPI("POST /summary", protected(requiresEngine(handleSummary)))
+	handleAPI("POST /aggregate", protected(handleAggregate))
+	handleAPI("POST /query", protected(requiresEngine(handleQuery)))
+	handleAPI("POST /join", protected(handleJoin))
+	handleAPI("POST /distribution", protected(handleDistribution))
+	handleAPI("POST /train", protected(requiresEngine(handleTrain)))
+	handleAPI("GET /models", protected(handleListModels))
+	handleAPI("GET /models/{id}", protected(handleGetModel))
+	handleAPI("DELETE /models/{id}", protected(handleDeleteModel))
+	handleAPI("GET /models/{id}/explanation", protected(handleGetModelExplanation))
+	handleAPI("POST /models/{id}/score", protected(requiresEngine(handleScoreModel)))
+	handleAPI("GET /baselines", protected(handleListBaselines))
+	handleAPI("POST /baselines", protected(handleCreateBaseline))
+	handleAPI("GET /baselines/{id}", protected(handleGetBaseline))
+	handleAPI("DELETE /baselines/{id}", protected(handleDeleteBaseline))
+	handleAPI("POST /baselines/{id}/drift", protected(handleDrift))
+	handleAPI("GET /datasets", protected(handleListDatasets))
+	handleAPI("POST /datasets", protected(handleCreateDataset))
+	handleAPI("DELETE /datasets/{id}", protected(handleDeleteDataset))
+	handleAPI("GET /datasets/{id}/expectations", protected(handleGetDatasetExpectations))
+	handleAPI("PUT /datasets/{id}/expectations", protected(handlePutDatasetExpectations))
+	handleAPI("GET /datasets/{id}/semantic_types", protected(handleGetDatasetSemanticTypes))
+	handleAPI("PUT /datasets/{id}/semantic_types", protected(handlePutDatasetSemanticTypes))
+	handleAPI("GET /datasets/{id}/reports", protected(handleListDatasetReports))
+	handleAPI("GET /datasets/{id}/reports/{version}", protected(handleGetDatasetReport))
+	handleAPI("GET /reports", protected(handleListReports))
+	handleAPI("GET /reports/{id}", protected(handleGetReport))
+	handleAPI("DELETE /reports/{id}", protected(handleDeleteReport))
+	handleAPI("GET /jobs", protected(handleListJobs))
+	handleAPI("GET /jobs/{id}", protected(handleGetJob))
+	handleAPI("POST /jobs/status", protected(handleBulkJobStatus))
+	handleAPI("GET /ws", protected(handleWebSocket))
+	handleAPI("GET /jobs/{id}/report", protected(handleGetJobReport))
+	handleAPI("GET /jobs/{id}/preview", protected(handleGetJobPreview))
+	handleAPI("GET /jobs/{id}/artifacts/{name}", protected(handleGetJobArtifact))
+	handleAPI("GET /jobs/{id}/expectations", protected(handleGetJobExpectations))
+	handleAPI("GET /jobs/{id}/schema", protected(requiresEngine(handleGetJobSchema)))
+	handleAPI("POST /jobs/{id}/rerun", protected(requiresEngine(handleRerunJob)))
+	handleAPI("POST /jobs/{id}/share", protected(handleCreateShare))
+	handleAPI("GET /jobs/{id}/shares", protected(handleListShares))
+	handleAPI("DELETE /jobs/{id}/shares/{share}", protected(handleRevokeShare))
+	// Share links authenticate with their token instead of credentials
+	handleAPI("GET /shared/{token}", ipFilter(http.HandlerFunc(handleShared)))
+	handleAPI("GET /jobs/{id}/logs", protected(requireAdmin(handleGetJobLogs)))
+	handleAPI("GET /admin/blobs", protected(requireAdmin(handleListBlobs)))
+	registerTus()
+	registerChunkedUploads()
+	registerDLQ()
+	registerQuarantine()
+	registerFeatureFlags()
+	registerPresets()
+	if err := loadEndpointPolicies(); err != nil {
+		log.Fatalf("endpoint policies: %v", err)
+	}
+	mountAPI(http.DefaultServeMux)
+
+	var err error
+	if workspaces, err = newWorkspaceManager(workspaceRoots(), cfg.WorkspaceLimit); err != nil {
+		log.Fatalf("workspaces: %v", err)
+	}
+	workspaces.minFree = cfg.WorkspaceMinFree
+	// Spooled uploads and the analyzers' temporary files go to the spool
+	// directory, or else to the first volume rather than the default
+	// temporary directory
+	if tmp := cfg.SpoolDir; tmp != "" || len(cfg.WorkspaceVolumes) > 0 {
+		if tmp == "" {
+			tmp = filepath.Join(workspaces.roots[0], "tmp")
+		}
+		if err := os.MkdirAll(tmp, 0o700); err != nil {
+			log.Fatalf("spool directory: %v", err)
+		}
+		os.Setenv("TMPDIR", tmp)
+	}
+	if cfg.UploadBufferSize <= 0 {
+		log.Fatalf("invalid DATASCRIBE_UPLOAD_BUFFER_SIZE=%d: want a positive size", cfg.UploadBufferSize)
+	}
+	if cfg.MemoryWorkspaceRoot != "" {
+		if memoryWorkspaces, err = newWorkspaceManager([]string{cfg.MemoryWorkspaceRoot}, cfg.WorkspaceLimit); err != nil {
+			log.Fatalf("memory workspaces: %v", err)
+		}
+	}
+	if cfg.DedupInputs {
+		// Each process has its own store, as its blobs are counted in memory
+		blobs := filepath.Join(workspaces.roots[0], "blobs", strconv.Itoa(os.Getpid()))
+		if inputBlobs, err = newBlobStore(blobs); err != nil {
+			log.Fatalf("input deduplication: %v", err)
+		}
+	}
+	if err := loadModels(); err != nil {
+		log.Fatalf("models: %v", err)
+	}
+	if err := loadBaselines(); err != nil {
+		log.Fatalf("baselines: %v", err)
+	}
+	if err := loadDatasets(); err != nil {
+		log.Fatalf("datasets: %v", err)
+	}
+	if cfg.ReportStoreDir != "" {
+		if store, err = openReportStore(cfg.ReportStoreDir); err != nil {
+			log.Fatalf("report store: %v", err)
+		}
+	}
+	if err := loadFeatureFlags(); err != nil {
+		log.Fatalf("feature flags: %v", err)
+	}
+	if err := loadPresets(); err != nil {
+		log.Fatalf("presets: %v", err)
+	}
+	if err := loadQuarantine(); err != nil {
+		log.Fatalf("quarantine: %v", err)
+	}
+	if err := loadExportConnectors(); err != nil {
+		log.Fatalf("export connectors: %v", err)
+	}
+	if err := checkCatalogConfig(); err != nil {
+		log.Fatalf("catalog: %v", err)
+	}
+	if err := openAuditLog(); err != nil {
+		log.Fatalf("audit log: %v", err)
+	}
+	if err := openAccessLog(); err != nil {
+		log.Fatalf("access log: %v", err)
+	}
+	if err := checkMetricLabels(); err != nil {
+		log.Fatalf("metric labels: %v", err)
+	}
+	if cfg.ErrorTrackerDSN != "" {
+		if tracker, err = startErrorTracker(cfg.ErrorTrackerDSN); err != nil {
+			log.Fatalf("error tracker: %v", err)
+		}
+	}
+	if cfg.SigningCertFile != "" || cfg.SigningKeyFile != "" {
+		if signer, err = loadReportSigner(cfg.SigningCertFile, cfg.SigningKeyFile); err != nil {
+			log.Fatalf("report signing: %v", err)
+		}
+	}
+	if cfg.Engine != "python" && cfg.Engine != "disabled" {
+		log.Fatalf("invalid DATASCRIBE_ENGINE=%q: want python or disabled", cfg.Engine)
+	}
+	if cfg.DisconnectMode != "cancel" && cfg.DisconnectMode != "async" {
+		log.Fatalf("invalid DATASCRIBE_DISCONNECT_MODE=%q: want cancel or async", cfg.DisconnectMode)
+	}
+	startWorkers(cfg.Workers)
+	if engineDisabled() {
+		log.Printf("the Python engine is disabled: only native endpoints are served")
+		startCanary(0)
+	} else {
+		startCanary(cfg.CanaryInterval)
+	}
+
+	// HTTP/2 is negotiated via ALPN over TLS; plaintext HTTP/2 (h2c) is
+	// opt-in for deployments behind a mesh that terminates TLS.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+	srv := &http.Server{Addr: cfg.Addr, Handler: accessLog(http.DefaultServeMux), Protocols: protocols}
+	l, err := listen()
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	useTLS := cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+	if useTLS {
+		// Loaded before signalReady, so that an upgraded process that
+		// cannot serve leaves the old one serving
+		if srv.TLSConfig, err = tlsConfig(); err != nil {
+			log.Fatalf("tls config: %v", err)
+		}
+		pair, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("tls certificate: %v", err)
+		}
+		srv.TLSConfig.Certificates = []tls.Certificate{pair}
+	}
+	go handleUpgrades(srv, l)
+	signalReady()
+	if useTLS {
+		log.Printf("Server listening on %s (TLS)", l.Addr())
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		if cfg.H2C {
+			log.Printf("Server listening on %s (h2c enabled)", l.Addr())
+		} else {
+			log.Printf("Server listening on %s", l.Addr())
+		}
+		err = srv.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		// An upgrade is draining the jobs and exits when done
+		select {}
+	}
+	log.Fatal(err)
+}
+
+// protected wraps h with the IP filter and authentication, in that order.
+func protected(h http.HandlerFunc) http.Handler {
+	return ipFilter(requireAuth(h))
 }
 
 // handlePredict accepts a multipart/form-data request with a 'file' field (CSV).
 // It invokes the local Python script (predict.py) to analyze the CSV and produce a PDF.
-// The PDF is streamed back to the client as application/pdf.
+// The PDF is served back to the client as application/pdf.
 func handlePredict(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Key-ID, X-Signature")
 
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
@@ -43,82 +247,61 @@ func handlePredict(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
 		http.Error(w, "Use POST with multipart/form-data (field name: file)", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Limit the size to avoid exhausting memory
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-
-	// Parse multipart form
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		http.Error(w, fmt.Sprintf("failed to parse form: %v", err), http.StatusBadRequest)
+	in, ok := receiveCSV(w, r, "predict")
+	if !ok {
 		return
 	}
-
-	file, header, err := r.FormFile("file")
+	// Clean up after the response is sent, even if the handler panics
+	defer in.ws.release()
+	disposition, err := reportDisposition(r, in.filename)
 	if err != nil {
-		http.Error(w, "missing 'file' field in form-data", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	// Create a working temp directory
-	workdir, err := os.MkdirTemp("", "predict_job_*")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create temp dir: %v", err), http.StatusInternalServerError)
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
 		return
 	}
-	// Clean up temp directory after response is sent
-	defer os.RemoveAll(workdir)
-
-	// Save uploaded CSV
-	inPath := filepath.Join(workdir, sanitizeFilename(header.Filename))
-	outPath := filepath.Join(workdir, "report.pdf")
-
-	inFile, err := os.Create(inPath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create temp file: %v", err), http.StatusInternalServerError)
+	if dryRun {
+		if err := in.ws.checkQuota(); err != nil {
+			writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+			return
+		}
+		res, err := newDryRunResult(in.path, in.filename, in.sha256, in.opts, "analyze the CSV and return the PDF report")
+		if err != nil {
+			writeOptionsError(w, err)
+			return
+		}
+		res.Input = in.input
+		writeJSON(w, http.StatusOK, res)
 		return
 	}
-	defer inFile.Close()
-
-	if _, err := io.Copy(inFile, file); err != nil {
-		http.Error(w, fmt.Sprintf("failed to save uploaded file: %v", err), http.StatusInternalServerError)
+	if canStreamReport(r, in.opts) {
+		streamReport(w, r, in, disposition)
 		return
 	}
+	outPath := in.ws.path("report.pdf")
 
 	// Run the Python analysis
-	cmd := exec.Command("python3", "predict.py", "--input", inPath, "--output", outPath)
-	cmd.Dir = "." // run from current directory; ensure predict.py is colocated with this binary
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	start := time.Now()
-	if err := cmd.Run(); err != nil {
-		http.Error(w, fmt.Sprintf("analysis failed: %v\n%s", err, stderr.String()), http.StatusInternalServerError)
+	if err := analyzeForRequest(r, in.path, outPath, in.filename, in.opts); err != nil {
+		if !errors.Is(err, errClientGone) {
+			quarantine(err, in.path, in.filename, identityFrom(r), r.Method+" "+r.URL.Path)
+			logAnalysisError(in.filename, err)
+			writeAnalysisError(w, err)
+		}
 		return
 	}
-	log.Printf("Analysis finished in %s", time.Since(start))
-
-	// Open and stream the resulting PDF
-	report, err := os.Open(outPath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to open generated PDF: %v", err), http.StatusInternalServerError)
+	if err := in.ws.checkQuota(); err != nil {
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
 		return
 	}
-	defer report.Close()
 
-	// Set headers for file download
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, "report.pdf"))
-	w.Header().Set("Cache-Control", "no-store")
-
-	// Stream the file efficiently
-	buf := bufio.NewReader(report)
-	if _, err := buf.WriteTo(w); err != nil {
-		log.Printf("error streaming pdf: %v", err)
-	}
+	serveReport(w, r, outPath, disposition)
 }
 
 // sanitizeFilename does minimal cleanup for an uploaded filename.
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests with the default configuration, which tests
+// change where they need to.
+func TestMain(m *testing.M) {
+	cfg = loadConfig()
+	os.Exit(m.Run())
+}
+
+func TestPredictMethods(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+	}{
+		{"OPTIONS", http.StatusOK},
+		{"HEAD", http.StatusMethodNotAllowed},
+		{"GET", http.StatusMethodNotAllowed},
+		{"PUT", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handlePredict(w, httptest.NewRequest(tt.method, "/predict", nil))
+		if w.Code != tt.status {
+			t.Errorf("%s /predict = %d, want %d", tt.method, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Content-Type"); got == "application/pdf" {
+			t.Errorf("%s /predict advertises a PDF", tt.method)
+		}
+		if tt.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "POST, OPTIONS" {
+			t.Errorf("%s /predict: Allow = %q, want POST, OPTIONS", tt.method, w.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With DATASCRIBE_JOB_MEMORY_LIMIT set, every analysis is held to a memory
+// budget shared by the buffers the server keeps for it and the resident
+// memory of the analyzer processes. The server reserves its buffers before
+// filling them, and the analyzer, with any processes it starts, is killed
+// once its resident set exceeds what is left. Either way the analysis fails
+// with memory_limit_exceeded instead of running the host out of memory.
+// The analyzer is also made the kernel's first choice should it run out of
+// memory anyway between two measurements.
+
+const (
+	codeMemoryExceeded = "memory_limit_exceeded"
+	memoryPollInterval = 100 * time.Millisecond
+)
+
+var memoryKills = newCounter("datascribe_analyzer_memory_kills_total", "Analyzer processes killed for exceeding the memory budget of their job.")
+
+// memoryBudget is the memory one analysis may use. A nil budget is
+// unlimited.
+type memoryBudget struct {
+	limit int64
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+type memoryBudgetKey struct{}
+
+// withMemoryBudget returns ctx with a new budget, unless it already has one
+// or no limit is configured.
+func withMemoryBudget(ctx context.Context) context.Context {
+	if cfg.JobMemoryLimit <= 0 || memoryBudgetFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, memoryBudgetKey{}, &memoryBudget{limit: cfg.JobMemoryLimit})
+}
+
+func memoryBudgetFrom(ctx context.Context) *memoryBudget {
+	b, _ := ctx.Value(memoryBudgetKey{}).(*memoryBudget)
+	return b
+}
+
+// memoryExceeded is the failure of an analysis over its budget.
+func memoryExceeded(format string, args ...any) *analysisError {
+	return &analysisError{Code: codeMemoryExceeded, Status: http.StatusRequestEntityTooLarge,
+		Message: fmt.Sprintf("dataset too large for configured memory: "+format, args...)}
+}
+
+// reserve takes n bytes of the budget for what, failing if they are not
+// left.
+func (b *memoryBudget) reserve(n int64, what string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reserved+n > b.limit {
+		return memoryExceeded("%s needs %d bytes, but only %d of the job's %d are left", what, n, b.limit-b.reserved, b.limit)
+	}
+	b.reserved += n
+	return nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.reserved -= n
+	b.mu.Unlock()
+}
+
+// available returns the bytes not reserved.
+func (b *memoryBudget) available() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit - b.reserved
+}
+
+// run runs cmd, killing it once the resident memory of it and its children
+// exceeds what is left of b. It reports whether it did.
+func (b *memoryBudget) run(cmd *exec.Cmd) (exceeded bool, err error) {
+	if b == nil {
+		return false, cmd.Run()
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	pid := cmd.Process.Pid
+	// Best effort: raising the score of a child needs no privileges
+	os.WriteFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid), []byte("1000"), 0)
+
+	var over atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(memoryPollInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			tree := processTree(pid)
+			var rss int64
+			for _, p := range tree {
+				rss += processRSS(p)
+			}
+			if limit := b.available(); rss > limit {
+				log.Printf("analyzer %d uses %d bytes, more than the %d left of its budget: killing it", pid, rss, limit)
+				over.Store(true)
+				memoryKills.inc()
+				for _, p := range tree {
+					syscall.Kill(p, syscall.SIGKILL)
+				}
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	return over.Load(), err
+}
+
+// processTree returns pid and the descendants of the process, as far as
+// they can still be read.
+func processTree(pid int) []int {
+	var tree []int
+	pending := []int{pid}
+	for len(pending) > 0 {
+		p := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		tree = append(tree, p)
+		lists, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", p))
+		for _, list := range lists {
+			data, _ := os.ReadFile(list)
+			for _, field := range strings.Fields(string(data)) {
+				if child, err := strconv.Atoi(field); err == nil {
+					pending = append(pending, child)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+// processRSS reads VmRSS from /proc/<pid>/status.
+func processRSS(pid int) int64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "VmRSS:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge exported on /metrics in the Prometheus text
+// format. Values are keyed by their rendered label set; gauges may instead
+// be computed at scrape time by fn.
+type metric struct {
+	name string
+	help string
+	kind string
+
+	mu     sync.Mutex
+	values map[string]float64
+	fn     func() float64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+func register(m *metric) *metric {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+	return m
+}
+
+// newCounter registers a monotonically increasing metric.
+func newCounter(name, help string) *metric {
+	return register(&metric{name: name, help: help, kind: "counter", values: map[string]float64{}})
+}
+
+// newGaugeFunc registers a gauge whose value is read from fn on every scrape.
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// labelValueEscaper escapes label values as the Prometheus text format
+// requires; everything else, UTF-8 included, is written as is.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderLabels turns key, value pairs into a Prometheus label set.
+func renderLabels(kv []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], labelValueEscaper.Replace(kv[i+1]))
+	}
+	return b.String()
+}
+
+// add increases the series identified by the key, value label pairs by v.
+func (m *metric) add(v float64, labels ...string) {
+	key := renderLabels(labels)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labels ...string) { m.add(1, labels...) }
+
+func (m *metric) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(b, "%s %g\n", m.name, m.fn())
+		return
+	}
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(b, "%s %g\n", m.name, m.values[k])
+		} else {
+			fmt.Fprintf(b, "%s{%s} %g\n", m.name, k, m.values[k])
+		}
+	}
+	m.mu.Unlock()
+}
+
+// handleMetrics writes every registered metric in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	registryMu.Lock()
+	for _, m := range registry {
+		m.write(&b)
+	}
+	registryMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
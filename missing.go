@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// missingReport is the response of POST /missing.
+type missingReport struct {
+	Rows    int             `json:"rows"`
+	Columns []columnMissing `json:"columns"`
+	// Correlation is the phi coefficient between the missingness of each
+	// pair of columns that are neither complete nor entirely missing.
+	Correlation     missingCorrelation `json:"correlation"`
+	RowCompleteness []rowCompleteness  `json:"row_completeness"`
+}
+
+type columnMissing struct {
+	Name       string  `json:"name"`
+	Missing    int     `json:"missing"`
+	MissingPct float64 `json:"missing_pct"`
+}
+
+type missingCorrelation struct {
+	Columns []string    `json:"columns"`
+	Matrix  [][]float64 `json:"matrix"`
+}
+
+// rowCompleteness counts the rows with a given number of missing values.
+type rowCompleteness struct {
+	MissingValues int     `json:"missing_values"`
+	Rows          int     `json:"rows"`
+	Pct           float64 `json:"pct"`
+}
+
+// handleMissing profiles the missing values of an uploaded CSV. The file is
+// streamed, so only per-column and per-pair counters are held in memory.
+func handleMissing(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "missing")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	report, err := profileMissing(in.path, in.opts)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func profileMissing(path string, opts analysisOptions) (*missingReport, error) {
+	t, err := openTable(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	n := len(t.Columns)
+	missing := make([]int, n)
+	both := map[[2]int]int{} // rows where both columns are missing
+	perRow := map[int]int{}  // missing values per row -> rows
+	rows := 0
+	var gaps []int
+	for {
+		row, err := t.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", rows+1, err)
+		}
+		rows++
+		gaps = gaps[:0]
+		for i, v := range row {
+			if isNA(v) {
+				missing[i]++
+				gaps = append(gaps, i)
+			}
+		}
+		for a := range gaps {
+			for b := a + 1; b < len(gaps); b++ {
+				both[[2]int{gaps[a], gaps[b]}]++
+			}
+		}
+		perRow[len(gaps)]++
+	}
+
+	report := &missingReport{Rows: rows, Columns: make([]columnMissing, n)}
+	for i, name := range t.Columns {
+		report.Columns[i] = columnMissing{Name: name, Missing: missing[i], MissingPct: pct(missing[i], rows)}
+	}
+
+	var partial []int
+	for i, m := range missing {
+		if m > 0 && m < rows {
+			partial = append(partial, i)
+		}
+	}
+	report.Correlation.Columns = make([]string, len(partial))
+	report.Correlation.Matrix = make([][]float64, len(partial))
+	for a, i := range partial {
+		report.Correlation.Columns[a] = t.Columns[i]
+		report.Correlation.Matrix[a] = make([]float64, len(partial))
+		for b, j := range partial {
+			if i == j {
+				report.Correlation.Matrix[a][b] = 1
+				continue
+			}
+			n11 := both[[2]int{min(i, j), max(i, j)}]
+			report.Correlation.Matrix[a][b] = phi(rows, missing[i], missing[j], n11)
+		}
+	}
+
+	for k, count := range perRow {
+		report.RowCompleteness = append(report.RowCompleteness, rowCompleteness{MissingValues: k, Rows: count, Pct: pct(count, rows)})
+	}
+	sort.Slice(report.RowCompleteness, func(a, b int) bool {
+		return report.RowCompleteness[a].MissingValues < report.RowCompleteness[b].MissingValues
+	})
+	return report, nil
+}
+
+// phi is the Pearson correlation of two binary indicators over n rows, given
+// how often each is set (n1, n2) and how often both are (n11).
+func phi(n, n1, n2, n11 int) float64 {
+	num := float64(n)*float64(n11) - float64(n1)*float64(n2)
+	den := math.Sqrt(float64(n1) * float64(n-n1) * float64(n2) * float64(n-n2))
+	return round4(num / den)
+}
+
+func pct(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return round4(100 * float64(part) / float64(total))
+}
+
+func round4(v float64) float64 { return math.Round(v*1e4) / 1e4 }
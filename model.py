@@ -0,0 +1,262 @@
+#!/usr/bin/env python3
+"""
+model.py
+--------
+Trains baseline predictive models on a CSV and scores new data with them.
+CSV loading (column selection, type hints, header handling) is shared with
+predict.py so models see the same data the reports describe.
+
+Usage:
+    python model.py train --input data.csv --target churned --model model.pkl --output metrics.json [--explain-pdf explain.pdf]
+    python model.py score --input new.csv --model model.pkl --output scored.csv [--format json]
+"""
+
+import argparse
+import json
+import pickle
+import sys
+
+import numpy as np
+import pandas as pd
+
+from predict import (EXIT_MALFORMED_CSV, EXIT_UNSUPPORTED_COLUMNS, UnsupportedColumnsError,
+                     infer_task, load_csv_to_df, select_columns, target_warnings)
+
+# Exit codes understood by the Go server (see analyzer.go)
+EXIT_INVALID_TARGET = 7
+
+
+class InvalidTargetError(Exception):
+    """Raised when the target column cannot be modelled."""
+
+
+def build_pipeline(X: pd.DataFrame, task: str):
+    from sklearn.compose import ColumnTransformer
+    from sklearn.ensemble import GradientBoostingClassifier, GradientBoostingRegressor
+    from sklearn.impute import SimpleImputer
+    from sklearn.pipeline import Pipeline
+    from sklearn.preprocessing import OneHotEncoder
+
+    numeric = X.select_dtypes(include=[np.number, "bool"]).columns.tolist()
+    categorical = [c for c in X.columns if c not in numeric]
+    pre = ColumnTransformer([
+        ("num", SimpleImputer(strategy="median"), numeric),
+        ("cat", Pipeline([
+            ("impute", SimpleImputer(strategy="most_frequent")),
+            ("onehot", OneHotEncoder(handle_unknown="ignore")),
+        ]), categorical),
+    ])
+    estimator = GradientBoostingClassifier() if task == "classification" else GradientBoostingRegressor()
+    return Pipeline([("pre", pre), ("model", estimator)])
+
+
+def evaluate(pipeline, X_test: pd.DataFrame, y_test: pd.Series, task: str) -> dict:
+    from sklearn import metrics
+
+    pred = pipeline.predict(X_test)
+    if task == "regression":
+        return {
+            "r2": float(metrics.r2_score(y_test, pred)),
+            "mae": float(metrics.mean_absolute_error(y_test, pred)),
+            "rmse": float(np.sqrt(metrics.mean_squared_error(y_test, pred))),
+        }
+    result = {
+        "accuracy": float(metrics.accuracy_score(y_test, pred)),
+        "f1_macro": float(metrics.f1_score(y_test, pred, average="macro")),
+    }
+    if y_test.nunique() == 2:
+        proba = pipeline.predict_proba(X_test)[:, 1]
+        positive = (y_test == pipeline.classes_[1]).astype(int)
+        result["roc_auc"] = float(metrics.roc_auc_score(positive, proba))
+    return result
+
+
+def feature_importances(pipeline, features) -> list:
+    """Sums the importances of one-hot encoded columns back onto their source column."""
+    pre = pipeline.named_steps["pre"]
+    importances = pipeline.named_steps["model"].feature_importances_
+    totals = {f: 0.0 for f in features}
+    for name, value in zip(pre.get_feature_names_out(), importances):
+        kind, _, column = name.partition("__")
+        if kind == "cat":
+            column = next((f for f in features if column.startswith(f"{f}_")), column)
+        totals[column] = totals.get(column, 0.0) + float(value)
+    ranked = sorted(totals.items(), key=lambda kv: kv[1], reverse=True)
+    return [{"feature": f, "importance": round(v, 6)} for f, v in ranked]
+
+
+def permutation_importances(pipeline, X_test: pd.DataFrame, y_test: pd.Series, seed: int = 0) -> list:
+    """Drop in held-out score when each column is shuffled, largest first."""
+    from sklearn.inspection import permutation_importance
+
+    result = permutation_importance(pipeline, X_test, y_test, n_repeats=5, random_state=seed)
+    ranked = sorted(zip(X_test.columns, result.importances_mean), key=lambda kv: kv[1], reverse=True)
+    return [{"feature": f, "importance": round(float(v), 6)} for f, v in ranked]
+
+
+def partial_dependence(pipeline, X: pd.DataFrame, column: str, task: str, points: int = 20):
+    """Average prediction as column sweeps over its quantiles, other columns unchanged."""
+    grid = np.unique(X[column].dropna().quantile(np.linspace(0, 1, points)).values)
+    sample = X.sample(min(len(X), 500), random_state=0)
+    averages = []
+    for value in grid:
+        varied = sample.copy()
+        varied[column] = value
+        if task == "classification" and len(pipeline.classes_) == 2:
+            averages.append(pipeline.predict_proba(varied)[:, 1].mean())
+        else:
+            averages.append(pd.to_numeric(pd.Series(pipeline.predict(varied)), errors="coerce").mean())
+    return grid, np.array(averages)
+
+
+def add_explanation_pages(pdf, pipeline, X: pd.DataFrame, summary: dict, max_effects: int = 4) -> None:
+    """Permutation importance chart and per-feature effect plots for a fitted model."""
+    import matplotlib.pyplot as plt
+
+    importances = summary["permutation_importances"][:15]
+    fig, ax = plt.subplots(figsize=(8.5, 6))
+    ax.barh([i["feature"] for i in reversed(importances)], [i["importance"] for i in reversed(importances)])
+    ax.set_title(f"What drives {summary['target']}: permutation importance")
+    ax.set_xlabel("Drop in held-out score when the feature is shuffled")
+    fig.tight_layout()
+    pdf.savefig(fig)
+    plt.close(fig)
+
+    numeric = set(X.select_dtypes(include=[np.number]).columns)
+    top = [i["feature"] for i in summary["permutation_importances"] if i["feature"] in numeric][:max_effects]
+    label = "Average predicted probability" if summary["task"] == "classification" else "Average prediction"
+    for column in top:
+        grid, averages = partial_dependence(pipeline, X, column, summary["task"])
+        fig, ax = plt.subplots(figsize=(8.5, 5))
+        ax.plot(grid, averages, marker="o")
+        ax.set_title(f"Effect of {column} on {summary['target']}")
+        ax.set_xlabel(column)
+        ax.set_ylabel(label)
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+
+
+def train(df: pd.DataFrame, target: str, seed: int = 0, explain: bool = False):
+    from sklearn.model_selection import train_test_split
+
+    if target not in df.columns:
+        raise InvalidTargetError(f"target column {target!r} is not in the data")
+    df = df[df[target].notna()]
+    if len(df) < 10:
+        raise InvalidTargetError("at least 10 rows with a target value are needed")
+    y = df[target]
+    X = df.drop(columns=[target])
+    if X.shape[1] == 0:
+        raise InvalidTargetError("there are no feature columns besides the target")
+    task = infer_task(y)
+    if task == "classification":
+        y = y.astype(str)
+        if y.nunique() < 2:
+            raise InvalidTargetError("the target has a single class")
+
+    stratify = y if task == "classification" and y.value_counts().min() >= 2 else None
+    X_train, X_test, y_train, y_test = train_test_split(X, y, test_size=0.2, random_state=seed, stratify=stratify)
+    pipeline = build_pipeline(X, task)
+    pipeline.fit(X_train, y_train)
+    summary = {
+        "task": task,
+        "target": target,
+        "features": X.columns.tolist(),
+        "rows": int(len(df)),
+        "metrics": evaluate(pipeline, X_test, y_test, task),
+        "feature_importances": feature_importances(pipeline, X.columns.tolist()),
+        "warnings": target_warnings(df, target),
+    }
+    if explain:
+        summary["permutation_importances"] = permutation_importances(pipeline, X_test, y_test, seed)
+    # Refit on all rows so the stored model uses every labelled example
+    pipeline.fit(X, y)
+    return pipeline, summary
+
+
+def score(df: pd.DataFrame, pipeline, features, column: str) -> pd.DataFrame:
+    """Returns df with the model's predictions appended as column."""
+    missing = [f for f in features if f not in df.columns]
+    if missing:
+        raise UnsupportedColumnsError(f"missing feature columns: {', '.join(missing)}")
+    scored = df.copy()
+    scored[column] = pipeline.predict(df[features])
+    return scored
+
+
+def write_scored(df: pd.DataFrame, path: str, fmt: str) -> None:
+    if fmt == "csv":
+        df.to_csv(path, index=False)
+        return
+    rows = df.astype(object).where(df.notna(), None).values.tolist()
+    with open(path, "w") as f:
+        json.dump({"columns": df.columns.tolist(), "rows": rows}, f, default=str)
+
+
+def add_data_args(p: argparse.ArgumentParser) -> None:
+    p.add_argument("--input", "-i", required=True, help="Path to input CSV")
+    p.add_argument("--include-column", action="append", default=[], metavar="NAME")
+    p.add_argument("--exclude-column", action="append", default=[], metavar="NAME")
+    p.add_argument("--types", type=json.loads, default={})
+    p.add_argument("--no-header", dest="has_header", action="store_false")
+    p.add_argument("--column-names", type=json.loads, default=None)
+
+
+def load(args) -> pd.DataFrame:
+    df = load_csv_to_df(args.input, args.types, args.has_header, args.column_names)
+    return select_columns(df, args.include_column, args.exclude_column)
+
+
+def parse_args() -> argparse.Namespace:
+    p = argparse.ArgumentParser()
+    sub = p.add_subparsers(dest="command", required=True)
+
+    t = sub.add_parser("train", help="Fit a baseline model and report its metrics")
+    add_data_args(t)
+    t.add_argument("--target", required=True, help="Column to predict")
+    t.add_argument("--model", required=True, help="Where to write the fitted model")
+    t.add_argument("--output", "-o", required=True, help="Where to write metrics as JSON")
+    t.add_argument("--explain-pdf", metavar="PATH", help="Also write importance and effect charts as a PDF")
+
+    s = sub.add_parser("score", help="Append a stored model's predictions to new rows")
+    add_data_args(s)
+    s.add_argument("--model", required=True, help="Fitted model written by train")
+    s.add_argument("--features", type=json.loads, required=True, help="JSON array of the model's feature columns")
+    s.add_argument("--column", default="prediction", help="Name of the appended column")
+    s.add_argument("--output", "-o", required=True, help="Where to write the scored rows")
+    s.add_argument("--format", choices=["csv", "json"], default="csv")
+    return p.parse_args()
+
+
+def main():
+    args = parse_args()
+    try:
+        df = load(args)
+        if args.command == "train":
+            pipeline, summary = train(df, args.target, explain=bool(args.explain_pdf))
+            if args.explain_pdf:
+                from matplotlib.backends.backend_pdf import PdfPages
+                with PdfPages(args.explain_pdf) as pdf:
+                    add_explanation_pages(pdf, pipeline, df[summary["features"]], summary)
+            with open(args.model, "wb") as f:
+                pickle.dump(pipeline, f)
+            with open(args.output, "w") as f:
+                json.dump(summary, f)
+        elif args.command == "score":
+            with open(args.model, "rb") as f:
+                pipeline = pickle.load(f)
+            write_scored(score(df, pipeline, args.features, args.column), args.output, args.format)
+    except (pd.errors.ParserError, pd.errors.EmptyDataError, UnicodeDecodeError) as e:
+        print(f"malformed CSV: {e}", file=sys.stderr)
+        sys.exit(EXIT_MALFORMED_CSV)
+    except UnsupportedColumnsError as e:
+        print(str(e), file=sys.stderr)
+        sys.exit(EXIT_UNSUPPORTED_COLUMNS)
+    except InvalidTargetError as e:
+        print(str(e), file=sys.stderr)
+        sys.exit(EXIT_INVALID_TARGET)
+
+
+if __name__ == "__main__":
+    main()
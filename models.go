@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// model is a trained baseline model as shown to its owner. The fitted
+// pipeline is stored as model.pkl in the model's directory under
+// cfg.ModelDir, next to its metadata.
+type model struct {
+	ID                 string              `json:"id"`
+	Task               string              `json:"task"`
+	Target             string              `json:"target"`
+	Features           []string            `json:"features"`
+	Rows               int                 `json:"rows"`
+	Metrics            map[string]float64  `json:"metrics"`
+	FeatureImportances []featureImportance `json:"feature_importances"`
+	// PermutationImportances are measured on the held-out rows when the
+	// model was trained with explain=true; its charts are then served by
+	// GET /models/{id}/explanation.
+	PermutationImportances []featureImportance `json:"permutation_importances,omitempty"`
+	// Warnings flag likely target leakage and severe class imbalance.
+	Warnings []targetWarning `json:"warnings"`
+	// DatasetSHA256 identifies the CSV the model was trained on.
+	DatasetSHA256 string    `json:"dataset_sha256"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	owner string
+}
+
+// codeMissingFeatures is returned when rows to score lack columns the model
+// was trained on.
+const codeMissingFeatures = "missing_features"
+
+type featureImportance struct {
+	Feature    string  `json:"feature"`
+	Importance float64 `json:"importance"`
+}
+
+// targetWarning is a red flag predict.py raises about a target column.
+type targetWarning struct {
+	// Kind is target_leakage or class_imbalance.
+	Kind   string `json:"kind"`
+	Column string `json:"column"`
+	Detail string `json:"detail"`
+}
+
+// modelRecord is the metadata persisted in meta.json.
+type modelRecord struct {
+	model
+	Owner string `json:"owner"`
+}
+
+var (
+	modelsMu sync.Mutex
+	models   = map[string]*model{}
+)
+
+func modelDir(id string) string       { return filepath.Join(cfg.ModelDir, id) }
+func (m *model) artifactPath() string { return filepath.Join(modelDir(m.ID), "model.pkl") }
+func (m *model) explanationPath() string {
+	return filepath.Join(modelDir(m.ID), "explanation.pdf")
+}
+
+// loadModels reads the metadata of every stored model.
+func loadModels() error {
+	if err := os.MkdirAll(cfg.ModelDir, 0o700); err != nil {
+		return err
+	}
+	metas, err := filepath.Glob(filepath.Join(cfg.ModelDir, "*", "meta.json"))
+	if err != nil {
+		return err
+	}
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	for _, path := range metas {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var rec modelRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("skipping model %s: %v", path, err)
+			continue
+		}
+		m := rec.model
+		m.owner = rec.Owner
+		models[m.ID] = &m
+	}
+	log.Printf("loaded %d models from %s", len(metas), cfg.ModelDir)
+	return nil
+}
+
+// saveModelMeta writes the metadata of m atomically.
+func saveModelMeta(m *model) error {
+	data, err := json.MarshalIndent(modelRecord{model: *m, Owner: m.owner}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(modelDir(m.ID), "meta.json.tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(modelDir(m.ID), "meta.json"))
+}
+
+// handleTrain fits a baseline gradient boosting model predicting the target
+// form field from the other columns of an uploaded CSV. Rows without a
+// target are ignored; 20% of the rest are held out for the metrics, after
+// which the model is refit on all of them and stored. explain=true also
+// measures permutation importance and renders the explanation charts.
+func handleTrain(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "train")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	target := in.opts.Target
+	if target == "" {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: "target is required", Code: codeInvalidTarget})
+		return
+	}
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	columns := t.Columns
+	t.Close()
+	if !slices.Contains(columns, target) {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: fmt.Sprintf("target column %q is not in the data", target), Code: codeInvalidTarget})
+		return
+	}
+
+	m := &model{ID: newID(), DatasetSHA256: in.sha256, owner: identityFrom(r)}
+	if err := os.MkdirAll(modelDir(m.ID), 0o700); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create model: %v", err), http.StatusInternalServerError)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			os.RemoveAll(modelDir(m.ID))
+		}
+	}()
+
+	summary := in.ws.path("summary.json")
+	args := append([]string{"train", "--input", in.path, "--target", target,
+		"--model", m.artifactPath(), "--output", summary}, in.opts.columnArgs()...)
+	if in.opts.Explain {
+		args = append(args, "--explain-pdf", m.explanationPath())
+	}
+	if _, err := runPython(context.Background(), "model.py", args...); err != nil {
+		logAnalysisError(in.filename, err)
+		writeAnalysisError(w, err)
+		return
+	}
+	data, err := os.ReadFile(summary)
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("training produced no summary: %v", err), http.StatusInternalServerError)
+		return
+	}
+	m.CreatedAt = time.Now().UTC()
+	if err := saveModelMeta(m); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store model: %v", err), http.StatusInternalServerError)
+		return
+	}
+	stored = true
+	modelsMu.Lock()
+	models[m.ID] = m
+	modelsMu.Unlock()
+
+	w.Header().Set("Location", apiPath(r, "/models/"+m.ID))
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// lookupModel returns the model named by the id path value, answering 404
+// when it does not exist or belongs to someone else.
+func lookupModel(w http.ResponseWriter, r *http.Request) (*model, bool) {
+	modelsMu.Lock()
+	m, ok := models[r.PathValue("id")]
+	modelsMu.Unlock()
+	if !ok || m.owner != identityFrom(r) {
+		http.Error(w, "model not found", http.StatusNotFound)
+		return nil, false
+	}
+	return m, true
+}
+
+// handleListModels returns a page of the caller's models, newest first unless
+// sorted otherwise; see listquery.go.
+func handleListModels(w http.ResponseWriter, r *http.Request) {
+	owner := identityFrom(r)
+	list := []model{}
+	modelsMu.Lock()
+	for _, m := range models {
+		if m.owner == owner {
+			list = append(list, *m)
+		}
+	}
+	modelsMu.Unlock()
+	modelList.serve(w, r, list)
+}
+
+var modelList = listSpec[model]{
+	name: "models",
+	id:   func(m model) string { return m.ID },
+	fields: []listField[model]{
+		textField("id", func(m model) string { return m.ID }),
+		textField("task", func(m model) string { return m.Task }),
+		textField("target", func(m model) string { return m.Target }),
+		numberField("rows", func(m model) float64 { return float64(m.Rows) }),
+		tagsField("features", func(m model) []string { return m.Features }),
+		timeField("created_at", func(m model) time.Time { return m.CreatedAt }),
+	},
+	defaultSort: "-created_at",
+}
+
+// handleGetModel returns the metadata and metrics of one model.
+func handleGetModel(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupModel(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleDeleteModel removes a model and its artifact from disk.
+func handleDeleteModel(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupModel(w, r)
+	if !ok {
+		return
+	}
+	modelsMu.Lock()
+	delete(models, m.ID)
+	modelsMu.Unlock()
+	if err := os.RemoveAll(modelDir(m.ID)); err != nil {
+		log.Printf("failed to remove model %s: %v", m.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetModelExplanation serves the explanation PDF of a model trained
+// with explain=true.
+func handleGetModelExplanation(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupModel(w, r)
+	if !ok {
+		return
+	}
+	if len(m.PermutationImportances) == 0 {
+		http.Error(w, "model was not trained with explain=true", http.StatusNotFound)
+		return
+	}
+	disposition, err := reportDisposition(r, m.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveReport(w, r, m.explanationPath(), disposition)
+}
+
+// handleScoreModel appends the predictions of a stored model to the rows of
+// an uploaded CSV, as a prediction column. The CSV needs every feature the
+// model was trained on; other columns are passed through. format=json
+// returns the rows as JSON instead of CSV.
+func handleScoreModel(w http.ResponseWriter, r *http.Request) {
+	m, ok := lookupModel(w, r)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(m.artifactPath()); err != nil {
+		http.Error(w, "model artifact is no longer available", http.StatusGone)
+		return
+	}
+	in, ok := receiveCSV(w, r, "score")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("unsupported format %q (want json or csv)", format), http.StatusBadRequest)
+		return
+	}
+	t, err := openTable(in.path, in.opts)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	columns := t.Columns
+	t.Close()
+	var missing []string
+	for _, f := range m.Features {
+		if !slices.Contains(columns, f) {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		writeJSON(w, http.StatusBadRequest, unknownColumnsBody{
+			errorBody: errorBody{Error: "missing feature columns: " + strings.Join(missing, ", "), Code: codeMissingFeatures},
+			Columns:   missing,
+		})
+		return
+	}
+	column := "prediction"
+	if slices.Contains(columns, column) {
+		column = m.Target + "_prediction"
+	}
+
+	features, _ := json.Marshal(m.Features)
+	scored := in.ws.path("scored." + format)
+	args := append([]string{"score", "--input", in.path, "--model", m.artifactPath(),
+		"--features", string(features), "--column", column, "--output", scored, "--format", format}, in.opts.columnArgs()...)
+	if _, err := runPython(context.Background(), "model.py", args...); err != nil {
+		logAnalysisError(in.filename, err)
+		writeAnalysisError(w, err)
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="scored.csv"`)
+	}
+	http.ServeFile(w, r, scored)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// tlsConfig builds the server TLS settings. When a client CA bundle is
+// configured, client certificates are verified against it and, with
+// DATASCRIBE_MTLS_REQUIRED, demanded during the handshake.
+func tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tc, nil
+	}
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.MTLSRequired {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// verifyClientCert authenticates r by its verified client certificate. The
+// identity is looked up in cfg.MTLSIdentities by URI SAN, DNS SAN, email SAN
+// or common name, in that order, falling back to the common name itself.
+func verifyClientCert(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", errNoCredentials
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	var names []string
+	for _, u := range leaf.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	names = append(names, leaf.Subject.CommonName)
+
+	for _, name := range names {
+		if id, ok := cfg.MTLSIdentities[name]; ok {
+			return "mtls:" + id, nil
+		}
+	}
+	if len(cfg.MTLSIdentities) > 0 {
+		return "", fmt.Errorf("client certificate %q is not mapped to an identity", leaf.Subject.CommonName)
+	}
+	if leaf.Subject.CommonName == "" {
+		return "", fmt.Errorf("client certificate has no common name")
+	}
+	return "mtls:" + leaf.Subject.CommonName, nil
+}
@@ -0,0 +1,876 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	codeUnknownColumns  = "unknown_columns"
+	codeInvalidTypeHint = "invalid_type_hint"
+	codeColumnCount     = "column_count_mismatch"
+	codeInvalidFields   = "invalid_fields"
+	codeDerivedExists   = "derived_column_exists"
+)
+
+var (
+	// errInvalidOptions matches every error returned by analysisOptions.validate.
+	errInvalidOptions   = errors.New("invalid analysis options")
+	errInvalidTypeHint  = errors.New("invalid type hint")
+	errUnreadableHeader = errors.New("cannot read CSV header")
+	errColumnCount      = errors.New("column_names does not match the number of columns")
+	errDerivedExists    = errors.New("derive would replace existing columns")
+)
+
+// analysisOptions tune what the analyzer looks at. They arrive as request
+// fields on /predict, query parameters on chunked uploads and metadata on
+// tus uploads, and are forwarded to predict.py as command-line flags.
+type analysisOptions struct {
+	IncludeColumns []string `json:"include_columns,omitempty"`
+	ExcludeColumns []string `json:"exclude_columns,omitempty"`
+	// Types overrides the inferred type of columns, e.g. {"ts": "datetime:%d/%m/%Y"}.
+	Types map[string]string `json:"types,omitempty"`
+	// SemanticTypes say what columns hold, e.g. {"price": "currency:EUR"};
+	// see semantic.go.
+	SemanticTypes map[string]string `json:"semantic_types,omitempty"`
+	// Units annotate numeric columns, e.g. {"latency": "ms", "price": "€"},
+	// in the tables and on the chart axes of the report.
+	Units map[string]string `json:"units,omitempty"`
+	// HasHeader set to false marks CSVs whose first row is data. Their
+	// columns are named by ColumnNames, or column_1, column_2, ... otherwise.
+	HasHeader *bool `json:"has_header,omitempty"`
+	// ColumnNames replaces the header row, or supplies a missing one.
+	ColumnNames []string `json:"column_names,omitempty"`
+	// MissingHeatmap adds a page showing where values are missing.
+	MissingHeatmap bool `json:"missing_heatmap,omitempty"`
+	// PDFA produces a PDF/A-2b report for archival.
+	PDFA bool `json:"pdfa,omitempty"`
+	// Charts limits the report to these charts and sections; empty means all.
+	Charts []string `json:"charts,omitempty"`
+	// ChartOptions tune individual charts, e.g. {"histograms": {"bins": 50}}.
+	ChartOptions map[string]map[string]any `json:"chart_options,omitempty"`
+	// TextColumns are analyzed as free text even when they would not be
+	// detected as such.
+	TextColumns []string `json:"text_columns,omitempty"`
+	// Target is the column a model would predict. With Explain the report
+	// fits a baseline model for it and shows what drives the predictions.
+	Target  string `json:"target,omitempty"`
+	Explain bool   `json:"explain,omitempty"`
+	// Delimiter separates the fields of an uploaded text file; it is
+	// detected when empty. Uploads are normalized to comma-separated CSV
+	// before analysis, so predict.py never sees it.
+	Delimiter string `json:"delimiter,omitempty"`
+	// Artifacts are the optional files a job produces besides its report,
+	// from jobArtifactOptions.
+	Artifacts []string `json:"artifacts,omitempty"`
+	// Anonymize maps columns to the transforms applied to them before
+	// analysis, e.g. {"email": "hash", "income": "bucket:10000"}.
+	Anonymize map[string]string `json:"anonymize,omitempty"`
+	// Derive adds columns computed from others, e.g.
+	// {"margin": "(revenue - cost) / revenue"}; see derive.go.
+	Derive map[string]string `json:"derive,omitempty"`
+	// Schema is a contract the upload must meet, a Frictionless Table
+	// Schema or JSON Schema document; see contract.go.
+	Schema string `json:"schema,omitempty"`
+	// Filter keeps only the rows matching an expression such as
+	// country == "DE" && amount > 0; see filter.go.
+	Filter string `json:"filter,omitempty"`
+	// DPEpsilon, when set, is the privacy budget of the JSON summary, which
+	// is then released with Laplace noise. DPBounds clip numeric columns to
+	// [lo, hi]; only bounded columns get a noisy mean.
+	DPEpsilon float64               `json:"dp_epsilon,omitempty"`
+	DPBounds  map[string][2]float64 `json:"dp_bounds,omitempty"`
+
+	// expectations are the results of the dataset's expectation suite,
+	// set by the job for the report.
+	expectations *expectationResults
+	// provenance is the job's provenance so far, for the report appendix.
+	provenance *jobProvenance
+}
+
+// maxDPEpsilon is the largest privacy budget accepted; beyond it the noise
+// no longer protects anyone.
+const maxDPEpsilon = 10
+
+// typeHints are the column types predict.py understands. "datetime" may
+// carry a strftime format after a colon.
+var typeHints = map[string]bool{
+	"string": true, "category": true, "integer": true, "float": true, "boolean": true, "datetime": true,
+}
+
+// chartOptions lists the report charts and sections predict.py can draw,
+// with the options each accepts.
+var chartOptions = map[string][]string{
+	"missingness":    nil,
+	"histograms":     {"max_columns", "bins", "log_scale"},
+	"categorical":    {"max_columns", "max_categories"},
+	"correlations":   {"max_columns"},
+	"boxplots":       {"max_columns", "log_scale"},
+	"violins":        {"max_columns", "log_scale"},
+	"density":        {"max_columns", "bins", "log_scale"},
+	"scatter_matrix": {"max_columns"},
+	"timeseries":     {"max_columns", "log_scale"},
+	"pie":            {"max_columns", "max_categories"},
+	"text":           nil,
+	"geo":            nil,
+	"datetime":       nil,
+}
+
+// parseAnalysisOptions reads the options with get, which looks up a request
+// field by name. Every invalid field is reported, as an *invalidFieldsError.
+func parseAnalysisOptions(get func(string) string) (analysisOptions, error) {
+	var opts analysisOptions
+	var errs invalidFieldsError
+	nameList := func(field string, dst *[]string) {
+		var err error
+		if *dst, err = parseNameList(field, get(field)); err != nil {
+			errs.add(field, err)
+		}
+	}
+	boolean := func(field string, dst *bool) bool {
+		v := get(field)
+		if v == "" {
+			return false
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs.add(field, fmt.Errorf("%s must be true or false", field), "true", "false")
+			return false
+		}
+		*dst = b
+		return true
+	}
+
+	nameList("include_columns", &opts.IncludeColumns)
+	nameList("exclude_columns", &opts.ExcludeColumns)
+	var err error
+	if opts.Types, err = parseTypeHints(get("types")); err != nil {
+		errs.add("types", err, typeHintNames()...)
+	}
+	if opts.SemanticTypes, err = parseSemanticTypes(get("semantic_types")); err != nil {
+		errs.add("semantic_types", err, semanticTypeNames()...)
+	}
+	for column, s := range opts.SemanticTypes {
+		hint, _, _ := strings.Cut(opts.Types[column], ":")
+		if textSemanticType(s) && hint != "" && hint != "string" && hint != "category" {
+			errs.add("types", fmt.Errorf("column %q is a %s and can only be typed string or category", column, s), "string", "category")
+		} else if !textSemanticType(s) && hint != "" && hint != "integer" && hint != "float" {
+			errs.add("types", fmt.Errorf("column %q is a %s and can only be typed integer or float", column, s), "integer", "float")
+		}
+	}
+	if opts.Units, err = parseUnits(get("units")); err != nil {
+		errs.add("units", err)
+	}
+	for column := range opts.Units {
+		if s := opts.SemanticTypes[column]; s != "" {
+			errs.add("units", fmt.Errorf("column %q has the semantic type %s, which sets its formatting", column, s))
+		}
+	}
+	var hasHeader bool
+	if boolean("has_header", &hasHeader) {
+		opts.HasHeader = &hasHeader
+	}
+	boolean("missing_heatmap", &opts.MissingHeatmap)
+	if boolean("pdfa", &opts.PDFA) && opts.PDFA && cfg.PDFAICCProfile == "" {
+		errs.add("pdfa", errors.New("pdfa is not available: this server has no PDF/A color profile configured"))
+	}
+	nameList("charts", &opts.Charts)
+	for _, name := range opts.Charts {
+		if _, ok := chartOptions[name]; !ok {
+			errs.add("charts", fmt.Errorf("unknown chart %q", name), chartNames()...)
+		}
+	}
+	if opts.ChartOptions, err = parseChartOptions(get("chart_options")); err != nil {
+		errs.add("chart_options", err)
+	}
+	nameList("text_columns", &opts.TextColumns)
+	opts.Target = strings.TrimSpace(get("target"))
+	boolean("explain", &opts.Explain)
+	nameList("column_names", &opts.ColumnNames)
+	for i, name := range opts.ColumnNames {
+		if slices.Contains(opts.ColumnNames[:i], name) {
+			errs.add("column_names", fmt.Errorf("column_names lists %q twice", name))
+		}
+	}
+	if opts.Explain && opts.Target == "" {
+		errs.add("explain", errors.New("explain needs a target column"))
+	}
+	if opts.Delimiter, err = parseDelimiter(get("delimiter")); err != nil {
+		errs.add("delimiter", err, delimiterNames()...)
+	}
+	if opts.Anonymize, err = parseAnonymize(get("anonymize")); err != nil {
+		errs.add("anonymize", err, anonymizeTransforms...)
+	}
+	for column := range opts.Anonymize {
+		// The transforms produce text
+		if hint := opts.Types[column]; hint != "" && hint != "string" && hint != "category" {
+			errs.add("types", fmt.Errorf("column %q is anonymized and can only be typed string or category", column), "string", "category")
+		}
+		if _, ok := opts.Units[column]; ok {
+			errs.add("units", fmt.Errorf("column %q is anonymized and has no unit", column))
+		}
+		if s := opts.SemanticTypes[column]; s != "" && !textSemanticType(s) {
+			errs.add("semantic_types", fmt.Errorf("column %q is anonymized and can only be an identifier or category", column), "identifier", "category")
+		}
+	}
+	if opts.Derive, err = parseDerive(get("derive")); err != nil {
+		errs.add("derive", err)
+	}
+	for _, column := range deriveUses(opts.Derive) {
+		if hint, _, _ := strings.Cut(opts.Types[column], ":"); hint != "" && hint != "integer" && hint != "float" {
+			errs.add("derive", fmt.Errorf("derive uses column %q, which is typed %s rather than as a number", column, hint))
+		}
+		if s := opts.SemanticTypes[column]; textSemanticType(s) {
+			errs.add("derive", fmt.Errorf("derive uses column %q, which is a %s rather than a number", column, s))
+		}
+		// The derived values would give the original ones away
+		if _, ok := opts.Anonymize[column]; ok {
+			errs.add("derive", fmt.Errorf("derive cannot use column %q, which is anonymized", column))
+		}
+	}
+	if opts.Schema = strings.TrimSpace(get("schema")); opts.Schema != "" {
+		if _, err := parseContract(opts.Schema); err != nil {
+			errs.add("schema", err)
+		}
+	}
+	if opts.Filter = strings.TrimSpace(get("filter")); opts.Filter != "" {
+		if _, err := parseFilter(opts.Filter); err != nil {
+			errs.add("filter", err)
+		}
+	}
+	if opts.DPEpsilon, err = parseDPEpsilon(get("dp_epsilon")); err != nil {
+		errs.add("dp_epsilon", err)
+	}
+	if opts.DPBounds, err = parseDPBounds(get("dp_bounds")); err != nil {
+		errs.add("dp_bounds", err)
+	} else if len(opts.DPBounds) > 0 && opts.DPEpsilon == 0 {
+		errs.add("dp_bounds", errors.New("dp_bounds needs dp_epsilon"))
+	}
+	nameList("artifacts", &opts.Artifacts)
+	for _, name := range opts.Artifacts {
+		if !slices.Contains(jobArtifactOptions, name) {
+			errs.add("artifacts", fmt.Errorf("unknown artifact %q", name), jobArtifactOptions...)
+		}
+	}
+	return opts, errs.orNil()
+}
+
+// decodeAnalysisOptions is parseAnalysisOptions for requests whose field
+// names are known: names that are neither analysis options nor listed in
+// extra are reported too, so that a typo such as "targt" is not silently
+// ignored.
+func decodeAnalysisOptions(get func(string) string, names, extra []string) (analysisOptions, error) {
+	opts, err := parseAnalysisOptions(get)
+	errs, _ := err.(*invalidFieldsError)
+	if errs == nil {
+		errs = &invalidFieldsError{}
+	}
+	known := slices.Concat(optionFieldNames(), extra)
+	sort.Strings(known)
+	sort.Strings(names)
+	for _, name := range names {
+		if slices.Contains(known, name) {
+			continue
+		}
+		reason := fmt.Sprintf("unknown field %q", name)
+		if guess := closestName(name, known); guess != "" {
+			reason += fmt.Sprintf("; did you mean %q?", guess)
+		}
+		errs.add(name, errors.New(reason), known...)
+	}
+	return opts, errs.orNil()
+}
+
+// closestName returns the name in candidates within two edits of name, if any.
+func closestName(name string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// fieldProblem is one invalid request field. Allowed lists the accepted
+// values or, for an unknown field, the accepted field names.
+type fieldProblem struct {
+	Field   string   `json:"field"`
+	Reason  string   `json:"reason"`
+	Allowed []string `json:"allowed,omitempty"`
+
+	err error
+}
+
+// invalidFieldsError reports every invalid field of a request.
+type invalidFieldsError struct {
+	Problems []fieldProblem
+}
+
+func (e *invalidFieldsError) add(field string, err error, allowed ...string) {
+	e.Problems = append(e.Problems, fieldProblem{Field: field, Reason: err.Error(), Allowed: allowed, err: err})
+}
+
+// orNil returns e, or nil when there are no problems.
+func (e *invalidFieldsError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *invalidFieldsError) Error() string {
+	reasons := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		reasons[i] = p.Reason
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func (e *invalidFieldsError) Unwrap() []error {
+	errs := make([]error, len(e.Problems))
+	for i, p := range e.Problems {
+		errs[i] = p.err
+	}
+	return errs
+}
+
+func typeHintNames() []string {
+	names := make([]string, 0, len(typeHints))
+	for name := range typeHints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func chartNames() []string {
+	names := make([]string, 0, len(chartOptions))
+	for name := range chartOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseChartOptions parses a JSON object of chart names to their options.
+// Counts must be integers between 1 and 1000 (50 for max_categories, which
+// keeps categorical charts readable) and log_scale a boolean.
+func parseChartOptions(v string) (map[string]map[string]any, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var options map[string]map[string]any
+	if err := json.Unmarshal([]byte(v), &options); err != nil {
+		return nil, fmt.Errorf("chart_options must be a JSON object of chart names to option objects")
+	}
+	for chart, opts := range options {
+		allowed, ok := chartOptions[chart]
+		if !ok {
+			return nil, fmt.Errorf("chart_options: unknown chart %q", chart)
+		}
+		for name, value := range opts {
+			if !slices.Contains(allowed, name) {
+				return nil, fmt.Errorf("chart_options[%q]: unsupported option %q", chart, name)
+			}
+			if name == "log_scale" {
+				if _, ok := value.(bool); !ok {
+					return nil, fmt.Errorf("chart_options[%q].log_scale must be true or false", chart)
+				}
+				continue
+			}
+			limit := 1000.0
+			if name == "max_categories" {
+				limit = 50
+			}
+			if n, ok := value.(float64); !ok || n != float64(int(n)) || n < 1 || n > limit {
+				return nil, fmt.Errorf("chart_options[%q].%s must be an integer between 1 and %g", chart, name, limit)
+			}
+		}
+	}
+	return options, nil
+}
+
+// parseTypeHints parses a JSON object mapping column names to type hints.
+func parseTypeHints(v string) (map[string]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var types map[string]string
+	if err := json.Unmarshal([]byte(v), &types); err != nil {
+		return nil, fmt.Errorf("%w: types must be a JSON object of column names to type hints", errInvalidTypeHint)
+	}
+	for col, hint := range types {
+		if err := checkTypeHint(hint); err != nil {
+			return nil, fmt.Errorf("%w: types[%q]: %w", errInvalidTypeHint, col, err)
+		}
+	}
+	return types, nil
+}
+
+func checkTypeHint(hint string) error {
+	name, format, hasFormat := strings.Cut(hint, ":")
+	if !typeHints[name] {
+		return fmt.Errorf("unknown type %q (want string, category, integer, float, boolean or datetime)", name)
+	}
+	if !hasFormat {
+		return nil
+	}
+	if name != "datetime" {
+		return fmt.Errorf("only datetime takes a format, got %q", hint)
+	}
+	return checkStrftime(format)
+}
+
+// checkStrftime rejects formats with no directives or with directives
+// Python's strptime does not know.
+func checkStrftime(format string) error {
+	directives := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i == len(format) {
+			return fmt.Errorf("datetime format %q ends with a lone %%", format)
+		}
+		if !strings.ContainsRune("aAwdbBmyYHIpMSfzZjUWcxX%GuV", rune(format[i])) {
+			return fmt.Errorf("datetime format %q has unknown directive %%%c", format, format[i])
+		}
+		directives++
+	}
+	if directives == 0 {
+		return fmt.Errorf("datetime format %q has no %% directives", format)
+	}
+	return nil
+}
+
+// namedDelimiters are the delimiters that may be given by name, which is
+// easier than sending a tab in a form field.
+var namedDelimiters = map[string]string{"comma": ",", "tab": "\t", "semicolon": ";", "pipe": "|"}
+
+func delimiterNames() []string {
+	names := make([]string, 0, len(namedDelimiters))
+	for name := range namedDelimiters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseDelimiter accepts a delimiter name, \t, or any single character
+// encoding/csv can split on. Spaces are significant.
+func parseDelimiter(v string) (string, error) {
+	if d, ok := namedDelimiters[strings.ToLower(v)]; ok {
+		return d, nil
+	}
+	if v == `\t` {
+		return "\t", nil
+	}
+	if v == "" {
+		return "", nil
+	}
+	if utf8.RuneCountInString(v) != 1 {
+		return "", fmt.Errorf("delimiter must be a single character or one of %s", strings.Join(delimiterNames(), ", "))
+	}
+	if r, _ := utf8.DecodeRuneInString(v); r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return "", fmt.Errorf("%q cannot be used as a delimiter", v)
+	}
+	return v, nil
+}
+
+// parseNameList accepts either a JSON array of strings, for names that
+// contain commas, or a comma-separated list.
+func parseNameList(field, v string) ([]string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	var names []string
+	if strings.HasPrefix(v, "[") {
+		if err := json.Unmarshal([]byte(v), &names); err != nil {
+			return nil, fmt.Errorf("%s must be a JSON array of strings or a comma-separated list", field)
+		}
+		return names, nil
+	}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (o analysisOptions) hasHeader() bool { return o.HasHeader == nil || *o.HasHeader }
+
+// columnNames returns ColumnNames for the prepared upload, which has the
+// derived columns appended.
+func (o analysisOptions) columnNames() []string {
+	if len(o.ColumnNames) == 0 {
+		return nil
+	}
+	return slices.Concat(o.ColumnNames, derivedNames(o.Derive))
+}
+
+// args returns the predict.py flags for the options. The contract and the
+// provenance can be larger than Linux allows a single argument, 128 KiB,
+// so they are written to files in dir and passed by path.
+func (o analysisOptions) args(dir string) ([]string, error) {
+	args := o.columnArgs()
+	if len(o.SemanticTypes) > 0 {
+		semantic, _ := json.Marshal(o.SemanticTypes)
+		args = append(args, "--semantic-types="+string(semantic))
+	}
+	if len(o.Units) > 0 {
+		units, _ := json.Marshal(o.Units)
+		args = append(args, "--units="+string(units))
+	}
+	if o.MissingHeatmap {
+		args = append(args, "--missing-heatmap")
+	}
+	for _, c := range o.TextColumns {
+		args = append(args, "--text-column="+c)
+	}
+	for _, c := range o.Charts {
+		args = append(args, "--chart="+c)
+	}
+	if o.PDFA {
+		args = append(args, "--pdfa")
+	}
+	if len(o.Anonymize) > 0 {
+		policy, _ := json.Marshal(o.Anonymize)
+		args = append(args, "--anonymized="+string(policy))
+	}
+	if o.Schema != "" {
+		path, err := writeArgFile(dir, "contract.json", contractSummary(o.Schema))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--contract-file="+path)
+	}
+	if len(o.Derive) > 0 {
+		derive, _ := json.Marshal(o.Derive)
+		args = append(args, "--derived="+string(derive))
+	}
+	if o.Filter != "" {
+		args = append(args, "--filtered="+o.Filter)
+	}
+	if o.DPEpsilon > 0 {
+		args = append(args, "--dp-epsilon="+strconv.FormatFloat(o.DPEpsilon, 'g', -1, 64))
+	}
+	if len(o.DPBounds) > 0 {
+		bounds, _ := json.Marshal(o.DPBounds)
+		args = append(args, "--dp-bounds="+string(bounds))
+	}
+	if o.provenance != nil {
+		path, err := writeArgFile(dir, "provenance.json", o.provenance)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--provenance-file="+path)
+	}
+	if o.expectations != nil {
+		results, _ := json.Marshal(o.expectations)
+		args = append(args, "--expectations="+string(results))
+	}
+	if len(o.ChartOptions) > 0 {
+		options, _ := json.Marshal(o.ChartOptions)
+		args = append(args, "--chart-options="+string(options))
+	}
+	if o.Target != "" {
+		args = append(args, "--target="+o.Target)
+	}
+	if o.Explain {
+		args = append(args, "--explain")
+	}
+	return args, nil
+}
+
+// writeArgFile writes v as JSON to the file name in dir, for a predict.py
+// flag that takes a file, and returns its path.
+func writeArgFile(dir, name string, v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// columnArgs returns the flags that shape the loaded data: column selection,
+// type hints and header handling. model.py accepts these too.
+func (o analysisOptions) columnArgs() []string {
+	var args []string
+	for _, c := range o.IncludeColumns {
+		args = append(args, "--include-column="+c)
+	}
+	for _, c := range o.ExcludeColumns {
+		args = append(args, "--exclude-column="+c)
+	}
+	if len(o.Types) > 0 {
+		types, _ := json.Marshal(o.Types)
+		args = append(args, "--types="+string(types))
+	}
+	return append(args, o.headerArgs()...)
+}
+
+// headerArgs returns the flags describing the header row, which every
+// script reading the CSV understands.
+func (o analysisOptions) headerArgs() []string {
+	var args []string
+	if !o.hasHeader() {
+		args = append(args, "--no-header")
+	}
+	if len(o.ColumnNames) > 0 {
+		names, _ := json.Marshal(o.columnNames())
+		args = append(args, "--column-names="+string(names))
+	}
+	return args
+}
+
+// unknownColumnsError lists requested columns missing from the CSV header.
+type unknownColumnsError struct {
+	Columns []string
+}
+
+func (e *unknownColumnsError) Error() string {
+	return "unknown columns: " + strings.Join(e.Columns, ", ")
+}
+
+func (e *unknownColumnsError) Is(target error) bool { return target == errInvalidOptions }
+
+// validate checks the options against the CSV at path, so typos are
+// reported before the analyzer runs.
+func (o analysisOptions) validate(path string) error {
+	if len(o.IncludeColumns) == 0 && len(o.ExcludeColumns) == 0 && len(o.Types) == 0 && len(o.ColumnNames) == 0 &&
+		len(o.SemanticTypes) == 0 && len(o.Units) == 0 && len(o.TextColumns) == 0 && len(o.Anonymize) == 0 && len(o.DPBounds) == 0 && o.Filter == "" &&
+		len(o.Derive) == 0 {
+		return nil
+	}
+	header, err := readCSVHeader(path)
+	if err != nil {
+		return err
+	}
+	if !o.hasHeader() {
+		for i := range header {
+			header[i] = "column_" + strconv.Itoa(i+1)
+		}
+	}
+	if len(o.ColumnNames) > 0 {
+		if len(o.ColumnNames) != len(header) {
+			return fmt.Errorf("%w: %w (%d names for %d columns)", errInvalidOptions, errColumnCount, len(o.ColumnNames), len(header))
+		}
+		header = o.ColumnNames
+	}
+	known := make(map[string]bool, len(header))
+	for _, name := range header {
+		known[name] = true
+	}
+	var clashes []string
+	for _, name := range derivedNames(o.Derive) {
+		if known[name] {
+			clashes = append(clashes, name)
+		}
+	}
+	if len(clashes) > 0 {
+		return fmt.Errorf("%w: %w %s", errInvalidOptions, errDerivedExists, strings.Join(clashes, ", "))
+	}
+	// The other options can refer to derived columns
+	for _, name := range derivedNames(o.Derive) {
+		known[name] = true
+	}
+	typed := make([]string, 0, len(o.Types))
+	for name := range o.Types {
+		typed = append(typed, name)
+	}
+	for name := range o.SemanticTypes {
+		if _, ok := o.Types[name]; !ok {
+			typed = append(typed, name)
+		}
+	}
+	sort.Strings(typed)
+	anonymized := make([]string, 0, len(o.Anonymize))
+	for name := range o.Anonymize {
+		anonymized = append(anonymized, name)
+	}
+	sort.Strings(anonymized)
+	bounded := make([]string, 0, len(o.DPBounds))
+	for name := range o.DPBounds {
+		bounded = append(bounded, name)
+	}
+	sort.Strings(bounded)
+	annotated := make([]string, 0, len(o.Units))
+	for name := range o.Units {
+		annotated = append(annotated, name)
+	}
+	sort.Strings(annotated)
+
+	e := &unknownColumnsError{}
+	for _, names := range [][]string{o.IncludeColumns, o.ExcludeColumns, typed, o.TextColumns, anonymized, bounded,
+		annotated, filterColumns(o.Filter), deriveUses(o.Derive)} {
+		for _, name := range names {
+			if !known[name] && !slices.Contains(e.Columns, name) {
+				e.Columns = append(e.Columns, name)
+			}
+		}
+	}
+	if len(e.Columns) > 0 {
+		return e
+	}
+	return nil
+}
+
+// readCSVHeader returns the fields of the first row of the CSV at path.
+func readCSVHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", errInvalidOptions, errUnreadableHeader, err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	return header, nil
+}
+
+// unknownColumnsBody is the 400 response for an unknownColumnsError.
+type unknownColumnsBody struct {
+	errorBody
+	Columns []string `json:"columns"`
+}
+
+// invalidFieldsBody is the 400 response for an invalidFieldsError.
+type invalidFieldsBody struct {
+	errorBody
+	Problems []fieldProblem `json:"problems"`
+}
+
+// writeOptionsError sends an options parsing or validation error as a 400
+// response.
+func writeOptionsError(w http.ResponseWriter, err error) {
+	var e *unknownColumnsError
+	var fe *invalidFieldsError
+	switch {
+	case errors.As(err, &fe):
+		code := codeInvalidFields
+		// A lone bad type hint keeps the code it always had
+		if len(fe.Problems) == 1 && errors.Is(err, errInvalidTypeHint) {
+			code = codeInvalidTypeHint
+		}
+		writeJSON(w, http.StatusBadRequest, invalidFieldsBody{
+			errorBody: errorBody{Error: fe.Error(), Code: code},
+			Problems:  fe.Problems,
+		})
+	case errors.As(err, &e):
+		writeJSON(w, http.StatusBadRequest, unknownColumnsBody{
+			errorBody: errorBody{Error: e.Error(), Code: codeUnknownColumns},
+			Columns:   e.Columns,
+		})
+	case errors.Is(err, errInvalidTypeHint):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error(), Code: codeInvalidTypeHint})
+	case errors.Is(err, errColumnCount):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error(), Code: codeColumnCount})
+	case errors.Is(err, errDerivedExists):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error(), Code: codeDerivedExists})
+	case errors.Is(err, errUnreadableHeader):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+	default:
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error()})
+	}
+}
+
+// parseDPEpsilon parses the privacy budget of the dp_epsilon option.
+func parseDPEpsilon(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	eps, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(eps > 0) || eps > maxDPEpsilon {
+		return 0, fmt.Errorf("dp_epsilon must be a number greater than 0 and at most %d", maxDPEpsilon)
+	}
+	return eps, nil
+}
+
+// maxUnitLength bounds a unit, which is a label such as ms, GB or €.
+const maxUnitLength = 16
+
+// parseUnits parses a JSON object mapping columns to their units.
+func parseUnits(v string) (map[string]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var units map[string]string
+	if err := json.Unmarshal([]byte(v), &units); err != nil {
+		return nil, errors.New(`units must be a JSON object of column names to units, e.g. {"latency": "ms"}`)
+	}
+	for column, unit := range units {
+		if unit = strings.TrimSpace(unit); unit == "" || len(unit) > maxUnitLength || strings.ContainsFunc(unit, unicode.IsControl) {
+			return nil, fmt.Errorf("units[%q] must be a label of 1 to %d bytes, such as ms or €", column, maxUnitLength)
+		}
+		units[column] = unit
+	}
+	return units, nil
+}
+
+// parseDPBounds parses a JSON object mapping numeric columns to their
+// [lo, hi] value bounds.
+func parseDPBounds(v string) (map[string][2]float64, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var pairs map[string][]float64
+	if err := json.Unmarshal([]byte(v), &pairs); err != nil {
+		return nil, errors.New(`dp_bounds must be a JSON object of column names to [lo, hi] pairs, e.g. {"age": [0, 120]}`)
+	}
+	bounds := make(map[string][2]float64, len(pairs))
+	for column, b := range pairs {
+		if len(b) != 2 {
+			return nil, fmt.Errorf("dp_bounds[%q] must be a [lo, hi] pair", column)
+		}
+		if !(b[0] < b[1]) {
+			return nil, fmt.Errorf("dp_bounds[%q]: lo must be less than hi", column)
+		}
+		bounds[column] = [2]float64{b[0], b[1]}
+	}
+	return bounds, nil
+}
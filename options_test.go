@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAnalysisOptions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string // the fields reported, in order
+	}{
+		{query: "target=churn&explain=true&charts=histograms,pie&delimiter=tab"},
+		{query: "targt=churn", want: []string{"targt"}},
+		{query: "explain=yes&charts=histogram&delimiter=ab", want: []string{"charts", "explain", "delimiter"}},
+		{query: "explain=true", want: []string{"explain"}},
+		{query: "types=%7B%22a%22%3A%22date%22%7D&units=%7B%22a%22%3A%22%22%7D", want: []string{"types", "units"}},
+		{query: "column_names=a,b,a&dp_bounds=%7B%22a%22%3A%5B0%2C1%5D%7D", want: []string{"column_names", "dp_bounds"}},
+		{query: "artifacts=report.pdf&dp_epsilon=11", want: []string{"dp_epsilon", "artifacts"}},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		_, err := decodeAnalysisOptions(q.Get, slices.Collect(maps.Keys(q)), nil)
+		var fields []string
+		var fe *invalidFieldsError
+		if errors.As(err, &fe) {
+			for _, p := range fe.Problems {
+				fields = append(fields, p.Field)
+			}
+		}
+		if !slices.Equal(fields, tt.want) {
+			t.Errorf("%s: invalid fields %q (%v), want %q", tt.query, fields, err, tt.want)
+		}
+	}
+
+	_, err := decodeAnalysisOptions(url.Values{"targt": {"x"}}.Get, []string{"targt"}, nil)
+	if err == nil || !strings.Contains(err.Error(), `did you mean "target"?`) {
+		t.Errorf("misspelled target: error = %v, want a suggestion", err)
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"tab", "\t", true},
+		{"Semicolon", ";", true},
+		{`\t`, "\t", true},
+		{" ", " ", true},
+		{"§", "§", true},
+		{`"`, "", false},
+		{"\n", "", false},
+		{",,", "", false},
+		{"\xff", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseDelimiter(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseDelimiter(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseChartOptions(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{in: ""},
+		{in: `{"histograms": {"bins": 50, "log_scale": true}, "pie": {"max_categories": 50}}`},
+		{in: `[]`, wantErr: "chart_options must be a JSON object"},
+		{in: `{"bars": {}}`, wantErr: `unknown chart "bars"`},
+		{in: `{"pie": {"bins": 5}}`, wantErr: `chart_options["pie"]: unsupported option "bins"`},
+		{in: `{"pie": {"max_categories": 51}}`, wantErr: "between 1 and 50"},
+		{in: `{"histograms": {"bins": 2.5}}`, wantErr: "between 1 and 1000"},
+		{in: `{"histograms": {"bins": 0}}`, wantErr: "between 1 and 1000"},
+		{in: `{"density": {"log_scale": "yes"}}`, wantErr: "log_scale must be true or false"},
+	}
+	for _, tt := range tests {
+		_, err := parseChartOptions(tt.in)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseChartOptions(%s) = %v, want %q", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckTypeHint(t *testing.T) {
+	tests := []struct {
+		hint    string
+		wantErr string
+	}{
+		{hint: "integer"},
+		{hint: "datetime"},
+		{hint: "datetime:%d/%m/%Y %H:%M"},
+		{hint: "date", wantErr: `unknown type "date"`},
+		{hint: "float:%f", wantErr: "only datetime takes a format"},
+		{hint: "datetime:%Q", wantErr: "unknown directive %Q"},
+		{hint: "datetime:%Y%", wantErr: "ends with a lone %"},
+		{hint: "datetime:dd/mm", wantErr: "has no % directives"},
+	}
+	for _, tt := range tests {
+		err := checkTypeHint(tt.hint)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkTypeHint(%q) = %v, want %q", tt.hint, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseNameList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a, b,,c ", []string{"a", "b", "c"}},
+		{`["a, b", "c"]`, []string{"a, b", "c"}},
+	}
+	for _, tt := range tests {
+		if got, err := parseNameList("charts", tt.in); err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parseNameList(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := parseNameList("charts", `["a", 1]`); err == nil {
+		t.Errorf("parseNameList of a mixed array succeeded")
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	names := []string{"charts", "explain", "target"}
+	for in, want := range map[string]string{"targt": "target", "chrts": "charts", "explian": "explain", "xyz": "", "": ""} {
+		if got := closestName(in, names); got != want {
+			t.Errorf("closestName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
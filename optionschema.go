@@ -0,0 +1,172 @@
+package main
+
+import "net/http"
+
+// optionField documents one form field read by parseAnalysisOptions. The
+// list below is the source of GET /options; keep it in step with the parser.
+type optionField struct {
+	name        string
+	description string
+	schema      func() map[string]any
+}
+
+// Form encodings of option values, reported as x-form-encoding.
+const (
+	encodingBool     = "true or false"
+	encodingNameList = "comma-separated list, or a JSON array for names containing commas"
+	encodingJSON     = "JSON"
+	encodingText     = "plain text"
+)
+
+var analysisOptionFields = []optionField{
+	{"include_columns", "Only analyze these columns, in this order.", nameListSchema},
+	{"exclude_columns", "Leave these columns out of the analysis.", nameListSchema},
+	{"types", "Override the inferred type of columns, e.g. {\"ts\": \"datetime:%d/%m/%Y\"}.", typesSchema},
+	{"semantic_types", "What columns hold: currency[:CODE], percentage[:ratio], identifier or category, e.g. {\"price\": \"currency:EUR\"}.", func() map[string]any {
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"anyOf": []any{
+			map[string]any{"enum": semanticTypeNames()},
+			map[string]any{"type": "string", "pattern": "^currency:[A-Z]{3}$", "description": "currency with its ISO 4217 code"},
+			map[string]any{"const": "percentage:ratio", "description": "percentage stored as a ratio from 0 to 1"},
+		}}, "x-form-encoding": encodingJSON}
+	}},
+	{"units", "Units of numeric columns for the tables and chart axes of the report, e.g. {\"latency\": \"ms\", \"price\": \"€\"}.", func() map[string]any {
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string", "minLength": 1, "maxLength": maxUnitLength},
+			"x-form-encoding": encodingJSON}
+	}},
+	{"has_header", "Set to false when the first row is data rather than column names.", boolSchema(true)},
+	{"column_names", "Names for the columns, replacing the header row or supplying a missing one.", nameListSchema},
+	{"missing_heatmap", "Add a page showing where values are missing.", boolSchema(false)},
+	{"pdfa", "Produce a PDF/A-2b report for archival.", pdfaSchema},
+	{"charts", "Limit the report to these charts and sections; all when empty.", chartsSchema},
+	{"chart_options", "Tune individual charts, e.g. {\"histograms\": {\"bins\": 50}}.", chartOptionsSchema},
+	{"text_columns", "Analyze these columns as free text.", nameListSchema},
+	{"target", "The column a model would predict.", func() map[string]any {
+		return map[string]any{"type": "string", "x-form-encoding": encodingText}
+	}},
+	{"explain", "Fit a baseline model for target and show what drives its predictions; needs target.", boolSchema(false)},
+	{"delimiter", "Field separator of a delimited text upload, detected when not given.", delimiterSchema},
+	{"anonymize", "Transform columns before analysis: hash, mask[:N], month, year or bucket:W.", func() map[string]any {
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"anyOf": []any{
+			map[string]any{"enum": []string{"hash", "mask", "month", "year"}},
+			map[string]any{"type": "string", "pattern": `^mask:[0-9]+$`, "description": "mask all but the last N characters"},
+			map[string]any{"type": "string", "pattern": `^bucket:[0-9.eE+]+$`, "description": "intervals of width W"},
+		}}, "x-form-encoding": encodingJSON}
+	}},
+	{"derive", "Add columns computed from others, e.g. {\"margin\": \"(revenue - cost) / revenue\"}.", func() map[string]any {
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string", "maxLength": maxExprLen},
+			"maxProperties": maxDerivedColumns, "x-form-encoding": encodingJSON}
+	}},
+	{"schema", "A contract the upload must meet, as a Frictionless Table Schema or a JSON Schema of a row; violations are listed in a 422 response.", func() map[string]any {
+		return map[string]any{"type": "object", "x-form-encoding": encodingJSON}
+	}},
+	{"filter", "Only analyze the rows matching an expression, e.g. country == \"DE\" && amount > 0.", func() map[string]any {
+		return map[string]any{"type": "string", "maxLength": maxExprLen, "x-form-encoding": encodingText}
+	}},
+	{"dp_epsilon", "Release the JSON summary with differential privacy, spending this privacy budget.", func() map[string]any {
+		return map[string]any{"type": "number", "exclusiveMinimum": 0, "maximum": maxDPEpsilon, "x-form-encoding": encodingText}
+	}},
+	{"dp_bounds", "Value bounds of numeric columns, e.g. {\"age\": [0, 120]}; only bounded columns get a private mean. Needs dp_epsilon.", func() map[string]any {
+		pair := map[string]any{"type": "array", "items": map[string]any{"type": "number"}, "minItems": 2, "maxItems": 2}
+		return map[string]any{"type": "object", "additionalProperties": pair, "x-form-encoding": encodingJSON}
+	}},
+	{"artifacts", "Optional files a job produces besides its report, served from /jobs/{id}/artifacts/{name}.", func() map[string]any {
+		return map[string]any{"type": "array", "items": map[string]any{"enum": jobArtifactOptions}, "uniqueItems": true,
+			"x-form-encoding": encodingNameList}
+	}},
+}
+
+func optionFieldNames() []string {
+	names := make([]string, len(analysisOptionFields))
+	for i, f := range analysisOptionFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+func nameListSchema() map[string]any {
+	return map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "x-form-encoding": encodingNameList}
+}
+
+func boolSchema(def bool) func() map[string]any {
+	return func() map[string]any {
+		return map[string]any{"type": "boolean", "default": def, "x-form-encoding": encodingBool}
+	}
+}
+
+func typesSchema() map[string]any {
+	hints := typeHintNames()
+	return map[string]any{
+		"type": "object",
+		"additionalProperties": map[string]any{"anyOf": []any{
+			map[string]any{"enum": hints},
+			map[string]any{"type": "string", "pattern": "^datetime:.*%", "description": "datetime with a strftime format"},
+		}},
+		"x-form-encoding": encodingJSON,
+	}
+}
+
+func pdfaSchema() map[string]any {
+	s := boolSchema(false)()
+	// Only servers with a color profile can produce PDF/A
+	s["x-available"] = cfg.PDFAICCProfile != ""
+	return s
+}
+
+func chartsSchema() map[string]any {
+	return map[string]any{"type": "array", "items": map[string]any{"enum": chartNames()}, "uniqueItems": true,
+		"x-form-encoding": encodingNameList}
+}
+
+func delimiterSchema() map[string]any {
+	return map[string]any{"anyOf": []any{
+		map[string]any{"enum": delimiterNames()},
+		map[string]any{"type": "string", "minLength": 1, "maxLength": 1, "description": "a single character"},
+	}, "x-form-encoding": encodingText}
+}
+
+// chartOptionsSchema mirrors the limits enforced by parseChartOptions.
+func chartOptionsSchema() map[string]any {
+	charts := map[string]any{}
+	for _, chart := range chartNames() {
+		props := map[string]any{}
+		for _, name := range chartOptions[chart] {
+			switch name {
+			case "log_scale":
+				props[name] = map[string]any{"type": "boolean"}
+			case "max_categories":
+				props[name] = map[string]any{"type": "integer", "minimum": 1, "maximum": 50}
+			default:
+				props[name] = map[string]any{"type": "integer", "minimum": 1, "maximum": 1000}
+			}
+		}
+		charts[chart] = map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]any{"type": "object", "properties": charts, "additionalProperties": false,
+		"x-form-encoding": encodingJSON}
+}
+
+// analysisOptionsSchema returns a JSON Schema of the analysis options.
+// Values are described by their meaning; x-form-encoding tells how each is
+// written as a form field.
+func analysisOptionsSchema() map[string]any {
+	props := map[string]any{}
+	for _, f := range analysisOptionFields {
+		s := f.schema()
+		s["description"] = f.description
+		props[f.name] = s
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "DataScribe analysis options",
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// handleOptionsSchema serves the JSON Schema of the analysis options, so
+// clients can build their forms from it.
+func handleOptionsSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, analysisOptionsSchema())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const codePDFAFailed = "pdfa_conversion_failed"
+
+// pdfaDef is the PostScript prologue declaring the output intent that
+// PDF/A requires, after Ghostscript's lib/PDFA_def.ps.
+const pdfaDef = `%%!
+/ICCProfile (%s) def
+[/Title (DataScribe report) /Creator (DataScribe) /DOCINFO pdfmark
+[/_objdef {icc_PDFA} /type /stream /OBJ pdfmark
+[{icc_PDFA} << /N 3 >> /PUT pdfmark
+[{icc_PDFA} ICCProfile (r) file /PUT pdfmark
+[/_objdef {OutputIntent_PDFA} /type /dict /OBJ pdfmark
+[{OutputIntent_PDFA} <<
+  /Type /OutputIntent
+  /S /GTS_PDFA1
+  /DestOutputProfile {icc_PDFA}
+  /OutputConditionIdentifier (sRGB)
+>> /PUT pdfmark
+[{Catalog} << /OutputIntents [ {OutputIntent_PDFA} ] >> /PUT pdfmark
+`
+
+// convertToPDFA rewrites the report at path as PDF/A-2b with Ghostscript,
+// which embeds the fonts, attaches the sRGB output intent from
+// cfg.PDFAICCProfile and writes the XMP metadata.
+func convertToPDFA(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.AnalysisTimeout)
+	defer cancel()
+
+	dir := filepath.Dir(path)
+	def := filepath.Join(dir, "PDFA_def.ps")
+	escaped := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(cfg.PDFAICCProfile)
+	if err := os.WriteFile(def, fmt.Appendf(nil, pdfaDef, escaped), 0o600); err != nil {
+		return err
+	}
+	out := filepath.Join(dir, "report-pdfa.pdf")
+	cmd := exec.CommandContext(ctx, cfg.Ghostscript,
+		"-dPDFA=2", "-dBATCH", "-dNOPAUSE", "-dQUIET", "-dPDFACompatibilityPolicy=1",
+		"-sColorConversionStrategy=RGB", "-sDEVICE=pdfwrite",
+		"--permit-file-read="+cfg.PDFAICCProfile,
+		"-sOutputFile="+out, def, path)
+	cmd.WaitDelay = 5 * time.Second
+	stderr := &tailBuffer{limit: cfg.AnalyzerLogLimit}
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		msg := lastLine(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return &analysisError{Code: codePDFAFailed, Status: http.StatusInternalServerError,
+			Message: "PDF/A conversion failed: " + msg, Stderr: stderr.String()}
+	}
+	log.Printf("PDF/A conversion finished in %s", time.Since(start))
+	return os.Rename(out, path)
+}
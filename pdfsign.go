@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Reports are signed with an invisible adbe.pkcs7.detached signature added
+// as an incremental update, which PDF readers verify without extra tools.
+
+// signatureSpace is the room reserved in the PDF for the CMS signature, in
+// bytes; it holds the signing certificate and its chain.
+const signatureSpace = 16 << 10
+
+const codeSigningFailed = "signing_failed"
+
+var (
+	oidData               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttrContentType    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	errUnsupportedPDF     = errors.New("report has no classic cross-reference table")
+	errUnsupportedSignKey = errors.New("signing key must be RSA or ECDSA")
+)
+
+// reportSigner signs reports with the configured certificate.
+type reportSigner struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+// reportSignature describes the signature on a job's report.
+type reportSignature struct {
+	Signer            string    `json:"signer"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	CertificateSHA256 string    `json:"certificate_sha256"`
+	NotAfter          time.Time `json:"certificate_not_after"`
+}
+
+// signer is set at startup when DATASCRIBE_SIGNING_CERT is configured.
+var signer *reportSigner
+
+// loadReportSigner reads the PEM certificate chain and key used to sign
+// reports.
+func loadReportSigner(certFile, keyFile string) (*reportSigner, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &reportSigner{}
+	switch key := pair.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		s.key = key
+	case *ecdsa.PrivateKey:
+		s.key = key
+	default:
+		return nil, errUnsupportedSignKey
+	}
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		s.chain = append(s.chain, cert)
+	}
+	return s, nil
+}
+
+func (s *reportSigner) status() *reportSignature {
+	cert := s.chain[0]
+	sum := sha256.Sum256(cert.Raw)
+	return &reportSignature{
+		Signer:            cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.Text(16),
+		CertificateSHA256: hex.EncodeToString(sum[:]),
+		NotAfter:          cert.NotAfter,
+	}
+}
+
+// signFile adds the signature to the PDF at path in place.
+func (s *reportSigner) signFile(path string) error {
+	pdf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signed, err := s.signPDF(pdf, time.Now())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".signing"
+	if err := os.WriteFile(tmp, signed, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var (
+	trailerRoot  = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+	trailerSize  = regexp.MustCompile(`/Size\s+(\d+)`)
+	trailerID    = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+	startxrefPos = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+)
+
+// signPDF appends a signature field, its signature dictionary and an updated
+// catalog to pdf, then signs every byte except the signature contents.
+func (s *reportSigner) signPDF(pdf []byte, now time.Time) ([]byte, error) {
+	m := startxrefPos.FindSubmatch(pdf)
+	if m == nil {
+		return nil, errUnsupportedPDF
+	}
+	prevXref := string(m[1])
+	t := bytes.LastIndex(pdf, []byte("trailer"))
+	if t < 0 {
+		return nil, errUnsupportedPDF
+	}
+	trailer := pdf[t:]
+	root, size := trailerRoot.FindSubmatch(trailer), trailerSize.FindSubmatch(trailer)
+	if root == nil || size == nil {
+		return nil, errUnsupportedPDF
+	}
+	catalog, err := findObject(pdf, string(root[1]), string(root[2]))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(catalog, []byte("/AcroForm")) {
+		return nil, errors.New("report already has a form")
+	}
+	end := bytes.LastIndex(catalog, []byte(">>"))
+	if end < 0 {
+		return nil, errors.New("report catalog is not a dictionary")
+	}
+
+	n, _ := strconv.Atoi(string(size[1]))
+	sigObj, fieldObj, formObj := n, n+1, n+2
+	cert := s.chain[0]
+
+	var out bytes.Buffer
+	out.Write(pdf)
+	if pdf[len(pdf)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+	offsets := map[int]int{}
+	begin := func(num string) int {
+		id, _ := strconv.Atoi(num)
+		offsets[id] = out.Len()
+		fmt.Fprintf(&out, "%s 0 obj\n", num)
+		return id
+	}
+
+	begin(strconv.Itoa(sigObj))
+	out.WriteString("<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /adbe.pkcs7.detached\n/ByteRange ")
+	byteRangeAt := out.Len()
+	out.WriteString("[0 0000000000 0000000000 0000000000]")
+	out.WriteString("\n/Contents ")
+	contentsAt := out.Len()
+	out.WriteByte('<')
+	out.Write(bytes.Repeat([]byte("0"), 2*signatureSpace))
+	out.WriteByte('>')
+	contentsEnd := out.Len()
+	fmt.Fprintf(&out, "\n/M (%s) /Name %s /Reason (Generated by DataScribe) >>\nendobj\n",
+		now.UTC().Format("D:20060102150405Z"), pdfString(cert.Subject.CommonName))
+
+	begin(strconv.Itoa(fieldObj))
+	fmt.Fprintf(&out, "<< /FT /Sig /T (DataScribe) /V %d 0 R /Type /Annot /Subtype /Widget /Rect [0 0 0 0] /F 132 >>\nendobj\n", sigObj)
+	begin(strconv.Itoa(formObj))
+	fmt.Fprintf(&out, "<< /Fields [%d 0 R] /SigFlags 3 >>\nendobj\n", fieldObj)
+	rootID := begin(string(root[1]))
+	out.Write(catalog[:end])
+	fmt.Fprintf(&out, " /AcroForm %d 0 R ", formObj)
+	out.Write(catalog[end:])
+	out.WriteString("\nendobj\n")
+
+	// Cross-reference section for the new and replaced objects
+	xrefAt := out.Len()
+	ids := make([]int, 0, len(offsets))
+	for id := range offsets {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	out.WriteString("xref\n")
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		fmt.Fprintf(&out, "%d %d\n", ids[i], j-i+1)
+		for _, id := range ids[i : j+1] {
+			gen := 0
+			if id == rootID {
+				gen, _ = strconv.Atoi(string(root[2]))
+			}
+			fmt.Fprintf(&out, "%010d %05d n \n", offsets[id], gen)
+		}
+		i = j + 1
+	}
+	id := ""
+	if m := trailerID.Find(trailer); m != nil {
+		id = " " + string(m)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %s %s R /Prev %s%s >>\nstartxref\n%d\n%%%%EOF\n",
+		formObj+1, root[1], root[2], prevXref, id, xrefAt)
+
+	// Fill in the byte range, then sign it
+	signed := out.Bytes()
+	byteRange := fmt.Sprintf("[0 %010d %010d %010d]", contentsAt, contentsEnd, len(signed)-contentsEnd)
+	copy(signed[byteRangeAt:], byteRange)
+	digest := sha256.New()
+	digest.Write(signed[:contentsAt])
+	digest.Write(signed[contentsEnd:])
+	cms, err := s.signDigest(digest.Sum(nil), now)
+	if err != nil {
+		return nil, err
+	}
+	if len(cms) > signatureSpace {
+		return nil, fmt.Errorf("signature needs %d bytes, only %d are reserved", len(cms), signatureSpace)
+	}
+	hex.Encode(signed[contentsAt+1:], cms)
+	return signed, nil
+}
+
+// findObject returns the body of the last definition of object num gen.
+func findObject(pdf []byte, num, gen string) ([]byte, error) {
+	re := regexp.MustCompile(`(?:^|[\r\n])` + num + `\s+` + gen + `\s+obj\b`)
+	locs := re.FindAllIndex(pdf, -1)
+	if locs == nil {
+		return nil, fmt.Errorf("object %s %s not found", num, gen)
+	}
+	body := pdf[locs[len(locs)-1][1]:]
+	end := bytes.Index(body, []byte("endobj"))
+	if end < 0 {
+		return nil, fmt.Errorf("object %s %s is not terminated", num, gen)
+	}
+	return bytes.TrimSpace(body[:end]), nil
+}
+
+// pdfString encodes s as a PDF literal string.
+func pdfString(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('(')
+	for _, c := range []byte(s) {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// CMS (RFC 5652) structures for a detached SignedData.
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// signDigest returns a DER CMS SignedData over a document with the given
+// SHA-256 digest.
+func (s *reportSigner) signDigest(digest []byte, now time.Time) ([]byte, error) {
+	attr := func(oid asn1.ObjectIdentifier, value any) ([]byte, error) {
+		v, err := asn1.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct {
+			Type   asn1.ObjectIdentifier
+			Values asn1.RawValue
+		}{oid, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: v}})
+	}
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value any
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, now.UTC()},
+		{oidAttrMessageDigest, digest},
+	} {
+		der, err := attr(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, der)
+	}
+	// DER orders the members of a SET OF by their encoding
+	slices.SortFunc(attrs, bytes.Compare)
+	attrBytes := bytes.Join(attrs, nil)
+
+	// The signature covers the attributes encoded as a SET, while the
+	// SignerInfo carries them with an implicit [0] tag
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrBytes})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(set)
+	sig, err := s.key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg := algorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.key.(*ecdsa.PrivateKey); ok {
+		sigAlg = algorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+
+	cert := s.chain[0]
+	info, err := asn1.Marshal(signerInfo{
+		Version:            1,
+		SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+		DigestAlgorithm:    algorithmIdentifier{Algorithm: oidSHA256},
+		SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrBytes},
+		SignatureAlgorithm: sigAlg,
+		Signature:          sig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digestAlg, err := asn1.Marshal(algorithmIdentifier{Algorithm: oidSHA256})
+	if err != nil {
+		return nil, err
+	}
+	var certs []byte
+	for _, c := range s.chain {
+		certs = append(certs, c.Raw...)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: digestAlg},
+		EncapContentInfo: encapContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: info},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
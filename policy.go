@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DATASCRIBE_ENDPOINT_POLICIES limits the requests to each endpoint, as
+// path=concurrency/timeout entries, either part of which may be left out:
+//
+//	/predict=2/10m,/distribution=64/30s,*=16
+//
+// The path is as routed, without API version, so /jobs/{id}/report covers
+// every job; * is the policy of each endpoint without one of its own, so
+// *=16 allows 16 requests to every such path, not 16 between them. All
+// methods on a path share its policy.
+//
+// Beyond concurrency requests in flight, further ones get 429 with code
+// endpoint_busy. WebSocket connections on /ws and long-polls with ?wait=
+// spend their time idle, so they do not take a slot. After timeout the context of a request is cancelled,
+// which stops its analysis even when DATASCRIBE_ANALYSIS_TIMEOUT is
+// longer, and a request that has not started its response by the time it
+// stops gets 504 with code request_timeout.
+
+const (
+	codeEndpointBusy   = "endpoint_busy"
+	codeRequestTimeout = "request_timeout"
+)
+
+var endpointRejections = newCounter("datascribe_endpoint_rejections_total", "Requests rejected by the concurrency limit of their endpoint, by route.")
+
+// endpointPolicy limits the requests to the routes on one path.
+type endpointPolicy struct {
+	path    string
+	timeout time.Duration
+	slots   chan struct{} // nil without a concurrency limit
+}
+
+var endpointPolicies map[string]*endpointPolicy
+
+// loadEndpointPolicies parses cfg.EndpointPolicies for the routes
+// registered so far.
+func loadEndpointPolicies() error {
+	paths := map[string]bool{"*": true}
+	for _, rt := range apiRoutes {
+		paths[routePath(rt.pattern)] = true
+	}
+	endpointPolicies = map[string]*endpointPolicy{}
+	for path, spec := range cfg.EndpointPolicies {
+		if !paths[path] {
+			return fmt.Errorf("no endpoint %s", path)
+		}
+		p := &endpointPolicy{path: path}
+		concurrency, timeout, _ := strings.Cut(spec, "/")
+		if concurrency != "" {
+			n, err := strconv.Atoi(concurrency)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%s: invalid concurrency %q", path, concurrency)
+			}
+			p.slots = make(chan struct{}, n)
+		}
+		if timeout != "" {
+			d, err := time.ParseDuration(timeout)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%s: invalid timeout %q", path, timeout)
+			}
+			p.timeout = d
+		}
+		endpointPolicies[path] = p
+	}
+	if def := endpointPolicies["*"]; def != nil {
+		for path := range paths {
+			if endpointPolicies[path] == nil {
+				p := &endpointPolicy{path: path, timeout: def.timeout}
+				if def.slots != nil {
+					p.slots = make(chan struct{}, cap(def.slots))
+				}
+				endpointPolicies[path] = p
+			}
+		}
+	}
+	return nil
+}
+
+// routePath returns the path of a route pattern.
+func routePath(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		return pattern[i+1:]
+	}
+	return pattern
+}
+
+// withEndpointPolicy enforces the policy of the route pattern, if any,
+// on h.
+func withEndpointPolicy(pattern string, h http.Handler) http.Handler {
+	p := endpointPolicies[routePath(pattern)]
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.slots != nil && !idleRequest(r, p.path) {
+			select {
+			case p.slots <- struct{}{}:
+				defer func() { <-p.slots }()
+			default:
+				endpointRejections.inc("route", p.path)
+				w.Header().Set("Retry-After", "1")
+				writeJSON(w, http.StatusTooManyRequests, errorBody{
+					Error: fmt.Sprintf("%s already serves its %d concurrent requests", p.path, cap(p.slots)), Code: codeEndpointBusy})
+				return
+			}
+		}
+		if p.timeout <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), requestTimeoutKey{}, p.timeout), p.timeout)
+		defer cancel()
+		pw := &policyWriter{ResponseWriter: w}
+		h.ServeHTTP(pw, r.WithContext(ctx))
+		if !pw.written && ctx.Err() == context.DeadlineExceeded {
+			writeJSON(w, http.StatusGatewayTimeout, errorBody{
+				Error: fmt.Sprintf("the request did not finish within %s", p.timeout), Code: codeRequestTimeout})
+		}
+	})
+}
+
+// idleRequest reports whether r to path mostly waits, for job updates
+// over a WebSocket or for a long-polled job to finish, and so takes no
+// concurrency slot.
+func idleRequest(r *http.Request, path string) bool {
+	return path == "/ws" || r.URL.Query().Get("wait") != ""
+}
+
+type requestTimeoutKey struct{}
+
+// analysisTimeout returns how long an analysis for ctx may take: at most
+// cfg.AnalysisTimeout, and no longer than the timeout of its endpoint.
+func analysisTimeout(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(requestTimeoutKey{}).(time.Duration); ok && d < cfg.AnalysisTimeout {
+		return d
+	}
+	return cfg.AnalysisTimeout
+}
+
+// policyWriter records whether a response was started.
+type policyWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *policyWriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *policyWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *policyWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
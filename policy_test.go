@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useTestRoutes declares routes with patterns and the given policies.
+func useTestRoutes(t *testing.T, policies map[string]string, patterns ...string) {
+	savedCfg, savedRoutes, savedPolicies := cfg, apiRoutes, endpointPolicies
+	t.Cleanup(func() { cfg, apiRoutes, endpointPolicies = savedCfg, savedRoutes, savedPolicies })
+	apiRoutes = nil
+	for _, pattern := range patterns {
+		handleAPI(pattern, http.NotFoundHandler())
+	}
+	cfg.EndpointPolicies = policies
+}
+
+func TestLoadEndpointPolicies(t *testing.T) {
+	tests := []struct {
+		policies map[string]string
+		want     string // policies of /predict and /jobs/{id}, as concurrency/timeout
+		wantErr  string
+	}{
+		{want: "<nil> <nil>"},
+		{policies: map[string]string{"/predict": "2/10m"}, want: "2/10m0s <nil>"},
+		{policies: map[string]string{"/predict": "2"}, want: "2/0s <nil>"},
+		{policies: map[string]string{"/predict": "/30s"}, want: "0/30s <nil>"},
+		{policies: map[string]string{"*": "16", "/predict": "2/10m"}, want: "2/10m0s 16/0s"},
+		{policies: map[string]string{"/jobs/{id}": "4"}, want: "<nil> 4/0s"},
+		{policies: map[string]string{"/nope": "1"}, wantErr: "no endpoint /nope"},
+		{policies: map[string]string{"/predict": "0"}, wantErr: `/predict: invalid concurrency "0"`},
+		{policies: map[string]string{"/predict": "x/1s"}, wantErr: `/predict: invalid concurrency "x"`},
+		{policies: map[string]string{"/predict": "1/-1s"}, wantErr: `/predict: invalid timeout "-1s"`},
+		{policies: map[string]string{"/predict": "1/soon"}, wantErr: `/predict: invalid timeout "soon"`},
+	}
+	describe := func(p *endpointPolicy) string {
+		if p == nil {
+			return "<nil>"
+		}
+		return fmt.Sprintf("%d/%s", cap(p.slots), p.timeout)
+	}
+	for _, tt := range tests {
+		useTestRoutes(t, tt.policies, "POST /predict", "GET /jobs/{id}", "DELETE /jobs/{id}")
+		err := loadEndpointPolicies()
+		if got := fmt.Sprint(err); tt.wantErr != "" && got != tt.wantErr || tt.wantErr == "" && err != nil {
+			t.Errorf("%v: error = %v, want %q", tt.policies, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := describe(endpointPolicies["/predict"]) + " " + describe(endpointPolicies["/jobs/{id}"]); got != tt.want {
+			t.Errorf("%v: policies = %s, want %s", tt.policies, got, tt.want)
+		}
+	}
+}
+
+// TestEndpointPolicySlots holds requests open under a policy of *=1 and
+// checks which further requests are still served.
+func TestEndpointPolicySlots(t *testing.T) {
+	useTestRoutes(t, map[string]string{"*": "1"}, "GET /a", "GET /b", "GET /ws", "GET /jobs/{id}")
+	if err := loadEndpointPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	release, started := make(chan struct{}), make(chan struct{})
+	serve := func(pattern, target string, hold bool) int {
+		w := httptest.NewRecorder()
+		h := withEndpointPolicy(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hold {
+				started <- struct{}{}
+				<-release
+			}
+		}))
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+
+	held := [][2]string{{"GET /a", "/a"}, {"GET /ws", "/ws"}, {"GET /ws", "/ws"}, {"GET /jobs/{id}", "/jobs/1?wait=30s"}, {"GET /jobs/{id}", "/jobs/2?wait=30s"}}
+	done := make(chan int, len(held))
+	for _, req := range held {
+		go func() { done <- serve(req[0], req[1], true) }()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not served", req[1])
+		}
+	}
+	tests := []struct {
+		pattern, target string
+		status          int
+	}{
+		{"GET /a", "/a", http.StatusTooManyRequests},
+		{"GET /b", "/b", http.StatusOK},
+		{"GET /jobs/{id}", "/jobs/1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := serve(tt.pattern, tt.target, false); got != tt.status {
+			t.Errorf("%s while the others are held = %d, want %d", tt.target, got, tt.status)
+		}
+	}
+	close(release)
+	for range held {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("held request = %d, want 200", code)
+		}
+	}
+}
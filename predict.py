@@ -6,12 +6,31 @@ Reads a CSV, performs EDA (stats, missingness, distributions, correlations, etc.
 creates charts, and exports a single PDF report with proper headings.
 
 Usage:
-    python predict.py --input data.csv --output report.pdf
+    python predict.py --input data.csv --output report.pdf [--include-column NAME ...] [--exclude-column NAME ...]
+                      [--types '{"order_id": "string", "ts": "datetime:%d/%m/%Y"}']
+                      [--semantic-types '{"price": "currency:EUR", "order_id": "identifier"}']
+                      [--units '{"latency": "ms", "disk": "GB"}']
+                      [--no-header] [--column-names '["id", "amount"]'] [--missing-heatmap]
+                      [--suggestions-json suggestions.json] [--target churned [--explain]]
+                      [--text-column NAME ...] [--summary-json summary.json] [--profile-json profile.json]
+                      [--chart histograms --chart correlations ...] [--chart-options '{"histograms": {"bins": 50}}']
+                      [--charts-dir charts/] [--anonymized '{"email": "hash"}']
+                      [--dp-epsilon 1.0 [--dp-bounds '{"age": [0, 120]}']] [--filtered 'amount > 0']
+                      [--derived '{"margin": "(revenue - cost) / revenue"}']
+                      [--contract-file contract.json]
+                      [--expectations '{"passed": false, "results": [...]}']
+                      [--provenance-file provenance.json]
 """
 
 import argparse
+import json
+import os
+import re
+import secrets
 import textwrap
-from typing import List
+import warnings
+from collections import Counter
+from typing import Dict, List
 
 import pandas as pd
 import numpy as np
@@ -19,26 +38,186 @@ import matplotlib.pyplot as plt
 from matplotlib.backends.backend_pdf import PdfPages
 from pandas.plotting import scatter_matrix
 import sys
+
+# With --output=- the PDF is streamed on stdout as it is produced, so
+# everything else printed goes to stderr
+REPORT_STDOUT = None
+if __name__ == "__main__" and "--output=-" in sys.argv:
+    REPORT_STDOUT, sys.stdout = sys.stdout.buffer, sys.stderr
 print(sys.executable)
 
 plt.switch_backend("Agg")  # For headless environments
 
+# Exit codes understood by the Go server (see analyzer.go)
+EXIT_MALFORMED_CSV = 3
+EXIT_UNSUPPORTED_COLUMNS = 4
+
+# Report guardrails: wide datasets get a column overview table, categorical
+# charts show at most MAX_CATEGORIES_SHOWN values, and row-level charts
+# sample MAX_PLOT_ROWS rows so the PDF stays small
+WIDE_COLUMNS = 50
+MAX_CATEGORIES_SHOWN = 50
+MAX_PLOT_ROWS = 5000
+
+# Integer targets with at most this many distinct values are treated as classes
+MAX_CLASSES = 20
+# A feature this correlated with the target is flagged as likely leakage
+LEAKAGE_CORRELATION = 0.98
+# A class rarer than this share of labelled rows is flagged as severe imbalance
+IMBALANCE_SHARE = 0.05
+
+
+class UnsupportedColumnsError(Exception):
+    """Raised when the dataset has no columns the report can handle."""
+
+
+def load_csv_to_df(path: str, types: Dict[str, str] = None, has_header: bool = True,
+                   column_names: List[str] = None, semantic: Dict[str, str] = None) -> pd.DataFrame:
+    types = types or {}
+    semantic = semantic or {}
+    if not has_header and not column_names:
+        # Name the columns the same way the Go server validates them
+        width = pd.read_csv(path, header=None, nrows=1).shape[1]
+        column_names = [f"column_{i + 1}" for i in range(width)]
+    # Text-like columns are read as text so IDs keep their leading zeros
+    dtype = {col: str for col, hint in types.items() if hint in ("string", "category")}
+    dtype.update({col: str for col, s in semantic.items() if col not in types and s in TEXT_SEMANTIC_TYPES})
+    df = pd.read_csv(path, dtype=dtype or None,
+                     header=0 if has_header else None,
+                     names=column_names or None)
+    return apply_semantic_types(apply_type_hints(df, types), semantic, types)
+
+
+def apply_type_hints(df: pd.DataFrame, types: Dict[str, str]) -> pd.DataFrame:
+    for col, hint in types.items():
+        if col not in df.columns:
+            raise UnsupportedColumnsError(f"unknown column in types: {col}")
+        name, _, fmt = hint.partition(":")
+        if name == "string":
+            df[col] = df[col].astype("string")
+        elif name == "category":
+            df[col] = df[col].astype("category")
+        elif name == "integer":
+            df[col] = pd.to_numeric(df[col], errors="coerce").astype("Int64")
+        elif name == "float":
+            df[col] = pd.to_numeric(df[col], errors="coerce").astype(float)
+        elif name == "boolean":
+            lowered = df[col].astype(str).str.strip().str.lower()
+            df[col] = lowered.map({"true": True, "1": True, "yes": True,
+                                   "false": False, "0": False, "no": False}).astype("boolean")
+        elif name == "datetime":
+            df[col] = pd.to_datetime(df[col], format=fmt or None, errors="coerce")
+    return df
+
+
+# Semantic types read as text; currency and percentage columns are numbers
+TEXT_SEMANTIC_TYPES = ("identifier", "category")
+
+
+def apply_semantic_types(df: pd.DataFrame, semantic: Dict[str, str], types: Dict[str, str]) -> pd.DataFrame:
+    """Reads the columns with a semantic type and no type hint as it implies.
+    The server checks the columns of the request; those of the dataset may
+    be missing from an upload and are skipped."""
+    for col, s in semantic.items():
+        if col not in df.columns or col in types:
+            continue
+        if s == "identifier":
+            df[col] = df[col].astype("string")
+        elif s == "category":
+            df[col] = df[col].astype("category")
+        else:
+            df[col] = pd.to_numeric(df[col], errors="coerce").astype(float)
+    return df
+
+
+def format_value(value: float, semantic: str) -> str:
+    """A statistic of a column formatted for its semantic type."""
+    name, _, param = semantic.partition(":")
+    if name == "currency":
+        return f"{value:,.2f} {param}".rstrip()
+    if name == "percentage":
+        return f"{value * 100 if param == 'ratio' else value:.2f}%"
+    return f"{value:.4g}"
+
+
+# Units of columns (--units), for the tables and chart axes
+COLUMN_UNITS: Dict[str, str] = {}
+
+# Currency symbols are written before amounts, other units after them
+PREFIX_UNITS = ("€", "$", "£", "¥", "₹")
+
+
+def format_with_unit(value: float, unit: str) -> str:
+    """A statistic of a column with its unit."""
+    if unit in PREFIX_UNITS:
+        return f"{unit}{value:,.2f}"
+    if unit == "%":
+        return f"{value:.4g}%"
+    return f"{value:.4g} {unit}"
+
 
-def load_csv_to_df(path: str) -> pd.DataFrame:
-    df = pd.read_csv(path)
+def axis_label(col) -> str:
+    """The label of a column on a chart axis, with its unit."""
+    unit = COLUMN_UNITS.get(str(col))
+    return f"{col} ({unit})" if unit else str(col)
+
+
+def select_columns(df: pd.DataFrame, include: List[str], exclude: List[str]) -> pd.DataFrame:
+    missing = [col for col in include + exclude if col not in df.columns]
+    if missing:
+        raise UnsupportedColumnsError("unknown columns: " + ", ".join(missing))
+    if include:
+        df = df[include]
+    if exclude:
+        df = df.drop(columns=exclude)
     return df
 
 
-def compute_basic_stats(df: pd.DataFrame) -> pd.DataFrame:
+def check_supported_columns(df: pd.DataFrame) -> None:
+    if df.shape[1] == 0:
+        raise UnsupportedColumnsError("the CSV has no columns")
+    unsupported = [col for col in df.columns if df[col].dtype.kind == "c"]
+    if unsupported:
+        raise UnsupportedColumnsError("unsupported column types (complex numbers): " + ", ".join(map(str, unsupported)))
+
+
+def compute_basic_stats(df: pd.DataFrame, semantic: Dict[str, str] = None) -> pd.DataFrame:
     desc = df.describe(include=[np.number]).T
     desc["missing"] = df[desc.index].isna().sum()
+    # Amounts of money also add up to something meaningful
+    currency = [c for c in desc.index if (semantic or {}).get(c, "").startswith("currency")]
+    if currency:
+        desc["total"] = df[currency].sum()
     return desc
 
 
+def identifier_profile(values: pd.Series) -> Dict:
+    """How well an identifier column identifies its rows."""
+    counts = values.dropna().value_counts()
+    repeated = counts[counts > 1]
+    return {"distinct": int(len(counts)), "missing": int(values.isna().sum()),
+            "duplicates": int(repeated.sum() - len(repeated)), "examples": [str(v) for v in repeated.index[:5]]}
+
+
+def add_identifier_page(df: pd.DataFrame, identifiers: List[str], pdf: PdfPages) -> None:
+    if not identifiers:
+        return
+    lines = ["Identifier columns get no statistics or charts; each value should appear once.", ""]
+    for col in identifiers:
+        p = identifier_profile(df[col])
+        line = f"{col}: {p['distinct']} distinct values, {p['missing']} missing"
+        if p["duplicates"]:
+            line += f", {p['duplicates']} rows repeating an earlier value, e.g. " + ", ".join(p["examples"])
+        else:
+            line += ", no duplicates"
+        lines.append(line)
+    add_text_page(pdf, "Identifiers", "\n".join(lines))
+
+
 def detect_categoricals(df: pd.DataFrame, max_unique: int = 20) -> List[str]:
     cats = []
     for col in df.columns:
-        if df[col].dtype == "object":
+        if df[col].dtype == "object" or isinstance(df[col].dtype, pd.CategoricalDtype):
             cats.append(col)
         else:
             if df[col].nunique(dropna=True) <= max_unique:
@@ -46,10 +225,369 @@ def detect_categoricals(df: pd.DataFrame, max_unique: int = 20) -> List[str]:
     return cats
 
 
+# --------------------- TEXT --------------------- #
+
+TOKEN_RE = re.compile(r"[^\W\d_]+(?:'[^\W\d_]+)?")
+
+# Frequent function words per language, used both to guess the language and
+# to keep them out of the top terms
+STOPWORDS = {
+    "english": {"the", "and", "of", "to", "a", "in", "is", "it", "that", "for", "was", "on", "with", "this",
+                "as", "are", "be", "at", "have", "not", "but", "i", "you", "my", "we", "they", "or", "an"},
+    "spanish": {"el", "la", "de", "que", "y", "en", "los", "se", "del", "las", "un", "por", "con", "no",
+                "una", "su", "para", "es", "al", "lo", "como", "pero", "muy"},
+    "french": {"le", "la", "de", "et", "les", "des", "en", "un", "une", "du", "est", "que", "pour", "dans",
+               "qui", "pas", "sur", "au", "avec", "ce", "il", "je", "très"},
+    "german": {"der", "die", "und", "in", "den", "von", "zu", "das", "mit", "sich", "des", "auf", "für",
+               "ist", "im", "nicht", "ein", "eine", "als", "auch", "es", "ich", "sehr"},
+    "portuguese": {"o", "a", "de", "que", "e", "do", "da", "em", "um", "para", "com", "não", "uma", "os",
+                   "no", "se", "na", "por", "mais", "as", "dos", "muito"},
+    "italian": {"il", "di", "che", "e", "la", "per", "un", "in", "non", "una", "sono", "mi", "ho", "lo",
+                "ma", "ha", "le", "si", "con", "della", "molto"},
+}
+ALL_STOPWORDS = set().union(*STOPWORDS.values())
+
+# Object columns averaging at least this many tokens per value are free text
+TEXT_MIN_TOKENS = 4
+
+
+def tokenize(text: str) -> List[str]:
+    return TOKEN_RE.findall(text.lower())
+
+
+def detect_text_columns(df: pd.DataFrame, forced: List[str] = ()) -> List[str]:
+    """Object columns of mostly distinct, multi-word values, plus any forced ones."""
+    cols = [c for c in forced if c in df.columns]
+    for col in df.columns:
+        if col in cols or df[col].dtype != "object":
+            continue
+        values = df[col].dropna().astype(str).head(1000)
+        if values.empty or values.nunique() < 0.5 * len(values):
+            continue
+        if values.map(lambda v: len(tokenize(v))).mean() >= TEXT_MIN_TOKENS:
+            cols.append(col)
+    return cols
+
+
+def detect_language(tokens: List[str]) -> str:
+    """Guesses the language by which stopword list covers the most tokens."""
+    if not tokens:
+        return "unknown"
+    hits = {lang: sum(t in words for t in tokens) for lang, words in STOPWORDS.items()}
+    lang, best = max(hits.items(), key=lambda kv: kv[1])
+    return lang if best >= max(3, 0.05 * len(tokens)) else "unknown"
+
+
+def text_stats(values: pd.Series, top_k: int = 15) -> Dict:
+    """Length and token statistics, top unigrams and bigrams, and the language of a text column."""
+    texts = values.dropna().astype(str)
+    tokenized = [tokenize(t) for t in texts]
+    tokens = [t for ts in tokenized for t in ts]
+    unigrams = Counter(t for t in tokens if t not in ALL_STOPWORDS and len(t) > 1)
+    bigrams = Counter(f"{a} {b}" for ts in tokenized for a, b in zip(ts, ts[1:])
+                      if a not in ALL_STOPWORDS and b not in ALL_STOPWORDS)
+    return {
+        "values": int(len(texts)),
+        "avg_length": float(texts.str.len().mean()) if len(texts) else 0.0,
+        "avg_tokens": float(np.mean([len(ts) for ts in tokenized])) if tokenized else 0.0,
+        "vocabulary": len(set(tokens)),
+        "language": detect_language(tokens[:20000]),
+        "top_terms": unigrams.most_common(top_k),
+        "top_bigrams": bigrams.most_common(top_k),
+    }
+
+
+def add_text_column_pages(df: pd.DataFrame, text_cols: List[str], pdf: PdfPages) -> None:
+    for col in text_cols:
+        stats = text_stats(df[col])
+        add_text_page(pdf, f"Text Column: {col}",
+                      f"Values: {stats['values']}\n"
+                      f"Average length: {stats['avg_length']:.1f} characters, {stats['avg_tokens']:.1f} words\n"
+                      f"Distinct words: {stats['vocabulary']}\n"
+                      f"Detected language: {stats['language']}\n\n"
+                      "Top bigrams: " + (", ".join(f"{g} ({n})" for g, n in stats["top_bigrams"]) or "none"))
+        if not stats["top_terms"]:
+            continue
+        terms, counts = zip(*reversed(stats["top_terms"]))
+        fig, ax = plt.subplots(figsize=(8.5, 6))
+        ax.barh(terms, counts)
+        ax.set_title(f"Most frequent terms: {col}")
+        ax.set_xlabel("Occurrences")
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+
+
+# --------------------- GEO --------------------- #
+
+LAT_RE = re.compile(r"(^|_)(lat|latitude)$", re.IGNORECASE)
+LON_RE = re.compile(r"(^|_)(lon|lng|long|longitude)$", re.IGNORECASE)
+REGION_RE = re.compile(r"(^|_)(country|country_code|region|state|province)$", re.IGNORECASE)
+
+
+def detect_coordinates(df: pd.DataFrame) -> List[tuple]:
+    """Pairs numeric latitude and longitude columns that share a name prefix."""
+    numeric = set(df.select_dtypes(include=[np.number]).columns)
+    lats = [c for c in df.columns if c in numeric and LAT_RE.search(str(c))]
+    lons = [c for c in df.columns if c in numeric and LON_RE.search(str(c))]
+    pairs = []
+    for lat in lats:
+        prefix = LAT_RE.sub("", str(lat))
+        lon = next((c for c in lons if LON_RE.sub("", str(c)) == prefix), None)
+        if lon is not None:
+            pairs.append((lat, lon))
+            lons.remove(lon)
+    return pairs
+
+
+def geo_summary(df: pd.DataFrame) -> Dict:
+    """Bounding boxes and invalid coordinate counts, plus counts of region columns."""
+    coordinates = []
+    for lat, lon in detect_coordinates(df):
+        both = df[[lat, lon]].dropna()
+        valid = both[both[lat].between(-90, 90) & both[lon].between(-180, 180)]
+        # Latitudes beyond +-90 that would be valid longitudes suggest swapped columns
+        swapped = both[~both[lat].between(-90, 90) & both[lat].between(-180, 180) & both[lon].between(-90, 90)]
+        entry = {
+            "latitude": str(lat), "longitude": str(lon),
+            "valid": int(len(valid)), "invalid": int(len(both) - len(valid)),
+            "possibly_swapped": int(len(swapped)), "missing": int(len(df) - len(both)),
+            "bounding_box": None,
+        }
+        if not valid.empty:
+            entry["bounding_box"] = {"min_lat": float(valid[lat].min()), "max_lat": float(valid[lat].max()),
+                                     "min_lon": float(valid[lon].min()), "max_lon": float(valid[lon].max())}
+        coordinates.append(entry)
+    regions = []
+    for col in df.columns:
+        if df[col].dtype == "object" and REGION_RE.search(str(col)):
+            counts = df[col].dropna().astype(str).str.strip().value_counts()
+            regions.append({"column": str(col), "distinct": int(len(counts)),
+                            "top": [{"value": v, "count": int(n)} for v, n in counts.head(10).items()]})
+    return {"coordinates": coordinates, "regions": regions}
+
+
+def plot_geo(df: pd.DataFrame, geo: Dict, pdf: PdfPages, top_k: int = 25) -> None:
+    """Point density of each coordinate pair and row counts of region columns."""
+    for c in geo["coordinates"]:
+        lat, lon = c["latitude"], c["longitude"]
+        points = df[[lat, lon]].dropna()
+        points = points[points[lat].between(-90, 90) & points[lon].between(-180, 180)]
+        if points.empty:
+            continue
+        fig, ax = plt.subplots(figsize=(11, 6))
+        hb = ax.hexbin(points[lon], points[lat], gridsize=60, bins="log", mincnt=1, cmap="viridis")
+        fig.colorbar(hb, ax=ax, label="Rows (log scale)")
+        box = c["bounding_box"]
+        pad_lat = max(0.5, 0.05 * (box["max_lat"] - box["min_lat"]))
+        pad_lon = max(0.5, 0.05 * (box["max_lon"] - box["min_lon"]))
+        ax.set_xlim(max(-180, box["min_lon"] - pad_lon), min(180, box["max_lon"] + pad_lon))
+        ax.set_ylim(max(-90, box["min_lat"] - pad_lat), min(90, box["max_lat"] + pad_lat))
+        ax.set_xlabel(f"{lon} (longitude)")
+        ax.set_ylabel(f"{lat} (latitude)")
+        ax.set_title(f"Point density: {lat}/{lon} ({c['invalid']} invalid coordinates)")
+        ax.grid(alpha=0.3)
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+    for r in geo["regions"]:
+        counts = df[r["column"]].dropna().astype(str).str.strip().value_counts().head(top_k)
+        fig, ax = plt.subplots(figsize=(8.5, 6))
+        counts.iloc[::-1].plot(kind="barh", ax=ax)
+        ax.set_title(f"Rows by {r['column']} (top {len(counts)} of {r['distinct']})")
+        ax.set_xlabel("Rows")
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+
+
+# --------------------- DATETIME --------------------- #
+
+# Named frequencies by their typical step, smallest first
+FREQUENCIES = [("secondly", pd.Timedelta(seconds=1)), ("minutely", pd.Timedelta(minutes=1)),
+               ("hourly", pd.Timedelta(hours=1)), ("daily", pd.Timedelta(days=1)),
+               ("weekly", pd.Timedelta(weeks=1)), ("monthly", pd.Timedelta(days=30)),
+               ("quarterly", pd.Timedelta(days=91)), ("yearly", pd.Timedelta(days=365))]
+DAYS = ["Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"]
+MONTHS = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"]
+
+
+def datetime_columns(df: pd.DataFrame) -> Dict[str, pd.Series]:
+    """Datetime columns, typed or detected among text columns, parsed into datetimes."""
+    cols = {}
+    for col in df.columns:
+        series = df[col]
+        if pd.api.types.is_datetime64_any_dtype(series):
+            cols[col] = series
+        elif series.dtype == "object" and series.notna().any():
+            text = series.dropna().astype(str)
+            if pd.to_numeric(text, errors="coerce").notna().any() or not _looks_like_dates(text):
+                continue
+            with warnings.catch_warnings():
+                warnings.simplefilter("ignore")
+                try:
+                    cols[col] = pd.to_datetime(series, errors="coerce", format="mixed")
+                except (TypeError, ValueError):
+                    cols[col] = pd.to_datetime(series, errors="coerce")
+    return cols
+
+
+def infer_frequency(step: pd.Timedelta) -> str:
+    """Names the frequency closest to the typical step between timestamps."""
+    for name, typical in FREQUENCIES:
+        if step <= typical * 1.5:
+            return name
+    return "irregular"
+
+
+def datetime_profile(values: pd.Series, max_gaps: int = 5) -> Dict:
+    """Coverage, frequency, gaps, and duplicate or out-of-order timestamps of one column."""
+    present = values.dropna()
+    if present.dt.tz is not None:
+        present = present.dt.tz_convert(None)
+    profile = {"values": int(len(present)), "missing": int(values.isna().sum()), "start": None, "end": None,
+               "frequency": "unknown", "gaps": 0, "largest_gaps": [],
+               "duplicates": int(present.duplicated().sum()),
+               "out_of_order": int((present.diff() < pd.Timedelta(0)).sum())}
+    if present.empty:
+        return profile
+    profile["start"], profile["end"] = present.min().isoformat(), present.max().isoformat()
+    ordered = present.drop_duplicates().sort_values().reset_index(drop=True)
+    steps = ordered.diff().dropna()
+    if steps.empty:
+        return profile
+    step = steps.median()
+    profile["frequency"] = infer_frequency(step)
+    # A gap is a step well beyond the typical one, i.e. missing periods
+    gaps = steps[steps > step * 1.5]
+    profile["gaps"] = int(len(gaps))
+    for i, length in gaps.sort_values(ascending=False).head(max_gaps).items():
+        profile["largest_gaps"].append({"after": ordered[i - 1].isoformat(), "before": ordered[i].isoformat(),
+                                        "length": str(length)})
+    return profile
+
+
+def datetime_summary(df: pd.DataFrame) -> List[Dict]:
+    return [{"column": str(col), **datetime_profile(values)} for col, values in datetime_columns(df).items()]
+
+
+def add_datetime_pages(df: pd.DataFrame, pdf: PdfPages) -> None:
+    for col, values in datetime_columns(df).items():
+        profile = datetime_profile(values)
+        if not profile["values"]:
+            continue
+        flags = []
+        if profile["duplicates"]:
+            flags.append(f"{profile['duplicates']} duplicate timestamps")
+        if profile["out_of_order"]:
+            flags.append(f"{profile['out_of_order']} timestamps earlier than the row before")
+        gaps = "\n".join(f"  {g['after']} -> {g['before']} ({g['length']})" for g in profile["largest_gaps"])
+        add_text_page(pdf, f"Datetime Column: {col}",
+                      f"Coverage: {profile['start']} to {profile['end']}\n"
+                      f"Values: {profile['values']} ({profile['missing']} missing)\n"
+                      f"Inferred frequency: {profile['frequency']}\n"
+                      f"Gaps: {profile['gaps']}" + (f"\nLargest gaps:\n{gaps}" if gaps else "") + "\n\n"
+                      + ("FLAGGED: " + "; ".join(flags) if flags else "No duplicate or out-of-order timestamps."))
+
+        present = values.dropna()
+        fig, axes = plt.subplots(1, 2, figsize=(11, 4.5))
+        by_day = present.dt.dayofweek.value_counts().reindex(range(7), fill_value=0)
+        axes[0].bar(DAYS, by_day.values)
+        axes[0].set_title(f"{col}: rows by day of week")
+        by_month = present.dt.month.value_counts().reindex(range(1, 13), fill_value=0)
+        axes[1].bar(MONTHS, by_month.values)
+        axes[1].set_title(f"{col}: rows by month")
+        axes[1].tick_params(axis="x", labelrotation=45)
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+
+
+class StreamedReport:
+    """Lets PdfPages write to stdout, which cannot seek.
+
+    matplotlib only asks for the current position while writing, so that is
+    tracked by counting the bytes written.
+    """
+
+    def __init__(self, out):
+        self.out = out
+        self.written = 0
+
+    def write(self, data) -> int:
+        self.out.write(data)
+        self.written += len(data)
+        return len(data)
+
+    def tell(self) -> int:
+        return self.written
+
+    def seek(self, offset: int, whence: int = 0) -> int:
+        if (offset, whence) not in ((self.written, 0), (0, 1), (0, 2)):
+            raise OSError("the report stream cannot seek")
+        return self.written
+
+    def flush(self) -> None:
+        self.out.flush()
+
+
+class PageBudget:
+    """Stands in for PdfPages and drops charts once max_pages is nearly reached.
+
+    The last page is reserved for the closing notes, which report how many
+    pages were left out.
+    """
+
+    def __init__(self, pdf: PdfPages, max_pages: int = 0, charts_dir: str = None):
+        self.pdf = pdf
+        self.max_pages = max_pages
+        self.charts_dir = charts_dir
+        self.pages = 0
+        self.dropped = 0
+
+    def savefig(self, fig, **kwargs) -> None:
+        if self.max_pages and self.pages >= self.max_pages - 1:
+            self.dropped += 1
+            return
+        self.pages += 1
+        self.pdf.savefig(fig, **kwargs)
+        if self.charts_dir:
+            fig.savefig(os.path.join(self.charts_dir, f"page-{self.pages:03d}.png"), dpi=100)
+
+
+def add_column_overview(df: pd.DataFrame, pdf: PdfPages, rows_per_page: int = 40) -> None:
+    """One table row per column, summarizing what per-column charts would enumerate."""
+    overview = []
+    for col in df.columns:
+        values = df[col].dropna()
+        top = values.astype(str).value_counts()
+        overview.append([str(col)[:40], str(df[col].dtype), f"{df[col].isna().mean():.1%}",
+                         str(values.nunique()), (top.index[0][:30] if len(top) else "")])
+    for start in range(0, len(overview), rows_per_page):
+        fig, ax = plt.subplots(figsize=(11, 8.5))
+        ax.axis("off")
+        ax.set_title(f"Column Overview ({start + 1}-{min(start + rows_per_page, len(overview))} "
+                     f"of {len(overview)})", fontsize=14, fontweight="bold")
+        table = ax.table(cellText=overview[start:start + rows_per_page],
+                         colLabels=["Column", "Type", "Missing", "Distinct", "Most frequent"], loc="upper center")
+        table.auto_set_font_size(False)
+        table.set_fontsize(7)
+        fig.tight_layout()
+        pdf.savefig(fig)
+        plt.close(fig)
+
+
+def plot_rows(df: pd.DataFrame) -> pd.DataFrame:
+    """Evenly spaced rows, in order, for charts that draw every row."""
+    if len(df) <= MAX_PLOT_ROWS:
+        return df
+    return df.iloc[np.linspace(0, len(df) - 1, MAX_PLOT_ROWS).astype(int)]
+
+
 def add_text_page(pdf: PdfPages, title: str, body: str) -> None:
     fig, ax = plt.subplots(figsize=(11, 8.5))
     ax.axis("off")
-    wrapped = textwrap.fill(body, width=110)
+    wrapped = "\n".join(textwrap.fill(line, width=110) for line in body.split("\n"))
     ax.text(0.02, 0.95, title, fontsize=18, fontweight="bold", va="top")
     ax.text(0.02, 0.90, wrapped, fontsize=11, va="top")
     fig.tight_layout()
@@ -57,12 +595,25 @@ def add_text_page(pdf: PdfPages, title: str, body: str) -> None:
     plt.close(fig)
 
 
-def save_stats_table(desc: pd.DataFrame, pdf: PdfPages, title: str) -> None:
+def save_stats_table(desc: pd.DataFrame, pdf: PdfPages, title: str, semantic: Dict[str, str] = None) -> None:
     if desc.empty:
         return
     fig, ax = plt.subplots(figsize=(11, 8.5))
     ax.axis("off")
     display_df = desc.head(12).round(4)
+    semantic = semantic or {}
+    formatted = [c for c in display_df.index if c in semantic or str(c) in COLUMN_UNITS]
+    if formatted:
+        display_df = display_df.astype(object)
+        for col in formatted:
+            for stat in display_df.columns:
+                value = desc.at[col, stat]
+                if stat in ("count", "missing") or pd.isna(value):
+                    continue
+                if col in semantic:
+                    display_df.at[col, stat] = format_value(value, semantic[col])
+                else:
+                    display_df.at[col, stat] = format_with_unit(value, COLUMN_UNITS[str(col)])
     table = ax.table(cellText=display_df.values,
                      colLabels=display_df.columns,
                      rowLabels=display_df.index,
@@ -76,6 +627,128 @@ def save_stats_table(desc: pd.DataFrame, pdf: PdfPages, title: str) -> None:
     plt.close(fig)
 
 
+# --------------------- SUGGESTIONS --------------------- #
+
+def _looks_like_dates(values: pd.Series) -> bool:
+    sample = values.head(200)
+    with warnings.catch_warnings():
+        warnings.simplefilter("ignore")
+        try:
+            parsed = pd.to_datetime(sample, errors="coerce", format="mixed")
+        except (TypeError, ValueError):
+            parsed = pd.to_datetime(sample, errors="coerce")
+    return parsed.notna().mean() >= 0.9
+
+
+def cleaning_suggestions(df: pd.DataFrame, max_categorical: int = 10) -> List[Dict[str, str]]:
+    """Recommends fixes for common data-quality problems, one entry per column and issue."""
+    suggestions = []
+
+    def suggest(col, issue, detail, fix):
+        suggestions.append({"column": str(col), "issue": issue, "detail": detail, "suggestion": fix})
+
+    for col in df.columns:
+        series = df[col]
+        values = series.dropna()
+        if values.empty:
+            suggest(col, "all_null", "every value is missing", "drop the column")
+            continue
+        if values.nunique() == 1:
+            suggest(col, "constant", f"every value is {values.iloc[0]!r}", "drop the column")
+            continue
+
+        if pd.api.types.is_numeric_dtype(series) and not pd.api.types.is_bool_dtype(series):
+            integral = (values == values.round()).all()
+            if integral and values.nunique() <= max_categorical and len(values) > 2 * values.nunique():
+                suggest(col, "numeric_categorical",
+                        f"only {values.nunique()} distinct integer values",
+                        "treat as categorical (types: category)")
+            continue
+
+        if series.dtype != "object":
+            continue
+        text = values.astype(str)
+        padded = int((text != text.str.strip()).sum())
+        if padded:
+            suggest(col, "surrounding_whitespace", f"{padded} values have leading or trailing whitespace",
+                    "strip whitespace")
+        numeric = pd.to_numeric(text.str.strip(), errors="coerce").notna()
+        if 0 < numeric.sum() < len(text):
+            suggest(col, "mixed_types", f"{int(numeric.sum())} of {len(text)} values are numeric",
+                    "fix or remove the non-numeric values")
+        elif not numeric.any() and _looks_like_dates(text):
+            suggest(col, "date_as_string", "values look like dates but are stored as text",
+                    "parse as datetime (types: datetime:<format>)")
+    return suggestions
+
+
+def infer_task(y: pd.Series) -> str:
+    if not pd.api.types.is_numeric_dtype(y) or pd.api.types.is_bool_dtype(y):
+        return "classification"
+    integral = (y.dropna() == y.dropna().round()).all()
+    if integral and y.nunique() <= MAX_CLASSES:
+        return "classification"
+    return "regression"
+
+
+def target_warnings(df: pd.DataFrame, target: str) -> List[Dict[str, str]]:
+    """Red flags for modelling target: features that give it away, and rare classes."""
+    flags = []
+    labelled = df[df[target].notna()]
+    y = labelled[target]
+    if y.empty:
+        return flags
+    numeric_target = pd.api.types.is_numeric_dtype(y) and not pd.api.types.is_bool_dtype(y)
+
+    for col in labelled.columns:
+        if col == target:
+            continue
+        x = labelled[col]
+        if x.nunique() < 2:
+            continue
+        if numeric_target and pd.api.types.is_numeric_dtype(x) and not pd.api.types.is_bool_dtype(x):
+            corr = x.corr(y)
+            if pd.notna(corr) and abs(corr) >= LEAKAGE_CORRELATION:
+                flags.append({"kind": "target_leakage", "column": str(col),
+                                  "detail": f"correlation with {target} is {corr:.3f}"})
+                continue
+        # A feature that maps each of its (repeated) values to a single target
+        # value predicts the target perfectly; identifiers are excluded.
+        if x.nunique() <= len(x) / 2 and (labelled.groupby(col)[target].nunique() <= 1).all():
+            flags.append({"kind": "target_leakage", "column": str(col),
+                              "detail": f"every value of {col} determines {target} exactly"})
+
+    if infer_task(y) == "classification":
+        shares = y.astype(str).value_counts(normalize=True)
+        rare = shares[shares < IMBALANCE_SHARE]
+        if len(shares) > 1 and not rare.empty:
+            listed = ", ".join(f"{label!r} ({share:.1%})" for label, share in rare.items())
+            flags.append({"kind": "class_imbalance", "column": str(target),
+                              "detail": f"rare classes: {listed}"})
+    return flags
+
+
+def add_warning_page(pdf: PdfPages, target: str, flags: List[Dict[str, str]]) -> None:
+    """A page with the target warnings in a red box, so they are hard to miss."""
+    fig, ax = plt.subplots(figsize=(11, 8.5))
+    ax.axis("off")
+    ax.text(0.02, 0.95, f"Red Flags for Target: {target}", fontsize=18, fontweight="bold",
+            color="darkred", va="top")
+    body = "\n".join(textwrap.fill(f"- {w['column']}: {w['detail']} ({w['kind'].replace('_', ' ')})", width=100)
+                     for w in flags)
+    ax.text(0.04, 0.86, body, fontsize=12, va="top", color="darkred",
+            bbox=dict(boxstyle="round,pad=1", facecolor="mistyrose", edgecolor="red", linewidth=2))
+    fig.tight_layout()
+    pdf.savefig(fig)
+    plt.close(fig)
+
+
+def suggestions_text(suggestions: List[Dict[str, str]]) -> str:
+    if not suggestions:
+        return "No data-cleaning issues were detected."
+    return "\n".join(f"- {s['column']}: {s['detail']} -> {s['suggestion']}" for s in suggestions)
+
+
 # --------------------- PLOTS --------------------- #
 
 def plot_missingness(df: pd.DataFrame, pdf: PdfPages) -> None:
@@ -90,13 +763,30 @@ def plot_missingness(df: pd.DataFrame, pdf: PdfPages) -> None:
     plt.close(fig)
 
 
-def plot_histograms(df: pd.DataFrame, pdf: PdfPages, bins: int = 30, max_cols: int = 12) -> None:
+def plot_missing_heatmap(df: pd.DataFrame, pdf: PdfPages, max_rows: int = 500) -> None:
+    # Sample evenly so large files still fit on one page
+    mask = df.isna()
+    if len(mask) > max_rows:
+        mask = mask.iloc[np.linspace(0, len(mask) - 1, max_rows).astype(int)]
+    fig, ax = plt.subplots(figsize=(11, 8.5))
+    ax.imshow(mask.values, aspect="auto", interpolation="nearest", cmap="Greys")
+    ax.set_title("Missing Values Heatmap (black = missing)", fontsize=14, fontweight="bold")
+    ax.set_xticks(range(len(mask.columns)))
+    ax.set_xticklabels(mask.columns, rotation=90)
+    ax.set_ylabel("Row (sampled)" if len(df) > max_rows else "Row")
+    fig.tight_layout()
+    pdf.savefig(fig)
+    plt.close(fig)
+
+
+def plot_histograms(df: pd.DataFrame, pdf: PdfPages, bins: int = 30, max_cols: int = 12,
+                    log_scale: bool = False) -> None:
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     for col in num_cols:
         fig, ax = plt.subplots(figsize=(8, 4))
-        ax.hist(df[col].dropna(), bins=bins)
+        ax.hist(df[col].dropna(), bins=bins, log=log_scale)
         ax.set_title(f"Histogram: {col}", fontsize=12, fontweight="bold")
-        ax.set_xlabel(col)
+        ax.set_xlabel(axis_label(col))
         ax.set_ylabel("Frequency")
         fig.tight_layout()
         pdf.savefig(fig)
@@ -105,20 +795,21 @@ def plot_histograms(df: pd.DataFrame, pdf: PdfPages, bins: int = 30, max_cols: i
 
 def plot_categorical_bars(df: pd.DataFrame, pdf: PdfPages, top_k: int = 15, max_cols: int = 8) -> None:
     cats = detect_categoricals(df)[:max_cols]
+    top_k = min(top_k, MAX_CATEGORIES_SHOWN)
     for col in cats:
         counts = df[col].astype(str).value_counts().head(top_k)
         fig, ax = plt.subplots(figsize=(10, 5))
         counts.plot(kind="bar", ax=ax)
         ax.set_title(f"Top {top_k} Values: {col}", fontsize=12, fontweight="bold")
         ax.set_ylabel("Count")
-        ax.set_xlabel(col)
+        ax.set_xlabel(axis_label(col))
         fig.tight_layout()
         pdf.savefig(fig)
         plt.close(fig)
 
 
-def plot_correlation_heatmap(df: pd.DataFrame, pdf: PdfPages) -> None:
-    num_df = df.select_dtypes(include=[np.number])
+def plot_correlation_heatmap(df: pd.DataFrame, pdf: PdfPages, max_cols: int = None) -> None:
+    num_df = df.select_dtypes(include=[np.number]).iloc[:, :max_cols]
     if num_df.shape[1] < 2:
         return
     corr = num_df.corr(numeric_only=True)
@@ -135,29 +826,34 @@ def plot_correlation_heatmap(df: pd.DataFrame, pdf: PdfPages) -> None:
     plt.close(fig)
 
 
-def plot_boxplots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8) -> None:
+def plot_boxplots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8, log_scale: bool = False) -> None:
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     for col in num_cols:
         fig, ax = plt.subplots(figsize=(6, 4))
         ax.boxplot(df[col].dropna(), vert=True)
+        if log_scale:
+            ax.set_yscale("log")
         ax.set_title(f"Boxplot: {col}", fontsize=12, fontweight="bold")
-        ax.set_ylabel(col)
+        ax.set_ylabel(axis_label(col))
         pdf.savefig(fig)
         plt.close(fig)
 
 
-def plot_violinplots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 6) -> None:
+def plot_violinplots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 6, log_scale: bool = False) -> None:
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     for col in num_cols:
         fig, ax = plt.subplots(figsize=(6, 4))
         ax.violinplot(df[col].dropna(), showmeans=True)
+        if log_scale:
+            ax.set_yscale("log")
         ax.set_title(f"Violin Plot: {col}", fontsize=12, fontweight="bold")
-        ax.set_ylabel(col)
+        ax.set_ylabel(axis_label(col))
         pdf.savefig(fig)
         plt.close(fig)
 
 
-def plot_density_plots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8) -> None:
+def plot_density_plots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8, bins: int = 30,
+                       log_scale: bool = False) -> None:
     # Density plots without requiring scipy
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     for col in num_cols:
@@ -165,10 +861,10 @@ def plot_density_plots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8) -> No
         if data.empty:
             continue
         fig, ax = plt.subplots(figsize=(6, 4))
-        ax.hist(data, bins=30, density=True, alpha=0.5, label="Histogram")
-        data.plot(kind="hist", bins=30, density=True, alpha=0.3, ax=ax)  # smooth histogram
+        ax.hist(data, bins=bins, density=True, alpha=0.5, label="Histogram", log=log_scale)
+        data.plot(kind="hist", bins=bins, density=True, alpha=0.3, ax=ax, logy=log_scale)  # smooth histogram
         ax.set_title(f"Approx Density Plot: {col}", fontsize=12, fontweight="bold")
-        ax.set_xlabel(col)
+        ax.set_xlabel(axis_label(col))
         ax.legend()
         pdf.savefig(fig)
         plt.close(fig)
@@ -177,26 +873,26 @@ def plot_density_plots(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 8) -> No
 def plot_scatter_matrix(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 5) -> None:
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     if len(num_cols) > 1:
-        fig = scatter_matrix(df[num_cols], figsize=(10, 10), diagonal="kde")
+        fig = scatter_matrix(plot_rows(df[num_cols]).rename(columns=axis_label), figsize=(10, 10), diagonal="kde")
         plt.suptitle("Scatter Matrix", y=1.02, fontsize=14, fontweight="bold")
         pdf.savefig(fig[0][0].figure)
         plt.close(fig[0][0].figure)
 
 
-def plot_line_charts(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 6) -> None:
+def plot_line_charts(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 6, log_scale: bool = False) -> None:
     num_cols = df.select_dtypes(include=[np.number]).columns.tolist()[:max_cols]
     if num_cols:
         fig, ax = plt.subplots(figsize=(10, 5))
-        df[num_cols].plot(ax=ax)
+        plot_rows(df[num_cols]).rename(columns=axis_label).plot(ax=ax, logy=log_scale)
         ax.set_title("Line Chart (first few numeric cols)", fontsize=12, fontweight="bold")
         pdf.savefig(fig)
         plt.close(fig)
 
 
-def plot_pie_charts(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 4) -> None:
+def plot_pie_charts(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 4, top_k: int = 6) -> None:
     cats = detect_categoricals(df)[:max_cols]
     for col in cats:
-        counts = df[col].astype(str).value_counts().head(6)
+        counts = df[col].astype(str).value_counts().head(min(top_k, MAX_CATEGORIES_SHOWN))
         fig, ax = plt.subplots(figsize=(6, 6))
         counts.plot(kind="pie", autopct="%1.1f%%", ax=ax)
         ax.set_ylabel("")
@@ -205,9 +901,38 @@ def plot_pie_charts(df: pd.DataFrame, pdf: PdfPages, max_cols: int = 4) -> None:
         plt.close(fig)
 
 
+# Report charts in page order, by the names the charts option uses
+CHARTS = {
+    "missingness": plot_missingness,
+    "histograms": plot_histograms,
+    "categorical": plot_categorical_bars,
+    "correlations": plot_correlation_heatmap,
+    "boxplots": plot_boxplots,
+    "violins": plot_violinplots,
+    "density": plot_density_plots,
+    "scatter_matrix": plot_scatter_matrix,
+    "timeseries": plot_line_charts,
+    "pie": plot_pie_charts,
+}
+
+# Per-chart option names and the keyword arguments they set
+CHART_OPTION_ARGS = {"max_columns": "max_cols", "max_categories": "top_k", "bins": "bins", "log_scale": "log_scale"}
+
+
+def plot_charts(df: pd.DataFrame, pdf: PdfPages, charts: List[str] = (), options: Dict[str, Dict] = None) -> None:
+    """Draws the selected charts (all when none are selected) with their options."""
+    options = options or {}
+    for name, plot in CHARTS.items():
+        if charts and name not in charts:
+            continue
+        kwargs = {CHART_OPTION_ARGS[k]: v for k, v in options.get(name, {}).items()}
+        plot(df, pdf, **kwargs)
+
+
 # --------------------- MAIN PIPELINE --------------------- #
 
-def summary_text(df: pd.DataFrame, desc: pd.DataFrame) -> str:
+def summary_text(df: pd.DataFrame, desc: pd.DataFrame, semantic: Dict[str, str] = None) -> str:
+    semantic = semantic or {}
     lines = []
     lines.append(f"Rows: {df.shape[0]}, Columns: {df.shape[1]}")
     numeric_cols = df.select_dtypes(include=[np.number]).columns.tolist()
@@ -219,49 +944,445 @@ def summary_text(df: pd.DataFrame, desc: pd.DataFrame) -> str:
         means = desc['mean'].dropna().to_dict()
         if means:
             sample = list(means.items())[:8]
-            lines.append("Sample means: " + "; ".join(f"{k}={v:.4g}" for k, v in sample))
+            lines.append("Sample means: " + "; ".join(f"{k}={summary_value(k, v, semantic)}" for k, v in sample))
+    present = {col: s for col, s in semantic.items() if col in df.columns}
+    if present:
+        lines.append("Semantic types: " + "; ".join(f"{col}={s}" for col, s in sorted(present.items())))
     return "\n".join(lines)
 
 
-def analyze_to_pdf(csv_path: str, out_pdf: str) -> None:
-    df = load_csv_to_df(csv_path)
-    desc = compute_basic_stats(df)
+def summary_value(col, value: float, semantic: Dict[str, str]) -> str:
+    if col in semantic:
+        return format_value(value, semantic[col])
+    if str(col) in COLUMN_UNITS:
+        return format_with_unit(value, COLUMN_UNITS[str(col)])
+    return f"{value:.4g}"
+
+
+def column_mean(values: pd.Series):
+    """The mean of a numeric column, or None when it has no finite mean."""
+    if not pd.api.types.is_numeric_dtype(values) or pd.api.types.is_bool_dtype(values):
+        return None
+    mean = float(values.mean())
+    return mean if np.isfinite(mean) else None
+
+
+def dataset_summary(df: pd.DataFrame, geo: Dict) -> Dict:
+    columns = [{"name": str(c), "dtype": str(df[c].dtype), "missing": int(df[c].isna().sum()),
+                "mean": column_mean(df[c])}
+               for c in df.columns]
+    for column in columns:
+        if column["name"] in COLUMN_UNITS:
+            column["unit"] = COLUMN_UNITS[column["name"]]
+    return {
+        "rows": int(len(df)),
+        "columns": columns,
+        "geo": geo,
+        "datetimes": datetime_summary(df),
+    }
+
 
-    with PdfPages(out_pdf) as pdf:
+# Columns with at most this many distinct values, each seen at least twice on
+# average, are profiled as enumerations
+PROFILE_MAX_ENUM = 20
+
+
+def profile_type(values: pd.Series) -> str:
+    """The Table Schema type of a column."""
+    if pd.api.types.is_bool_dtype(values):
+        return "boolean"
+    if pd.api.types.is_integer_dtype(values):
+        return "integer"
+    if pd.api.types.is_numeric_dtype(values):
+        return "number"
+    if pd.api.types.is_datetime64_any_dtype(values):
+        return "datetime"
+    return "string"
+
+
+def inferred_profile(df: pd.DataFrame) -> Dict:
+    """The inferred type of each column and the constraints its values meet,
+    which the server exports as a Table Schema or Great Expectations suite."""
+    columns = []
+    for c in df.columns:
+        values = df[c]
+        present = values.dropna()
+        column = {"name": str(c), "type": profile_type(values), "dtype": str(values.dtype),
+                  "missing": int(values.isna().sum()), "unique": bool(len(present) and present.is_unique)}
+        if column["type"] in ("integer", "number") and len(present):
+            column["min"], column["max"] = float(present.min()), float(present.max())
+        elif column["type"] == "string":
+            distinct = present.astype(str).unique()
+            if len(distinct) <= PROFILE_MAX_ENUM and 2 * len(distinct) <= len(present):
+                column["enum"] = sorted(distinct.tolist())
+        columns.append(column)
+    return {"rows": int(len(df)), "columns": columns}
+
+
+def private_summary(df: pd.DataFrame, epsilon: float, bounds: Dict[str, List[float]]) -> Dict:
+    """dataset_summary under epsilon-differential privacy, by the Laplace mechanism.
+
+    The row count and every column's missing count have sensitivity 1. Means
+    are released only for numeric columns with bounds: values are clipped to
+    [lo, hi], so their sum has sensitivity max(|lo|, |hi|), and the mean is
+    the noisy sum over the noisy count of present values. epsilon is split
+    evenly over the released statistics (basic composition). Column names
+    and dtypes are treated as public; the geo and datetime statistics have
+    no bounded sensitivity and are withheld.
+    """
+    rng = np.random.default_rng(secrets.randbits(128))
+    bounded = [c for c in df.columns if str(c) in bounds and column_mean(df[c]) is not None]
+    per_statistic = epsilon / (1 + len(df.columns) + len(bounded))
+
+    def noisy(value: float, sensitivity: float) -> float:
+        return value + rng.laplace(0.0, sensitivity / per_statistic)
+
+    rows = noisy(len(df), 1)
+    columns, withheld = [], []
+    for c in df.columns:
+        missing = noisy(int(df[c].isna().sum()), 1)
+        column = {"name": str(c), "dtype": str(df[c].dtype), "missing": max(0, round(missing)), "mean": None}
+        if c in bounded:
+            lo, hi = bounds[str(c)]
+            total = noisy(float(df[c].dropna().clip(lo, hi).sum()), max(abs(lo), abs(hi)))
+            # Post-processing of released statistics costs no budget
+            present = rows - missing
+            column["mean"] = float(np.clip(total / present, lo, hi)) if present >= 1 else None
+        elif column_mean(df[c]) is not None:
+            withheld.append(f"columns[{str(c)!r}].mean")
+        columns.append(column)
+    return {
+        "rows": max(0, round(rows)),
+        "columns": columns,
+        "geo": None,
+        "datetimes": None,
+        "differential_privacy": {
+            "epsilon": epsilon,
+            "mechanism": "laplace",
+            "epsilon_per_statistic": per_statistic,
+            "noised": ["rows", "columns.missing"] + [f"columns[{str(c)!r}].mean" for c in bounded],
+            "exact": ["columns.name", "columns.dtype"],
+            "withheld": ["geo", "datetimes"] + withheld,
+        },
+    }
+
+
+def analyze_to_pdf(csv_path: str, out_pdf: str, include: List[str] = (), exclude: List[str] = (),
+                   types: Dict[str, str] = None, has_header: bool = True,
+                   column_names: List[str] = None, missing_heatmap: bool = False,
+                   suggestions_json: str = None, target: str = None, explain: bool = False,
+                   text_columns: List[str] = (), summary_json: str = None,
+                   charts: List[str] = (), chart_options: Dict[str, Dict] = None, max_pages: int = 0,
+                   pdfa: bool = False, charts_dir: str = None, anonymized: Dict[str, str] = None,
+                   dp_epsilon: float = None, dp_bounds: Dict[str, List[float]] = None,
+                   filtered: str = None, derived: Dict[str, str] = None,
+                   contract: List[Dict] = None, expectations: Dict = None,
+                   profile_json: str = None, provenance: Dict = None,
+                   semantic_types: Dict[str, str] = None, units: Dict[str, str] = None) -> None:
+    semantic_types = semantic_types or {}
+    COLUMN_UNITS.update(units or {})
+    df = load_csv_to_df(csv_path, types, has_header, column_names, semantic_types)
+    df = select_columns(df, list(include), list(exclude))
+    check_supported_columns(df)
+    suggestions = cleaning_suggestions(df)
+    flags = []
+    if target:
+        if target not in df.columns:
+            from model import InvalidTargetError
+            raise InvalidTargetError(f"target column {target!r} is not in the data")
+        flags = target_warnings(df, target)
+    if suggestions_json:
+        result = {"suggestions": suggestions}
+        if target:
+            result["warnings"] = flags
+        with open(suggestions_json, "w") as f:
+            json.dump(result, f)
+    geo = geo_summary(df)
+    if summary_json:
+        with open(summary_json, "w") as f:
+            if dp_epsilon:
+                json.dump(private_summary(df, dp_epsilon, dp_bounds or {}), f)
+            else:
+                json.dump(dataset_summary(df, geo), f)
+    if profile_json:
+        with open(profile_json, "w") as f:
+            json.dump(inferred_profile(df), f)
+    if not out_pdf:
+        return
+    desc = compute_basic_stats(df, semantic_types)
+    identifiers = [c for c in df.columns if semantic_types.get(c) == "identifier"]
+    # Identifiers are labels, not quantities or categories worth charting
+    chart_df = df.drop(columns=identifiers)
+    if explain:
+        # Fit before writing anything so an unusable target fails fast
+        from model import add_explanation_pages, train
+        pipeline, model_summary = train(df, target, explain=True)
+
+    metadata = None
+    if pdfa:
+        # PDF/A forbids Type 3 fonts, matplotlib's default; the server then
+        # converts the file with Ghostscript
+        plt.rcParams["pdf.fonttype"] = 42
+        metadata = {"Title": "DataScribe report", "Creator": "DataScribe", "Subject": f"Analysis of {csv_path}"}
+    if charts_dir:
+        os.makedirs(charts_dir, exist_ok=True)
+    target = StreamedReport(REPORT_STDOUT) if out_pdf == "-" else out_pdf
+    with PdfPages(target, metadata=metadata) as pages:
+        pdf = PageBudget(pages, max_pages, charts_dir)
         # Summary page
-        add_text_page(pdf, "Dataset Summary", summary_text(df, desc))
+        summary = summary_text(df, desc, semantic_types)
+        if derived:
+            summary += "\nDerived columns: " + "; ".join(f"{name} = {expr}" for name, expr in sorted(derived.items()))
+        if filtered:
+            summary = f"Only rows matching the filter {filtered} were analyzed.\n" + summary
+        add_text_page(pdf, "Dataset Summary", summary)
+        if expectations:
+            add_text_page(pdf, "Expectations: " + ("PASSED" if expectations["passed"] else "FAILED"),
+                          expectations_text(expectations))
+        if flags:
+            add_warning_page(pdf, target, flags)
+        add_text_page(pdf, "Data Cleaning Suggestions", suggestions_text(suggestions))
 
         # Stats table
-        save_stats_table(desc, pdf, "Descriptive Statistics (Numeric)")
+        save_stats_table(desc, pdf, "Descriptive Statistics (Numeric)", semantic_types)
+        add_identifier_page(df, identifiers, pdf)
+        if df.shape[1] > WIDE_COLUMNS:
+            add_column_overview(df, pdf)
 
         # Visualizations
-        plot_missingness(df, pdf)
-        plot_histograms(df, pdf)
-        plot_categorical_bars(df, pdf)
-        plot_correlation_heatmap(df, pdf)
-        plot_boxplots(df, pdf)
-        plot_violinplots(df, pdf)
-        plot_density_plots(df, pdf)
-        plot_scatter_matrix(df, pdf)
-        plot_line_charts(df, pdf)
-        plot_pie_charts(df, pdf)
-
-        # Closing notes
-        add_text_page(pdf, "Notes",
-                      "This report was auto-generated. Graphs are limited in number for readability. "
-                      "Consider domain-specific EDA for deeper insights.")
+        if missing_heatmap:
+            plot_missing_heatmap(df, pdf)
+        plot_charts(chart_df, pdf, charts, chart_options)
+        if not charts or "text" in charts:
+            add_text_column_pages(chart_df, detect_text_columns(chart_df, list(text_columns)), pdf)
+        if not charts or "geo" in charts:
+            plot_geo(df, geo, pdf)
+        if not charts or "datetime" in charts:
+            add_datetime_pages(df, pdf)
+
+        # Model explanation: what drives the baseline model fitted above
+        if explain:
+            add_text_page(pdf, f"Model Explanation: {target}",
+                          f"A baseline {model_summary['task']} model was fitted to predict {target} from the "
+                          f"other columns ({model_summary['rows']} labelled rows).\n\nHeld-out metrics: "
+                          + ", ".join(f"{k}={v:.4g}" for k, v in model_summary["metrics"].items())
+                          + "\n\nThe next pages show how much the held-out score drops when each feature is "
+                          "shuffled, and how the average prediction changes with the most important numeric "
+                          "features.")
+            add_explanation_pages(pdf, pipeline, df[model_summary["features"]], model_summary)
+
+        # Appendix on the schema contract the upload met, past the budget
+        if contract:
+            add_text_page(pages, "Appendix: Schema Conformance", conformance_text(contract))
+
+        # Appendix on how the data was anonymized, also past the budget
+        if anonymized:
+            add_text_page(pages, "Appendix: Anonymization", anonymization_text(anonymized))
+
+        # Appendix on where the data came from, for audits
+        if provenance:
+            add_text_page(pages, "Appendix: Provenance", provenance_text(provenance))
+
+        # Closing notes, written past the budget so they always appear
+        notes = ("This report was auto-generated. Graphs are limited in number for readability. "
+                 "Consider domain-specific EDA for deeper insights.")
+        if dp_epsilon:
+            notes += (f"\n\nThe JSON summary of this data was released with differential privacy "
+                      f"(epsilon={dp_epsilon:g}). The figures in this report are exact and must not be "
+                      "published in its place.")
+        if pdf.dropped:
+            notes += (f"\n\n{pdf.dropped} further pages were left out to keep the report within "
+                      f"{max_pages} pages. Select fewer charts or columns to see them.")
+        add_text_page(pages, "Notes", notes)
+
+
+ANONYMIZE_DESCRIPTIONS = {
+    "hash": "replaced by a keyed SHA-256 hash; equal values have equal hashes",
+    "month": "dates generalized to their month",
+    "year": "dates generalized to their year",
+}
+
+
+def anonymization_text(policy: Dict[str, str]) -> str:
+    """Describes the anonymize transforms the server applied before analysis."""
+    lines = ["These columns were transformed before the data reached the analyzer; "
+             "the report describes the transformed values.", ""]
+    for column, spec in sorted(policy.items()):
+        name, _, param = spec.partition(":")
+        if name == "mask":
+            desc = f"all but the last {param or 4} characters masked"
+        elif name == "bucket":
+            desc = f"numbers replaced by intervals of width {param}"
+        else:
+            desc = ANONYMIZE_DESCRIPTIONS.get(name, spec)
+        lines.append(f"- {column}: {desc}")
+    return "\n".join(lines)
+
+
+def conformance_text(contract: List[Dict]) -> str:
+    """Lists the schema contract checks the server verified before analysis."""
+    lines = ["The upload was checked against the schema attached to it before analysis and met "
+             "every check below.", ""]
+    for field in contract:
+        lines.append(f"- {field['column']}: " + ", ".join(field["checks"]))
+    return "\n".join(lines)
+
+
+def expectations_text(expectations: Dict) -> str:
+    """Lists the results of the dataset's expectation suite, failures first."""
+    results = expectations["results"]
+    lines = [f"{len(results) - expectations['failed']} of {len(results)} expectations of the dataset passed."]
+    if expectations.get("gate") and not expectations["passed"]:
+        lines.append("The suite is a gate: this upload did not meet it.")
+    lines.append("")
+    for r in sorted(results, key=lambda r: r["passed"]):
+        bounds = [f"{k} {r[k]:g}" for k in ("min", "max", "mostly") if r.get(k) is not None]
+        line = f"[{'PASS' if r['passed'] else 'FAIL'}] {r['type']}"
+        if r.get("column"):
+            line += f" {r['column']}"
+        if bounds:
+            line += " (" + ", ".join(bounds) + ")"
+        observed = r.get("observed")
+        if isinstance(observed, list):
+            line += f": observed {observed[0]:g} to {observed[1]:g}"
+        elif observed is not None:
+            line += f": observed {observed:g}"
+        if r.get("detail"):
+            line += f" - {r['detail']}"
+        lines.append(line)
+    return "\n".join(lines)
+
+
+def provenance_text(provenance: Dict) -> str:
+    """Describes where the analyzed data came from and how it was processed."""
+    analyzer = provenance.get("analyzer") or {}
+    lines = [
+        f"File: {provenance['filename']} ({provenance['size_bytes']} bytes)",
+        f"SHA-256 as received: {provenance.get('sha256') or 'not recorded'}",
+        f"SHA-256 as analyzed: {provenance.get('analyzed_sha256') or 'not recorded'}",
+        f"Submitted by: {provenance['submitter'] or 'anonymous'} via {provenance['channel']} upload",
+    ]
+    if provenance.get("source"):
+        lines.append(f"Source: {provenance['source']}")
+    if analyzer:
+        lines.append(f"Analyzer: {analyzer['script']} (SHA-256 {analyzer['script_sha256']}), server {analyzer['server']}")
+        if analyzer.get("script_git_hash"):
+            lines.append(f"Analyzer git object: {analyzer['script_git_hash']}")
+        env = analyzer.get("environment")
+        if env:
+            lines.append(f"Python {env['python']} with {len(env['packages'])} packages "
+                         f"(environment SHA-256 {env['sha256']})")
+    options = provenance.get("options") or {}
+    shown = {k: json.dumps(v) for k, v in sorted(options.items())}
+    lines += ["", "Options:"] + ([f"  {k} = {v if len(v) <= 200 else v[:200] + '...'}" for k, v in shown.items()]
+                                 or ["  (defaults)"])
+    if provenance.get("schema_sha256"):
+        lines.append(f"  schema = SHA-256 {provenance['schema_sha256']}")
+    lines += ["", "Stages completed before this report was written:"]
+    lines += [f"  {st['stage']}: {st['duration_ms'] / 1000:.3f} s" for st in provenance.get("stages", [])]
+    lines += ["", "Later stages are recorded in the job's provenance metadata."]
+    return "\n".join(lines)
+
+
+def load_json_file(path: str):
+    """Reads a JSON flag passed as a file, for values too large for the command line."""
+    with open(path) as f:
+        return json.load(f)
 
 
 def parse_args() -> argparse.Namespace:
     p = argparse.ArgumentParser()
     p.add_argument("--input", "-i", required=True, help="Path to input CSV")
-    p.add_argument("--output", "-o", required=True, help="Path to output PDF")
-    return p.parse_args()
+    p.add_argument("--output", "-o", help="Path to output PDF, or - to write it to stdout (as --output=-)")
+    p.add_argument("--suggestions-json", metavar="PATH", help="Also write data-cleaning suggestions as JSON")
+    p.add_argument("--summary-json", metavar="PATH",
+                   help="Also write a dataset summary (columns, geospatial and datetime statistics) as JSON")
+    p.add_argument("--profile-json", metavar="PATH",
+                   help="Also write the inferred type and constraints of each column as JSON")
+    p.add_argument("--include-column", action="append", default=[], metavar="NAME",
+                   help="Only analyze this column (repeatable)")
+    p.add_argument("--exclude-column", action="append", default=[], metavar="NAME",
+                   help="Leave this column out of the analysis (repeatable)")
+    p.add_argument("--types", type=json.loads, default={},
+                   help='JSON object of column type hints, e.g. {"ts": "datetime:%%d/%%m/%%Y"}')
+    p.add_argument("--semantic-types", type=json.loads, default={},
+                   help='JSON object of what columns hold, e.g. {"price": "currency:EUR", "order_id": "identifier"}')
+    p.add_argument("--units", type=json.loads, default={},
+                   help='JSON object of the units of numeric columns, e.g. {"latency": "ms", "price": "€"}')
+    p.add_argument("--no-header", dest="has_header", action="store_false",
+                   help="The first row is data, not column names")
+    p.add_argument("--column-names", type=json.loads, default=None,
+                   help="JSON array of column names replacing (or, with --no-header, supplying) the header")
+    p.add_argument("--missing-heatmap", action="store_true",
+                   help="Add a heatmap of missing values to the report")
+    p.add_argument("--text-column", action="append", default=[], metavar="NAME",
+                   help="Analyze this column as free text (repeatable)")
+    p.add_argument("--chart", action="append", default=[], choices=[*CHARTS, "text", "geo", "datetime"],
+                   help="Only draw this chart or section (repeatable; default all)")
+    p.add_argument("--chart-options", type=json.loads, default={},
+                   help='JSON object of per-chart options, e.g. {"histograms": {"bins": 50, "log_scale": true}}')
+    p.add_argument("--pdfa", action="store_true",
+                   help="Embed TrueType fonts and document metadata for PDF/A conversion")
+    p.add_argument("--max-pages", type=int, default=0,
+                   help="Stop adding charts once the report has this many pages (0 = no limit)")
+    p.add_argument("--anonymized", type=json.loads, default={},
+                   help="JSON object of the anonymize transforms applied to the input, for the report appendix")
+    p.add_argument("--contract-file", dest="contract", type=load_json_file, default=[], metavar="PATH",
+                   help="JSON file listing the schema checks the input passed, for the report appendix")
+    p.add_argument("--expectations", type=json.loads, default=None,
+                   help="JSON results of the dataset's expectation suite, for the report")
+    p.add_argument("--provenance-file", dest="provenance", type=load_json_file, default=None, metavar="PATH",
+                   help="JSON file of the provenance of the input, for the report appendix")
+    p.add_argument("--derived", type=json.loads, default={},
+                   help="JSON object of the columns the server derived from others, noted in the report")
+    p.add_argument("--filtered", metavar="EXPR",
+                   help="The row filter applied to the input, noted in the report")
+    p.add_argument("--dp-epsilon", type=float, metavar="EPSILON",
+                   help="Release the --summary-json output with Laplace noise for this privacy budget")
+    p.add_argument("--dp-bounds", type=json.loads, default={},
+                   help='JSON object of [lo, hi] value bounds of numeric columns, e.g. {"age": [0, 120]}; '
+                        "only bounded columns get a noisy mean")
+    p.add_argument("--charts-dir", metavar="DIR",
+                   help="Also save every report page as a PNG in this directory")
+    p.add_argument("--target", help="Column a model would predict")
+    p.add_argument("--explain", action="store_true",
+                   help="Fit a baseline model for --target and explain it in the report")
+    args = p.parse_args()
+    if not args.output and not args.suggestions_json and not args.summary_json and not args.profile_json:
+        p.error("one of --output, --suggestions-json, --summary-json or --profile-json is required")
+    if args.output == "-" and REPORT_STDOUT is None:
+        p.error("write the report to stdout with --output=-, as a single argument")
+    if args.explain and not args.target:
+        p.error("--explain requires --target")
+    if args.dp_epsilon is not None and not args.dp_epsilon > 0:
+        p.error("--dp-epsilon must be positive")
+    if args.dp_bounds and not args.dp_epsilon:
+        p.error("--dp-bounds requires --dp-epsilon")
+    return args
 
 
 def main():
+    # model.py builds on this module, so import it only once this one is loaded
+    from model import EXIT_INVALID_TARGET, InvalidTargetError
+
     args = parse_args()
-    analyze_to_pdf(args.input, args.output)
+    try:
+        analyze_to_pdf(args.input, args.output, args.include_column, args.exclude_column, args.types,
+                       args.has_header, args.column_names, args.missing_heatmap,
+                       args.suggestions_json, args.target, args.explain, args.text_column,
+                       args.summary_json, args.chart, args.chart_options, args.max_pages,
+                       args.pdfa, args.charts_dir, args.anonymized, args.dp_epsilon, args.dp_bounds,
+                       args.filtered, args.derived, args.contract, args.expectations,
+                       args.profile_json, args.provenance, args.semantic_types, args.units)
+    except (pd.errors.ParserError, pd.errors.EmptyDataError, UnicodeDecodeError) as e:
+        print(f"malformed CSV: {e}", file=sys.stderr)
+        sys.exit(EXIT_MALFORMED_CSV)
+    except UnsupportedColumnsError as e:
+        print(str(e), file=sys.stderr)
+        sys.exit(EXIT_UNSUPPORTED_COLUMNS)
+    except InvalidTargetError as e:
+        print(str(e), file=sys.stderr)
+        sys.exit(EXIT_INVALID_TARGET)
 
 
 if __name__ == "__main__":
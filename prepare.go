@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// prepareRows checks the CSV at path against the schema of opts, if any,
+// and then rewrites it in one streaming pass: it appends
+// the derived columns of opts, keeps only the rows matching its filter and
+// then applies its anonymize transforms, so a filter sees the original
+// values. It does nothing when there are none; call it after opts.validate,
+// which checks that the columns exist.
+func prepareRows(ws *workspace, path string, opts analysisOptions) error {
+	if opts.Schema != "" {
+		if err := checkContract(path, opts); err != nil {
+			return err
+		}
+	}
+	if opts.Filter == "" && len(opts.Anonymize) == 0 && len(opts.Derive) == 0 {
+		return nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedInput, err)
+	}
+	header = slices.Clone(header)
+
+	names := uploadColumnNames(header, opts)
+	width := len(names)
+	var derive *derivation
+	if len(opts.Derive) > 0 {
+		if derive, err = newDerivation(opts.Derive, names); err != nil {
+			return err
+		}
+		names = slices.Concat(names, derivedNames(opts.Derive))
+		header = slices.Concat(header, derivedNames(opts.Derive))
+	}
+	var filter *rowFilter
+	if opts.Filter != "" {
+		if filter, err = parseFilter(opts.Filter); err != nil {
+			return err
+		}
+		if err := filter.bind(names); err != nil {
+			return err
+		}
+	}
+	transforms := make([]*anonymizeTransform, len(names))
+	for i, name := range names {
+		if spec, ok := opts.Anonymize[name]; ok {
+			t, _ := parseTransform(spec)
+			transforms[i] = &t
+		}
+	}
+
+	tmp := path + ".prepared"
+	defer os.Remove(tmp)
+	out, w, err := createIn(ws, tmp)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cw := csv.NewWriter(w)
+	kept := 0
+	write := func(rec []string) error {
+		if derive != nil {
+			rec = derive.extend(rec, width)
+		}
+		if filter != nil && !filter.match(rec) {
+			return nil
+		}
+		kept++
+		for i, t := range transforms {
+			if t != nil && i < len(rec) {
+				rec[i] = t.apply(rec[i])
+			}
+		}
+		return cw.Write(rec)
+	}
+	if opts.hasHeader() {
+		err = cw.Write(header)
+	} else {
+		err = write(header[:width])
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errMalformedInput, err)
+		}
+		if err := write(rec); err != nil {
+			return err
+		}
+	}
+	if kept == 0 && filter != nil {
+		return fmt.Errorf("%w: %s", errNoMatchingRows, opts.Filter)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// uploadColumnNames returns the names of the columns of an upload whose
+// first record is header: the header itself, column_1, column_2, ... when
+// it is data, or ColumnNames.
+func uploadColumnNames(header []string, opts analysisOptions) []string {
+	if len(opts.ColumnNames) == len(header) {
+		return slices.Clone(opts.ColumnNames)
+	}
+	names := slices.Clone(header)
+	names[0] = strings.TrimPrefix(names[0], "\ufeff")
+	if !opts.hasHeader() {
+		for i := range names {
+			names[i] = "column_" + strconv.Itoa(i+1)
+		}
+	}
+	return names
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Presets are named bundles of analysis options that admins define once,
+// so that clients submit preset=finance-monthly instead of repeating the
+// same fields. A preset belongs to a tenant, the identity of its callers,
+// or with tenant * to every tenant; a tenant's own preset shadows a global
+// one of the same name. A tenant's preset named default applies to its
+// submissions that name no preset.
+//
+// The fields of a submission take precedence over those of its preset.
+// Presets are kept in cfg.PresetsFile (DATASCRIBE_PRESETS_FILE) and
+// managed with GET /admin/presets and PUT and DELETE
+// /admin/presets/{tenant}/{name}; callers list theirs with GET /presets.
+
+const (
+	allTenants    = "*"
+	defaultPreset = "default"
+)
+
+// preset is a named set of analysis option fields, encoded as in the JSON
+// of analysisOptions.
+type preset struct {
+	Description string                     `json:"description,omitempty"`
+	Options     map[string]json.RawMessage `json:"options"`
+}
+
+var presets struct {
+	mu sync.Mutex
+	// byTenant maps tenants, or allTenants, to their presets by name.
+	byTenant map[string]map[string]preset
+}
+
+// loadPresets reads cfg.PresetsFile, if it exists.
+func loadPresets() error {
+	byTenant := map[string]map[string]preset{}
+	data, err := os.ReadFile(cfg.PresetsFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &byTenant); err != nil {
+			return fmt.Errorf("%s: %w", cfg.PresetsFile, err)
+		}
+	}
+	presets.mu.Lock()
+	presets.byTenant = byTenant
+	presets.mu.Unlock()
+	return nil
+}
+
+// savePresets writes the presets atomically. presets.mu must be held.
+func savePresets() error {
+	data, err := json.MarshalIndent(presets.byTenant, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cfg.PresetsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.PresetsFile)
+}
+
+// lookupPreset returns the preset name of tenant, or the global one.
+func lookupPreset(tenant, name string) (preset, bool) {
+	presets.mu.Lock()
+	defer presets.mu.Unlock()
+	if p, ok := presets.byTenant[tenant][name]; ok {
+		return p, true
+	}
+	p, ok := presets.byTenant[allTenants][name]
+	return p, ok
+}
+
+// field returns the value of an option field in the form of a request field.
+func (p preset) field(name string) string {
+	raw, ok := p.Options[name]
+	if !ok {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return string(raw)
+	}
+	return s
+}
+
+// withPreset returns get with the fields of the preset the request asks
+// for, with its preset field, or of the default preset of the caller of
+// r, filled in. It fails with an *invalidFieldsError for an unknown preset.
+func withPreset(r *http.Request, get func(string) string) (func(string) string, error) {
+	tenant := identityFrom(r)
+	name := strings.TrimSpace(get("preset"))
+	p, ok := lookupPreset(tenant, name)
+	if name == "" {
+		if p, ok = lookupPreset(tenant, defaultPreset); !ok {
+			return get, nil
+		}
+	} else if !ok {
+		errs := &invalidFieldsError{}
+		errs.add("preset", fmt.Errorf("unknown preset %q", name), visiblePresetNames(tenant)...)
+		return nil, errs
+	}
+	return func(field string) string {
+		if v := get(field); v != "" {
+			return v
+		}
+		return p.field(field)
+	}, nil
+}
+
+// presetEntry is a preset as listed.
+type presetEntry struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+	preset
+}
+
+// visiblePresets returns the presets tenant can use, by name.
+func visiblePresets(tenant string) []presetEntry {
+	presets.mu.Lock()
+	defer presets.mu.Unlock()
+	seen := map[string]presetEntry{}
+	for name, p := range presets.byTenant[allTenants] {
+		seen[name] = presetEntry{Name: name, Tenant: allTenants, preset: p}
+	}
+	if tenant != "" {
+		for name, p := range presets.byTenant[tenant] {
+			seen[name] = presetEntry{Name: name, Tenant: tenant, preset: p}
+		}
+	}
+	list := make([]presetEntry, 0, len(seen))
+	for _, name := range slices.Sorted(maps.Keys(seen)) {
+		list = append(list, seen[name])
+	}
+	return list
+}
+
+func visiblePresetNames(tenant string) []string {
+	var names []string
+	for _, e := range visiblePresets(tenant) {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func registerPresets() {
+	handleAPI("GET /presets", protected(handleListPresets))
+	handleAPI("GET /admin/presets", protected(requireAdmin(handleListAllPresets)))
+	handleAPI("PUT /admin/presets/{tenant}/{name}", protected(requireAdmin(handleSetPreset)))
+	handleAPI("DELETE /admin/presets/{tenant}/{name}", protected(requireAdmin(handleDeletePreset)))
+}
+
+// handleListPresets lists the presets of the caller.
+func handleListPresets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"presets": visiblePresets(identityFrom(r))})
+}
+
+// handleListAllPresets lists the presets of every tenant.
+func handleListAllPresets(w http.ResponseWriter, r *http.Request) {
+	presets.mu.Lock()
+	list := []presetEntry{}
+	for _, tenant := range slices.Sorted(maps.Keys(presets.byTenant)) {
+		for _, name := range slices.Sorted(maps.Keys(presets.byTenant[tenant])) {
+			list = append(list, presetEntry{Name: name, Tenant: tenant, preset: presets.byTenant[tenant][name]})
+		}
+	}
+	presets.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"presets": list})
+}
+
+// handleSetPreset creates or replaces a preset with the JSON body.
+func handleSetPreset(w http.ResponseWriter, r *http.Request) {
+	tenant, name := r.PathValue("tenant"), r.PathValue("name")
+	if err := checkPresetName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var p preset
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(p.Description) > maxNameLength {
+		http.Error(w, fmt.Sprintf("description must be at most %d bytes", maxNameLength), http.StatusBadRequest)
+		return
+	}
+	if p.Options == nil {
+		p.Options = map[string]json.RawMessage{}
+	}
+	if _, err := decodeAnalysisOptions(p.field, slices.Collect(maps.Keys(p.Options)), nil); err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	presets.mu.Lock()
+	if presets.byTenant[tenant] == nil {
+		presets.byTenant[tenant] = map[string]preset{}
+	}
+	previous, existed := presets.byTenant[tenant][name]
+	presets.byTenant[tenant][name] = p
+	err := savePresets()
+	if err != nil {
+		if existed {
+			presets.byTenant[tenant][name] = previous
+		} else {
+			delete(presets.byTenant[tenant], name)
+		}
+	}
+	presets.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to save preset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	audit(r, "preset_changed", map[string]any{"tenant": tenant, "preset": name, "options": slices.Sorted(maps.Keys(p.Options))})
+	writeJSON(w, http.StatusOK, presetEntry{Name: name, Tenant: tenant, preset: p})
+}
+
+// handleDeletePreset removes a preset.
+func handleDeletePreset(w http.ResponseWriter, r *http.Request) {
+	tenant, name := r.PathValue("tenant"), r.PathValue("name")
+	presets.mu.Lock()
+	p, ok := presets.byTenant[tenant][name]
+	var err error
+	if ok {
+		delete(presets.byTenant[tenant], name)
+		if len(presets.byTenant[tenant]) == 0 {
+			delete(presets.byTenant, tenant)
+		}
+		if err = savePresets(); err != nil {
+			if presets.byTenant[tenant] == nil {
+				presets.byTenant[tenant] = map[string]preset{}
+			}
+			presets.byTenant[tenant][name] = p
+		}
+	}
+	presets.mu.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, "preset not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to save presets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	audit(r, "preset_deleted", map[string]any{"tenant": tenant, "preset": name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func checkPresetName(name string) error {
+	if name == "" || len(name) > maxNameLength || strings.ContainsAny(name, " \t\r\n/") {
+		return fmt.Errorf("invalid preset name %q: want at most %d bytes without spaces or slashes", name, maxNameLength)
+	}
+	return nil
+}
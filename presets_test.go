@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// presetRequest is a request of tenant, or an anonymous one for "".
+func presetRequest(method, target, tenant, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if tenant != "" {
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, tenant))
+	}
+	return r
+}
+
+func TestPresets(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() {
+		cfg = saved
+		loadPresets()
+	})
+	cfg.PresetsFile = filepath.Join(t.TempDir(), "presets.json")
+	if err := loadPresets(); err != nil {
+		t.Fatal(err)
+	}
+
+	puts := []struct {
+		tenant, name, body string
+		status             int
+	}{
+		{"*", "monthly", `{"description": "everyone", "options": {"target": "revenue", "charts": ["histograms"]}}`, http.StatusOK},
+		{"acme", "monthly", `{"options": {"target": "margin"}}`, http.StatusOK},
+		{"acme", "default", `{"options": {"delimiter": "semicolon"}}`, http.StatusOK},
+		{"acme", "bad name", `{"options": {}}`, http.StatusBadRequest},
+		{"acme", "typo", `{"options": {"targt": "x"}}`, http.StatusBadRequest},
+		{"acme", "invalid", `{"options": {"explain": "sometimes"}}`, http.StatusBadRequest},
+		{"acme", "unknown", `{"options": {}, "extra": 1}`, http.StatusBadRequest},
+	}
+	for _, tt := range puts {
+		r := presetRequest("PUT", "/admin/presets/"+url.PathEscape(tt.tenant)+"/"+url.PathEscape(tt.name), "root", tt.body)
+		r.SetPathValue("tenant", tt.tenant)
+		r.SetPathValue("name", tt.name)
+		w := httptest.NewRecorder()
+		handleSetPreset(w, r)
+		if w.Code != tt.status {
+			t.Errorf("PUT %s/%s = %d, want %d: %s", tt.tenant, tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	tests := []struct {
+		tenant, query string
+		want          string // target and delimiter, as resolved
+		wantErr       bool
+	}{
+		// A named preset is used instead of the default one, not on top
+		{tenant: "acme", query: "preset=monthly", want: "margin "},
+		{tenant: "acme", query: "preset=monthly&target=cost", want: "cost "},
+		{tenant: "acme", query: "preset=monthly&delimiter=tab", want: "margin tab"},
+		{tenant: "acme", query: "", want: " semicolon"},
+		{tenant: "globex", query: "preset=monthly", want: "revenue "},
+		{tenant: "", query: "preset=monthly", want: "revenue "},
+		{tenant: "globex", query: "", want: " "},
+		{tenant: "globex", query: "preset=default", wantErr: true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		get, err := withPreset(presetRequest("POST", "/predict", tt.tenant, ""), q.Get)
+		var fe *invalidFieldsError
+		if tt.wantErr {
+			if !errors.As(err, &fe) || fe.Problems[0].Field != "preset" {
+				t.Errorf("%s %q: error = %v, want an unknown preset", tt.tenant, tt.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.tenant, tt.query, err)
+			continue
+		}
+		if got := get("target") + " " + get("delimiter"); got != tt.want {
+			t.Errorf("%s %q: resolved %q, want %q", tt.tenant, tt.query, got, tt.want)
+		}
+	}
+	if got := strings.Join(visiblePresetNames("acme"), ","); got != "default,monthly" {
+		t.Errorf("presets of acme = %s", got)
+	}
+
+	// The presets survive a restart, and deleting acme's own preset
+	// uncovers the global one
+	if err := loadPresets(); err != nil {
+		t.Fatal(err)
+	}
+	r := presetRequest("DELETE", "/admin/presets/acme/monthly", "root", "")
+	r.SetPathValue("tenant", "acme")
+	r.SetPathValue("name", "monthly")
+	w := httptest.NewRecorder()
+	handleDeletePreset(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", w.Code)
+	}
+	p, ok := lookupPreset("acme", "monthly")
+	if charts, _ := parseNameList("charts", p.field("charts")); !ok || p.field("target") != "revenue" || !slices.Equal(charts, []string{"histograms"}) {
+		t.Errorf("acme's monthly after the delete = %+v, want the global one", p)
+	}
+	if data, _ := os.ReadFile(cfg.PresetsFile); strings.Contains(string(data), "margin") {
+		t.Errorf("the deleted preset is still saved: %s", data)
+	}
+}
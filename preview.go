@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// previewLocks serialises rendering of a job's previews so concurrent
+// requests for the same page render it once.
+var (
+	previewLocksMu sync.Mutex
+	previewLocks   = map[string]*sync.Mutex{}
+)
+
+func previewLock(id string) *sync.Mutex {
+	previewLocksMu.Lock()
+	defer previewLocksMu.Unlock()
+	mu, ok := previewLocks[id]
+	if !ok {
+		mu = new(sync.Mutex)
+		previewLocks[id] = mu
+	}
+	return mu
+}
+
+// forgetPreviews drops the preview lock of a deleted job.
+func forgetPreviews(id string) {
+	previewLocksMu.Lock()
+	delete(previewLocks, id)
+	previewLocksMu.Unlock()
+}
+
+// handleGetJobPreview serves a PNG of one page (page, 1-based, default 1) of
+// a finished job's report. Pages are rendered with Ghostscript on first
+// request and cached in the job workspace until the job expires.
+func handleGetJobPreview(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	page := 1
+	if v := r.FormValue("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if j.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("report not available: job is %s", j.Status), http.StatusConflict)
+		return
+	}
+
+	path := j.ws.path(fmt.Sprintf("preview-%d.png", page))
+	mu := previewLock(j.ID)
+	mu.Lock()
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		err = renderPreview(r.Context(), j.reportPath(), path, page)
+	}
+	mu.Unlock()
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("report has no page %d", page), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("preview of job %s page %d: %v", j.ID, page, err)
+		http.Error(w, "failed to render preview", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open preview: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, j.ReportSHA256, page))
+	http.ServeContent(w, r, "", *j.FinishedAt, f)
+}
+
+// renderPreview draws page of the PDF at report to a PNG at out at
+// cfg.PreviewResolution. It returns an os.IsNotExist error when the report
+// has fewer pages: Ghostscript then writes nothing, and newer releases also
+// complain about FirstPage.
+func renderPreview(ctx context.Context, report, out string, page int) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.AnalysisTimeout)
+	defer cancel()
+
+	tmp := out + ".rendering"
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, cfg.Ghostscript,
+		"-dSAFER", "-dBATCH", "-dNOPAUSE", "-dQUIET", "-sDEVICE=png16m",
+		"-dTextAlphaBits=4", "-dGraphicsAlphaBits=4",
+		"-r"+strconv.Itoa(cfg.PreviewResolution),
+		"-dFirstPage="+strconv.Itoa(page), "-dLastPage="+strconv.Itoa(page),
+		"-sOutputFile="+tmp, report)
+	cmd.WaitDelay = 5 * time.Second
+	stderr := &tailBuffer{limit: cfg.AnalyzerLogLimit}
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil && !strings.Contains(stderr.String(), "FirstPage") {
+		return fmt.Errorf("%v: %s", err, lastLine(stderr.String()))
+	}
+	if info, err := os.Stat(tmp); err != nil || info.Size() == 0 {
+		return os.ErrNotExist
+	}
+	return os.Rename(tmp, out)
+}
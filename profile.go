@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// POST /profile summarizes every column of an uploaded CSV in Go, without
+// the Python engine. The file is split at record boundaries into chunks of
+// profileChunkSize bytes, which DATASCRIBE_PROFILE_WORKERS goroutines (one
+// per CPU by default) parse and summarize in parallel. Distinct values are
+// estimated with HyperLogLog, quantiles with a t-digest and the most
+// frequent values with a Count-Min sketch, so memory stays fixed per column
+// whatever the size of the file; profileAccuracy documents the error
+// bounds. With exact=true every value is kept instead, and memory grows
+// with the file. Partial results are merged in file order, which keeps the
+// profile of a file reproducible.
+
+const (
+	profileChunkSize = 1 << 20
+	// profileTopValues is how many of the most frequent values are listed
+	// for non-numeric columns.
+	profileTopValues = 10
+)
+
+// profileQuantiles are the quantiles reported for numeric columns.
+var profileQuantiles = []struct {
+	name string
+	q    float64
+}{{"p1", 0.01}, {"p5", 0.05}, {"p25", 0.25}, {"p50", 0.5}, {"p75", 0.75}, {"p95", 0.95}, {"p99", 0.99}}
+
+// profileReport is the response of POST /profile.
+type profileReport struct {
+	Rows    int              `json:"rows"`
+	Columns []profiledColumn `json:"columns"`
+	// Chunks is the number of parts the file was profiled in, by Workers
+	// goroutines.
+	Chunks  int `json:"chunks"`
+	Workers int `json:"workers"`
+	// Accuracy is set unless the profile is exact.
+	Accuracy *sketchAccuracy `json:"accuracy,omitempty"`
+}
+
+// sketchAccuracy states the error bounds of approximate statistics.
+type sketchAccuracy struct {
+	// DistinctRelativeError is the standard error of distinct counts
+	// (1.04/sqrt(m) for m HyperLogLog registers); small counts are close to
+	// exact.
+	DistinctRelativeError float64 `json:"distinct_relative_error"`
+	// QuantileRankError bounds how far, as a fraction of the values, a
+	// quantile can be from the requested rank; it is much smaller towards
+	// the tails.
+	QuantileRankError float64 `json:"quantile_rank_error"`
+	// TopCountError is the share of the column's values by which a count of
+	// a top value may exceed the true count, with probability
+	// TopCountConfidence. Counts are never too low.
+	TopCountError      float64 `json:"top_count_error,omitempty"`
+	TopCountConfidence float64 `json:"top_count_confidence,omitempty"`
+}
+
+var profileAccuracy = &sketchAccuracy{
+	DistinctRelativeError: round4(1.04 / math.Sqrt(1<<hllPrecision)),
+	QuantileRankError:     round4(1 / float64(tdigestCompression)),
+	TopCountError:         round4(math.E / cmsWidth),
+	TopCountConfidence:    round4(1 - math.Exp(-cmsDepth)),
+}
+
+// profiledColumn summarizes one column. The moments and quantiles are set
+// for numeric columns, and Top for the others.
+type profiledColumn struct {
+	Name       string             `json:"name"`
+	Numeric    bool               `json:"numeric"`
+	Count      int                `json:"count"`
+	Missing    int                `json:"missing"`
+	MissingPct float64            `json:"missing_pct"`
+	Distinct   int                `json:"distinct"`
+	Mean       *float64           `json:"mean,omitempty"`
+	Std        *float64           `json:"std,omitempty"`
+	Min        *float64           `json:"min,omitempty"`
+	Max        *float64           `json:"max,omitempty"`
+	Quantiles  map[string]float64 `json:"quantiles,omitempty"`
+	Top        []valueCount       `json:"top,omitempty"`
+}
+
+// columnSketch is the mergeable summary of a column over part of the file.
+type columnSketch struct {
+	count, missing int
+	// numeric holds while every value seen parses as a finite float; mean
+	// and m2 (the sum of squared deviations) are then those of all values.
+	numeric  bool
+	mean, m2 float64
+	lo, hi   float64
+	// The sketches, or for an exact profile every value: counts of each
+	// and the numeric ones.
+	digest   *tdigest
+	distinct *hyperLogLog
+	frequent *heavyHitters
+	counts   map[string]int
+	values   []float64
+}
+
+func (s *columnSketch) add(v string) {
+	if isNA(v) {
+		s.missing++
+		return
+	}
+	s.count++
+	if s.counts != nil {
+		s.counts[v]++
+	} else {
+		x := hashString(v)
+		s.distinct.add(x)
+		s.frequent.add(v, x)
+	}
+	if !s.numeric {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		s.numeric, s.digest, s.values = false, nil, nil
+		return
+	}
+	delta := f - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (f - s.mean)
+	s.lo, s.hi = min(s.lo, f), max(s.hi, f)
+	if s.counts != nil {
+		s.values = append(s.values, f)
+		return
+	}
+	if s.digest == nil {
+		s.digest = newTDigest()
+	}
+	s.digest.add(f)
+}
+
+// merge adds the summary o of the part of the file following s.
+func (s *columnSketch) merge(o *columnSketch) {
+	s.missing += o.missing
+	if o.count == 0 {
+		return
+	}
+	if s.counts != nil {
+		for v, n := range o.counts {
+			s.counts[v] += n
+		}
+	} else {
+		s.distinct.merge(o.distinct)
+		s.frequent.merge(o.frequent)
+	}
+	if s.numeric = s.numeric && o.numeric; s.numeric {
+		n := float64(s.count + o.count)
+		delta := o.mean - s.mean
+		s.m2 += o.m2 + delta*delta*float64(s.count)*float64(o.count)/n
+		s.mean += delta * float64(o.count) / n
+		s.lo, s.hi = min(s.lo, o.lo), max(s.hi, o.hi)
+		s.values = append(s.values, o.values...)
+		if o.digest != nil {
+			if s.digest == nil {
+				s.digest = newTDigest()
+			}
+			s.digest.merge(o.digest)
+		}
+	} else {
+		s.digest, s.values = nil, nil
+	}
+	s.count += o.count
+}
+
+func newColumnSketches(n int, exact bool) []columnSketch {
+	sketches := make([]columnSketch, n)
+	for i := range sketches {
+		s := &sketches[i]
+		s.numeric, s.lo, s.hi = true, math.Inf(1), math.Inf(-1)
+		if exact {
+			s.counts = map[string]int{}
+		} else {
+			s.distinct, s.frequent = &hyperLogLog{}, newHeavyHitters()
+		}
+	}
+	return sketches
+}
+
+// quantile returns the q-quantile of the numeric values.
+func (s *columnSketch) quantile(q float64) float64 {
+	if s.digest != nil {
+		return s.digest.quantile(q)
+	}
+	return quantile(s.values, q)
+}
+
+// column returns the summary of the column name, of rows in total.
+func (s *columnSketch) column(name string, rows int) profiledColumn {
+	c := profiledColumn{Name: name, Numeric: s.numeric && s.count > 0, Count: s.count, Missing: s.missing,
+		MissingPct: round4(pct(s.missing, rows))}
+	if s.counts != nil {
+		c.Distinct = len(s.counts)
+	} else {
+		c.Distinct = min(s.distinct.estimate(), s.count)
+	}
+	if !c.Numeric {
+		if s.counts != nil {
+			c.Top = topValues(s.counts, profileTopValues)
+		} else {
+			c.Top = topValues(s.frequent.candidates, profileTopValues)
+		}
+		return c
+	}
+	std := math.Sqrt(s.m2 / float64(s.count))
+	c.Mean, c.Std, c.Min, c.Max = ptr(round4(s.mean)), ptr(round4(std)), ptr(s.lo), ptr(s.hi)
+	slices.Sort(s.values)
+	c.Quantiles = make(map[string]float64, len(profileQuantiles))
+	for _, q := range profileQuantiles {
+		c.Quantiles[q.name] = round4(s.quantile(q.q))
+	}
+	return c
+}
+
+// handleProfile profiles an uploaded CSV; exact=true computes exact
+// statistics.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "profile")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+	exact, ok := exactRequested(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := profileFile(r.Context(), in.path, in.opts, exact)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error(), Code: codeMalformedCSV})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// fileChunk is a part of the file that starts and ends at record
+// boundaries.
+type fileChunk struct {
+	index      int
+	start, end int64
+}
+
+type chunkProfile struct {
+	index    int
+	rows     int
+	sketches []columnSketch
+	err      error
+}
+
+// profileFile profiles the CSV at path, applying the header and column
+// selection of opts.
+func profileFile(ctx context.Context, path string, opts analysisOptions, exact bool) (*profileReport, error) {
+	t, err := openTable(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	// Without a header the first record is data, read again by its chunk
+	start := int64(0)
+	if opts.hasHeader() {
+		start = t.offset()
+	}
+	info, err := t.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	workers := cfg.ProfileWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan fileChunk, workers)
+	results := make(chan chunkProfile, workers)
+	var splitErr error
+	go func() {
+		defer close(chunks)
+		splitErr = splitRecords(ctx, t.f, start, info.Size(), chunks)
+	}()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				results <- profileChunk(t, c, exact)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Merge in file order: the t-digest depends slightly on the order of
+	// its merges
+	total := chunkProfile{sketches: newColumnSketches(len(t.Columns), exact)}
+	pending := map[int]chunkProfile{}
+	next, chunkCount := 0, 0
+	for res := range results {
+		chunkCount++
+		if res.err != nil {
+			if err == nil {
+				err = res.err
+			}
+			cancel()
+			continue
+		}
+		pending[res.index] = res
+		for p, ok := pending[next]; ok && err == nil; p, ok = pending[next] {
+			delete(pending, next)
+			total.rows += p.rows
+			for i := range total.sketches {
+				total.sketches[i].merge(&p.sketches[i])
+			}
+			next++
+		}
+	}
+	if err == nil {
+		err = splitErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &profileReport{Rows: total.rows, Columns: make([]profiledColumn, len(t.Columns)), Chunks: chunkCount, Workers: workers}
+	if !exact {
+		report.Accuracy = profileAccuracy
+	}
+	for i := range total.sketches {
+		report.Columns[i] = total.sketches[i].column(t.Columns[i], total.rows)
+	}
+	return report, nil
+}
+
+// profileChunk parses and summarizes one chunk, selecting the columns of t.
+func profileChunk(t *csvTable, c fileChunk, exact bool) chunkProfile {
+	res := chunkProfile{index: c.index, sketches: newColumnSketches(len(t.idx), exact)}
+	r := csv.NewReader(bufio.NewReaderSize(io.NewSectionReader(t.f, c.start, c.end-c.start), 256<<10))
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	r.LazyQuotes = true
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return res
+		}
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.rows++
+		for j, i := range t.idx {
+			// Short rows are padded with missing values
+			v := ""
+			if i < len(rec) {
+				v = rec[i]
+			}
+			res.sketches[j].add(v)
+		}
+	}
+}
+
+// splitRecords sends chunks of about profileChunkSize bytes covering start
+// to end of f. A chunk ends after a newline outside quotes; quotes are
+// followed the way encoding/csv reads them, opening a field only at its
+// start and escaped by doubling.
+func splitRecords(ctx context.Context, f *os.File, start, end int64, chunks chan<- fileChunk) error {
+	send := func(c fileChunk) error {
+		select {
+		case chunks <- c:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	buf := make([]byte, 256<<10)
+	index, from, pos := 0, start, start
+	fieldStart, quoted, quote := true, false, false
+	for pos < end {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), end-pos)], pos)
+		if n == 0 && err != nil {
+			return err
+		}
+		block := buf[:n]
+		for i := 0; i < len(block); i++ {
+			b := block[i]
+			if quoted {
+				if !quote {
+					// Skip to the next quote of the field
+					k := bytes.IndexByte(block[i:], '"')
+					if k < 0 {
+						break
+					}
+					i += k
+					quote = true
+					continue
+				}
+				// A doubled quote is an escaped one; anything else ends the field
+				quote = false
+				if b == '"' {
+					continue
+				}
+				quoted = false
+			}
+			switch b {
+			case ',':
+				fieldStart = true
+			case '\n':
+				fieldStart = true
+				if at := pos + int64(i) + 1; at-from >= profileChunkSize {
+					if err := send(fileChunk{index, from, at}); err != nil {
+						return err
+					}
+					index, from = index+1, at
+				}
+			case '"':
+				quoted = fieldStart
+				fieldStart = false
+			default:
+				fieldStart = false
+			}
+		}
+		pos += int64(n)
+	}
+	if end > from {
+		return send(fileChunk{index, from, end})
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProfileFile profiles a file of several chunks, with quoted line
+// breaks for the split to respect, both exactly and with sketches.
+func TestProfileFile(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.ProfileWorkers = 3
+
+	var b strings.Builder
+	b.WriteString("id,amount,city,note\n")
+	const rows = 60000
+	for i := range rows {
+		amount := fmt.Sprint(i % 1000)
+		if i%10 == 0 {
+			amount = "NA"
+		}
+		fmt.Fprintf(&b, "%d,%s,city%d,\"a note\nabout \"\"%d\"\"\"\n", i, amount, i%7, i)
+	}
+	path := filepath.Join(t.TempDir(), "data.csv")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	exact, err := profileFile(context.Background(), path, analysisOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sketched, err := profileFile(context.Background(), path, analysisOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exact.Chunks < 2 || exact.Accuracy != nil || sketched.Accuracy == nil {
+		t.Errorf("profiled in %d chunks with accuracy %v and %v, want several, nil and set", exact.Chunks, exact.Accuracy, sketched.Accuracy)
+	}
+	for _, p := range []*profileReport{exact, sketched} {
+		if p.Rows != rows || len(p.Columns) != 4 {
+			t.Fatalf("%d rows and %d columns, want %d and 4", p.Rows, len(p.Columns), rows)
+		}
+		id, amount, city, note := p.Columns[0], p.Columns[1], p.Columns[2], p.Columns[3]
+		if !id.Numeric || *id.Min != 0 || *id.Max != rows-1 || *id.Mean != (rows-1)/2.0 {
+			t.Errorf("id = %+v", id)
+		}
+		if amount.Missing != rows/10 || amount.Count != rows-rows/10 || math.Abs(float64(amount.Distinct-900)) > 45 {
+			t.Errorf("amount = %+v", amount)
+		}
+		if math.Abs(amount.Quantiles["p50"]-500) > 15 {
+			t.Errorf("amount median = %g, want about 500", amount.Quantiles["p50"])
+		}
+		if city.Numeric || city.Distinct != 7 || len(city.Top) != 7 || city.Top[0] != (valueCount{"city0", rows/7 + 1}) {
+			t.Errorf("city = %+v", city)
+		}
+		if note.Numeric || math.Abs(float64(note.Distinct-rows)) > 0.05*rows {
+			t.Errorf("note has %d distinct values, want about %d", note.Distinct, rows)
+		}
+	}
+	if got, want := exact.Columns[1].Distinct, 900; got != want {
+		t.Errorf("exact distinct amounts = %d, want %d", got, want)
+	}
+}
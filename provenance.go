@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxSourceLength bounds the source a client declares for an upload.
+const maxSourceLength = 2048
+
+// jobProvenance records where the input of a job came from and how it was
+// analyzed, for audits. It is part of GET /jobs/{id} and of the report's
+// provenance appendix, which lists the stages finished before the report
+// was written.
+type jobProvenance struct {
+	Filename string `json:"filename"`
+	// Size and SHA256 describe the upload as received. Synchronous
+	// requests kept as jobs record the CSV that was analyzed instead.
+	Size      int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256,omitempty"`
+	Submitter string `json:"submitter"`
+	// Channel is how the upload arrived: chunked, tus, sync for a
+	// synchronous request kept as a job after its client disconnected, or
+	// rerun for a job queued on the input of the job named by Source.
+	Channel string `json:"channel"`
+	// Source is where the client says the data came from, such as a URL
+	// or the name of a connector.
+	Source string `json:"source,omitempty"`
+	// AnalyzedSHA256 is the digest of the CSV the analyzer read, after
+	// conversion and preparation.
+	AnalyzedSHA256 string           `json:"analyzed_sha256,omitempty"`
+	Analyzer       *analyzerVersion `json:"analyzer,omitempty"`
+	// Options are those of the job without the schema, which is recorded
+	// by SchemaSHA256 instead.
+	Options      analysisOptions `json:"options"`
+	SchemaSHA256 string          `json:"schema_sha256,omitempty"`
+	// Stages are the durations of the steps of the submission and of the
+	// last attempt, in order.
+	Stages []jobStage `json:"stages"`
+}
+
+// analyzerVersion identifies the code that produced a report.
+type analyzerVersion struct {
+	Script       string `json:"script"`
+	ScriptSHA256 string `json:"script_sha256"`
+	// ScriptGitHash is the git object name of the script, to find it in
+	// the history of the repository.
+	ScriptGitHash string               `json:"script_git_hash"`
+	Server        string               `json:"server"`
+	Environment   *analyzerEnvironment `json:"environment,omitempty"`
+}
+
+type jobStage struct {
+	Stage      string `json:"stage"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// parseSource reads the optional source of a submission.
+func parseSource(get func(string) string) (string, error) {
+	source := strings.TrimSpace(get("source"))
+	if len(source) > maxSourceLength {
+		return "", fmt.Errorf("source must be at most %d bytes", maxSourceLength)
+	}
+	if strings.ContainsFunc(source, unicode.IsControl) {
+		return "", errors.New("source must not contain control characters")
+	}
+	return source, nil
+}
+
+// recordOptions sets the options of p, with the schema replaced by its
+// digest; the report appendix lists the checks it made instead.
+func (p *jobProvenance) recordOptions(o analysisOptions) {
+	if o.Schema != "" {
+		sum := sha256.Sum256([]byte(o.Schema))
+		p.SchemaSHA256 = hex.EncodeToString(sum[:])
+		o.Schema = ""
+	}
+	p.Options = o
+}
+
+// stage records that the stage name, begun at start, has finished.
+func (p *jobProvenance) stage(name string, start time.Time) {
+	if p != nil {
+		p.Stages = append(p.Stages, jobStage{Stage: name, DurationMS: time.Since(start).Milliseconds()})
+	}
+}
+
+// clone returns a copy of p that can be changed while p is shared.
+func (p *jobProvenance) clone() *jobProvenance {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Stages = slices.Clone(p.Stages)
+	return &c
+}
+
+// currentAnalyzer describes predict.py as it is on disk, the Python
+// environment it runs in and the server build.
+func currentAnalyzer() *analyzerVersion {
+	v := &analyzerVersion{Script: "predict.py", Server: "unknown"}
+	if sum, err := fileSHA256(v.Script); err == nil {
+		v.ScriptSHA256 = sum
+	}
+	if hash, err := gitBlobHash(v.Script); err == nil {
+		v.ScriptGitHash = hash
+	}
+	v.Environment = currentEnvironment()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		v.Server = cmp.Or(info.Main.Version, v.Server)
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				v.Server = s.Value
+			}
+		}
+	}
+	return v
+}
+
+// fileSize returns the size of the file at path, or 0.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
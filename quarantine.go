@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With DATASCRIBE_QUARANTINE_DIR set, uploads rejected for their content
+// are kept there for a while, so that an administrator can look at the
+// file behind a "your validator rejected my perfectly fine file" report
+// without asking for it again. Rejections for the content are malformed or
+// unsupported files, contract violations, options naming missing columns,
+// filters matching nothing and analyzer failures caused by the input.
+// Infected and oversized uploads are never kept.
+//
+// Each upload is kept as <dir>/<id>.bin, cut to the first
+// DATASCRIBE_QUARANTINE_MAX_FILE_SIZE bytes, and described in
+// <dir>/<id>.json. Uploads are deleted after DATASCRIBE_QUARANTINE_TTL, and
+// the oldest go first once the files exceed DATASCRIBE_QUARANTINE_MAX_SIZE.
+// Only admins can reach them, and each download is audited.
+
+// quarantinedUpload describes a kept upload.
+type quarantinedUpload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Owner    string `json:"owner"`
+	// Source is where the upload was rejected: the request, chunked or
+	// tus upload, or job.
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	// Size is the size of the upload and Stored the bytes kept of it.
+	Size      int64     `json:"size_bytes"`
+	Stored    int64     `json:"stored_bytes"`
+	Truncated bool      `json:"truncated,omitempty"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	quarantineMu      sync.Mutex
+	quarantineEntries = map[string]*quarantinedUpload{}
+)
+
+func registerQuarantine() {
+	handleAPI("GET /admin/quarantine", protected(requireAdmin(handleListQuarantine)))
+	handleAPI("GET /admin/quarantine/{id}", protected(requireAdmin(handleGetQuarantined)))
+	handleAPI("DELETE /admin/quarantine/{id}", protected(requireAdmin(handleDeleteQuarantined)))
+}
+
+var _ = newGaugeFunc("datascribe_quarantine_bytes", "Disk space used by quarantined uploads.", func() float64 {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	var total int64
+	for _, e := range quarantineEntries {
+		total += e.Stored
+	}
+	return float64(total)
+})
+
+func quarantinePath(id, ext string) string { return filepath.Join(cfg.QuarantineDir, id+ext) }
+
+// loadQuarantine reads the descriptions of the uploads kept by a previous
+// process and drops the expired ones.
+func loadQuarantine() error {
+	if cfg.QuarantineDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.QuarantineDir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.QuarantineDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	quarantineMu.Lock()
+	for _, path := range paths {
+		var e quarantinedUpload
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil || e.ID == "" {
+			log.Printf("quarantine: skipping %s: %v", path, err)
+			continue
+		}
+		quarantineEntries[e.ID] = &e
+	}
+	quarantineMu.Unlock()
+	expireQuarantine()
+	return nil
+}
+
+// quarantinable reports whether err rejects an upload for its content.
+func quarantinable(err error) bool {
+	var ae *analysisError
+	var ce *contractError
+	switch {
+	case errors.As(err, &ae):
+		return ae.Status < 500 && ae.Status != http.StatusRequestEntityTooLarge
+	case errors.As(err, &ce):
+		return true
+	}
+	for _, target := range []error{errMalformedInput, errUnsupportedFormat, errNoMatchingRows, errInvalidOptions,
+		errUnreadableHeader, errColumnCount, errDerivedExists} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantine keeps the file at path, an upload of owner named filename
+// rejected with err at source, if quarantining is enabled and err is about
+// its content. Failures are only logged: the client gets the rejection
+// either way.
+func quarantine(err error, path, filename, owner, source string) {
+	if cfg.QuarantineDir == "" || !quarantinable(err) {
+		return
+	}
+	e, qerr := storeQuarantined(path, quarantinedUpload{Filename: filename, Owner: owner, Source: source, Reason: err.Error()})
+	if qerr != nil {
+		log.Printf("quarantine: keeping %s: %v", filename, qerr)
+		return
+	}
+	log.Printf("quarantine: kept %s from %s as %s (%s)", filename, source, e.ID, e.Reason)
+}
+
+func storeQuarantined(path string, e quarantinedUpload) (*quarantinedUpload, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e.ID = newID()
+	e.Size = info.Size()
+	e.CreatedAt = time.Now().UTC()
+	e.ExpiresAt = e.CreatedAt.Add(cfg.QuarantineTTL)
+	if e.SHA256, err = fileSHA256(path); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(quarantinePath(e.ID, ".bin"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	e.Stored, err = io.Copy(out, io.LimitReader(in, cfg.QuarantineMaxFileSize))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	e.Truncated = e.Stored < e.Size
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(&e, "", "  "); err == nil {
+			err = os.WriteFile(quarantinePath(e.ID, ".json"), data, 0o600)
+		}
+	}
+	if err != nil {
+		os.Remove(quarantinePath(e.ID, ".bin"))
+		return nil, err
+	}
+	quarantineMu.Lock()
+	quarantineEntries[e.ID] = &e
+	quarantineMu.Unlock()
+	expireQuarantine()
+	return &e, nil
+}
+
+// expireQuarantine deletes the expired uploads and then the oldest until
+// the rest fit in cfg.QuarantineMaxSize.
+func expireQuarantine() {
+	if cfg.QuarantineDir == "" {
+		return
+	}
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	list := make([]*quarantinedUpload, 0, len(quarantineEntries))
+	var total int64
+	for _, e := range quarantineEntries {
+		list = append(list, e)
+		total += e.Stored
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.Before(list[k].CreatedAt) })
+	now := time.Now()
+	for _, e := range list {
+		if now.Before(e.ExpiresAt) && total <= cfg.QuarantineMaxSize {
+			continue
+		}
+		removeQuarantined(e.ID)
+		total -= e.Stored
+	}
+}
+
+// removeQuarantined deletes an upload. The caller holds quarantineMu.
+func removeQuarantined(id string) {
+	delete(quarantineEntries, id)
+	for _, ext := range []string{".bin", ".json"} {
+		if err := os.Remove(quarantinePath(id, ext)); err != nil && !os.IsNotExist(err) {
+			log.Printf("quarantine: removing %s: %v", id, err)
+		}
+	}
+}
+
+func quarantineDisabled(w http.ResponseWriter) bool {
+	if cfg.QuarantineDir == "" {
+		http.Error(w, "quarantine is not enabled", http.StatusNotFound)
+		return true
+	}
+	return false
+}
+
+// handleListQuarantine lists the kept uploads, newest first, optionally
+// only those of ?owner=.
+func handleListQuarantine(w http.ResponseWriter, r *http.Request) {
+	if quarantineDisabled(w) {
+		return
+	}
+	owner, filterOwner := r.URL.Query()["owner"]
+	quarantineMu.Lock()
+	list := make([]quarantinedUpload, 0, len(quarantineEntries))
+	for _, e := range quarantineEntries {
+		if !filterOwner || e.Owner == owner[0] {
+			list = append(list, *e)
+		}
+	}
+	quarantineMu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.After(list[k].CreatedAt) })
+	writeJSON(w, http.StatusOK, map[string]any{"uploads": list})
+}
+
+// handleGetQuarantined downloads the bytes kept of an upload.
+func handleGetQuarantined(w http.ResponseWriter, r *http.Request) {
+	if quarantineDisabled(w) {
+		return
+	}
+	id := r.PathValue("id")
+	quarantineMu.Lock()
+	e, ok := quarantineEntries[id]
+	var entry quarantinedUpload
+	if ok {
+		entry = *e
+	}
+	quarantineMu.Unlock()
+	if !ok {
+		http.Error(w, "quarantined upload not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(quarantinePath(id, ".bin"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open quarantined upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	audit(r, "quarantine_accessed", map[string]any{"quarantine_id": id, "owner": entry.Owner, "filename": entry.Filename})
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, filepath.Base(entry.Filename))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if entry.Truncated {
+		w.Header().Set("X-Quarantine-Truncated", "true")
+	}
+	http.ServeContent(w, r, "", entry.CreatedAt, f)
+}
+
+// handleDeleteQuarantined deletes a kept upload before it expires.
+func handleDeleteQuarantined(w http.ResponseWriter, r *http.Request) {
+	if quarantineDisabled(w) {
+		return
+	}
+	id := r.PathValue("id")
+	quarantineMu.Lock()
+	_, ok := quarantineEntries[id]
+	if ok {
+		removeQuarantined(id)
+	}
+	quarantineMu.Unlock()
+	if !ok {
+		http.Error(w, "quarantined upload not found", http.StatusNotFound)
+		return
+	}
+	audit(r, "quarantine_deleted", map[string]any{"quarantine_id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
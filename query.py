@@ -0,0 +1,122 @@
+#!/usr/bin/env python3
+"""
+query.py
+--------
+Loads a CSV into an in-memory SQLite table named "data" and runs one
+read-only SELECT against it, writing the result as JSON.
+
+Usage:
+    python query.py --input data.csv --output result.json --sql "SELECT ..." [--limit 1000] [--timeout 30]
+"""
+
+import argparse
+import csv
+import itertools
+import json
+import sqlite3
+import sys
+import time
+
+# Exit codes understood by the Go server (see analyzer.go)
+EXIT_MALFORMED_CSV = 3
+EXIT_INVALID_QUERY = 5
+EXIT_QUERY_TIMEOUT = 6
+
+NA_VALUES = {"", "#N/A", "#N/A N/A", "#NA", "-1.#IND", "-1.#QNAN", "-NaN", "-nan", "1.#IND",
+             "1.#QNAN", "<NA>", "N/A", "NA", "NULL", "NaN", "None", "n/a", "nan", "null"}
+
+# Everything a plain SELECT needs; writes, ATTACH and PRAGMA are denied
+ALLOWED_ACTIONS = {sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION}
+if hasattr(sqlite3, "SQLITE_RECURSIVE"):
+    ALLOWED_ACTIONS.add(sqlite3.SQLITE_RECURSIVE)
+
+
+def convert(value: str):
+    if value in NA_VALUES:
+        return None
+    for parse in (int, float):
+        try:
+            return parse(value)
+        except ValueError:
+            pass
+    return value
+
+
+def load(conn: sqlite3.Connection, path: str, has_header: bool, column_names) -> None:
+    with open(path, newline="", encoding="utf-8-sig") as f:
+        reader = csv.reader(f)
+        first = next(reader, None)
+        if first is None:
+            raise ValueError("the CSV is empty")
+        rows = reader
+        if not has_header:
+            rows = itertools.chain([first], reader)
+            header = [f"column_{i + 1}" for i in range(len(first))]
+        else:
+            header = first
+        if column_names:
+            header = column_names
+        width = len(header)
+        quoted = ", ".join('"' + name.replace('"', '""') + '"' for name in header)
+        conn.execute(f"CREATE TABLE data ({quoted})")
+        placeholders = ", ".join("?" * width)
+        conn.executemany(
+            f"INSERT INTO data VALUES ({placeholders})",
+            ([convert(v) for v in (row + [""] * width)[:width]] for row in rows),
+        )
+
+
+def run_query(conn: sqlite3.Connection, sql: str, limit: int, timeout: float) -> dict:
+    deadline = time.monotonic() + timeout
+    conn.set_progress_handler(lambda: 1 if time.monotonic() > deadline else 0, 10000)
+    conn.set_authorizer(lambda action, *_: sqlite3.SQLITE_OK if action in ALLOWED_ACTIONS else sqlite3.SQLITE_DENY)
+    cur = conn.execute(sql)
+    if cur.description is None:
+        raise sqlite3.DatabaseError("only SELECT statements are allowed")
+    rows = cur.fetchmany(limit + 1)
+    return {
+        "columns": [d[0] for d in cur.description],
+        "rows": [list(r) for r in rows[:limit]],
+        "truncated": len(rows) > limit,
+    }
+
+
+def parse_args() -> argparse.Namespace:
+    p = argparse.ArgumentParser()
+    p.add_argument("--input", "-i", required=True, help="Path to input CSV")
+    p.add_argument("--output", "-o", required=True, help="Path to output JSON")
+    p.add_argument("--sql", required=True, help="SELECT statement over the table named data")
+    p.add_argument("--limit", type=int, default=1000, help="Maximum rows returned")
+    p.add_argument("--timeout", type=float, default=30, help="Seconds the query may run")
+    p.add_argument("--no-header", dest="has_header", action="store_false",
+                   help="The first row is data, not column names")
+    p.add_argument("--column-names", type=json.loads, default=None,
+                   help="JSON array of column names replacing (or, with --no-header, supplying) the header")
+    return p.parse_args()
+
+
+def main():
+    args = parse_args()
+    conn = sqlite3.connect(":memory:")
+    try:
+        load(conn, args.input, args.has_header, args.column_names)
+    except (csv.Error, UnicodeDecodeError, ValueError, sqlite3.DatabaseError) as e:
+        print(f"malformed CSV: {e}", file=sys.stderr)
+        sys.exit(EXIT_MALFORMED_CSV)
+    try:
+        result = run_query(conn, args.sql, args.limit, args.timeout)
+    except sqlite3.OperationalError as e:
+        if "interrupted" in str(e):
+            print(f"query did not finish within {args.timeout:g}s", file=sys.stderr)
+            sys.exit(EXIT_QUERY_TIMEOUT)
+        print(f"invalid query: {e}", file=sys.stderr)
+        sys.exit(EXIT_INVALID_QUERY)
+    except (sqlite3.DatabaseError, sqlite3.Warning) as e:
+        print(f"invalid query: {e}", file=sys.stderr)
+        sys.exit(EXIT_INVALID_QUERY)
+    with open(args.output, "w") as f:
+        json.dump(result, f)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobPriority orders waiting jobs; higher priorities are always served first.
+type jobPriority string
+
+const (
+	priorityLow    jobPriority = "low"
+	priorityNormal jobPriority = "normal"
+	priorityHigh   jobPriority = "high"
+)
+
+// priorityLevels lists priorities from most to least urgent.
+var priorityLevels = []jobPriority{priorityHigh, priorityNormal, priorityLow}
+
+// parsePriority validates a submitted priority; empty means normal.
+func parsePriority(s string) (jobPriority, error) {
+	switch p := jobPriority(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return priorityNormal, nil
+	case priorityLow, priorityNormal, priorityHigh:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid priority %q: want low, normal or high", s)
+	}
+}
+
+// priorityQueue is a bounded multi-level FIFO queue of job IDs. Interactive
+// submissions at high priority jump ahead of bulk low priority work.
+type priorityQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	levels   map[jobPriority][]string
+	capacity int
+	// queuedAt records when each waiting job was pushed.
+	queuedAt map[string]time.Time
+}
+
+func newPriorityQueue(capacity int) *priorityQueue {
+	q := &priorityQueue{levels: map[jobPriority][]string{}, capacity: capacity, queuedAt: map[string]time.Time{}}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends id at the given priority, reporting false when the queue is full.
+func (q *priorityQueue) push(id string, p jobPriority) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.lenLocked() >= q.capacity {
+		return false
+	}
+	q.levels[p] = append(q.levels[p], id)
+	q.queuedAt[id] = time.Now()
+	q.cond.Signal()
+	return true
+}
+
+// pop blocks until a job is waiting and returns the most urgent one. The
+// time it waited is folded into queueWaits.
+func (q *priorityQueue) pop() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for _, p := range priorityLevels {
+			if ids := q.levels[p]; len(ids) > 0 {
+				q.levels[p] = ids[1:]
+				queueWaits.add(time.Since(q.queuedAt[ids[0]]))
+				delete(q.queuedAt, ids[0])
+				return ids[0]
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *priorityQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+// ahead returns the jobs that will be served before id, most urgent
+// first, and whether id is waiting at all.
+func (q *priorityQueue) ahead(id string) ([]string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ahead []string
+	for _, p := range priorityLevels {
+		for _, queued := range q.levels[p] {
+			if queued == id {
+				return ahead, true
+			}
+			ahead = append(ahead, queued)
+		}
+	}
+	return nil, false
+}
+
+func (q *priorityQueue) lenLocked() int {
+	n := 0
+	for _, ids := range q.levels {
+		n += len(ids)
+	}
+	return n
+}
+
+// defaultJobDuration is assumed for Retry-After estimates until a job has finished.
+const defaultJobDuration = 30 * time.Second
+
+var (
+	runningJobs atomic.Int64
+
+	// jobDurations, queueWaits and jobCPU are moving averages of analysis run
+	// times, of the time jobs wait for a worker and of the CPU time the
+	// analyzer uses per job.
+	jobDurations, queueWaits, jobCPU movingAverage
+
+	// jobDurationsBySize are the moving averages of run times by input
+	// size: below each of jobSizeBuckets, and beyond the last.
+	jobDurationsBySize [len(jobSizeBuckets) + 1]movingAverage
+)
+
+// jobSizeBuckets bound the input sizes whose run times are averaged apart
+// for the estimates of GET /jobs/{id}.
+var jobSizeBuckets = [...]int64{1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+var (
+	jobsTotal         = newCounter("datascribe_jobs_total", "Finished jobs by status and the job labels of DATASCRIBE_METRIC_LABELS.")
+	jobRunSeconds     = newCounter("datascribe_job_run_seconds_total", "Analysis run time of job attempts, by the job labels of DATASCRIBE_METRIC_LABELS.")
+	jobsRejectedTotal = newCounter("datascribe_jobs_rejected_total", "Jobs rejected because the queue was full.")
+	_                 = newGaugeFunc("datascribe_queue_depth", "Jobs waiting for a worker.", func() float64 { return float64(jobQueue.len()) })
+	_                 = newGaugeFunc("datascribe_queue_capacity", "Maximum number of waiting jobs.", func() float64 { return float64(jobQueue.capacity) })
+	_                 = newGaugeFunc("datascribe_jobs_running", "Jobs currently being analyzed.", func() float64 { return float64(runningJobs.Load()) })
+	_                 = newGaugeFunc("datascribe_job_duration_avg_seconds", "Moving average of job run time.", func() float64 { return averageJobDuration().Seconds() })
+	_                 = newGaugeFunc("datascribe_queue_wait_avg_seconds", "Moving average of the time jobs wait for a worker.", func() float64 { return queueWaits.get().Seconds() })
+	_                 = newGaugeFunc("datascribe_job_cpu_avg_seconds", "Moving average of analyzer CPU time per job.", func() float64 { return jobCPU.get().Seconds() })
+)
+
+// movingAverage is an exponential moving average of durations; it is zero
+// until the first sample.
+type movingAverage struct {
+	mu sync.Mutex
+	v  time.Duration
+}
+
+func (m *movingAverage) add(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.v == 0 {
+		m.v = d
+		return
+	}
+	m.v = (m.v*4 + d) / 5
+}
+
+func (m *movingAverage) get() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.v
+}
+
+// recordJobDuration folds d, the run time of a job with an input of size
+// bytes, into the moving averages of job run times.
+func recordJobDuration(d time.Duration, size int64) {
+	jobDurations.add(d)
+	jobDurationsBySize[jobSizeBucket(size)].add(d)
+}
+
+func jobSizeBucket(size int64) int {
+	for i, limit := range jobSizeBuckets {
+		if size < limit {
+			return i
+		}
+	}
+	return len(jobSizeBuckets)
+}
+
+// expectedJobDuration is how long a job with an input of size bytes is
+// expected to run: the average for its size, or for all sizes until one of
+// its size has finished.
+func expectedJobDuration(size int64) time.Duration {
+	if d := jobDurationsBySize[jobSizeBucket(size)].get(); d != 0 {
+		return d
+	}
+	return averageJobDuration()
+}
+
+func averageJobDuration() time.Duration {
+	if d := jobDurations.get(); d != 0 {
+		return d
+	}
+	return defaultJobDuration
+}
+
+// estimatedWait is how long a newly queued job would wait for a worker:
+// the average job duration times the jobs ahead of it, spread over the workers.
+func estimatedWait() time.Duration {
+	ahead := jobQueue.len() + int(runningJobs.Load())
+	workers := max(cfg.Workers, 1)
+	return averageJobDuration() * time.Duration(ahead) / time.Duration(workers)
+}
+
+// jobEstimate is where a job stands in the queue and when it should start
+// and finish.
+type jobEstimate struct {
+	position   int
+	start      time.Time
+	completion time.Time
+}
+
+// estimateJob estimates j, when it is queued or running. The workers take
+// the jobs ahead of a queued job in order, each as soon as one is free,
+// and every job is expected to take the recent average for its size.
+func estimateJob(j *job) (jobEstimate, bool) {
+	now := time.Now().UTC()
+	switch j.Status {
+	case jobRunning:
+		if j.StartedAt == nil {
+			return jobEstimate{}, false
+		}
+		return jobEstimate{start: *j.StartedAt, completion: later(j.StartedAt.Add(expectedJobDuration(j.inputSize())), now)}, true
+	case jobQueued:
+	default:
+		return jobEstimate{}, false
+	}
+	ahead, ok := jobQueue.ahead(j.ID)
+	if !ok {
+		return jobEstimate{}, false
+	}
+	// free holds when each worker is next free, from now
+	free := make([]time.Duration, max(cfg.Workers, 1))
+	jobsMu.Lock()
+	i := 0
+	for _, running := range jobs {
+		if running.Status == jobRunning && running.StartedAt != nil && i < len(free) {
+			free[i] = max(expectedJobDuration(running.inputSize())-now.Sub(*running.StartedAt), 0)
+			i++
+		}
+	}
+	sizes := make([]int64, 0, len(ahead))
+	for _, id := range ahead {
+		if queued, ok := jobs[id]; ok {
+			sizes = append(sizes, queued.inputSize())
+		}
+	}
+	jobsMu.Unlock()
+	for _, size := range sizes {
+		first := slices.Index(free, slices.Min(free))
+		free[first] += expectedJobDuration(size)
+	}
+	start := now.Add(slices.Min(free))
+	return jobEstimate{position: len(ahead), start: start, completion: start.Add(expectedJobDuration(j.inputSize()))}, true
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// queueStatus is the body of GET /status.
+type queueStatus struct {
+	QueueDepth           int     `json:"queue_depth"`
+	QueueCapacity        int     `json:"queue_capacity"`
+	Running              int64   `json:"running"`
+	Workers              int     `json:"workers"`
+	AvgJobSeconds        float64 `json:"avg_job_seconds"`
+	EstimatedWaitSeconds float64 `json:"estimated_wait_seconds"`
+	// Engine is the analyzer mode, cfg.Engine.
+	Engine string `json:"engine"`
+}
+
+func currentQueueStatus() queueStatus {
+	return queueStatus{
+		QueueDepth:           jobQueue.len(),
+		QueueCapacity:        jobQueue.capacity,
+		Running:              runningJobs.Load(),
+		Workers:              cfg.Workers,
+		AvgJobSeconds:        averageJobDuration().Seconds(),
+		EstimatedWaitSeconds: estimatedWait().Seconds(),
+		Engine:               cfg.Engine,
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentQueueStatus())
+}
+
+// scalingStatus is the body of GET /scaling, for autoscalers that scale on
+// backlog rather than CPU, e.g. KEDA's metrics-api scaler with
+// valueLocation "backlog".
+type scalingStatus struct {
+	QueueLength int   `json:"queue_length"`
+	Running     int64 `json:"running"`
+	// Backlog is the queued and running jobs.
+	Backlog          int64   `json:"backlog"`
+	Workers          int     `json:"workers"`
+	AvgWaitSeconds   float64 `json:"avg_wait_seconds"`
+	AvgJobSeconds    float64 `json:"avg_job_seconds"`
+	AvgJobCPUSeconds float64 `json:"avg_job_cpu_seconds"`
+	// BacklogCPUSeconds estimates the CPU time needed to clear the backlog.
+	BacklogCPUSeconds float64 `json:"backlog_cpu_seconds"`
+}
+
+func handleScaling(w http.ResponseWriter, r *http.Request) {
+	queued, running := jobQueue.len(), runningJobs.Load()
+	backlog := int64(queued) + running
+	cpu := jobCPU.get().Seconds()
+	writeJSON(w, http.StatusOK, scalingStatus{
+		QueueLength:       queued,
+		Running:           running,
+		Backlog:           backlog,
+		Workers:           cfg.Workers,
+		AvgWaitSeconds:    queueWaits.get().Seconds(),
+		AvgJobSeconds:     averageJobDuration().Seconds(),
+		AvgJobCPUSeconds:  cpu,
+		BacklogCPUSeconds: cpu * float64(backlog),
+	})
+}
+
+// writeSubmitError reports why submitJob refused a job.
+func writeSubmitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPriorityLimit) {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	writeQueueFull(w)
+}
+
+// writeQueueFull answers a submission rejected by backpressure with 503
+// and a Retry-After estimate.
+func writeQueueFull(w http.ResponseWriter) {
+	jobsRejectedTotal.inc()
+	status := currentQueueStatus()
+	retry := int(math.Max(1, math.Ceil(status.EstimatedWaitSeconds)))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+		"error":               fmt.Sprintf("%v, retry in %ds", errQueueFull, retry),
+		"queue_depth":         status.QueueDepth,
+		"retry_after_seconds": retry,
+	})
+}
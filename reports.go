@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	maxNameLength = 200
+	maxTags       = 20
+	maxTagLength  = 50
+)
+
+// parseLabels reads the optional dataset name and tags of a submission.
+// Tags are a comma-separated list or JSON array; duplicates are dropped.
+func parseLabels(get func(string) string) (name string, tags []string, err error) {
+	name = strings.TrimSpace(get("name"))
+	if len(name) > maxNameLength {
+		return "", nil, fmt.Errorf("name must be at most %d bytes", maxNameLength)
+	}
+	list, err := parseNameList("tags", get("tags"))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, tag := range list {
+		if len(tag) > maxTagLength {
+			return "", nil, fmt.Errorf("tag %q is longer than %d bytes", tag, maxTagLength)
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return "", nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return name, tags, nil
+}
+
+// reportEntry is a finished report in the history.
+type reportEntry struct {
+	JobID        string    `json:"job_id"`
+	Name         string    `json:"name,omitempty"`
+	Filename     string    `json:"filename"`
+	Tags         []string  `json:"tags,omitempty"`
+	Submitter    string    `json:"submitter"`
+	ReportSHA256 string    `json:"report_sha256"`
+	CreatedAt    time.Time `json:"created_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// reportQuery filters the report history.
+type reportQuery struct {
+	search       string
+	tags         []string
+	submitter    string
+	since, until time.Time
+}
+
+// newReportEntry describes the report of the succeeded job j.
+func newReportEntry(j *job) reportEntry {
+	return reportEntry{
+		JobID:        j.ID,
+		Name:         j.Name,
+		Filename:     j.Filename,
+		Tags:         j.Tags,
+		Submitter:    j.owner,
+		ReportSHA256: j.ReportSHA256,
+		CreatedAt:    j.CreatedAt,
+		FinishedAt:   *j.FinishedAt,
+	}
+}
+
+func (q reportQuery) matches(e reportEntry) bool {
+	if q.submitter != "" && e.Submitter != q.submitter {
+		return false
+	}
+	if !q.since.IsZero() && e.CreatedAt.Before(q.since) || !q.until.IsZero() && !e.CreatedAt.Before(q.until) {
+		return false
+	}
+	for _, tag := range q.tags {
+		if !slices.Contains(e.Tags, tag) {
+			return false
+		}
+	}
+	if q.search != "" {
+		s := strings.ToLower(q.search)
+		return strings.Contains(strings.ToLower(e.Name), s) || strings.Contains(strings.ToLower(e.Filename), s)
+	}
+	return true
+}
+
+// parseReportTime accepts an RFC 3339 timestamp or a date; a date given as
+// until includes that whole day.
+func parseReportTime(field, v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", field)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// handleListReports searches the caller's finished reports, newest first,
+// including those kept in the report store after their job expired.
+// search matches the dataset name or filename case-insensitively, each tag
+// parameter must be present on the job, and since/until bound the
+// submission time. Admins see every submitter's reports and can narrow them
+// with submitter. The results are paged with the list query grammar of
+// listquery.go.
+func handleListReports(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	identity := identityFrom(r)
+	q := reportQuery{search: strings.TrimSpace(params.Get("search")), tags: params["tag"], submitter: params.Get("submitter")}
+	if identity == "" || !slices.Contains(cfg.AdminIdentities, identity) {
+		if q.submitter != "" && q.submitter != identity {
+			http.Error(w, "forbidden: only admins can search other submitters' reports", http.StatusForbidden)
+			return
+		}
+		q.submitter = identity
+	}
+	var err error
+	if q.since, err = parseReportTime("since", params.Get("since"), false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.until, err = parseReportTime("until", params.Get("until"), true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reports := []reportEntry{}
+	seen := map[string]bool{}
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if j.Status != jobSucceeded {
+			continue
+		}
+		seen[j.ID] = true
+		if e := newReportEntry(j); q.matches(e) {
+			reports = append(reports, e)
+		}
+	}
+	jobsMu.Unlock()
+	if store != nil {
+		for _, e := range store.entries() {
+			if !seen[e.JobID] && q.matches(e) {
+				reports = append(reports, e)
+			}
+		}
+	}
+	reportList.serve(w, r, reports)
+}
+
+var reportList = listSpec[reportEntry]{
+	name: "reports",
+	id:   func(e reportEntry) string { return e.JobID },
+	fields: []listField[reportEntry]{
+		textField("job_id", func(e reportEntry) string { return e.JobID }),
+		textField("name", func(e reportEntry) string { return e.Name }),
+		textField("filename", func(e reportEntry) string { return e.Filename }),
+		textField("submitter", func(e reportEntry) string { return e.Submitter }),
+		tagsField("tags", func(e reportEntry) []string { return e.Tags }),
+		timeField("created_at", func(e reportEntry) time.Time { return e.CreatedAt }),
+		timeField("finished_at", func(e reportEntry) time.Time { return e.FinishedAt }),
+	},
+	defaultSort: "-created_at",
+}
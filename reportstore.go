@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The report store keeps finished reports on local disk after their jobs
+// expire, for single-node deployments. Reports are laid out as
+//
+//	<root>/<yyyy>/<mm>/<dd>/<first two ID characters>/<job ID>.pdf
+//
+// and catalogued in <root>/index.jsonl, one storedReport per line. The index
+// is append-only while running, removals are recorded as tombstones, and it
+// is compacted on startup.
+
+// storedReport is an index entry. Path is relative to the store root.
+type storedReport struct {
+	reportEntry
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type reportStore struct {
+	root    string
+	mu      sync.Mutex
+	index   *os.File
+	reports map[string]*storedReport
+}
+
+// store is nil unless DATASCRIBE_REPORT_STORE_DIR is set.
+var store *reportStore
+
+// openReportStore loads and compacts the index under root.
+func openReportStore(root string) (*reportStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	s := &reportStore{root: root, reports: map[string]*storedReport{}}
+	indexPath := filepath.Join(root, "index.jsonl")
+	if f, err := os.Open(indexPath); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var rec storedReport
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				log.Printf("report store: skipping index line: %v", err)
+				continue
+			}
+			if rec.Deleted {
+				delete(s.reports, rec.JobID)
+			} else {
+				s.reports[rec.JobID] = &rec
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	tmp, err := os.Create(indexPath + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, rec := range s.reports {
+		if err := enc.Encode(rec); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), indexPath); err != nil {
+		return nil, err
+	}
+	if s.index, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	log.Printf("report store: %d reports in %s", len(s.reports), root)
+	return s, nil
+}
+
+// appendIndex writes rec to the index. The caller holds s.mu.
+func (s *reportStore) appendIndex(rec *storedReport) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.index.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// put copies the report of the finished job j into the store.
+func (s *reportStore) put(j *job, e reportEntry) error {
+	rel := filepath.Join(e.CreatedAt.Format("2006/01/02"), j.ID[:2], j.ID+".pdf")
+	dst := filepath.Join(s.root, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	if err := copyFile(j.reportPath(), dst+".tmp"); err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	info, err := os.Stat(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		return err
+	}
+	rec := &storedReport{reportEntry: e, Path: rel, Size: info.Size()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.appendIndex(rec); err != nil {
+		return err
+	}
+	s.reports[j.ID] = rec
+	return nil
+}
+
+// get returns the index entry of a stored report.
+func (s *reportStore) get(id string) (storedReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.reports[id]
+	if !ok {
+		return storedReport{}, false
+	}
+	return *rec, true
+}
+
+// entries returns every stored report.
+func (s *reportStore) entries() []reportEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]reportEntry, 0, len(s.reports))
+	for _, rec := range s.reports {
+		list = append(list, rec.reportEntry)
+	}
+	return list
+}
+
+// remove deletes a stored report and records the tombstone.
+func (s *reportStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.reports[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if err := s.appendIndex(&storedReport{reportEntry: reportEntry{JobID: id}, Deleted: true}); err != nil {
+		return err
+	}
+	delete(s.reports, id)
+	if err := os.Remove(filepath.Join(s.root, rec.Path)); err != nil {
+		log.Printf("report store: removing %s: %v", rec.Path, err)
+	}
+	return nil
+}
+
+// handleGetReport serves the report of a job by its ID, from the running
+// job while it is kept and from the report store afterwards.
+func handleGetReport(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if j, ok := getJob(id); ok && j.owner == identityFrom(r) && j.Status == jobSucceeded {
+		handleGetJobReport(w, r)
+		return
+	}
+	var rec storedReport
+	ok := false
+	if store != nil {
+		rec, ok = store.get(id)
+	}
+	if !ok || rec.Submitter != identityFrom(r) {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	disposition, err := reportDisposition(r, rec.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := os.Open(filepath.Join(store.root, rec.Path))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open stored report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer report.Close()
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", `"`+rec.ReportSHA256+`"`)
+	http.ServeContent(w, r, "report.pdf", rec.FinishedAt, report)
+}
+
+// handleDeleteReport removes a report from the store.
+func handleDeleteReport(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var rec storedReport
+	ok := false
+	if store != nil {
+		rec, ok = store.get(id)
+	}
+	if !ok || rec.Submitter != identityFrom(r) {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	if err := store.remove(id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to delete report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
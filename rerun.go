@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// POST /jobs/{id}/rerun queues a new job on the input of a finished job,
+// for as long as the job has not expired. It is linked to the original
+// through rerun_of and its provenance. Analysis options given as form
+// fields replace the original ones, field by field; the others are kept.
+//
+// The options that shaped the rows themselves cannot be changed, because
+// the input was converted and prepared with them when it was uploaded.
+var rerunFixedOptions = []string{"delimiter", "has_header", "column_names", "schema", "filter", "anonymize", "derive"}
+
+// handleRerunJob reruns a job. With environment=recorded the new job is
+// only queued when the analyzer is the one recorded for the original run;
+// otherwise the answer is 409 with the differences. The report does not
+// become a dataset version.
+func handleRerunJob(w http.ResponseWriter, r *http.Request) {
+	orig, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid form: %v", err), http.StatusBadRequest)
+		return
+	}
+	environment := r.Form.Get("environment")
+	if environment != "" && environment != "current" && environment != "recorded" {
+		http.Error(w, fmt.Sprintf("unsupported environment %q (want current or recorded)", environment), http.StatusBadRequest)
+		return
+	}
+	opts, err := rerunOptions(orig.Options, r)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	if orig.Status != jobSucceeded && orig.Status != jobFailed {
+		http.Error(w, fmt.Sprintf("job is %s", orig.Status), http.StatusConflict)
+		return
+	}
+	if environment == "recorded" {
+		recorded := orig.Provenance
+		if recorded == nil || recorded.Analyzer == nil {
+			http.Error(w, "the job has no recorded analyzer environment", http.StatusConflict)
+			return
+		}
+		if diff := environmentDiff(recorded.Analyzer, currentAnalyzer()); len(diff) > 0 {
+			writeJSON(w, http.StatusConflict, map[string]any{
+				"error":       "the analyzer differs from the one recorded for the job",
+				"code":        codeEnvironmentMismatch,
+				"differences": diff,
+			})
+			return
+		}
+	}
+
+	j, err := createJob(jobSpec{Filename: orig.Filename, Name: orig.Name, Tags: orig.Tags, Labels: orig.Labels, Owner: orig.owner,
+		Priority: orig.Priority, Options: opts, Channel: "rerun", Source: "job:" + orig.ID, Size: fileSize(orig.inputPath())})
+	if err != nil {
+		writeWorkspaceError(w, "job", err)
+		return
+	}
+	if err := copyFile(orig.inputPath(), j.inputPath()); err != nil {
+		deleteJob(j.ID)
+		if os.IsNotExist(err) {
+			http.Error(w, "the input of the job is no longer available", http.StatusGone)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to copy input: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The rows are prepared already, so only the options that select and
+	// describe columns are checked again, against the names of the
+	// prepared columns, derived ones included
+	check := opts
+	check.ColumnNames = opts.columnNames()
+	check.Schema, check.Filter, check.Anonymize, check.Derive = "", "", nil, nil
+	if err := check.validate(j.inputPath()); err != nil {
+		deleteJob(j.ID)
+		writeOptionsError(w, err)
+		return
+	}
+	prov := j.Provenance.clone()
+	if p := orig.Provenance; p != nil {
+		prov.Size, prov.SHA256 = p.Size, p.SHA256
+	}
+	updateJob(j.ID, func(j *job) { j.Input, j.Provenance, j.RerunOf = orig.Input, prov, orig.ID })
+	if err := submitJob(j); err != nil {
+		deleteJob(j.ID)
+		writeSubmitError(w, err)
+		return
+	}
+	queued, _ := getJob(j.ID)
+	w.Header().Set("Location", apiPath(r, "/jobs/"+j.ID))
+	writeJSON(w, http.StatusAccepted, queued)
+}
+
+// rerunOptions returns the options of a rerun: the fields of r override
+// those of orig, and the result is checked like a new submission.
+func rerunOptions(orig analysisOptions, r *http.Request) (analysisOptions, error) {
+	// Every option field holds its form encoding as JSON, except that text
+	// is a JSON string
+	encoded := map[string]json.RawMessage{}
+	data, err := json.Marshal(orig)
+	if err != nil {
+		return orig, err
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return orig, err
+	}
+	get := func(name string) string {
+		if _, ok := r.Form[name]; ok {
+			return r.Form.Get(name)
+		}
+		var s string
+		if raw, ok := encoded[name]; ok && json.Unmarshal(raw, &s) != nil {
+			return string(raw)
+		}
+		return s
+	}
+	opts, err := decodeAnalysisOptions(get, slices.Collect(maps.Keys(r.Form)), []string{"environment"})
+	errs, _ := err.(*invalidFieldsError)
+	if errs == nil {
+		errs = &invalidFieldsError{}
+	}
+	for _, name := range rerunFixedOptions {
+		if _, ok := r.Form[name]; ok {
+			errs.add(name, errors.New(name+" cannot be changed on a rerun, as the input was prepared with it"))
+		}
+	}
+	return opts, errs.orNil()
+}
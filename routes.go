@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersions lists the versions served below /<version>, oldest first.
+var apiVersions = []string{"v1"}
+
+// legacyDeprecatedAt is when the unversioned routes were superseded by /v1.
+var legacyDeprecatedAt = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+
+var legacyRequests = newCounter("datascribe_legacy_requests_total", "Requests to deprecated unversioned routes.")
+
+// apiRoute is an endpoint of the public API. Its handler may change between
+// versions; each version uses the handler of the newest version at or
+// before it.
+type apiRoute struct {
+	pattern  string
+	handlers map[string]http.Handler
+}
+
+var apiRoutes []*apiRoute
+
+// handleAPI declares an API endpoint, served from v1 onwards. Routes are
+// registered on the mux by mountAPI.
+func handleAPI(pattern string, h http.Handler) *apiRoute {
+	rt := &apiRoute{pattern: pattern, handlers: map[string]http.Handler{apiVersions[0]: h}}
+	apiRoutes = append(apiRoutes, rt)
+	return rt
+}
+
+// changedIn serves h from version onwards; earlier versions keep their
+// handler. A nil h removes the endpoint from version onwards.
+func (rt *apiRoute) changedIn(version string, h http.Handler) *apiRoute {
+	rt.handlers[version] = h
+	return rt
+}
+
+func (rt *apiRoute) handler(version string) http.Handler {
+	var h http.Handler
+	for _, v := range apiVersions {
+		if next, ok := rt.handlers[v]; ok {
+			h = next
+		}
+		if v == version {
+			break
+		}
+	}
+	return h
+}
+
+// mountAPI registers every API route below each version, and at its legacy
+// unversioned path, which behaves like v1 and is marked deprecated.
+func mountAPI(mux *http.ServeMux) {
+	for _, rt := range apiRoutes {
+		method, path := "", rt.pattern
+		if i := strings.IndexByte(path, ' '); i >= 0 {
+			method, path = path[:i+1], path[i+1:]
+		}
+		for _, v := range apiVersions {
+			if h := rt.handler(v); h != nil {
+				mux.Handle(method+"/"+v+path, withAPIVersion(v, withEndpointPolicy(rt.pattern, h)))
+			}
+		}
+		if h := rt.handler(apiVersions[0]); h != nil {
+			mux.Handle(rt.pattern, deprecated(rt.pattern, withEndpointPolicy(rt.pattern, h)))
+		}
+	}
+}
+
+type apiVersionKey struct{}
+
+func withAPIVersion(version string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
+
+// apiVersion returns the API version of the request, or "" on a legacy route.
+func apiVersion(r *http.Request) string {
+	v, _ := r.Context().Value(apiVersionKey{}).(string)
+	return v
+}
+
+// apiPath returns path as seen by the caller, i.e. below the version prefix
+// the request came in on, so Location headers keep clients on their version.
+func apiPath(r *http.Request, path string) string {
+	if v := apiVersion(r); v != "" {
+		return "/" + v + path
+	}
+	return path
+}
+
+// deprecated serves a legacy route with Deprecation (RFC 9745) and Sunset
+// (RFC 8594) headers pointing clients at the /v1 equivalent.
+func deprecated(pattern string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		legacyRequests.inc("route", pattern)
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()))
+		w.Header().Set("Sunset", cfg.LegacySunset.UTC().Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("</%s%s>; rel=\"successor-version\"", apiVersions[0], r.URL.Path))
+		h.ServeHTTP(w, r)
+	})
+}
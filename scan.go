@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// scanResult is the verdict of a malware scan.
+type scanResult struct {
+	Scanner   string `json:"scanner"`
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// scanEnabled reports whether uploads must be scanned before analysis.
+func scanEnabled() bool {
+	return cfg.ClamdAddr != "" || cfg.ScanURL != ""
+}
+
+// scanFile runs the configured scanner against the file at path. clamd is
+// preferred when both a daemon and an external API are configured.
+func scanFile(ctx context.Context, path string) (scanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.ScanTimeout)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer f.Close()
+
+	if cfg.ClamdAddr != "" {
+		return scanClamd(ctx, f)
+	}
+	return scanHTTP(ctx, f)
+}
+
+// scanClamd streams r to clamd using the INSTREAM command. ClamdAddr is
+// either tcp://host:port or unix:///path/to/clamd.sock.
+func scanClamd(ctx context.Context, r io.Reader) (scanResult, error) {
+	network, addr := "tcp", strings.TrimPrefix(cfg.ClamdAddr, "tcp://")
+	if strings.HasPrefix(cfg.ClamdAddr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(cfg.ClamdAddr, "unix://")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return scanResult{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanResult{}, err
+	}
+	chunk := make([]byte, 64<<10)
+	var size [4]byte
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, werr := conn.Write(size[:]); werr != nil {
+				return scanResult{}, werr
+			}
+			if _, werr := conn.Write(chunk[:n]); werr != nil {
+				return scanResult{}, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return scanResult{}, err
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return scanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return scanResult{}, fmt.Errorf("read clamd reply: %w", err)
+	}
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND".
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return scanResult{Scanner: "clamd"}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanResult{Scanner: "clamd", Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return scanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanHTTP posts r to an external scanning API, which must answer with
+// JSON of the form {"infected": bool, "signature": "..."}.
+func scanHTTP(ctx context.Context, r io.Reader) (scanResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.ScanURL, r)
+	if err != nil {
+		return scanResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return scanResult{}, fmt.Errorf("scan api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return scanResult{}, fmt.Errorf("scan api: unexpected status %s", resp.Status)
+	}
+	res := scanResult{Scanner: "http"}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return scanResult{}, fmt.Errorf("scan api: decode response: %w", err)
+	}
+	res.Scanner = "http"
+	return res, nil
+}
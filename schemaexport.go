@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// schemaFormats are the documents GET /jobs/{id}/schema exports the
+// inferred profile of a job's input as; the first is the default.
+var schemaFormats = []string{"table_schema", "great_expectations"}
+
+// jobProfile is predict.py's inference for the input of a job, written
+// with --profile-json: the type of each column and the constraints all its
+// values meet.
+type jobProfile struct {
+	Rows    int             `json:"rows"`
+	Columns []profileColumn `json:"columns"`
+}
+
+// profileColumn describes one column. Type is a Table Schema type and
+// DType the pandas dtype it was read as. Min and Max are set for numeric
+// columns and Enum for strings with few distinct values.
+type profileColumn struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	DType   string   `json:"dtype"`
+	Missing int      `json:"missing"`
+	Unique  bool     `json:"unique"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+}
+
+// handleGetJobSchema exports what the analyzer inferred about the input of
+// a finished job, as a Frictionless Table Schema (format=table_schema, the
+// default) or a Great Expectations suite (format=great_expectations), for
+// downstream validation. A Table Schema can be attached as the schema
+// option of later uploads of the same data. The profile is computed on first
+// request and cached in the job workspace until the job expires.
+func handleGetJobSchema(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	format := cmp.Or(r.FormValue("format"), schemaFormats[0])
+	if !slices.Contains(schemaFormats, format) {
+		http.Error(w, fmt.Sprintf("unsupported format %q (want %s)", format, strings.Join(schemaFormats, ", ")), http.StatusBadRequest)
+		return
+	}
+	if j.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("schema not available: job is %s", j.Status), http.StatusConflict)
+		return
+	}
+
+	p, err := loadJobProfile(r.Context(), &j)
+	if err != nil {
+		logAnalysisError(fmt.Sprintf("job %s (schema)", j.ID), err)
+		writeAnalysisError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if format == "great_expectations" {
+		writeJSON(w, http.StatusOK, p.expectationSuite(cmp.Or(j.Name, j.Filename, j.ID)))
+		return
+	}
+	writeJSON(w, http.StatusOK, p.tableSchema())
+}
+
+// loadJobProfile returns the profile of the input of j, running predict.py
+// unless it is cached.
+func loadJobProfile(ctx context.Context, j *job) (*jobProfile, error) {
+	path := j.ws.path("profile.json")
+	mu := previewLock(j.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		defer os.Remove(path + ".tmp")
+		args := append([]string{"--input", j.inputPath(), "--profile-json", path + ".tmp"}, j.Options.columnArgs()...)
+		if _, err := runPredict(ctx, args...); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p jobProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("analyzer produced an invalid profile: %v", err)
+	}
+	return &p, nil
+}
+
+// tableSchema returns the profile as a Frictionless Table Schema. Its
+// missing values are the ones the analyzer reads as missing.
+func (p *jobProfile) tableSchema() map[string]any {
+	fields := make([]map[string]any, len(p.Columns))
+	for i, c := range p.Columns {
+		constraints := map[string]any{}
+		if c.Missing == 0 && p.Rows > 0 {
+			constraints["required"] = true
+		}
+		if c.Unique {
+			constraints["unique"] = true
+		}
+		if c.Min != nil {
+			constraints["minimum"], constraints["maximum"] = *c.Min, *c.Max
+		}
+		if c.Enum != nil {
+			constraints["enum"] = c.Enum
+		}
+		field := map[string]any{"name": c.Name, "type": c.Type}
+		if len(constraints) > 0 {
+			field["constraints"] = constraints
+		}
+		fields[i] = field
+	}
+	return map[string]any{
+		"fields":        fields,
+		"missingValues": slices.Sorted(maps.Keys(naValues)),
+	}
+}
+
+// geExpectation is an expectation of a Great Expectations suite.
+type geExpectation struct {
+	Type   string         `json:"expectation_type"`
+	Kwargs map[string]any `json:"kwargs"`
+}
+
+// expectationSuite returns the profile as a Great Expectations suite named
+// name: the ordered column list, and per column its dtype, nullability,
+// uniqueness, range and value set.
+func (p *jobProfile) expectationSuite(name string) map[string]any {
+	names := make([]string, len(p.Columns))
+	for i, c := range p.Columns {
+		names[i] = c.Name
+	}
+	list := []geExpectation{{"expect_table_columns_to_match_ordered_list", map[string]any{"column_list": names}}}
+	for _, c := range p.Columns {
+		add := func(typ string, kwargs map[string]any) {
+			kwargs["column"] = c.Name
+			list = append(list, geExpectation{typ, kwargs})
+		}
+		add("expect_column_values_to_be_of_type", map[string]any{"type_": c.DType})
+		if c.Missing == 0 && p.Rows > 0 {
+			add("expect_column_values_to_not_be_null", map[string]any{})
+		}
+		if c.Unique {
+			add("expect_column_values_to_be_unique", map[string]any{})
+		}
+		if c.Min != nil {
+			add("expect_column_values_to_be_between", map[string]any{"min_value": *c.Min, "max_value": *c.Max})
+		}
+		if c.Enum != nil {
+			add("expect_column_values_to_be_in_set", map[string]any{"value_set": c.Enum})
+		}
+	}
+	return map[string]any{
+		"expectation_suite_name": name,
+		"expectations":           list,
+		"meta":                   map[string]any{"generated_by": "DataScribe", "rows": p.Rows},
+	}
+}
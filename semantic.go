@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// Semantic types say what the values of a column mean, beyond how they are
+// stored:
+//
+//	currency[:CODE]     amounts of money, in the ISO 4217 currency CODE
+//	percentage[:ratio]  percentages from 0 to 100, or with ratio from 0 to 1
+//	identifier          keys such as order IDs, read as text
+//	category            one of a fixed set of values, even when numbers
+//
+// They come from the semantic_types option, e.g. {"price": "currency:EUR"},
+// and from the semantic types of the dataset a job is submitted to, which
+// the option overrides column by column; the dataset ones may name columns
+// an upload lacks. The report formats currencies and percentages and
+// totals currency columns; identifiers and categories get no numeric
+// statistics or charts, and identifiers are checked for duplicates instead.
+
+// semanticTypes are the semantic types and whether each takes a parameter.
+var semanticTypes = map[string]bool{"currency": true, "percentage": true, "identifier": false, "category": false}
+
+func semanticTypeNames() []string {
+	return []string{"category", "currency", "identifier", "percentage"}
+}
+
+// parseSemanticTypes parses a JSON object of column names to semantic types.
+func parseSemanticTypes(v string) (map[string]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var semantic map[string]string
+	if err := json.Unmarshal([]byte(v), &semantic); err != nil {
+		return nil, fmt.Errorf("semantic_types must be a JSON object of column names to semantic types")
+	}
+	for col, s := range semantic {
+		if err := checkSemanticType(s); err != nil {
+			return nil, fmt.Errorf("semantic_types[%q]: %w", col, err)
+		}
+	}
+	return semantic, nil
+}
+
+func checkSemanticType(s string) error {
+	name, param, hasParam := strings.Cut(s, ":")
+	takesParam, ok := semanticTypes[name]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown semantic type %q (want currency, percentage, identifier or category)", name)
+	case hasParam && !takesParam:
+		return fmt.Errorf("%s takes no parameter, got %q", name, s)
+	case hasParam && name == "currency" && !isCurrencyCode(param):
+		return fmt.Errorf("invalid currency code %q: want three capital letters, as in currency:EUR", param)
+	case hasParam && name == "percentage" && param != "ratio":
+		return fmt.Errorf("invalid percentage scale %q: want percentage or percentage:ratio", param)
+	}
+	return nil
+}
+
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// textSemanticType reports whether the semantic type s is read as text
+// rather than numbers.
+func textSemanticType(s string) bool {
+	name, _, _ := strings.Cut(s, ":")
+	return name == "identifier" || name == "category"
+}
+
+// withDatasetSemanticTypes returns semantic with the semantic types of the
+// dataset id filled in for the columns it does not mention.
+func withDatasetSemanticTypes(id string, semantic map[string]string) map[string]string {
+	datasetsMu.Lock()
+	defer datasetsMu.Unlock()
+	d, ok := datasets[id]
+	if !ok || len(d.SemanticTypes) == 0 {
+		return semantic
+	}
+	merged := maps.Clone(d.SemanticTypes)
+	maps.Copy(merged, semantic)
+	return merged
+}
+
+// handleGetDatasetSemanticTypes returns the semantic types of a dataset.
+func handleGetDatasetSemanticTypes(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	datasetsMu.Lock()
+	semantic := maps.Clone(d.SemanticTypes)
+	datasetsMu.Unlock()
+	if semantic == nil {
+		semantic = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, semantic)
+}
+
+// handlePutDatasetSemanticTypes replaces the semantic types of a dataset
+// with the JSON object of the body. Jobs already running keep the ones
+// they started with.
+func handlePutDatasetSemanticTypes(w http.ResponseWriter, r *http.Request) {
+	d, ok := lookupDataset(w, r)
+	if !ok {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	semantic, err := parseSemanticTypes(string(data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	datasetsMu.Lock()
+	prev := d.SemanticTypes
+	d.SemanticTypes = semantic
+	if err = saveDataset(d); err != nil {
+		d.SemanticTypes = prev
+	}
+	datasetsMu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to store dataset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if semantic == nil {
+		semantic = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, semantic)
+}
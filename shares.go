@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// share is a link to a job's report that works without credentials. Only
+// the SHA-256 of its token is kept; the token itself is returned once, when
+// the share is created.
+type share struct {
+	ID    string `json:"id"`
+	JobID string `json:"job_id"`
+	// URL is only set in the creation response.
+	URL       string    `json:"url,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxDownloads of 0 allows any number of downloads.
+	MaxDownloads int        `json:"max_downloads"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+
+	tokenHash string
+	// lastDownload is when the share was last downloaded from its start.
+	lastDownload time.Time
+}
+
+var (
+	sharesMu sync.Mutex
+	// shares is keyed by token hash.
+	shares = map[string]*share{}
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleCreateShare creates a share link for a finished job's report.
+// expires_in (a duration, default cfg.ShareDefaultExpiry) sets its lifetime
+// and max_downloads caps how often it can be used. A share never outlives
+// the job itself.
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	expiresIn := cfg.ShareDefaultExpiry
+	if v := r.FormValue("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in must be a positive duration such as 72h", http.StatusBadRequest)
+			return
+		}
+		expiresIn = d
+	}
+	maxDownloads := 0
+	if v := r.FormValue("max_downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "max_downloads must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		maxDownloads = n
+	}
+	if j.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("report not available: job is %s", j.Status), http.StatusConflict)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now().UTC()
+	s := &share{ID: newID(), JobID: j.ID, ExpiresAt: now.Add(expiresIn), MaxDownloads: maxDownloads,
+		CreatedAt: now, tokenHash: hashToken(token)}
+	sharesMu.Lock()
+	shares[s.tokenHash] = s
+	created := *s
+	sharesMu.Unlock()
+
+	audit(r, "share_created", map[string]any{"job_id": j.ID, "share_id": s.ID,
+		"expires_at": s.ExpiresAt, "max_downloads": maxDownloads})
+	created.URL = apiPath(r, "/shared/"+token)
+	w.Header().Set("Location", created.URL)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// handleListShares returns the shares of a job, newest first.
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	list := []share{}
+	sharesMu.Lock()
+	for _, s := range shares {
+		if s.JobID == j.ID {
+			list = append(list, *s)
+		}
+	}
+	sharesMu.Unlock()
+	slices.SortFunc(list, func(a, b share) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	writeJSON(w, http.StatusOK, map[string][]share{"shares": list})
+}
+
+// handleRevokeShare disables a share; it stays listed as revoked.
+func handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("share")
+	found := false
+	sharesMu.Lock()
+	for _, s := range shares {
+		if s.JobID == j.ID && s.ID == id {
+			found = true
+			if s.RevokedAt == nil {
+				now := time.Now().UTC()
+				s.RevokedAt = &now
+			}
+		}
+	}
+	sharesMu.Unlock()
+	if !found {
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	}
+	audit(r, "share_revoked", map[string]any{"job_id": j.ID, "share_id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareRangeWindow is how long after a download of a share the rest of the
+// report can be fetched in ranges without counting again.
+const shareRangeWindow = 15 * time.Minute
+
+// handleShared serves the report behind a share token to anyone holding
+// it. Every GET that starts at the first byte of the report, with or
+// without a Range header, counts as a download. Ranges further in are only
+// served within shareRangeWindow of a download, so a viewer fetching the
+// rest of the file in ranges uses one download, and ranges cannot be used
+// to fetch the report without counting.
+func handleShared(w http.ResponseWriter, r *http.Request) {
+	hash := hashToken(r.PathValue("token"))
+	sharesMu.Lock()
+	s, ok := shares[hash]
+	sharesMu.Unlock()
+	if !ok {
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	}
+	j, ok := getJob(s.JobID)
+	if !ok || j.Status != jobSucceeded {
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	}
+	disposition, err := reportDisposition(r, j.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts := r.Method == http.MethodGet && rangeStartsAtZero(r.Header.Get("Range"))
+	continues := r.Method == http.MethodGet && !counts
+	now := time.Now()
+	var reason string
+	status := http.StatusGone
+	sharesMu.Lock()
+	switch {
+	case s.RevokedAt != nil:
+		reason = "revoked"
+	case now.After(s.ExpiresAt):
+		reason = "expired"
+	case continues && now.Sub(s.lastDownload) > shareRangeWindow:
+		reason, status = "ranges past the start are only served shortly after a download", http.StatusForbidden
+	case s.MaxDownloads > 0 && counts && s.Downloads >= s.MaxDownloads:
+		reason = "download limit reached"
+	case counts:
+		s.Downloads++
+		s.lastDownload = now
+	}
+	details := map[string]any{"job_id": s.JobID, "share_id": s.ID, "downloads": s.Downloads,
+		"counted": counts && reason == ""}
+	sharesMu.Unlock()
+	if reason != "" {
+		details["denied"] = reason
+		audit(r, "share_accessed", details)
+		if status == http.StatusGone {
+			reason = "share is no longer available: " + reason
+		}
+		http.Error(w, reason, status)
+		return
+	}
+
+	report, err := os.Open(j.reportPath())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open generated PDF: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer report.Close()
+	if rng := r.Header.Get("Range"); rng != "" {
+		details["range"] = rng
+	}
+	audit(r, "share_accessed", details)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeContent(w, r, "report.pdf", *j.FinishedAt, report)
+}
+
+// rangeStartsAtZero reports whether the Range header h asks for the report
+// from its first byte, as does a request without one. Headers that are
+// not byte ranges are ignored by http.ServeContent, which then sends the
+// whole report.
+func rangeStartsAtZero(h string) bool {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(h), "bytes=")
+	if !ok {
+		return true
+	}
+	for _, r := range strings.Split(spec, ",") {
+		start, _, _ := strings.Cut(r, "-")
+		if n, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64); err == nil && n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetShares drops the shares of a deleted job.
+func forgetShares(jobID string) {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	for hash, s := range shares {
+		if s.JobID == jobID {
+			delete(shares, hash)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRangeStartsAtZero(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-99", true},
+		{" bytes=500-999, 0-99", true},
+		{"bytes=100-", false},
+		{"bytes=-500", false},
+		{"bytes=1-1,2-2", false},
+		{"bytes=00-10", true},
+		{"bytes=", false},
+		{"items=5-10", true},
+	}
+	for _, tt := range tests {
+		if got := rangeStartsAtZero(tt.header); got != tt.want {
+			t.Errorf("rangeStartsAtZero(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
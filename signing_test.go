@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useSigningConfig(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.HMACKeys = map[string]string{"partner": "s3cret"}
+	cfg.SignatureMaxSkew = 5 * time.Minute
+}
+
+// signRequest returns the X-Signature of a request signed with secret at t.
+func signRequest(secret string, t time.Time, method, uri, body string) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	bodySum := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", ts, method, uri, hex.EncodeToString(bodySum[:]))
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	useSigningConfig(t)
+	now := time.Now()
+	tests := []struct {
+		name string
+		// the request as signed
+		keyID, secret string
+		signedAt      time.Time
+		signedURI     string
+		signedBody    string
+		// the request as sent
+		uri, body string
+		header    string // X-Signature, if not the signed one
+		want      string // error, or empty for success
+	}{
+		{name: "valid", keyID: "partner", secret: "s3cret", signedAt: now,
+			signedURI: "/v1/predict?preset=monthly", uri: "/v1/predict?preset=monthly", signedBody: "a,b\n1,2\n", body: "a,b\n1,2\n"},
+		{name: "clock skew within the window", keyID: "partner", secret: "s3cret", signedAt: now.Add(-4 * time.Minute),
+			signedURI: "/predict", uri: "/predict"},
+		{name: "query changed", keyID: "partner", secret: "s3cret", signedAt: now,
+			signedURI: "/v1/predict?preset=monthly", uri: "/v1/predict?preset=daily", want: "signature mismatch"},
+		{name: "query added", keyID: "partner", secret: "s3cret", signedAt: now,
+			signedURI: "/v1/predict", uri: "/v1/predict?wait=30s", want: "signature mismatch"},
+		{name: "path changed", keyID: "partner", secret: "s3cret", signedAt: now,
+			signedURI: "/jobs/a", uri: "/jobs/b", want: "signature mismatch"},
+		{name: "body changed", keyID: "partner", secret: "s3cret", signedAt: now,
+			signedURI: "/predict", uri: "/predict", signedBody: "a\n1\n", body: "a\n2\n", want: "signature mismatch"},
+		{name: "wrong secret", keyID: "partner", secret: "guess", signedAt: now,
+			signedURI: "/predict", uri: "/predict", want: "signature mismatch"},
+		{name: "unknown key", keyID: "other", secret: "s3cret", signedAt: now,
+			signedURI: "/predict", uri: "/predict", want: `unknown key id "other"`},
+		{name: "too old", keyID: "partner", secret: "s3cret", signedAt: now.Add(-6 * time.Minute),
+			signedURI: "/predict", uri: "/predict", want: "signature timestamp outside allowed window (5m0s)"},
+		{name: "from the future", keyID: "partner", secret: "s3cret", signedAt: now.Add(6 * time.Minute),
+			signedURI: "/predict", uri: "/predict", want: "signature timestamp outside allowed window (5m0s)"},
+		{name: "no timestamp", keyID: "partner", uri: "/predict", header: "v1=00", want: "malformed X-Signature header"},
+		{name: "no signature", keyID: "partner", uri: "/predict", header: "t=1700000000", want: "malformed X-Signature header"},
+		{name: "bad timestamp", keyID: "partner", uri: "/predict", header: "t=soon,v1=00", want: "malformed X-Signature header"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.uri, strings.NewReader(tt.body))
+		r.Header.Set("X-Key-ID", tt.keyID)
+		header := tt.header
+		if header == "" {
+			header = signRequest(tt.secret, tt.signedAt, "POST", tt.signedURI, tt.signedBody)
+		}
+		r.Header.Set("X-Signature", header)
+		identity, err := verifySignature(r)
+		if tt.want != "" {
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if identity != "hmac:"+tt.keyID {
+			t.Errorf("%s: identity = %q, want hmac:%s", tt.name, identity, tt.keyID)
+		}
+		// the handler still reads the body that was hashed
+		body, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		if string(body) != tt.body {
+			t.Errorf("%s: body after verification = %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestVerifySignatureReplay(t *testing.T) {
+	useSigningConfig(t)
+	header := signRequest("s3cret", time.Now(), "DELETE", "/jobs/replayed", "")
+	send := func() error {
+		r := httptest.NewRequest("DELETE", "/jobs/replayed", nil)
+		r.Header.Set("X-Key-ID", "partner")
+		r.Header.Set("X-Signature", header)
+		_, err := verifySignature(r)
+		return err
+	}
+	if err := send(); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := send(); err == nil || err.Error() != "signature already used" {
+		t.Errorf("replayed request: error = %v, want signature already used", err)
+	}
+}
+
+func TestVerifySignatureWithoutHeader(t *testing.T) {
+	useSigningConfig(t)
+	r := httptest.NewRequest("GET", "/jobs", nil)
+	r.Header.Set("X-Key-ID", "partner")
+	if _, err := verifySignature(r); !errors.Is(err, errNoCredentials) {
+		t.Errorf("error = %v, want errNoCredentials", err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Streaming sketches for the statistics computed in Go, which keep memory
+// flat however large the file: the endpoints using them take exact=true to
+// keep every value instead. The sketches are mergeable, so the parallel
+// profiler summarizes each chunk of a file on its own and merges the
+// results, which do not depend on how the file was split beyond the
+// sketches' own error.
+
+// exactRequested parses the exact field, which defaults to whether the
+// sketch_stats feature flag is off for the caller.
+func exactRequested(w http.ResponseWriter, r *http.Request) (exact, ok bool) {
+	v := r.FormValue("exact")
+	if v == "" {
+		return !featureEnabled(r, "sketch_stats"), true
+	}
+	exact, err := strconv.ParseBool(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid exact %q: want true or false", v), http.StatusBadRequest)
+		return false, false
+	}
+	return exact, true
+}
+
+// tdigestCompression bounds the centroids of a t-digest to about this
+// many; quantile errors are around 1% in the middle of the distribution
+// and much smaller in the tails.
+const tdigestCompression = 100
+
+type centroid struct {
+	mean, weight float64
+}
+
+// tdigest estimates quantiles (Dunning's merging t-digest with the k1 scale
+// function). Values are buffered and merged into the centroids in batches.
+type tdigest struct {
+	centroids []centroid
+	buffer    []centroid
+	total     float64
+	lo, hi    float64
+}
+
+func newTDigest() *tdigest {
+	return &tdigest{lo: math.Inf(1), hi: math.Inf(-1)}
+}
+
+func (d *tdigest) add(x float64) {
+	d.buffer = append(d.buffer, centroid{x, 1})
+	d.lo, d.hi = min(d.lo, x), max(d.hi, x)
+	if len(d.buffer) >= 5*tdigestCompression {
+		d.compress()
+	}
+}
+
+// merge adds the values summarized by o.
+func (d *tdigest) merge(o *tdigest) {
+	d.buffer = append(d.buffer, o.centroids...)
+	d.buffer = append(d.buffer, o.buffer...)
+	d.lo, d.hi = min(d.lo, o.lo), max(d.hi, o.hi)
+	d.compress()
+}
+
+// compress merges the buffer into the centroids. A centroid may grow while
+// it stays within one unit of the scale function, which keeps the
+// centroids near the tails small.
+func (d *tdigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	d.buffer = d.buffer[:0]
+	slices.SortFunc(all, func(a, b centroid) int {
+		switch {
+		case a.mean < b.mean:
+			return -1
+		case a.mean > b.mean:
+			return 1
+		}
+		return 0
+	})
+	d.total = 0
+	for _, c := range all {
+		d.total += c.weight
+	}
+	k := func(q float64) float64 { return tdigestCompression / (2 * math.Pi) * math.Asin(2*q-1) }
+	kInverse := func(k float64) float64 { return (math.Sin(k*2*math.Pi/tdigestCompression) + 1) / 2 }
+
+	merged := []centroid{all[0]}
+	before := 0.0 // weight of the centroids before the last one
+	limit := d.total * kInverse(k(0)+1)
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		if before+last.weight+c.weight <= limit {
+			last.mean += (c.mean - last.mean) * c.weight / (last.weight + c.weight)
+			last.weight += c.weight
+			continue
+		}
+		before += last.weight
+		limit = d.total * kInverse(k(before/d.total)+1)
+		merged = append(merged, c)
+	}
+	d.centroids = merged
+}
+
+// quantile returns the estimated q-quantile, interpolating between the
+// centres of neighbouring centroids and towards the exact extremes.
+func (d *tdigest) quantile(q float64) float64 {
+	d.compress()
+	cs := d.centroids
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case q <= 0:
+		return d.lo
+	case q >= 1:
+		return d.hi
+	case len(cs) == 1:
+		return cs[0].mean
+	}
+	target := q * d.total
+	if first := cs[0]; target < first.weight/2 {
+		return d.lo + (first.mean-d.lo)*target/(first.weight/2)
+	}
+	cum := 0.0
+	for i := 1; i < len(cs); i++ {
+		prev, c := cs[i-1], cs[i]
+		from, to := cum+prev.weight/2, cum+prev.weight+c.weight/2
+		if target < to {
+			return prev.mean + (c.mean-prev.mean)*(target-from)/(to-from)
+		}
+		cum += prev.weight
+	}
+	last := cs[len(cs)-1]
+	from := d.total - last.weight/2
+	return last.mean + (d.hi-last.mean)*(target-from)/(last.weight/2)
+}
+
+// hllPrecision gives 2^12 registers: 4 KiB per sketch and a standard
+// error of about 1.6%.
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct strings added to it.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+// add records a value by its hashString.
+func (h *hyperLogLog) add(x uint64) {
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	h.registers[i] = max(h.registers[i], rank)
+}
+
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	for i, r := range o.registers {
+		h.registers[i] = max(h.registers[i], r)
+	}
+}
+
+// estimate returns the cardinality estimate, using linear counting while
+// empty registers still count it more precisely.
+func (h *hyperLogLog) estimate() int {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
+
+// Count-Min dimensions: an estimate exceeds the true count by more than
+// e/cmsWidth (0.13%) of all values added with probability e^-cmsDepth (2%).
+const (
+	cmsWidth = 2048
+	cmsDepth = 4
+	// topCandidates is how many values heavyHitters follows as possibly
+	// among the most frequent.
+	topCandidates = 50
+)
+
+// countMinSketch estimates how often values were added. Estimates never
+// undercount.
+type countMinSketch struct {
+	counts [cmsDepth][cmsWidth]uint32
+}
+
+// add records a value by its hashString and returns its new estimate.
+func (s *countMinSketch) add(x uint64) uint32 {
+	h1, h2 := uint32(x), uint32(x>>32)|1
+	est := uint32(math.MaxUint32)
+	for i := range s.counts {
+		c := &s.counts[i][(h1+uint32(i)*h2)%cmsWidth]
+		*c++
+		est = min(est, *c)
+	}
+	return est
+}
+
+func (s *countMinSketch) estimate(x uint64) uint32 {
+	h1, h2 := uint32(x), uint32(x>>32)|1
+	est := uint32(math.MaxUint32)
+	for i := range s.counts {
+		est = min(est, s.counts[i][(h1+uint32(i)*h2)%cmsWidth])
+	}
+	return est
+}
+
+func (s *countMinSketch) merge(o *countMinSketch) {
+	for i := range s.counts {
+		for j, c := range o.counts[i] {
+			s.counts[i][j] += c
+		}
+	}
+}
+
+// heavyHitters finds the most frequent values: every value goes into a
+// Count-Min sketch, and the topCandidates values with the highest
+// estimates so far are kept. A value frequent overall but never among the
+// candidates of any chunk of the file can be missed.
+type heavyHitters struct {
+	sketch     countMinSketch
+	candidates map[string]uint32
+	// floor is at most the lowest candidate estimate.
+	floor uint32
+}
+
+func newHeavyHitters() *heavyHitters {
+	return &heavyHitters{candidates: map[string]uint32{}}
+}
+
+// add records v, whose hashString is x.
+func (h *heavyHitters) add(v string, x uint64) {
+	est := h.sketch.add(x)
+	if _, ok := h.candidates[v]; ok {
+		h.candidates[v] = est
+		return
+	}
+	if len(h.candidates) < topCandidates {
+		h.candidates[strings.Clone(v)] = est
+		return
+	}
+	if est <= h.floor {
+		return
+	}
+	lowest, lowestEst, next := "", uint32(math.MaxUint32), uint32(math.MaxUint32)
+	for c, e := range h.candidates {
+		if e < lowestEst {
+			lowest, lowestEst, next = c, e, lowestEst
+		} else if e < next {
+			next = e
+		}
+	}
+	if est <= lowestEst {
+		h.floor = lowestEst
+		return
+	}
+	delete(h.candidates, lowest)
+	h.candidates[strings.Clone(v)] = est
+	h.floor = min(next, est)
+}
+
+func (h *heavyHitters) merge(o *heavyHitters) {
+	h.sketch.merge(&o.sketch)
+	for c := range o.candidates {
+		h.candidates[c] = 0
+	}
+	for c := range h.candidates {
+		h.candidates[c] = h.sketch.estimate(hashString(c))
+	}
+	if len(h.candidates) > topCandidates {
+		for _, vc := range topValues(h.candidates, 0)[topCandidates:] {
+			delete(h.candidates, vc.Value)
+		}
+	}
+	h.floor = 0
+}
+
+// valueCount is a value with how often it occurs.
+type valueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// topValues returns the n most frequent values of counts, or all of them
+// for n = 0, most frequent first and ties in value order.
+func topValues[N uint32 | int](counts map[string]N, n int) []valueCount {
+	list := make([]valueCount, 0, len(counts))
+	for v, c := range counts {
+		list = append(list, valueCount{v, int(c)})
+	}
+	slices.SortFunc(list, func(a, b valueCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// hashString is FNV-1a followed by the MurmurHash3 finalizer, which spreads
+// FNV's output over all bits as HyperLogLog needs. It is fixed, so
+// profiles of the same file are identical.
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
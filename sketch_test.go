@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestTDigestQuantiles compares the quantiles of a t-digest, built in one
+// piece or merged from parts, with the exact ones of a shuffled uniform
+// sample; the error is measured in rank.
+func TestTDigestQuantiles(t *testing.T) {
+	const n = 100000
+	rng := rand.New(rand.NewPCG(1, 2))
+	whole, merged := newTDigest(), newTDigest()
+	parts := []*tdigest{newTDigest(), newTDigest(), newTDigest()}
+	for i, x := range rng.Perm(n) {
+		whole.add(float64(x))
+		parts[i%len(parts)].add(float64(x))
+	}
+	for _, p := range parts {
+		merged.merge(p)
+	}
+	for _, d := range []*tdigest{whole, merged} {
+		for _, q := range []float64{0.001, 0.01, 0.25, 0.5, 0.75, 0.99, 0.999} {
+			if got := d.quantile(q); math.Abs(got/n-q) > 1.0/tdigestCompression {
+				t.Errorf("quantile(%g) = %g, want within 1%% of rank %g", q, got, q*n)
+			}
+		}
+		if lo, hi := d.quantile(0), d.quantile(1); lo != 0 || hi != n-1 {
+			t.Errorf("extremes = %g, %g, want 0, %d", lo, hi, n-1)
+		}
+	}
+	if len(whole.centroids) > 2*tdigestCompression {
+		t.Errorf("%d centroids, want at most about %d", len(whole.centroids), tdigestCompression)
+	}
+
+	small := newTDigest()
+	if !math.IsNaN(small.quantile(0.5)) {
+		t.Errorf("quantile of an empty digest is not NaN")
+	}
+	small.add(7)
+	if got := small.quantile(0.5); got != 7 {
+		t.Errorf("median of one value = %g, want 7", got)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 5000, 200000} {
+		var h, a, b hyperLogLog
+		for i := range n {
+			x := hashString("value-" + strconv.Itoa(i))
+			h.add(x)
+			h.add(x)
+			if i%2 == 0 {
+				a.add(x)
+			} else {
+				b.add(x)
+			}
+		}
+		a.merge(&b)
+		for name, got := range map[string]int{"one sketch": h.estimate(), "merged": a.estimate()} {
+			if math.Abs(float64(got-n)) > 0.05*float64(n)+0.5 {
+				t.Errorf("%s of %d distinct values estimates %d", name, n, got)
+			}
+		}
+	}
+}
+
+// TestHeavyHitters feeds a sketch, and two merged halves, values of which
+// 12 are frequent and within the candidates, among many rare ones.
+func TestHeavyHitters(t *testing.T) {
+	whole, a, b := newHeavyHitters(), newHeavyHitters(), newHeavyHitters()
+	want := map[string]int{}
+	for i := range 60000 {
+		v := "rare" + strconv.Itoa(i)
+		if i%5 == 0 {
+			v = "top" + strconv.Itoa(i%60/5)
+		}
+		want[v]++
+		whole.add(v, hashString(v))
+		if i < 30000 {
+			a.add(v, hashString(v))
+		} else {
+			b.add(v, hashString(v))
+		}
+	}
+	a.merge(b)
+	for name, h := range map[string]*heavyHitters{"one sketch": whole, "merged": a} {
+		top := topValues(h.candidates, 12)
+		for _, vc := range top {
+			// Estimates never undercount and stay within e/cmsWidth of all values
+			if !strings.HasPrefix(vc.Value, "top") || vc.Count < want[vc.Value] || vc.Count > want[vc.Value]+int(math.Ceil(60000*math.E/cmsWidth)) {
+				t.Errorf("%s: top value %s counted %d times, want %d", name, vc.Value, vc.Count, want[vc.Value])
+			}
+		}
+		if len(top) != 12 || len(h.candidates) > topCandidates {
+			t.Errorf("%s: %d top values of %d candidates, want 12 of at most %d", name, len(top), len(h.candidates), topCandidates)
+		}
+	}
+}
+
+func TestTopValues(t *testing.T) {
+	counts := map[string]int{"b": 2, "a": 2, "c": 5, "d": 1}
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "[{c 5} {a 2} {b 2} {d 1}]"},
+		{2, "[{c 5} {a 2}]"},
+		{9, "[{c 5} {a 2} {b 2} {d 1}]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(topValues(counts, tt.n)); got != tt.want {
+			t.Errorf("topValues(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestExactRequested(t *testing.T) {
+	tests := []struct {
+		flag  string // the rule of sketch_stats
+		form  string
+		exact bool
+		ok    bool
+	}{
+		{flag: "on", exact: false, ok: true},
+		{flag: "off", exact: true, ok: true},
+		{flag: "on", form: "exact=true", exact: true, ok: true},
+		{flag: "off", form: "exact=0", exact: false, ok: true},
+		{flag: "on", form: "exact=maybe", ok: false},
+	}
+	for _, tt := range tests {
+		useTestFlags(t, map[string]string{"sketch_stats": tt.flag})
+		w := httptest.NewRecorder()
+		exact, ok := exactRequested(w, httptest.NewRequest("POST", "/distribution?"+tt.form, nil))
+		if exact != tt.exact || ok != tt.ok || !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("sketch_stats %s with %q: exact %v, ok %v (%d), want %v, %v", tt.flag, tt.form, exact, ok, w.Code, tt.exact, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// How request bodies are held on their way to a workspace:
+//
+//   - A multipart upload keeps up to cfg.MultipartMemory bytes of its file
+//     parts in memory (DATASCRIBE_MULTIPART_MEMORY) and spools the rest to
+//     temporary files, from which the workspace copy is then made.
+//   - Temporary files go to cfg.SpoolDir (DATASCRIBE_SPOOL_DIR), which
+//     becomes the server's TMPDIR and so also holds the signed bodies
+//     spooled for verification and the analyzers' temporary files. It
+//     defaults to the first workspace volume, if any, and else the
+//     system's temporary directory.
+//   - Bodies, chunked and tus parts and spooled files are copied with
+//     buffers of cfg.UploadBufferSize bytes (DATASCRIBE_UPLOAD_BUFFER_SIZE),
+//     shared between requests.
+
+var uploadBuffers = sync.Pool{New: func() any {
+	b := make([]byte, cfg.UploadBufferSize)
+	return &b
+}}
+
+// copyBody copies src to dst through a buffer from uploadBuffers.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	buf := uploadBuffers.Get().(*[]byte)
+	defer uploadBuffers.Put(buf)
+	// Hiding ReadFrom and WriteTo makes the copy use the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// queryResult is the output of query.py.
+type queryResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Truncated bool     `json:"truncated"`
+}
+
+// handleQuery runs a read-only SQL SELECT, given in the sql form field,
+// over an uploaded CSV loaded as the table "data". query.py executes it in
+// an in-memory SQLite database that denies every statement but SELECT. At
+// most limit rows (capped by cfg.QueryMaxRows) are returned, as JSON or,
+// with format=csv, as CSV. The query stops when the client disconnects or
+// the request runs out of time. Registered datasets keep reports and
+// statistics rather than rows, so only uploads can be queried.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	in, ok := receiveCSV(w, r, "query")
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	sql := strings.TrimSpace(r.FormValue("sql"))
+	if sql == "" {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: "sql is required", Code: codeInvalidQuery})
+		return
+	}
+	// query.py enforces this too; checking here gives a clearer error
+	keyword := strings.ToUpper(sql)
+	if i := strings.IndexFunc(keyword, func(r rune) bool { return r < 'A' || r > 'Z' }); i >= 0 {
+		keyword = keyword[:i]
+	}
+	if keyword != "SELECT" && keyword != "WITH" {
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: "only SELECT statements are allowed", Code: codeInvalidQuery})
+		return
+	}
+	limit := cfg.QueryMaxRows
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, cfg.QueryMaxRows)
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("unsupported format %q (want json or csv)", format), http.StatusBadRequest)
+		return
+	}
+
+	out := in.ws.path("result.json")
+	args := append([]string{
+		"--input", in.path, "--output", out, "--sql", sql,
+		"--limit", strconv.Itoa(limit),
+		"--timeout", strconv.FormatFloat(cfg.QueryTimeout.Seconds(), 'f', -1, 64),
+	}, in.opts.headerArgs()...)
+	if _, err := runPython(r.Context(), "query.py", args...); err != nil {
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			log.Printf("query of %s cancelled: client disconnected", in.filename)
+			return
+		}
+		logAnalysisError(in.filename, err)
+		writeAnalysisError(w, err)
+		return
+	}
+	body, err := os.ReadFile(out)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("query produced no result: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var result queryResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		http.Error(w, fmt.Sprintf("query produced an invalid result: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if result.Truncated {
+		w.Header().Set("X-Result-Truncated", "true")
+	}
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="query.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(result.Columns)
+	record := make([]string, len(result.Columns))
+	for _, row := range result.Rows {
+		for i, v := range row {
+			record[i] = formatCell(v)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("query: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// With DATASCRIBE_STREAM_REPORTS set, POST /predict runs predict.py with
+// --output=-, which writes the PDF to its stdout, and relays the bytes to
+// the client with chunked transfer encoding as they are produced: the
+// first page arrives while the later charts are still drawn, and no report
+// file is written. Reports that need the finished file are still written
+// and sent at the end: PDF/A conversion, signing, and sync analyses kept as
+// jobs when the client disconnects (DATASCRIBE_DISCONNECT_MODE=async).
+//
+// Once the first byte is sent the status is 200, so a failure later on
+// aborts the response and the client sees a truncated transfer rather than
+// an incomplete PDF.
+
+// canStreamReport reports whether the report for opts can be streamed to
+// the caller of r.
+func canStreamReport(r *http.Request, opts analysisOptions) bool {
+	return cfg.StreamReports && !opts.PDFA && signer == nil && cfg.DisconnectMode != "async" &&
+		featureEnabled(r, "stream_reports")
+}
+
+// reportStream writes the analyzer's stdout to the response, sending the
+// PDF headers with the first byte. Past cfg.ReportMaxSize it discards the
+// rest, so that the analyzer still finishes normally.
+type reportStream struct {
+	w           http.ResponseWriter
+	disposition string
+	sent        int64
+	tooLarge    bool
+	err         error // of the response
+}
+
+func (s *reportStream) Write(p []byte) (int, error) {
+	if s.tooLarge || s.err != nil {
+		return len(p), nil
+	}
+	if cfg.ReportMaxSize > 0 && s.sent+int64(len(p)) > cfg.ReportMaxSize {
+		s.tooLarge = true
+		return len(p), nil
+	}
+	if s.sent == 0 {
+		s.w.Header().Set("Content-Type", "application/pdf")
+		s.w.Header().Set("Content-Disposition", s.disposition)
+		s.w.Header().Set("Cache-Control", "no-store")
+		s.w.WriteHeader(http.StatusOK)
+	}
+	n, err := s.w.Write(p)
+	s.sent += int64(n)
+	if err == nil {
+		err = http.NewResponseController(s.w).Flush()
+	}
+	s.err = err
+	return len(p), nil
+}
+
+// streamReport analyzes in and streams the report to w.
+func streamReport(w http.ResponseWriter, r *http.Request, in *receivedCSV, disposition string) {
+	optArgs, err := in.opts.args(in.ws.dir)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to prepare the analysis: %v", err), http.StatusInternalServerError)
+		return
+	}
+	args := append([]string{"--input", in.path, "--output=-"}, optArgs...)
+	if cfg.ReportMaxPages > 0 {
+		args = append(args, "--max-pages="+strconv.Itoa(cfg.ReportMaxPages))
+	}
+	s := &reportStream{w: w, disposition: disposition}
+	_, err = runPythonTo(r.Context(), s, "predict.py", args...)
+	if r.Context().Err() != nil {
+		log.Printf("analysis of %s cancelled: client disconnected", in.filename)
+		return
+	}
+	switch {
+	case err == nil && s.err != nil:
+		log.Printf("streaming the report of %s: %v", in.filename, s.err)
+		return
+	case err == nil && s.tooLarge:
+		err = &analysisError{Code: codeReportTooLarge, Status: http.StatusUnprocessableEntity,
+			Message: fmt.Sprintf("report is more than the %d bytes allowed; select fewer charts or columns", cfg.ReportMaxSize)}
+	case err == nil && s.sent == 0:
+		err = &analysisError{Code: codeAnalyzerCrashed, Status: http.StatusInternalServerError,
+			Message: "the analyzer wrote no report"}
+	case err == nil:
+		return
+	}
+	quarantine(err, in.path, in.filename, identityFrom(r), r.Method+" "+r.URL.Path)
+	logAnalysisError(in.filename, err)
+	if s.sent > 0 {
+		panic(http.ErrAbortHandler)
+	}
+	writeAnalysisError(w, err)
+}
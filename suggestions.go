@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// handleSuggestions returns predict.py's data-cleaning suggestions for an
+// uploaded CSV as JSON, without rendering the PDF report. The same
+// suggestions appear as a section of every report. With a target column the
+// response also carries the leakage and class imbalance warnings.
+func handleSuggestions(w http.ResponseWriter, r *http.Request) {
+	serveAnalyzerJSON(w, r, "suggestions", "--suggestions-json")
+}
+
+// handleSummary returns predict.py's dataset summary for an uploaded CSV:
+// column types and missing counts, the bounding box and invalid values of
+// coordinate columns, and the coverage, frequency and gaps of datetime
+// columns. With dp_epsilon the counts and bounded means are released with
+// differential-privacy noise instead, and the other statistics withheld.
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	serveAnalyzerJSON(w, r, "summary", "--summary-json")
+}
+
+// serveAnalyzerJSON runs predict.py on an uploaded CSV with only the given
+// JSON output flag, and sends that file back.
+func serveAnalyzerJSON(w http.ResponseWriter, r *http.Request, kind, flag string) {
+	in, ok := receiveCSV(w, r, kind)
+	if !ok {
+		return
+	}
+	defer in.ws.release()
+
+	out := in.ws.path(kind + ".json")
+	optArgs, err := in.opts.args(in.ws.dir)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to prepare the analysis: %v", err), http.StatusInternalServerError)
+		return
+	}
+	args := append([]string{"--input", in.path, flag, out}, optArgs...)
+	if _, err := runPredict(context.Background(), args...); err != nil {
+		logAnalysisError(in.filename, err)
+		writeAnalysisError(w, err)
+		return
+	}
+	body, err := os.ReadFile(out)
+	if err != nil || !json.Valid(body) {
+		http.Error(w, fmt.Sprintf("analyzer produced no %s: %v", kind, err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(body))
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the tus resumable upload protocol (https://tus.io),
+// version 1.0.0 with the creation, expiration and termination extensions.
+// Once an upload has received all of its bytes it is handed to the job
+// queue, and the job ID is reported in the X-Job-ID response header.
+//
+// Upload-Metadata carries the same fields as the query of a chunked upload,
+// and unknown keys are rejected the same way; filetype, which tus clients
+// commonly send, is accepted and ignored. PATCH requests that would take
+// the upload's workspace past DATASCRIBE_WORKSPACE_LIMIT fail with 413.
+
+const tusVersion = "1.0.0"
+
+// tusMetadataFields are the Upload-Metadata keys read besides the analysis
+// options.
+var tusMetadataFields = []string{"filename", "filetype", "name", "tags", "labels", "dataset", "source", "priority", "preset"}
+
+// upload is a partially received file.
+type upload struct {
+	mu       sync.Mutex // serializes PATCH requests and removal
+	id       string
+	owner    string
+	filename string
+	name     string
+	tags     []string
+	labels   map[string]string
+	dataset  string
+	source   string
+	priority jobPriority
+	options  analysisOptions
+	length   int64
+	offset   int64
+	expires  time.Time
+	jobID    string
+	ws       *workspace
+	// input is set once the data has been normalized and anonymized, which
+	// must not happen twice when the final PATCH is retried. sha256 and
+	// stages are recorded for the provenance of the job by then.
+	input  *inputInfo
+	sha256 string
+	stages []jobStage
+	// removed is set, under mu, once the upload is deleted or expired and
+	// its workspace is gone.
+	removed bool
+}
+
+func (u *upload) path() string { return u.ws.path("data") }
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*upload{}
+)
+
+// registerTus adds the tus endpoints under /files.
+func registerTus() {
+	handleAPI("OPTIONS /files", http.HandlerFunc(handleTusOptions))
+	handleAPI("OPTIONS /files/{id}", http.HandlerFunc(handleTusOptions))
+	handleAPI("POST /files", protected(requiresEngine(handleTusCreate)))
+	handleAPI("HEAD /files/{id}", protected(handleTusHead))
+	handleAPI("PATCH /files/{id}", protected(handleTusPatch))
+	handleAPI("DELETE /files/{id}", protected(handleTusDelete))
+}
+
+func handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusVersion rejects requests for a protocol version we do not speak.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// lookupUpload returns the upload named in the request path if the caller owns it.
+func lookupUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	uploadsMu.Lock()
+	u, ok := uploads[r.PathValue("id")]
+	uploadsMu.Unlock()
+	if !ok || u.owner != identityFrom(r) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "missing or invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+	if limit := uploadLimit(r); length > limit {
+		writeJSON(w, http.StatusRequestEntityTooLarge, uploadTooLarge{
+			Error:         fmt.Sprintf("upload exceeds the %d byte limit", limit),
+			LimitBytes:    limit,
+			ReceivedBytes: length,
+		})
+		return
+	}
+
+	meta := tusMetadata(r.Header.Get("Upload-Metadata"))
+	priority, err := parsePriority(meta["priority"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, tags, err := parseLabels(func(k string) string { return meta[k] })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := parseJobLabels(meta["labels"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkDataset(meta["dataset"], identityFrom(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := parseSource(func(k string) string { return meta[k] })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	get, err := withPreset(r, func(k string) string { return meta[k] })
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+	opts, err := decodeAnalysisOptions(get, slices.Collect(maps.Keys(meta)), tusMetadataFields)
+	if err != nil {
+		writeOptionsError(w, err)
+		return
+	}
+
+	u := &upload{
+		id:       newID(),
+		owner:    identityFrom(r),
+		filename: sanitizeFilename(meta["filename"]),
+		name:     name,
+		tags:     tags,
+		labels:   labels,
+		dataset:  meta["dataset"],
+		source:   source,
+		priority: priority,
+		options:  opts,
+		length:   length,
+		expires:  time.Now().Add(cfg.UploadExpiry),
+	}
+	if u.ws, err = allocateWorkspace("uploads", u.length); err != nil {
+		writeWorkspaceError(w, "upload", err)
+		return
+	}
+	f, err := os.Create(u.path())
+	if err != nil {
+		u.ws.release()
+		http.Error(w, fmt.Sprintf("failed to create upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	uploadsMu.Lock()
+	uploads[u.id] = u
+	uploadsMu.Unlock()
+
+	w.Header().Set("Location", apiPath(r, "/files/"+u.id))
+	w.Header().Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	u, ok := lookupUpload(w, r)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.removed {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	w.Header().Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if u.jobID != "" {
+		w.Header().Set("X-Job-ID", u.jobID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	u, ok := lookupUpload(w, r)
+	if !ok {
+		return
+	}
+	if !u.mu.TryLock() {
+		http.Error(w, "another request is writing to this upload", http.StatusConflict)
+		return
+	}
+	defer u.mu.Unlock()
+	if u.removed {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset must be %d", u.offset), http.StatusConflict)
+		return
+	}
+	if u.jobID != "" {
+		http.Error(w, "upload already complete", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.path(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Keep whatever arrived before a disconnect so the client can resume.
+	n, copyErr := copyBody(u.ws.writer(f), io.LimitReader(r.Body, u.length-u.offset))
+	f.Close()
+	u.offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	if errors.Is(copyErr, errWorkspaceFull) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorBody{Error: copyErr.Error(), Code: codeWorkspaceFull})
+		return
+	}
+	if copyErr != nil {
+		log.Printf("upload %s interrupted at offset %d: %v", u.id, u.offset, copyErr)
+		http.Error(w, "upload interrupted", http.StatusBadRequest)
+		return
+	}
+
+	if u.offset == u.length {
+		j, err := completeUpload(r.Context(), u)
+		if errors.Is(err, errQueueFull) || errors.Is(err, errPriorityLimit) {
+			writeSubmitError(w, err)
+			return
+		}
+		if errors.Is(err, errInvalidOptions) {
+			writeOptionsError(w, err)
+			return
+		}
+		var ie *ingestError
+		if errors.As(err, &ie) {
+			writeIngestError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to start analysis: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Job-ID", j.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload normalizes a fully received upload, moves it into a new
+// job and queues it.
+func completeUpload(ctx context.Context, u *upload) (*job, error) {
+	if u.input == nil {
+		sum, err := fileSHA256(u.path())
+		if err != nil {
+			return nil, err
+		}
+		var stages []jobStage
+		start := time.Now()
+		input, err := ingestFile(ctx, u.ws, u.path(), uploadLimitFor(u.owner), u.options.Delimiter)
+		if err != nil {
+			quarantine(err, u.path(), u.filename, u.owner, "tus upload "+u.id)
+			return nil, err
+		}
+		stages = append(stages, jobStage{Stage: "ingest", DurationMS: time.Since(start).Milliseconds()})
+		start = time.Now()
+		if err := u.options.validate(u.path()); err != nil {
+			quarantine(err, u.path(), u.filename, u.owner, "tus upload "+u.id)
+			return nil, err
+		}
+		if err := prepareRows(u.ws, u.path(), u.options); err != nil {
+			quarantine(err, u.path(), u.filename, u.owner, "tus upload "+u.id)
+			return nil, &ingestError{err}
+		}
+		stages = append(stages, jobStage{Stage: "prepare", DurationMS: time.Since(start).Milliseconds()})
+		u.input, u.sha256, u.stages = input, sum, stages
+	}
+	j, err := createJob(jobSpec{Filename: u.filename, Name: u.name, Tags: u.tags, Labels: u.labels, Dataset: u.dataset, Owner: u.owner,
+		Priority: u.priority, Options: u.options, Channel: "tus", Source: u.source, Size: u.length})
+	if err != nil {
+		return nil, err
+	}
+	prov := j.Provenance.clone()
+	prov.Size, prov.SHA256 = u.length, u.sha256
+	prov.Stages = append(prov.Stages, u.stages...)
+	updateJob(j.ID, func(j *job) { j.Input, j.Provenance = u.input, prov })
+	if err := moveFile(u.path(), j.inputPath()); err != nil {
+		deleteJob(j.ID)
+		return nil, err
+	}
+	if err := submitJob(j); err != nil {
+		// Keep the bytes so the client can retry the final PATCH.
+		moveFile(j.inputPath(), u.path())
+		deleteJob(j.ID)
+		return nil, err
+	}
+	u.jobID = j.ID
+	u.ws.release()
+	return j, nil
+}
+
+func handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	u, ok := lookupUpload(w, r)
+	if !ok {
+		return
+	}
+	// Wait for a PATCH in progress, which writes into the workspace
+	u.mu.Lock()
+	removeUpload(u)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireUploads drops uploads whose expiry has passed. Those receiving data
+// at the time are dropped by a later sweep.
+func expireUploads() {
+	now := time.Now()
+	var expired []*upload
+	uploadsMu.Lock()
+	for _, u := range uploads {
+		if now.After(u.expires) {
+			expired = append(expired, u)
+		}
+	}
+	uploadsMu.Unlock()
+	for _, u := range expired {
+		if u.mu.TryLock() {
+			removeUpload(u)
+			u.mu.Unlock()
+		}
+	}
+}
+
+// removeUpload forgets u and removes its workspace. The caller holds u.mu.
+func removeUpload(u *upload) {
+	uploadsMu.Lock()
+	delete(uploads, u.id)
+	uploadsMu.Unlock()
+	u.removed = true
+	u.ws.release()
+}
+
+// tusMetadata decodes an Upload-Metadata header ("key base64value,...").
+func tusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
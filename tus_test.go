@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testUpload registers an upload of length bytes owned by the anonymous
+// caller, in a workspace of at most quota bytes, or unlimited for 0.
+func testUpload(t *testing.T, length, quota int64) *upload {
+	ws := &workspace{dir: t.TempDir(), m: &workspaceManager{limit: quota}}
+	u := &upload{id: newID(), length: length, expires: time.Now().Add(time.Hour), ws: ws}
+	if err := os.WriteFile(u.path(), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	uploadsMu.Lock()
+	uploads[u.id] = u
+	uploadsMu.Unlock()
+	t.Cleanup(func() {
+		uploadsMu.Lock()
+		delete(uploads, u.id)
+		uploadsMu.Unlock()
+	})
+	return u
+}
+
+func tusRequest(method, id, offset string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, "/files/"+id, body)
+	r.SetPathValue("id", id)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	if offset != "" {
+		r.Header.Set("Upload-Offset", offset)
+	}
+	return r
+}
+
+// TestTusPatchOffsets sends a sequence of PATCH requests to one upload
+// of 10 bytes, none of which completes it.
+func TestTusPatchOffsets(t *testing.T) {
+	u := testUpload(t, 10, 0)
+	interrupted := func() io.Reader {
+		return io.MultiReader(strings.NewReader("hi"), iotest.ErrReader(errors.New("connection reset")))
+	}
+	tests := []struct {
+		name       string
+		change     func(r *http.Request)
+		offset     string
+		body       io.Reader
+		status     int
+		wantOffset string // Upload-Offset of the response, if any
+	}{
+		{name: "no version", change: func(r *http.Request) { r.Header.Del("Tus-Resumable") }, offset: "0", body: strings.NewReader("abcd"),
+			status: http.StatusPreconditionFailed},
+		{name: "wrong content type", change: func(r *http.Request) { r.Header.Set("Content-Type", "text/csv") }, offset: "0", body: strings.NewReader("abcd"),
+			status: http.StatusUnsupportedMediaType},
+		{name: "no offset", body: strings.NewReader("abcd"), status: http.StatusConflict},
+		{name: "offset ahead", offset: "3", body: strings.NewReader("abcd"), status: http.StatusConflict},
+		{name: "first bytes", offset: "0", body: strings.NewReader("abcd"), status: http.StatusNoContent, wantOffset: "4"},
+		{name: "acknowledged bytes again", offset: "0", body: strings.NewReader("abcd"), status: http.StatusConflict},
+		{name: "next bytes", offset: "4", body: strings.NewReader("efg"), status: http.StatusNoContent, wantOffset: "7"},
+		{name: "interrupted", offset: "7", body: interrupted(), status: http.StatusBadRequest, wantOffset: "9"},
+		{name: "resumed", offset: "7", body: strings.NewReader("h"), status: http.StatusConflict},
+		{name: "other owner", change: func(r *http.Request) {
+			*r = *r.WithContext(context.WithValue(r.Context(), identityKey{}, "mallory"))
+		}, offset: "9", body: strings.NewReader("j"), status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := tusRequest("PATCH", u.id, tt.offset, tt.body)
+		if tt.change != nil {
+			tt.change(r)
+		}
+		w := httptest.NewRecorder()
+		handleTusPatch(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if got := w.Header().Get("Upload-Offset"); got != tt.wantOffset {
+			t.Errorf("%s: Upload-Offset = %q, want %q", tt.name, got, tt.wantOffset)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleTusHead(w, tusRequest("HEAD", u.id, "", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "9" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD = %d with offset %q and length %q, want 200 with 9 of 10", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if data, _ := os.ReadFile(u.path()); string(data) != "abcdefghi" {
+		t.Errorf("upload data = %q, want %q", data, "abcdefghi")
+	}
+}
+
+func TestTusPatchWorkspaceQuota(t *testing.T) {
+	u := testUpload(t, 10, 6)
+	for _, tt := range []struct {
+		offset, body string
+		status       int
+		wantOffset   string
+	}{
+		{"0", "abcd", http.StatusNoContent, "4"},
+		{"4", "efgh", http.StatusRequestEntityTooLarge, "4"},
+		{"4", "ef", http.StatusNoContent, "6"},
+	} {
+		w := httptest.NewRecorder()
+		handleTusPatch(w, tusRequest("PATCH", u.id, tt.offset, strings.NewReader(tt.body)))
+		if w.Code != tt.status || w.Header().Get("Upload-Offset") != tt.wantOffset {
+			t.Errorf("PATCH %q at %s = %d with offset %q, want %d with %s: %s",
+				tt.body, tt.offset, w.Code, w.Header().Get("Upload-Offset"), tt.status, tt.wantOffset, w.Body)
+		}
+	}
+}
+
+func TestTusRemovedUpload(t *testing.T) {
+	u := testUpload(t, 10, 0)
+	u.removed = true
+	for _, method := range []string{"HEAD", "PATCH"} {
+		w := httptest.NewRecorder()
+		r := tusRequest(method, u.id, "0", strings.NewReader("a"))
+		if method == "HEAD" {
+			handleTusHead(w, r)
+		} else {
+			handleTusPatch(w, r)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s of a removed upload = %d, want 404", method, w.Code)
+		}
+	}
+}
+
+func TestTusMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"filename ZGF0YS5jc3Y=", map[string]string{"filename": "data.csv"}},
+		{"filename ZGF0YS5jc3Y=, tags YSxi , empty", map[string]string{"filename": "data.csv", "tags": "a,b", "empty": ""}},
+		{"bad !!!,name eA==", map[string]string{"name": "x"}},
+	}
+	for _, tt := range tests {
+		if got := tusMetadata(tt.header); !maps.Equal(got, tt.want) {
+			t.Errorf("tusMetadata(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SIGUSR2 upgrades the server in place: it starts the binary at its path
+// again, handing over the listening socket, and once the new process is
+// ready to serve, stops accepting connections. It then finishes the
+// requests in flight and every job it has queued or running, for up to
+// cfg.UpgradeDrainTimeout, and exits. Connections are never refused in
+// between, because the socket stays open throughout.
+//
+// Job state lives in the memory of the process that ran the job, so the
+// new process does not know the jobs of the old one; their reports stay
+// reachable through the report store (DATASCRIBE_REPORT_STORE_DIR) after
+// the old process exits. Unfinished chunked and tus uploads are lost and
+// must be started again. If the new process fails to start, the old one
+// carries on serving.
+//
+// Under a service manager the old process needs to be allowed to exit
+// without its child being stopped: with systemd, KillMode=process.
+
+const (
+	listenFDEnv = "DATASCRIBE_LISTEN_FD"
+	readyFDEnv  = "DATASCRIBE_READY_FD"
+)
+
+// upgraded reports whether the process was started by an upgrade, and so
+// shares its workspaces with the process it replaces.
+var upgraded = os.Getenv(listenFDEnv) != ""
+
+// listen returns the listener handed over by the process this one
+// replaces, or else a new one on cfg.Addr.
+func listen() (net.Listener, error) {
+	if !upgraded {
+		return net.Listen("tcp", cfg.Addr)
+	}
+	fd, err := strconv.Atoi(os.Getenv(listenFDEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", listenFDEnv, err)
+	}
+	os.Unsetenv(listenFDEnv)
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// signalReady tells the process this one replaces that it serves now.
+func signalReady() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("upgrade: invalid %s: %v", readyFDEnv, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handleUpgrades upgrades the server on every SIGUSR2 until one succeeds,
+// then drains srv and exits.
+func handleUpgrades(srv *http.Server, l net.Listener) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	for range sig {
+		pid, err := startUpgrade(l)
+		if err != nil {
+			log.Printf("upgrade failed, still serving: %v", err)
+			continue
+		}
+		log.Printf("upgrade: process %d serves now; draining", pid)
+		signal.Stop(sig)
+		drain(srv)
+		os.Exit(0)
+	}
+}
+
+// startUpgrade starts the new process with the listener and waits for it
+// to be ready, for up to cfg.UpgradeTimeout.
+func startUpgrade(l net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	lf, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return 0, fmt.Errorf("listener: %w", err)
+	}
+	defer lf.Close()
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// The files are passed as descriptors 3 and 4
+	cmd.ExtraFiles = []*os.File{lf, readyW}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready.SetReadDeadline(time.Now().Add(cfg.UpgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("%s was not ready within %s", exe, cfg.UpgradeTimeout)
+		}
+		return 0, fmt.Errorf("%s exited before serving: %v", exe, <-exited)
+	}
+	return cmd.Process.Pid, nil
+}
+
+// drain stops srv accepting connections and waits, for up to
+// cfg.UpgradeDrainTimeout in total, for its requests and jobs to finish,
+// then removes what is left of its workspaces.
+func drain(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.UpgradeDrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("upgrade: requests still in flight: %v", err)
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+wait:
+	for jobQueue.len() > 0 || runningJobs.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("upgrade: abandoning %d queued and %d running jobs", jobQueue.len(), runningJobs.Load())
+			break wait
+		case <-tick.C:
+		}
+	}
+	log.Printf("upgrade: drained")
+	workspaces.releaseAll()
+	memoryWorkspaces.releaseAll()
+	inputBlobs.remove()
+}
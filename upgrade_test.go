@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// handOver returns a descriptor of f for the code under test to own.
+func handOver(t *testing.T, f *os.File) string {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return strconv.Itoa(fd)
+}
+
+func TestListenHandover(t *testing.T) {
+	saved := upgraded
+	t.Cleanup(func() { upgraded = saved })
+	upgraded = true
+
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	f, err := old.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(listenFDEnv, handOver(t, f))
+	l, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().String() != old.Addr().String() {
+		t.Errorf("listening on %s, want the handed over %s", l.Addr(), old.Addr())
+	}
+	if v, ok := os.LookupEnv(listenFDEnv); ok {
+		t.Errorf("%s is still set to %s for the next upgrade", listenFDEnv, v)
+	}
+	// The old listener is closed first, as when the old process exits
+	old.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing the handed over listener: %v", err)
+	}
+	conn.Close()
+
+	t.Setenv(listenFDEnv, "three")
+	if _, err := listen(); err == nil {
+		t.Errorf("listen with %s=three succeeded", listenFDEnv)
+	}
+}
+
+func TestSignalReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	t.Setenv(readyFDEnv, handOver(t, w))
+	signalReady()
+	b := make([]byte, 2)
+	if n, err := r.Read(b); n != 1 || err != nil {
+		t.Errorf("read %d bytes (%v) from the ready pipe, want 1", n, err)
+	}
+	// The only writer is closed once ready is signalled
+	if _, err := r.Read(b); err == nil {
+		t.Errorf("the ready pipe is still open")
+	}
+	if v, ok := os.LookupEnv(readyFDEnv); ok {
+		t.Errorf("%s is still set to %s", readyFDEnv, v)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// receivedCSV is a CSV uploaded as multipart/form-data and saved into a
+// private workspace. The caller must release ws.
+type receivedCSV struct {
+	ws       *workspace
+	path     string
+	filename string
+	sha256   string
+	opts     analysisOptions
+	// input describes the first file as it was uploaded.
+	input *inputInfo
+	// paths holds every saved file by form field, for multi-file uploads.
+	paths map[string]string
+}
+
+// receiveCSV saves the 'file' field of a multipart upload into a new
+// workspace of the given kind, enforcing the size limit, the optional
+// Content-MD5 and content_sha256 checksums, the analysis options and the
+// malware scan, and applies the anonymize option. On failure the response
+// has been written and ok is false.
+func receiveCSV(w http.ResponseWriter, r *http.Request, kind string) (in *receivedCSV, ok bool) {
+	in, ok = receiveCSVs(w, r, kind, "file")
+	if !ok {
+		return nil, false
+	}
+	if err := in.opts.validate(in.path); err != nil {
+		quarantine(err, in.path, in.filename, identityFrom(r), r.Method+" "+r.URL.Path)
+		in.ws.release()
+		writeOptionsError(w, err)
+		return nil, false
+	}
+	if err := prepareRows(in.ws, in.path, in.opts); err != nil {
+		quarantine(err, in.path, in.filename, identityFrom(r), r.Method+" "+r.URL.Path)
+		in.ws.release()
+		writeIngestError(w, err)
+		return nil, false
+	}
+	return in, true
+}
+
+// requestFields lists, by upload kind, the form fields its handler reads
+// besides the CSV files, their checksums and the analysis options. Any
+// other field is rejected.
+var requestFields = map[string][]string{
+	"predict":      {"disposition", "dry_run"},
+	"aggregate":    {"format", "group_by", "aggregations"},
+	"distribution": {"format", "column", "binning", "bins", "log_scale", "exact"},
+	"profile":      {"exact"},
+	"baseline":     {"name", "psi_threshold", "ks_threshold"},
+	"duplicates":   {"format", "key_columns", "dedupe"},
+	"estimate":     {"size"},
+	"join":         {"how", "on", "left_on", "right_on", "analyze", "disposition"},
+	"score":        {"format"},
+	"query":        {"sql", "limit", "format"},
+}
+
+// formValueOrFile is r.FormValue, except that the schema option may also
+// be sent as a file, e.g. with curl -F schema=@schema.json.
+func formValueOrFile(r *http.Request) func(string) string {
+	return func(name string) string {
+		v := r.FormValue(name)
+		if v != "" || name != "schema" || r.MultipartForm == nil || len(r.MultipartForm.File[name]) == 0 {
+			return v
+		}
+		f, err := r.MultipartForm.File[name][0].Open()
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		// One byte over the limit makes parseContract reject it
+		data, _ := io.ReadAll(io.LimitReader(f, maxSchemaLen+1))
+		return string(data)
+	}
+}
+
+// formFieldNames returns the names of the query parameters and form fields,
+// including file fields, of a parsed request.
+func formFieldNames(r *http.Request) []string {
+	var names []string
+	for name := range r.URL.Query() {
+		names = append(names, name)
+	}
+	if r.MultipartForm != nil {
+		for name := range r.MultipartForm.Value {
+			names = append(names, name)
+		}
+		for name := range r.MultipartForm.File {
+			names = append(names, name)
+		}
+	}
+	for name := range r.PostForm {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// receiveCSVs is receiveCSV for uploads carrying one CSV per named form
+// field. path and filename describe the first field; analysis options are
+// parsed but, since they may apply to a derived file, not validated.
+//
+// The checksum of a single file is content_sha256. With several, each has
+// its own, content_sha256_<field>, and content_sha256 is rejected as an
+// unknown field rather than checked against one of them.
+func receiveCSVs(w http.ResponseWriter, r *http.Request, kind string, fields ...string) (in *receivedCSV, ok bool) {
+	// Limit the size to avoid exhausting memory
+	limit := uploadLimit(r)
+	if r.ContentLength > limit {
+		writeUploadTooLarge(w, r, limit)
+		return nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	var md5Body *hashingBody
+	if r.Header.Get("Content-MD5") != "" {
+		md5Body = newContentMD5Body(r.Body)
+		r.Body = md5Body
+	}
+
+	// Parse multipart form, spooling file parts beyond the memory threshold
+	if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadTooLarge(w, r, limit)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("failed to parse form: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	// The server only removes the spooled parts of the request it passed
+	// to the handlers, not of this one, which may be a copy; they are in
+	// the workspace by the time this returns
+	defer r.MultipartForm.RemoveAll()
+	if md5Body != nil {
+		if err := md5Body.verifyContentMD5(r.Header.Get("Content-MD5")); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return nil, false
+		}
+	}
+
+	checksums := map[string]string{}
+	for _, field := range fields {
+		checksums[field] = "content_sha256"
+		if len(fields) > 1 {
+			checksums[field] += "_" + field
+		}
+	}
+	known := slices.Concat(fields, slices.Collect(maps.Values(checksums)), requestFields[kind], []string{"preset"})
+	get, err := withPreset(r, formValueOrFile(r))
+	if err != nil {
+		writeOptionsError(w, err)
+		return nil, false
+	}
+	opts, err := decodeAnalysisOptions(get, formFieldNames(r), known)
+	if err != nil {
+		writeOptionsError(w, err)
+		return nil, false
+	}
+
+	// Create a private workspace for this request
+	ws, err := allocateWorkspace(kind, r.ContentLength)
+	if err != nil {
+		writeWorkspaceError(w, "workspace", err)
+		return nil, false
+	}
+	defer func() {
+		if !ok {
+			ws.release()
+		}
+	}()
+
+	in = &receivedCSV{ws: ws, opts: opts, paths: map[string]string{}}
+	for i, field := range fields {
+		path, filename, sum, input, ok := saveFormFile(w, r, ws, field, i, opts.Delimiter)
+		if !ok {
+			return nil, false
+		}
+		if want := strings.TrimSpace(r.FormValue(checksums[field])); want != "" && !strings.EqualFold(want, sum) {
+			http.Error(w, fmt.Sprintf("%s mismatch: computed %s", checksums[field], sum), http.StatusUnprocessableEntity)
+			return nil, false
+		}
+		in.paths[field] = path
+		if i == 0 {
+			in.path, in.filename, in.sha256, in.input = path, filename, sum, input
+		}
+	}
+	return in, true
+}
+
+// saveFormFile copies one uploaded form file into ws, scans it and
+// normalizes it to CSV, splitting delimited text on delimiter when it is
+// set. Files after the first are prefixed with their position so that
+// equal client filenames do not collide.
+func saveFormFile(w http.ResponseWriter, r *http.Request, ws *workspace, field string, position int, delimiter string) (path, filename, sum string, input *inputInfo, ok bool) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("missing '%s' field in form-data", field), http.StatusBadRequest)
+		return "", "", "", nil, false
+	}
+	defer file.Close()
+
+	// Save uploaded CSV
+	name := sanitizeFilename(header.Filename)
+	if position > 0 {
+		name = fmt.Sprintf("%d-%s", position, name)
+	}
+	path = ws.path(name)
+	inFile, err := os.Create(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create temp file: %v", err), http.StatusInternalServerError)
+		return "", "", "", nil, false
+	}
+	sum, err = copyWithSHA256(ws.writer(inFile), file)
+	inFile.Close()
+	if errors.Is(err, errWorkspaceFull) {
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+		return "", "", "", nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to save uploaded file: %v", err), http.StatusInternalServerError)
+		return "", "", "", nil, false
+	}
+
+	// Scan the upload before it reaches the analyzer
+	if scanEnabled() {
+		res, err := scanFile(r.Context(), path)
+		if err != nil {
+			log.Printf("malware scan failed: %v", err)
+			http.Error(w, "malware scan unavailable", http.StatusServiceUnavailable)
+			return "", "", "", nil, false
+		}
+		log.Printf("malware scan of %s by %s: infected=%t %s", header.Filename, res.Scanner, res.Infected, res.Signature)
+		if res.Infected {
+			http.Error(w, fmt.Sprintf("upload rejected: malware detected (%s)", res.Signature), http.StatusUnprocessableEntity)
+			return "", "", "", nil, false
+		}
+	}
+
+	input, err = ingestFile(r.Context(), ws, path, uploadLimit(r), delimiter)
+	if err != nil {
+		quarantine(err, path, header.Filename, identityFrom(r), r.Method+" "+r.URL.Path)
+		writeIngestError(w, err)
+		return "", "", "", nil, false
+	}
+	return path, header.Filename, sum, input, true
+}
+
+// reportDisposition returns the Content-Disposition of the report of the CSV
+// named dataset: an attachment unless the request asks for
+// disposition=inline, named report-<dataset>.pdf.
+func reportDisposition(r *http.Request, dataset string) (string, error) {
+	disposition := r.FormValue("disposition")
+	switch disposition {
+	case "":
+		disposition = "attachment"
+	case "inline", "attachment":
+	default:
+		return "", fmt.Errorf("unsupported disposition %q (want inline or attachment)", disposition)
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": reportFilename(dataset)}), nil
+}
+
+// reportFilename derives the report name from the uploaded CSV name.
+func reportFilename(dataset string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, filepath.Base(dataset))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if name == "" || name == "." {
+		return "report.pdf"
+	}
+	return "report-" + name + ".pdf"
+}
+
+// serveReport sends the PDF at path as a download that must not be cached.
+// disposition comes from reportDisposition.
+func serveReport(w http.ResponseWriter, r *http.Request, path, disposition string) {
+	report, err := os.Open(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open generated PDF: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer report.Close()
+
+	// Set headers for file download
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Cache-Control", "no-store")
+
+	// ServeContent sets Content-Length and lets the kernel copy the file (sendfile)
+	info, err := report.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to stat generated PDF: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "report.pdf", info.ModTime(), report)
+}
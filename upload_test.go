@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useTestWorkspaces makes workspaces allocate in a temporary directory.
+func useTestWorkspaces(t *testing.T) {
+	saved := workspaces
+	t.Cleanup(func() { workspaces = saved })
+	var err error
+	if workspaces, err = newWorkspaceManager([]string{t.TempDir()}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// multipartRequest returns a POST of files, by form field, and fields.
+func multipartRequest(files, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, data := range files {
+		fw, _ := mw.CreateFormFile(name, name+".csv")
+		fw.Write([]byte(data))
+	}
+	for name, v := range fields {
+		mw.WriteField(name, v)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestReceiveCSVsChecksums(t *testing.T) {
+	useTestWorkspaces(t)
+	const left, right = "id,a\n1,x\n", "id,b\n1,y\n"
+	tests := []struct {
+		name   string
+		kind   string
+		fields map[string]string
+		status int
+		want   string
+	}{
+		{name: "single file", kind: "predict", fields: map[string]string{"content_sha256": sha256Hex(left)}, status: http.StatusOK},
+		{name: "single file in upper case", kind: "predict", fields: map[string]string{"content_sha256": strings.ToUpper(sha256Hex(left))}, status: http.StatusOK},
+		{name: "single file mismatch", kind: "predict", fields: map[string]string{"content_sha256": sha256Hex(right)},
+			status: http.StatusUnprocessableEntity, want: "content_sha256 mismatch"},
+		{name: "both files", kind: "join", fields: map[string]string{"content_sha256_left": sha256Hex(left), "content_sha256_right": sha256Hex(right)},
+			status: http.StatusOK},
+		{name: "one of two files", kind: "join", fields: map[string]string{"content_sha256_right": sha256Hex(right)}, status: http.StatusOK},
+		{name: "second file mismatch", kind: "join", fields: map[string]string{"content_sha256_left": sha256Hex(left), "content_sha256_right": sha256Hex(left)},
+			status: http.StatusUnprocessableEntity, want: "content_sha256_right mismatch"},
+		{name: "one checksum for two files", kind: "join", fields: map[string]string{"content_sha256": sha256Hex(left)},
+			status: http.StatusBadRequest, want: "content_sha256"},
+		{name: "per-file checksum of a single file", kind: "predict", fields: map[string]string{"content_sha256_file": sha256Hex(left)},
+			status: http.StatusBadRequest, want: "content_sha256_file"},
+	}
+	for _, tt := range tests {
+		files := map[string]string{"file": left}
+		fields := []string{"file"}
+		if tt.kind == "join" {
+			files = map[string]string{"left": left, "right": right}
+			fields = []string{"left", "right"}
+		}
+		w := httptest.NewRecorder()
+		in, ok := receiveCSVs(w, multipartRequest(files, tt.fields), tt.kind, fields...)
+		if ok {
+			in.ws.release()
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// uploadLimit returns the maximum upload size allowed for the caller of r.
+func uploadLimit(r *http.Request) int64 {
+	return uploadLimitFor(identityFrom(r))
+}
+
+// uploadLimitFor returns the maximum upload size allowed for identity.
+func uploadLimitFor(identity string) int64 {
+	if n, ok := cfg.UploadLimits[identity]; ok {
+		return n
+	}
+	return cfg.MaxUploadSize
+}
+
+// maxUploadLimit returns the largest limit any caller may be granted. It
+// bounds work done before the caller is known, such as signature checks.
+func maxUploadLimit() int64 {
+	limit := cfg.MaxUploadSize
+	for _, n := range cfg.UploadLimits {
+		limit = max(limit, n)
+	}
+	return limit
+}
+
+// uploadTooLarge is the 413 response body.
+type uploadTooLarge struct {
+	Error         string `json:"error"`
+	LimitBytes    int64  `json:"limit_bytes"`
+	ReceivedBytes int64  `json:"received_bytes,omitempty"`
+}
+
+// writeUploadTooLarge reports that the request body exceeded limit. The
+// received size is only known when the client sent a Content-Length.
+func writeUploadTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	resp := uploadTooLarge{
+		Error:      fmt.Sprintf("upload exceeds the %d byte limit", limit),
+		LimitBytes: limit,
+	}
+	if r.ContentLength > 0 {
+		resp.ReceivedBytes = r.ContentLength
+	}
+	writeJSON(w, http.StatusRequestEntityTooLarge, resp)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// errWorkspaceFull is returned when a workspace grows past cfg.WorkspaceLimit.
+var errWorkspaceFull = errors.New("workspace disk quota exceeded")
+
+// workspaceManager hands out private directories under its roots, one per
+// job, upload or sync request, so concurrent work never shares files.
+//
+// With several roots, one per volume (DATASCRIBE_WORKSPACE_VOLUMES), each
+// workspace goes to the volume with the most free space at the time. A
+// workspace is only created where the input it is for fits with minFree
+// bytes to spare, so a full volume turns work away up front instead of
+// failing it halfway.
+type workspaceManager struct {
+	roots   []string
+	limit   int64
+	minFree int64
+
+	mu     sync.Mutex
+	active map[string]*workspace
+}
+
+// workspace is a directory owned by a single unit of work. It must be
+// released exactly once, typically with defer so panics clean up too.
+type workspace struct {
+	id   string
+	kind string
+	root string
+	dir  string
+	m    *workspaceManager
+}
+
+var workspaces *workspaceManager
+
+// memoryWorkspaces is set when DATASCRIBE_MEMORY_WORKSPACE_ROOT names a
+// memory-backed directory such as a tmpfs mount. Work on inputs of up to
+// cfg.MemoryWorkspaceMax bytes then runs there, so the input, the
+// report and everything in between never touch the disk, as long as the
+// memory workspaces stay within cfg.MemoryWorkspaceBudget in total.
+var memoryWorkspaces *workspaceManager
+
+var (
+	_ = newGaugeFunc("datascribe_workspace_bytes", "Disk space used by active workspaces.", func() float64 {
+		return float64(workspaces.totalUsage())
+	})
+	_ = newGaugeFunc("datascribe_memory_workspace_bytes", "Memory used by active memory-backed workspaces.", func() float64 {
+		return float64(memoryWorkspaces.totalUsage())
+	})
+	_ = newGaugeFunc("datascribe_workspace_free_bytes", "Free space on the workspace volume with the most room.", func() float64 {
+		_, free, _ := workspaces.roomiestRoot()
+		return float64(free)
+	})
+)
+
+// workspaceRoots returns the workspace roots: a datascribe directory on
+// each of cfg.WorkspaceVolumes, or else cfg.WorkspaceRoot.
+func workspaceRoots() []string {
+	if len(cfg.WorkspaceVolumes) == 0 {
+		return []string{cfg.WorkspaceRoot}
+	}
+	roots := make([]string, len(cfg.WorkspaceVolumes))
+	for i, volume := range cfg.WorkspaceVolumes {
+		roots[i] = filepath.Join(volume, "datascribe")
+	}
+	return roots
+}
+
+// newWorkspaceManager prepares roots. Anything left there by a previous
+// process is removed: job state lives in memory and cannot be recovered.
+// After an upgrade the process being replaced still works there, and
+// removes its own workspaces when it is done.
+func newWorkspaceManager(roots []string, limit int64) (*workspaceManager, error) {
+	for _, root := range roots {
+		if !upgraded {
+			if err := os.RemoveAll(root); err != nil {
+				return nil, fmt.Errorf("clear workspace root: %w", err)
+			}
+		}
+		if err := os.MkdirAll(root, 0o700); err != nil {
+			return nil, fmt.Errorf("create workspace root: %w", err)
+		}
+	}
+	return &workspaceManager{roots: roots, limit: limit, active: map[string]*workspace{}}, nil
+}
+
+// freeSpace returns the bytes available to the server on the volume
+// holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// roomiestRoot returns the root with the most free space.
+func (m *workspaceManager) roomiestRoot() (root string, free int64, err error) {
+	if m == nil {
+		return "", 0, errors.New("no workspaces")
+	}
+	free = -1
+	for _, r := range m.roots {
+		f, ferr := freeSpace(r)
+		if ferr != nil {
+			log.Printf("workspace volume %s: %v", r, ferr)
+			err = ferr
+			continue
+		}
+		if f > free {
+			root, free = r, f
+		}
+	}
+	if root == "" {
+		return "", 0, err
+	}
+	return root, free, nil
+}
+
+// pickRoot returns the root for a workspace for an input of size bytes; a
+// size of 0 or less is unknown.
+func (m *workspaceManager) pickRoot(size int64) (string, error) {
+	if len(m.roots) == 1 && m.minFree <= 0 && size <= 0 {
+		return m.roots[0], nil
+	}
+	root, free, err := m.roomiestRoot()
+	if err != nil {
+		return "", fmt.Errorf("checking workspace free space: %w", err)
+	}
+	if need := max(size, 0) + m.minFree; free < need {
+		return "", fmt.Errorf("%w: no workspace volume has %d bytes free for the input and DATASCRIBE_WORKSPACE_MIN_FREE; the most is %d",
+			errWorkspaceFull, need, free)
+	}
+	return root, nil
+}
+
+// allocate creates a new workspace; kind groups directories by purpose.
+func (m *workspaceManager) allocate(kind string) (*workspace, error) {
+	return m.allocateFor(kind, 0)
+}
+
+// allocateFor creates a new workspace for an input of size bytes, on a
+// volume with room for it.
+func (m *workspaceManager) allocateFor(kind string, size int64) (*workspace, error) {
+	root, err := m.pickRoot(size)
+	if err != nil {
+		return nil, err
+	}
+	ws := &workspace{id: newID(), kind: kind, root: root, m: m}
+	ws.dir = filepath.Join(root, kind, ws.id)
+	if err := os.MkdirAll(ws.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create workspace: %w", err)
+	}
+	m.mu.Lock()
+	m.active[ws.id] = ws
+	m.mu.Unlock()
+	return ws, nil
+}
+
+// allocateWorkspace allocates a workspace for work on an input of size
+// bytes, from memoryWorkspaces if the input is small enough and there is
+// room, and from workspaces otherwise. A size of 0 or less is unknown.
+func allocateWorkspace(kind string, size int64) (*workspace, error) {
+	if m := memoryWorkspaces; m != nil && size > 0 && size <= cfg.MemoryWorkspaceMax &&
+		m.totalUsage()+size <= cfg.MemoryWorkspaceBudget {
+		ws, err := m.allocate(kind)
+		if err == nil {
+			return ws, nil
+		}
+		log.Printf("memory workspace: %v; using the disk", err)
+	}
+	return workspaces.allocateFor(kind, size)
+}
+
+// writeWorkspaceError answers a request whose workspace, for what, could
+// not be created: 507 when there is no room for it.
+func writeWorkspaceError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, errWorkspaceFull) {
+		writeJSON(w, http.StatusInsufficientStorage, errorBody{Error: err.Error(), Code: codeWorkspaceFull})
+		return
+	}
+	http.Error(w, fmt.Sprintf("failed to create %s: %v", what, err), http.StatusInternalServerError)
+}
+
+func (m *workspaceManager) totalUsage() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	active := make([]*workspace, 0, len(m.active))
+	for _, ws := range m.active {
+		active = append(active, ws)
+	}
+	m.mu.Unlock()
+	var total int64
+	for _, ws := range active {
+		total += ws.usage()
+	}
+	// Inputs linked to a shared blob are counted once. Blobs only live
+	// on the disk workspaces, never in memory ones
+	if m == workspaces {
+		total -= inputBlobs.savedBytes()
+	}
+	return total
+}
+
+// path returns the location of name inside the workspace.
+func (ws *workspace) path(name string) string {
+	return filepath.Join(ws.dir, name)
+}
+
+// usage returns the bytes currently stored in the workspace.
+func (ws *workspace) usage() int64 {
+	var total int64
+	filepath.WalkDir(ws.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// checkQuota fails once the workspace holds more than the per-workspace cap.
+func (ws *workspace) checkQuota() error {
+	if ws.m.limit > 0 && ws.usage() > ws.m.limit {
+		return fmt.Errorf("%w (%d byte limit)", errWorkspaceFull, ws.m.limit)
+	}
+	return nil
+}
+
+// writer returns a writer that fails with errWorkspaceFull instead of
+// letting w push the workspace past its cap.
+func (ws *workspace) writer(w io.Writer) io.Writer {
+	if ws.m.limit <= 0 {
+		return w
+	}
+	return &quotaWriter{w: w, limit: ws.m.limit, remaining: ws.m.limit - ws.usage()}
+}
+
+type quotaWriter struct {
+	w         io.Writer
+	limit     int64
+	remaining int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > q.remaining {
+		return 0, fmt.Errorf("%w (%d byte limit)", errWorkspaceFull, q.limit)
+	}
+	n, err := q.w.Write(p)
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// moveFile renames src to dst, copying it when the two are on different
+// filesystems, as memory and disk workspaces are.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// releaseAll releases every workspace still active.
+func (m *workspaceManager) releaseAll() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	active := make([]*workspace, 0, len(m.active))
+	for _, ws := range m.active {
+		active = append(active, ws)
+	}
+	m.mu.Unlock()
+	for _, ws := range active {
+		ws.release()
+	}
+}
+
+// release deletes the workspace and everything in it.
+func (ws *workspace) release() {
+	ws.m.mu.Lock()
+	_, ok := ws.m.active[ws.id]
+	delete(ws.m.active, ws.id)
+	ws.m.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(ws.dir); err != nil {
+		log.Printf("failed to remove workspace %s: %v", ws.dir, err)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /ws is a WebSocket (RFC 6455) on which clients follow the lifecycle
+// of their jobs. They send JSON text messages:
+//
+//	{"type": "subscribe", "jobs": ["<id>", ...]}
+//	{"type": "subscribe", "all": true}
+//	{"type": "unsubscribe", "jobs": ["<id>", ...]}
+//	{"type": "unsubscribe", "all": true}
+//
+// and receive the current state of each job they subscribe to, then an
+// event every time its status changes:
+//
+//	{"type": "job", "job": {...}}          as from GET /jobs/{id}
+//	{"type": "job_deleted", "id": "<id>"}  after it expired or was deleted
+//	{"type": "error", "error": "..."}      for a message that was not valid
+//
+// With all, the caller's new jobs are followed too. Browsers send an Origin
+// with the handshake, which must be the server's own host or be listed in
+// DATASCRIBE_WEBSOCKET_ORIGINS, so that other sites cannot use the
+// credentials of a visitor.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsMaxMessage       = 64 << 10
+	wsMaxSubscriptions = 1000
+	wsPingInterval     = 30 * time.Second
+)
+
+var wsConnections = newCounter("datascribe_websocket_connections_total", "WebSocket connections accepted.")
+
+// wsConn is the server end of a WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex // serializes writes
+}
+
+// upgradeWebSocket completes the opening handshake of r, answering it
+// itself when it fails.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "this endpoint needs a WebSocket upgrade", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !allowedWebSocketOrigin(origin, r.Host) {
+		http.Error(w, "forbidden: origin not allowed", http.StatusForbidden)
+		return nil, false
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return nil, false
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, r: rw.Reader}, true
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func allowedWebSocketOrigin(origin, host string) bool {
+	if slices.Contains(cfg.WebSocketOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+// readMessage returns the next text or binary message, answering pings
+// and joining fragments. It fails with io.EOF once the client closes.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		var head [2]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return nil, err
+		}
+		fin, op := head[0]&0x80 != 0, head[0]&0x0f
+		if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+			c.close(1002, "frames from clients must be masked and use no extensions")
+			return nil, errors.New("protocol error")
+		}
+		n := int64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+		}
+		// Control frames are short and never fragmented (RFC 6455 5.5), and
+		// only data messages count towards wsMaxMessage
+		if op >= wsOpClose && (n > 125 || !fin) {
+			c.close(1002, "control frames must be unfragmented and at most 125 bytes")
+			return nil, errors.New("protocol error")
+		}
+		if op < wsOpClose && int64(len(msg))+n > wsMaxMessage {
+			c.close(1009, "message too large")
+			return nil, errors.New("message too large")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsOpPing:
+			c.write(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.write(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			msg = append(msg, payload...)
+		default:
+			c.close(1002, "unknown opcode")
+			return nil, errors.New("protocol error")
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// write sends one unfragmented frame.
+func (c *wsConn) write(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsPingInterval))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(wsOpText, data)
+}
+
+// close sends a close frame with code and reason.
+func (c *wsConn) close(code uint16, reason string) {
+	c.write(wsOpClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// wsRequest is a message from a client.
+type wsRequest struct {
+	Type string   `json:"type"`
+	Jobs []string `json:"jobs"`
+	All  bool     `json:"all"`
+}
+
+// wsSubscriptions are the jobs a connection follows.
+type wsSubscriptions struct {
+	mu      sync.Mutex
+	all     bool
+	jobs    map[string]bool
+	changed chan struct{} // signalled when the subscriptions change
+}
+
+// handleWebSocket serves the job lifecycle WebSocket.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	defer c.conn.Close()
+	wsConnections.inc()
+	owner := identityFrom(r)
+	subs := &wsSubscriptions{jobs: map[string]bool{}, changed: make(chan struct{}, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := c.readMessage()
+			if err != nil {
+				return
+			}
+			if err := subs.apply(msg); err != nil {
+				c.writeJSON(map[string]string{"type": "error", "error": err.Error()})
+				continue
+			}
+			select {
+			case subs.changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	sent := map[string]jobStatus{}
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		jobsMu.Lock()
+		changed := jobsChanged
+		events := subs.events(owner, sent)
+		jobsMu.Unlock()
+		for _, event := range events {
+			if err := c.writeJSON(event); err != nil {
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-subs.changed:
+		case <-ping.C:
+			if err := c.write(wsOpPing, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// apply changes the subscriptions as msg asks.
+func (s *wsSubscriptions) apply(msg []byte) error {
+	var req wsRequest
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Type {
+	case "subscribe":
+		if req.All {
+			s.all = true
+		}
+		for _, id := range req.Jobs {
+			if !s.jobs[id] && len(s.jobs) >= wsMaxSubscriptions {
+				return fmt.Errorf("at most %d jobs can be subscribed to; subscribe to all instead", wsMaxSubscriptions)
+			}
+			s.jobs[id] = true
+		}
+	case "unsubscribe":
+		if req.All {
+			s.all = false
+			clear(s.jobs)
+		}
+		for _, id := range req.Jobs {
+			delete(s.jobs, id)
+		}
+	default:
+		return fmt.Errorf("unknown message type %q (want subscribe or unsubscribe)", req.Type)
+	}
+	return nil
+}
+
+// events returns the events for the jobs followed, of owner, whose status
+// differs from the one in sent, and updates sent. jobsMu must be held.
+func (s *wsSubscriptions) events(owner string, sent map[string]jobStatus) []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []any
+	followed := func(j *job) bool { return j.owner == owner && (s.all || s.jobs[j.ID]) }
+	for id := range sent {
+		j, ok := jobs[id]
+		if ok && followed(j) {
+			continue
+		}
+		delete(sent, id)
+		if !ok {
+			events = append(events, map[string]string{"type": "job_deleted", "id": id})
+		}
+	}
+	for id := range s.jobs {
+		if j, ok := jobs[id]; !ok || j.owner != owner {
+			// Unknown to the caller: never reported, and dropped
+			delete(s.jobs, id)
+			events = append(events, map[string]string{"type": "error", "error": fmt.Sprintf("job %s not found", id)})
+		}
+	}
+	report := func(j *job) {
+		if followed(j) && sent[j.ID] != j.Status {
+			sent[j.ID] = j.Status
+			events = append(events, map[string]any{"type": "job", "job": *j})
+		}
+	}
+	if s.all {
+		for _, j := range jobs {
+			report(j)
+		}
+	} else {
+		for id := range s.jobs {
+			report(jobs[id])
+		}
+	}
+	return events
+}
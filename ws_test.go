@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedConn is the server end of a connection whose client has already
+// sent everything; it keeps what the server writes.
+type recordedConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordedConn) Write(b []byte) (int, error)      { return c.out.Write(b) }
+func (c *recordedConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *recordedConn) SetWriteDeadline(time.Time) error { return nil }
+
+// clientFrame encodes a masked frame as a client sends it.
+func clientFrame(fin bool, op byte, payload string) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 0x80|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i := range len(payload) {
+		b = append(b, payload[i]^mask[i%4])
+	}
+	return b
+}
+
+// serverFrames describes the short frames the server wrote, such as
+// "pong abc" or "close 1002".
+func serverFrames(out []byte) string {
+	var frames []string
+	for len(out) >= 2 {
+		op, n := out[0]&0x0f, int(out[1])
+		payload := out[2 : 2+n]
+		out = out[2+n:]
+		switch op {
+		case wsOpClose:
+			frames = append(frames, fmt.Sprintf("close %d", binary.BigEndian.Uint16(payload)))
+		case wsOpPong:
+			frames = append(frames, "pong "+string(payload))
+		default:
+			frames = append(frames, fmt.Sprintf("op %d", op))
+		}
+	}
+	return strings.Join(frames, ", ")
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+	big := strings.Repeat("x", 40<<10)
+	tests := []struct {
+		name    string
+		in      []byte
+		want    string
+		wantErr string
+		wrote   string
+	}{
+		{name: "text", in: clientFrame(true, wsOpText, "hello"), want: "hello"},
+		{name: "empty", in: clientFrame(true, wsOpBinary, ""), want: ""},
+		{name: "16-bit length", in: clientFrame(true, wsOpText, strings.Repeat("a", 300)), want: strings.Repeat("a", 300)},
+		{name: "64-bit length", in: clientFrame(true, wsOpText, strings.Repeat("b", 0x10000)), want: strings.Repeat("b", 0x10000)},
+		{name: "fragments", in: join(clientFrame(false, wsOpText, "hel"), clientFrame(false, wsOpContinuation, "l"), clientFrame(true, wsOpContinuation, "o")),
+			want: "hello"},
+		{name: "ping between fragments", in: join(clientFrame(false, wsOpText, "hel"), clientFrame(true, wsOpPing, "abc"), clientFrame(true, wsOpContinuation, "lo")),
+			want: "hello", wrote: "pong abc"},
+		{name: "pong", in: join(clientFrame(true, wsOpPong, "x"), clientFrame(true, wsOpText, "a")), want: "a"},
+		{name: "close", in: clientFrame(true, wsOpClose, "\x03\xe8"), wantErr: "EOF", wrote: "close 1000"},
+		{name: "unmasked", in: []byte{0x81, 0x01, 'a'}, wantErr: "protocol error", wrote: "close 1002"},
+		{name: "extension bit", in: append([]byte{0xc1}, clientFrame(true, wsOpText, "a")[1:]...), wantErr: "protocol error", wrote: "close 1002"},
+		{name: "unknown opcode", in: clientFrame(true, 0x3, "a"), wantErr: "protocol error", wrote: "close 1002"},
+		{name: "long ping", in: clientFrame(true, wsOpPing, strings.Repeat("p", 126)), wantErr: "protocol error", wrote: "close 1002"},
+		{name: "fragmented close", in: clientFrame(false, wsOpClose, ""), wantErr: "protocol error", wrote: "close 1002"},
+		{name: "message too large", in: clientFrame(true, wsOpText, strings.Repeat("x", wsMaxMessage+1)), wantErr: "message too large", wrote: "close 1009"},
+		{name: "fragments too large", in: join(clientFrame(false, wsOpText, big), clientFrame(true, wsOpContinuation, big)),
+			wantErr: "message too large", wrote: "close 1009"},
+		{name: "truncated", in: clientFrame(true, wsOpText, "hello")[:8], wantErr: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		conn := &recordedConn{}
+		c := &wsConn{conn: conn, r: bufio.NewReader(bytes.NewReader(tt.in))}
+		msg, err := c.readMessage()
+		if got := fmt.Sprint(err); tt.wantErr != "" && got != tt.wantErr || tt.wantErr == "" && err != nil {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if string(msg) != tt.want {
+			t.Errorf("%s: message = %.20q, want %.20q", tt.name, msg, tt.want)
+		}
+		if got := serverFrames(conn.out.Bytes()); got != tt.wrote {
+			t.Errorf("%s: server wrote %q, want %q", tt.name, got, tt.wrote)
+		}
+	}
+}
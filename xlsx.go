@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Excel workbooks (.xlsx) are zip archives of XML parts. convertWorkbook
+// reads the first worksheet with encoding/xml: cell values, shared and
+// inline strings, and numbers with a date format, which are written as ISO
+// dates. Formulas contribute their cached values.
+
+// isWorkbook reports whether a zip archive is an xlsx workbook.
+func isWorkbook(zr *zip.Reader) bool {
+	for _, f := range zr.File {
+		if f.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+type xlsxWorkbook struct {
+	Properties struct {
+		Date1904 bool `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+// xlsxText is rich or plain text, as in shared strings and inline strings.
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxCell struct {
+	Ref    string   `xml:"r,attr"`
+	Type   string   `xml:"t,attr"`
+	Style  int      `xml:"s,attr"`
+	Value  string   `xml:"v"`
+	Inline xlsxText `xml:"is"`
+}
+
+// workbook is what convertWorkbook needs to read cells of a worksheet.
+type workbook struct {
+	files     map[string]*zip.File
+	strings   []string
+	dateStyle []bool // by cell style index
+	epoch     time.Time
+	limit     int64
+}
+
+// convertWorkbook writes the first worksheet of the xlsx file at src as CSV
+// to dst and returns the sheet name. Rows are padded to the widest row so
+// that every record has the same number of fields.
+func convertWorkbook(ws *workspace, src, dst string, limit int64) (string, error) {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return "", fmt.Errorf("%w: unreadable workbook: %v", errMalformedInput, err)
+	}
+	defer zr.Close()
+	wb := &workbook{files: map[string]*zip.File{}, limit: limit,
+		epoch: time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)}
+	for _, f := range zr.File {
+		wb.files[f.Name] = f
+	}
+
+	var book xlsxWorkbook
+	if err := wb.decode("xl/workbook.xml", &book); err != nil {
+		return "", err
+	}
+	if len(book.Sheets) == 0 {
+		return "", fmt.Errorf("%w: the workbook has no worksheets", errMalformedInput)
+	}
+	if book.Properties.Date1904 {
+		wb.epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	var rels xlsxRelationships
+	if err := wb.decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return "", err
+	}
+	sheet := ""
+	for _, rel := range rels.Relationships {
+		if rel.ID == book.Sheets[0].RID {
+			sheet = rel.Target
+		}
+	}
+	if strings.HasPrefix(sheet, "/") {
+		sheet = sheet[1:]
+	} else {
+		sheet = path.Join("xl", sheet)
+	}
+	if wb.files[sheet] == nil {
+		return "", fmt.Errorf("%w: worksheet %q is missing from the workbook", errMalformedInput, book.Sheets[0].Name)
+	}
+	if err := wb.loadStrings(); err != nil {
+		return "", err
+	}
+	if err := wb.loadStyles(); err != nil {
+		return "", err
+	}
+
+	width := 0
+	err = wb.rows(sheet, func(cells []string) error {
+		width = max(width, len(cells))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if width == 0 {
+		return "", fmt.Errorf("%w: worksheet %q is empty", errMalformedInput, book.Sheets[0].Name)
+	}
+
+	out, w, err := createIn(ws, dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	cw := csv.NewWriter(w)
+	record := make([]string, width)
+	err = wb.rows(sheet, func(cells []string) error {
+		clear(record)
+		copy(record, cells)
+		return cw.Write(record)
+	})
+	if err != nil {
+		return "", err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return "", err
+	}
+	return book.Sheets[0].Name, out.Close()
+}
+
+// open opens a part of the workbook, held to the decompression limit.
+func (wb *workbook) open(name string) (io.ReadCloser, error) {
+	f := wb.files[name]
+	if f == nil {
+		return nil, fmt.Errorf("%w: %s is missing from the workbook", errMalformedInput, name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: unreadable workbook part %s: %v", errMalformedInput, name, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{newLimitedReader(rc, wb.limit), rc}, nil
+}
+
+func (wb *workbook) decode(name string, v any) error {
+	rc, err := wb.open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return wb.xmlError(name, err)
+	}
+	return nil
+}
+
+func (wb *workbook) xmlError(name string, err error) error {
+	if errors.Is(err, errInflatedTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: %s: %v", errMalformedInput, name, err)
+}
+
+// loadStrings reads the shared string table, which workbooks without text
+// cells leave out.
+func (wb *workbook) loadStrings() error {
+	if wb.files["xl/sharedStrings.xml"] == nil {
+		return nil
+	}
+	rc, err := wb.open("xl/sharedStrings.xml")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dec := xml.NewDecoder(rc)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return wb.xmlError("xl/sharedStrings.xml", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "si" {
+			var si xlsxText
+			if err := dec.DecodeElement(&si, &start); err != nil {
+				return wb.xmlError("xl/sharedStrings.xml", err)
+			}
+			wb.strings = append(wb.strings, si.String())
+		}
+	}
+}
+
+// loadStyles finds the cell styles that format numbers as dates.
+func (wb *workbook) loadStyles() error {
+	if wb.files["xl/styles.xml"] == nil {
+		return nil
+	}
+	var styles xlsxStyles
+	if err := wb.decode("xl/styles.xml", &styles); err != nil {
+		return err
+	}
+	custom := map[int]string{}
+	for _, f := range styles.NumFmts {
+		custom[f.ID] = f.Code
+	}
+	wb.dateStyle = make([]bool, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		if code, ok := custom[xf.NumFmtID]; ok {
+			wb.dateStyle[i] = isDateFormat(code)
+		} else {
+			// The built-in date and time formats
+			id := xf.NumFmtID
+			wb.dateStyle[i] = id >= 14 && id <= 22 || id >= 45 && id <= 47
+		}
+	}
+	return nil
+}
+
+// isDateFormat reports whether a number format code shows a date or time:
+// outside of quoted text, escapes and [...] sections it uses y, m, d, h or s.
+func isDateFormat(code string) bool {
+	quoted, bracket := false, false
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '\\' || c == '_' || c == '*':
+			i++
+		case c == '[':
+			bracket = true
+		case c == ']':
+			bracket = false
+		case bracket:
+		case strings.IndexByte("ymdhsYMDHS", c) >= 0:
+			return true
+		}
+	}
+	return false
+}
+
+// rows calls fn with the cell values of every row of the worksheet, with
+// empty strings for cells the sheet leaves out.
+func (wb *workbook) rows(sheet string, fn func(cells []string) error) error {
+	rc, err := wb.open(sheet)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dec := xml.NewDecoder(rc)
+	var cells []string
+	inRow := false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return wb.xmlError(sheet, err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				cells, inRow = cells[:0], true
+			case "c":
+				if !inRow {
+					continue
+				}
+				var c xlsxCell
+				if err := dec.DecodeElement(&c, &t); err != nil {
+					return wb.xmlError(sheet, err)
+				}
+				col := len(cells)
+				if c.Ref != "" {
+					if col, err = columnIndex(c.Ref); err != nil {
+						return fmt.Errorf("%w: %s: %v", errMalformedInput, sheet, err)
+					}
+				}
+				for len(cells) <= col {
+					cells = append(cells, "")
+				}
+				cells[col] = wb.cellValue(c)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" && inRow {
+				inRow = false
+				if len(cells) > 0 {
+					if err := fn(cells); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
+
+// columnIndex returns the zero-based column of a cell reference like "AB12".
+func columnIndex(ref string) (int, error) {
+	col := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A'+1)
+	}
+	// Excel stops at XFD, column 16384
+	if i == 0 || col > 16384 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return col - 1, nil
+}
+
+func (wb *workbook) cellValue(c xlsxCell) string {
+	switch c.Type {
+	case "s":
+		i, err := strconv.Atoi(c.Value)
+		if err != nil || i < 0 || i >= len(wb.strings) {
+			return ""
+		}
+		return wb.strings[i]
+	case "inlineStr":
+		return c.Inline.String()
+	case "b":
+		if c.Value == "1" {
+			return "true"
+		}
+		return "false"
+	case "", "n":
+		if c.Style >= 0 && c.Style < len(wb.dateStyle) && wb.dateStyle[c.Style] {
+			if v, err := strconv.ParseFloat(c.Value, 64); err == nil {
+				return wb.formatDate(v)
+			}
+		}
+	}
+	// str (formula text), e (errors such as #N/A) and d (ISO dates) are
+	// stored as they are shown
+	return c.Value
+}
+
+// formatDate turns a serial date number into an ISO date, with the time
+// of day when it has one.
+func (wb *workbook) formatDate(serial float64) string {
+	days := math.Floor(serial)
+	secs := math.Round((serial - days) * 86400)
+	if secs == 86400 {
+		days, secs = days+1, 0
+	}
+	t := wb.epoch.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+	switch {
+	case secs == 0:
+		return t.Format("2006-01-02")
+	case days == 0:
+		return t.Format("15:04:05")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}